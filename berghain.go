@@ -27,20 +27,66 @@ type LevelConfig struct {
 	// fixed hostname, so tests need this; production setups do not.
 	CaptchaSkipHostnameCheck bool
 
-	captchaBodyOnce sync.Once
-	captchaBody     []byte
+	// RateLimits bound the challenge requests of this level,
+	// see AllowChallenge.
+	RateLimits ChallengeRateLimits
 }
 
 type Berghain struct {
 	Levels         []*LevelConfig
 	TrustedDomains []string
 
+	// Cookie describes the clearance cookie issued with each token.
+	Cookie CookieConfig
+
+	// TrustedTokens are application-issued tokens accepted instead of the
+	// cookie, checked in order.
+	TrustedTokens []*TrustedToken
+
+	// Policy decides the level of requests sent with the policy message,
+	// nil if no policy is configured.
+	Policy *Policy
+
+	// GeoIP provides country and ASN signals, nil if no databases are
+	// configured. It is shared by all frontends.
+	GeoIP *GeoIP
+
+	// IPLists apply to the source address of validated and challenged
+	// requests, see ApplyIPLists. They are shared by all frontends.
+	IPLists IPLists
+
+	// Bots verifies requests claiming to come from crawlers, nil if no
+	// verified bots are configured. It is shared by all frontends.
+	Bots *BotVerifier
+
+	// Signatures verifies Web Bot Auth signatures, nil if no signature
+	// agents are configured. It is shared by all frontends.
+	Signatures *SignatureVerifier
+
+	// PrivacyPass redeems Privacy Pass tokens instead of challenges, nil if
+	// no token issuers are configured. It is shared by all frontends.
+	PrivacyPass *PrivacyPass
+
+	// BypassTokens let requests with a pre-shared token pass validation,
+	// nil if no tokens are scoped to the frontend.
+	BypassTokens *BypassTokens
+
+	// Reputation raises the level of addresses failing challenges, nil if
+	// disabled. It is shared by all frontends, see RecordFailure.
+	Reputation *Reputation
+
+	// Revocations deny cookies revoked by an application, nil if disabled.
+	// It is shared by all frontends, see RevokeCookie.
+	Revocations *Revocations
+
 	// HTTPClient is used for captcha siteverify requests.
 	// Defaults to a client with a 5 second timeout.
 	HTTPClient *http.Client
 
 	secret []byte
 	hmac   sync.Pool
+
+	challengeLimiter rateLimiter
 }
 
 var hashAlgo = sha256.New
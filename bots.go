@@ -0,0 +1,300 @@
+package berghain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bot describes a crawler whose requests can be verified, e.g. Googlebot.
+type Bot struct {
+	Name string
+	// UserAgents are case-insensitive substrings of the User-Agent claiming
+	// to be the bot. Only claiming requests are verified.
+	UserAgents []string
+	// Suffixes are the domains the reverse DNS names of the bot end in,
+	// e.g. googlebot.com. Names are only trusted if they resolve back to
+	// the address, see BotVerifier.
+	Suffixes []string
+	// Ranges are the address ranges published for the bot, checked before
+	// resorting to DNS.
+	Ranges IPLists
+}
+
+// Resolver looks up reverse and forward DNS records. It is satisfied by
+// *net.Resolver.
+type Resolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+const (
+	defaultBotCacheTTL    = 24 * time.Hour
+	defaultBotNegativeTTL = time.Hour
+	defaultBotTimeout     = 5 * time.Second
+	// botErrorTTL is how long failed lookups are cached, so an unreachable
+	// DNS server is not asked again for every request.
+	botErrorTTL = time.Minute
+	// maxBotLookups bounds the concurrent DNS lookups, so clients spoofing
+	// a bot User-Agent cannot flood the resolver.
+	maxBotLookups = 64
+	// maxBotCacheEntries bounds the number of cached verifications.
+	maxBotCacheEntries = 100000
+)
+
+// BotVerifier verifies requests claiming to come from a Bot, either by its
+// published ranges or by forward-confirmed reverse DNS: the reverse DNS name
+// of the address must end in one of the bot suffixes and resolve back to the
+// address. DNS results are cached. Lookups run in the background, a request
+// whose result is not cached yet is not verified unless Wait is set.
+type BotVerifier struct {
+	Bots []*Bot
+
+	// Resolver defaults to net.DefaultResolver.
+	Resolver Resolver
+	// CacheTTL and NegativeTTL are how long verified and rejected
+	// addresses are cached, defaulting to a day and an hour.
+	CacheTTL    time.Duration
+	NegativeTTL time.Duration
+	// Wait is how long a request waits for a DNS verification, zero does
+	// not wait. Slower verifications apply to later requests.
+	Wait time.Duration
+	// Timeout bounds a DNS verification, defaults to 5 seconds.
+	Timeout time.Duration
+
+	mu      sync.Mutex
+	cache   map[botCacheKey]botCacheEntry
+	pending map[botCacheKey]chan struct{}
+}
+
+type botCacheKey struct {
+	bot  *Bot
+	addr netip.Addr
+}
+
+type botCacheEntry struct {
+	verified bool
+	expires  time.Time
+}
+
+var errInvalidBot = errors.New("invalid verified bot")
+
+// NewBotVerifier returns a verifier of the bots.
+func NewBotVerifier(bots []*Bot) (*BotVerifier, error) {
+	for _, b := range bots {
+		if b.Name == "" {
+			return nil, fmt.Errorf("%w: missing name", errInvalidBot)
+		}
+		if len(b.UserAgents) == 0 {
+			return nil, fmt.Errorf("%w: %s: missing user agents", errInvalidBot, b.Name)
+		}
+		if len(b.Suffixes) == 0 && len(b.Ranges) == 0 {
+			return nil, fmt.Errorf("%w: %s: missing suffixes or ranges", errInvalidBot, b.Name)
+		}
+
+		b.UserAgents = lowerAll(b.UserAgents)
+		b.Suffixes = lowerAll(b.Suffixes)
+		for i, s := range b.Suffixes {
+			b.Suffixes[i] = strings.Trim(s, ".")
+		}
+	}
+
+	return &BotVerifier{Bots: bots}, nil
+}
+
+// Claimed returns the first bot the User-Agent claims to be, or nil.
+func (v *BotVerifier) Claimed(ua []byte) *Bot {
+	for _, b := range v.Bots {
+		if matchAny(b.UserAgents, ua, containsFold) {
+			return b
+		}
+	}
+	return nil
+}
+
+// Verify returns the bot the User-Agent claims to be if the address belongs
+// to it, or nil.
+func (v *BotVerifier) Verify(ctx context.Context, ua []byte, addr netip.Addr) *Bot {
+	bot := v.Claimed(ua)
+	if bot == nil {
+		return nil
+	}
+
+	addr = addr.Unmap()
+	if bot.Ranges.Match(addr) != nil {
+		return bot
+	}
+	if len(bot.Suffixes) == 0 {
+		return nil
+	}
+
+	key := botCacheKey{bot: bot, addr: addr}
+	now := tc.Now()
+
+	v.mu.Lock()
+	if e, ok := v.cache[key]; ok && now.Before(e.expires) {
+		v.mu.Unlock()
+		if e.verified {
+			return bot
+		}
+		return nil
+	}
+
+	done, ok := v.pending[key]
+	if !ok {
+		if len(v.pending) >= maxBotLookups {
+			v.mu.Unlock()
+			return nil
+		}
+		if v.pending == nil {
+			v.pending = make(map[botCacheKey]chan struct{})
+		}
+		done = make(chan struct{})
+		v.pending[key] = done
+		go v.lookup(key, done)
+	}
+	v.mu.Unlock()
+
+	if v.Wait <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(v.Wait)
+	defer t.Stop()
+
+	select {
+	case <-done:
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return nil
+	}
+
+	v.mu.Lock()
+	e := v.cache[key]
+	v.mu.Unlock()
+
+	if e.verified {
+		return bot
+	}
+	return nil
+}
+
+func (v *BotVerifier) lookup(key botCacheKey, done chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), orDefault(v.Timeout, defaultBotTimeout))
+	defer cancel()
+
+	verified, err := v.forwardConfirmed(ctx, key.bot, key.addr)
+
+	ttl := orDefault(v.NegativeTTL, defaultBotNegativeTTL)
+	switch {
+	case verified:
+		ttl = orDefault(v.CacheTTL, defaultBotCacheTTL)
+	case err != nil:
+		ttl = botErrorTTL
+	}
+
+	v.mu.Lock()
+	if v.cache == nil {
+		v.cache = make(map[botCacheKey]botCacheEntry)
+	}
+	if _, ok := v.cache[key]; !ok && len(v.cache) >= maxBotCacheEntries {
+		v.evict()
+	}
+	v.cache[key] = botCacheEntry{verified: verified, expires: tc.Now().Add(ttl)}
+	delete(v.pending, key)
+	v.mu.Unlock()
+
+	close(done)
+}
+
+// evict drops the entry expiring first among a few, see Reputation.evict.
+func (v *BotVerifier) evict() {
+	var victim botCacheKey
+	var earliest time.Time
+
+	n := 0
+	for k, e := range v.cache {
+		if n == 0 || e.expires.Before(earliest) {
+			victim, earliest = k, e.expires
+		}
+		if n++; n == evictionSamples {
+			break
+		}
+	}
+
+	delete(v.cache, victim)
+}
+
+// forwardConfirmed reports whether a reverse DNS name of addr ends in a
+// suffix of the bot and resolves back to addr. Names not found are no error.
+func (v *BotVerifier) forwardConfirmed(ctx context.Context, bot *Bot, addr netip.Addr) (bool, error) {
+	r := v.Resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+
+	names, err := r.LookupAddr(ctx, addr.String())
+	if err != nil && !isNotFound(err) {
+		return false, err
+	}
+
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if !matchSuffix(bot.Suffixes, name) {
+			continue
+		}
+
+		addrs, err := r.LookupNetIP(ctx, "ip", name)
+		if err != nil && !isNotFound(err) {
+			return false, err
+		}
+		for _, a := range addrs {
+			if a.Unmap() == addr {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// matchSuffix reports whether name is one of the domains or a subdomain.
+func matchSuffix(domains []string, name string) bool {
+	for _, d := range domains {
+		if name == d || strings.HasSuffix(name, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reload reloads the ranges of all bots and reports whether any changed.
+func (v *BotVerifier) Reload() (bool, error) {
+	var changed bool
+	var errs []error
+	for _, b := range v.Bots {
+		c, err := b.Ranges.Reload()
+		changed = changed || c
+		errs = append(errs, err)
+	}
+
+	return changed, errors.Join(errs...)
+}
+
+func orDefault(d, def time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return def
+}
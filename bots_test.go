@@ -0,0 +1,321 @@
+package berghain
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubDNS is a local DNS server answering PTR, A and AAAA queries from its
+// records, and NXDOMAIN for anything else.
+type stubDNS struct {
+	ptr  map[string][]string
+	addr map[string][]netip.Addr
+
+	queries atomic.Int32
+}
+
+const (
+	dnsTypeA    = 1
+	dnsTypePTR  = 12
+	dnsTypeAAAA = 28
+)
+
+// listen serves the records on a local UDP port until the test ends and
+// returns a resolver asking only this server.
+func (s *stubDNS) listen(t *testing.T) *net.Resolver {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := s.answer(buf[:n]); resp != nil {
+				_, _ = conn.WriteTo(resp, from)
+			}
+		}
+	}()
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", conn.LocalAddr().String())
+		},
+	}
+}
+
+func (s *stubDNS) answer(q []byte) []byte {
+	s.queries.Add(1)
+	if len(q) < 12 {
+		return nil
+	}
+
+	// the question follows the header, its name is a list of labels
+	end := 12
+	var labels []string
+	for end < len(q) && q[end] != 0 {
+		l := int(q[end])
+		if end+1+l > len(q) {
+			return nil
+		}
+		labels = append(labels, string(q[end+1:end+1+l]))
+		end += 1 + l
+	}
+	end += 5
+	if end > len(q) {
+		return nil
+	}
+	name := strings.ToLower(strings.Join(labels, "."))
+	qtype := binary.BigEndian.Uint16(q[end-4:])
+
+	var answers [][]byte
+	switch qtype {
+	case dnsTypePTR:
+		for _, host := range s.ptr[name] {
+			answers = append(answers, dnsName(nil, host))
+		}
+	case dnsTypeA, dnsTypeAAAA:
+		for _, a := range s.addr[name] {
+			if a.Is4() == (qtype == dnsTypeA) {
+				answers = append(answers, a.AsSlice())
+			}
+		}
+	}
+
+	_, known := s.ptr[name]
+	if _, ok := s.addr[name]; ok {
+		known = true
+	}
+
+	// response, recursion desired and available, NXDOMAIN for unknown names
+	flags := uint16(0x8180)
+	if !known {
+		flags |= 3
+	}
+
+	resp := binary.BigEndian.AppendUint16(nil, binary.BigEndian.Uint16(q))
+	resp = binary.BigEndian.AppendUint16(resp, flags)
+	resp = binary.BigEndian.AppendUint16(resp, 1)
+	resp = binary.BigEndian.AppendUint16(resp, uint16(len(answers)))
+	resp = append(resp, 0, 0, 0, 0)
+	resp = append(resp, q[12:end]...)
+	for _, rdata := range answers {
+		// a pointer to the name of the question
+		resp = append(resp, 0xc0, 12)
+		resp = binary.BigEndian.AppendUint16(resp, qtype)
+		resp = binary.BigEndian.AppendUint16(resp, 1)
+		resp = binary.BigEndian.AppendUint32(resp, 300)
+		resp = binary.BigEndian.AppendUint16(resp, uint16(len(rdata)))
+		resp = append(resp, rdata...)
+	}
+
+	return resp
+}
+
+func dnsName(b []byte, name string) []byte {
+	for _, l := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(l)))
+		b = append(b, l...)
+	}
+	return append(b, 0)
+}
+
+func testBots(t *testing.T, r Resolver) *BotVerifier {
+	t.Helper()
+
+	v, err := NewBotVerifier([]*Bot{
+		{Name: "googlebot", UserAgents: []string{"Googlebot"}, Suffixes: []string{"googlebot.com", "google.com."}},
+		{Name: "bingbot", UserAgents: []string{"bingbot"}, Suffixes: []string{"search.msn.com"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.Resolver = r
+	v.Wait = 5 * time.Second
+	return v
+}
+
+func TestBotVerifier_Verify(t *testing.T) {
+	dns := &stubDNS{
+		ptr: map[string][]string{
+			// forward-confirmed
+			"1.2.0.192.in-addr.arpa": {"crawl-192-0-2-1.googlebot.com."},
+			"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa": {"rate-limited-proxy.google.com."},
+			// resolves to another address
+			"2.2.0.192.in-addr.arpa": {"crawl-192-0-2-2.googlebot.com."},
+			// wrong domain, resolving back
+			"3.2.0.192.in-addr.arpa": {"googlebot.com.example.net."},
+			"4.2.0.192.in-addr.arpa": {"msnbot-192-0-2-4.search.msn.com."},
+		},
+		addr: map[string][]netip.Addr{
+			"crawl-192-0-2-1.googlebot.com":   {netip.MustParseAddr("192.0.2.1")},
+			"rate-limited-proxy.google.com":   {netip.MustParseAddr("2001:db8::1")},
+			"crawl-192-0-2-2.googlebot.com":   {netip.MustParseAddr("192.0.2.99")},
+			"googlebot.com.example.net":       {netip.MustParseAddr("192.0.2.3")},
+			"msnbot-192-0-2-4.search.msn.com": {netip.MustParseAddr("192.0.2.4")},
+		},
+	}
+	v := testBots(t, dns.listen(t))
+
+	const googlebot = "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+	tests := []struct {
+		name string
+		ua   string
+		addr string
+		want string
+	}{
+		{name: "forward-confirmed", ua: googlebot, addr: "192.0.2.1", want: "googlebot"},
+		{name: "forward-confirmed ipv6", ua: googlebot, addr: "2001:db8::1", want: "googlebot"},
+		{name: "mapped address", ua: googlebot, addr: "::ffff:192.0.2.1", want: "googlebot"},
+		{name: "forward mismatch", ua: googlebot, addr: "192.0.2.2"},
+		{name: "foreign domain", ua: googlebot, addr: "192.0.2.3"},
+		{name: "no reverse name", ua: googlebot, addr: "192.0.2.5"},
+		{name: "other bot", ua: googlebot, addr: "192.0.2.4"},
+		{name: "bingbot", ua: "Mozilla/5.0 (compatible; bingbot/2.0)", addr: "192.0.2.4", want: "bingbot"},
+		{name: "no claim", ua: "Mozilla/5.0", addr: "192.0.2.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			if bot := v.Verify(context.Background(), []byte(tt.ua), netip.MustParseAddr(tt.addr)); bot != nil {
+				got = bot.Name
+			}
+			if got != tt.want {
+				t.Errorf("Verify() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// results are cached
+	queries := dns.queries.Load()
+	for _, tt := range tests {
+		v.Verify(context.Background(), []byte(tt.ua), netip.MustParseAddr(tt.addr))
+	}
+	if q := dns.queries.Load(); q != queries {
+		t.Errorf("cached verifications sent %d queries", q-queries)
+	}
+}
+
+func TestBotVerifier_Ranges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "googlebot.json")
+	writeIPList(t, path, `{"prefixes": [{"ipv4Prefix": "192.0.2.64/27"}]}`, time.Now())
+	l, err := OpenIPList("googlebot", path, ListActionAllow, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := NewBotVerifier([]*Bot{{Name: "googlebot", UserAgents: []string{"googlebot"}, Ranges: IPLists{l}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.Resolver = failingResolver{t}
+
+	if bot := v.Verify(context.Background(), []byte("Googlebot/2.1"), netip.MustParseAddr("192.0.2.65")); bot == nil {
+		t.Errorf("address in ranges not verified")
+	}
+	if bot := v.Verify(context.Background(), []byte("Googlebot/2.1"), netip.MustParseAddr("192.0.2.1")); bot != nil {
+		t.Errorf("address outside of ranges verified")
+	}
+}
+
+// failingResolver fails tests resolving anything.
+type failingResolver struct{ t *testing.T }
+
+func (r failingResolver) LookupAddr(context.Context, string) ([]string, error) {
+	r.t.Errorf("unexpected reverse lookup")
+	return nil, errors.New("unexpected lookup")
+}
+
+func (r failingResolver) LookupNetIP(context.Context, string, string) ([]netip.Addr, error) {
+	r.t.Errorf("unexpected forward lookup")
+	return nil, errors.New("unexpected lookup")
+}
+
+// slowResolver verifies every address after release is closed.
+type slowResolver struct {
+	release chan struct{}
+	lookups atomic.Int32
+}
+
+func (r *slowResolver) LookupAddr(_ context.Context, addr string) ([]string, error) {
+	r.lookups.Add(1)
+	<-r.release
+	return []string{"crawl.googlebot.com."}, nil
+}
+
+func (r *slowResolver) LookupNetIP(_ context.Context, _, _ string) ([]netip.Addr, error) {
+	return []netip.Addr{netip.MustParseAddr("192.0.2.1")}, nil
+}
+
+func TestBotVerifier_Wait(t *testing.T) {
+	r := &slowResolver{release: make(chan struct{})}
+	v := testBots(t, r)
+	// requests do not wait by default
+	v.Wait = 0
+
+	ua, addr := []byte("Googlebot"), netip.MustParseAddr("192.0.2.1")
+	for i := 0; i < 3; i++ {
+		if bot := v.Verify(context.Background(), ua, addr); bot != nil {
+			t.Fatalf("verified before the lookup finished")
+		}
+	}
+	v.Wait = time.Millisecond
+	if bot := v.Verify(context.Background(), ua, addr); bot != nil {
+		t.Fatalf("verified before the lookup finished")
+	}
+	if n := r.lookups.Load(); n != 1 {
+		t.Errorf("pending verification started %d lookups", n)
+	}
+
+	close(r.release)
+	v.Wait = 5 * time.Second
+	if bot := v.Verify(context.Background(), ua, addr); bot == nil {
+		t.Errorf("not verified after the lookup finished")
+	}
+}
+
+func TestNewBotVerifier_Invalid(t *testing.T) {
+	for _, b := range []*Bot{
+		{UserAgents: []string{"googlebot"}, Suffixes: []string{"googlebot.com"}},
+		{Name: "googlebot", Suffixes: []string{"googlebot.com"}},
+		{Name: "googlebot", UserAgents: []string{"googlebot"}},
+	} {
+		if _, err := NewBotVerifier([]*Bot{b}); err == nil {
+			t.Errorf("NewBotVerifier(%+v) succeeded", b)
+		}
+	}
+}
+
+func TestBotVerifier_VerifyCachedAllocs(t *testing.T) {
+	v := testBots(t, &slowResolver{release: make(chan struct{})})
+	close(v.Resolver.(*slowResolver).release)
+
+	ua, addr := []byte("Googlebot"), netip.MustParseAddr("192.0.2.1")
+	if v.Verify(context.Background(), ua, addr) == nil {
+		t.Fatal("not verified")
+	}
+
+	if allocs := testing.AllocsPerRun(100, func() {
+		v.Verify(context.Background(), ua, addr)
+	}); allocs != 0 {
+		t.Errorf("cached Verify allocates %v times", allocs)
+	}
+}
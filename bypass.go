@@ -0,0 +1,89 @@
+package berghain
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+var (
+	errBypassTokenMissing = errors.New("no bypass token")
+	errBypassTokenUnknown = errors.New("unknown bypass token")
+	errBypassTokenExpired = errors.New("bypass token expired")
+	errBypassTokenScope   = errors.New("bypass token not valid for the request")
+)
+
+// BypassToken is a pre-shared token that lets monitoring, partners or smoke
+// tests pass validation without a challenge. Only the SHA-256 digest of the
+// token is known to the agent.
+type BypassToken struct {
+	// Label identifies the token in logs.
+	Label string
+	Hash  [sha256.Size]byte
+
+	// Hosts match like the hosts of policy rules, any host if empty.
+	Hosts []string
+	// CIDRs restrict the source addresses, any address if empty.
+	CIDRs []netip.Prefix
+	// Expires is when the token stops being accepted, never if zero.
+	Expires time.Time
+}
+
+// BypassTokens looks up bypass tokens by their digest.
+type BypassTokens struct {
+	tokens map[[sha256.Size]byte]*BypassToken
+}
+
+// NewBypassTokens validates the tokens and prepares them for matching.
+func NewBypassTokens(tokens []BypassToken) (*BypassTokens, error) {
+	b := &BypassTokens{tokens: make(map[[sha256.Size]byte]*BypassToken, len(tokens))}
+	for _, t := range tokens {
+		t := t
+		if t.Label == "" {
+			return nil, errors.New("bypass tokens need a label")
+		}
+		if _, ok := b.tokens[t.Hash]; ok {
+			return nil, fmt.Errorf("bypass token %s: duplicate hash", t.Label)
+		}
+
+		t.Hosts = lowerAll(t.Hosts)
+		cidrs := make([]netip.Prefix, len(t.CIDRs))
+		for i, p := range t.CIDRs {
+			cidrs[i] = p.Masked()
+		}
+		t.CIDRs = cidrs
+		b.tokens[t.Hash] = &t
+	}
+
+	return b, nil
+}
+
+// Match returns the token of a Bearer Authorization header value if it is
+// valid for the host and source address at now.
+func (b *BypassTokens) Match(authorization, host []byte, addr netip.Addr, now time.Time) (*BypassToken, error) {
+	scheme, token, _ := strings.Cut(strings.TrimSpace(string(authorization)), " ")
+	token = strings.TrimSpace(token)
+	if !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return nil, errBypassTokenMissing
+	}
+
+	t := b.tokens[sha256.Sum256([]byte(token))]
+	if t == nil {
+		return nil, errBypassTokenUnknown
+	}
+
+	if !t.Expires.IsZero() && !now.Before(t.Expires) {
+		return nil, fmt.Errorf("%w: %s", errBypassTokenExpired, t.Label)
+	}
+	if len(t.Hosts) > 0 && !matchAny(t.Hosts, host, matchHost) {
+		return nil, fmt.Errorf("%w: %s: host", errBypassTokenScope, t.Label)
+	}
+	if len(t.CIDRs) > 0 && !matchPrefixes(t.CIDRs, addr) {
+		return nil, fmt.Errorf("%w: %s: source address", errBypassTokenScope, t.Label)
+	}
+
+	return t, nil
+}
@@ -0,0 +1,71 @@
+package berghain
+
+import (
+	"crypto/sha256"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestBypassTokens_Match(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	tokens, err := NewBypassTokens([]BypassToken{
+		{Label: "monitoring", Hash: sha256.Sum256([]byte("monitoring-secret"))},
+		{
+			Label:   "ci",
+			Hash:    sha256.Sum256([]byte("ci-secret")),
+			Hosts:   []string{"*.Example.com"},
+			CIDRs:   []netip.Prefix{netip.MustParsePrefix("192.0.2.1/24")},
+			Expires: now.Add(time.Hour),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := netip.MustParseAddr("192.0.2.10")
+	tests := []struct {
+		name          string
+		authorization string
+		host          string
+		src           netip.Addr
+		now           time.Time
+		want          string
+		wantErr       error
+	}{
+		{name: "unscoped", authorization: "Bearer monitoring-secret", host: "example.org", src: src, now: now, want: "monitoring"},
+		{name: "scheme is case-insensitive", authorization: "bearer  monitoring-secret ", host: "example.org", src: src, now: now, want: "monitoring"},
+		{name: "scoped", authorization: "Bearer ci-secret", host: "staging.example.com", src: netip.MustParseAddr("::ffff:192.0.2.10"), now: now, want: "ci"},
+		{name: "other scheme", authorization: "Basic monitoring-secret", host: "example.org", src: src, now: now, wantErr: errBypassTokenMissing},
+		{name: "empty", authorization: "Bearer ", host: "example.org", src: src, now: now, wantErr: errBypassTokenMissing},
+		{name: "unknown", authorization: "Bearer guess", host: "example.org", src: src, now: now, wantErr: errBypassTokenUnknown},
+		{name: "expired", authorization: "Bearer ci-secret", host: "staging.example.com", src: src, now: now.Add(time.Hour), wantErr: errBypassTokenExpired},
+		{name: "other host", authorization: "Bearer ci-secret", host: "example.com", src: src, now: now, wantErr: errBypassTokenScope},
+		{name: "other address", authorization: "Bearer ci-secret", host: "staging.example.com", src: netip.MustParseAddr("198.51.100.1"), now: now, wantErr: errBypassTokenScope},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tokens.Match([]byte(tt.authorization), []byte(tt.host), tt.src, tt.now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Match() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && got.Label != tt.want {
+				t.Errorf("Match() = %s, want %s", got.Label, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewBypassTokens_Invalid(t *testing.T) {
+	hash := sha256.Sum256([]byte("secret"))
+	for name, tokens := range map[string][]BypassToken{
+		"missing label":  {{Hash: hash}},
+		"duplicate hash": {{Label: "a", Hash: hash}, {Label: "b", Hash: hash}},
+	} {
+		if _, err := NewBypassTokens(tokens); err == nil {
+			t.Errorf("%s: NewBypassTokens succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DropMorePackets/berghain"
+)
+
+// serveHTTP serves a local HTTP endpoint like the admin endpoint until the
+// context is done.
+func serveHTTP(ctx context.Context, wg *sync.WaitGroup, name, addr string, h http.Handler) {
+	defer wg.Done()
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+
+	slog.InfoContext(ctx, "Listening for "+name+" requests", "type", "tcp", "address", addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		Fatal(name+" endpoint failed", "error", err)
+	}
+}
+
+// adminHandler serves the admin API, authenticated by the admin key.
+func (i *instance) adminHandler(key []byte) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mint", i.handleMint)
+	mux.HandleFunc("/revoke", i.handleRevoke)
+	mux.HandleFunc("/support", i.handleSupport)
+
+	keySum := sha256.Sum256(key)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// comparing digests does not leak the key length
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		tokenSum := sha256.Sum256([]byte(token))
+		if subtle.ConstantTimeCompare(keySum[:], tokenSum[:]) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// mintRequest asks for a cookie for a client the application trusts.
+type mintRequest struct {
+	Frontend string `json:"frontend"`
+	Host     string `json:"host"`
+	Src      string `json:"src"`
+	Level    int    `json:"level"`
+	// TTL is a duration like 12h, the duration of the level if empty.
+	TTL string `json:"ttl"`
+	// SSL selects the Secure attribute in the secure: auto mode.
+	SSL bool `json:"ssl"`
+}
+
+type mintResponse struct {
+	Token     string `json:"token"`
+	SetCookie string `json:"set_cookie"`
+	// Expires is the expiration in unix seconds.
+	Expires int64 `json:"expires"`
+}
+
+func (i *instance) handleMint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req mintRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f, ok := i.adminFrontend(req.Frontend)
+	if !ok {
+		http.Error(w, "unknown frontend", http.StatusBadRequest)
+		return
+	}
+
+	resp, err := f.mint(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "minted cookie", "frontend", req.Frontend, "host", req.Host, "src", req.Src, "level", req.Level, "expires", resp.Expires)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// adminFrontend returns the named frontend, the default frontend if the name
+// is empty.
+func (i *instance) adminFrontend(name string) (*frontend, bool) {
+	if name == "" {
+		name = defaultFrontend
+	}
+	f, ok := i.c[name]
+	return f, ok
+}
+
+// revokeRequest asks to revoke a cookie the application saw abuse with.
+type revokeRequest struct {
+	Frontend string `json:"frontend"`
+	Host     string `json:"host"`
+	Src      string `json:"src"`
+	Cookie   string `json:"cookie"`
+}
+
+func (i *instance) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req revokeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f, ok := i.adminFrontend(req.Frontend)
+	if !ok {
+		http.Error(w, "unknown frontend", http.StatusBadRequest)
+		return
+	}
+
+	if err := f.revoke(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "revoked cookie", "frontend", req.Frontend, "host", req.Host, "src", req.Src)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revoke revokes the cookie of the request, which has to be valid for the
+// host and source address.
+func (f *frontend) revoke(req *revokeRequest) error {
+	addr, err := netip.ParseAddr(req.Src)
+	if err != nil {
+		return fmt.Errorf("invalid source address: %w", err)
+	}
+	host, err := f.identityHost([]byte(req.Host))
+	if err != nil {
+		return err
+	}
+
+	ri := berghain.RequestIdentifier{SrcAddr: addr, Host: host}
+	return f.bh.RevokeCookie(ri, []byte(req.Cookie))
+}
+
+// mint issues a cookie for the request, bound to the same host as the
+// cookies of validate messages.
+func (f *frontend) mint(req *mintRequest) (*mintResponse, error) {
+	addr, err := netip.ParseAddr(req.Src)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source address: %w", err)
+	}
+	host, err := f.identityHost([]byte(req.Host))
+	if err != nil {
+		return nil, err
+	}
+	if req.Level < 1 || req.Level > len(f.bh.Levels) {
+		return nil, fmt.Errorf("level %d is not configured", req.Level)
+	}
+
+	ttl := f.bh.LevelConfig(uint8(req.Level)).Duration
+	if req.TTL != "" {
+		if ttl, err = time.ParseDuration(req.TTL); err != nil {
+			return nil, fmt.Errorf("invalid ttl: %w", err)
+		}
+	}
+
+	token := berghain.AcquireCookieBuffer()
+	defer berghain.ReleaseCookieBuffer(token)
+
+	ri := berghain.RequestIdentifier{SrcAddr: addr, Host: host}
+	expiresAt, err := f.bh.MintCookie(ri, uint8(req.Level), ttl, token)
+	if err != nil {
+		return nil, err
+	}
+	f.audit.cleared(f, &ri, uint8(req.Level), auditValidatorMint)
+
+	var domain []byte
+	if bytes.Contains(host, []byte(".")) {
+		domain = host
+	}
+
+	return &mintResponse{
+		Token:     string(token.ReadBytes()),
+		SetCookie: string(f.bh.Cookie.AppendSetCookie(nil, token.ReadBytes(), domain, ttl, req.SSL)),
+		Expires:   expiresAt.Unix(),
+	}, nil
+}
+
+// runMint implements the mint subcommand, which prints a cookie minted with
+// the secret of the config.
+func runMint(arguments []string) {
+	var req mintRequest
+	var setCookie bool
+
+	fs := flag.NewFlagSet("mint", flag.ExitOnError)
+	fs.StringVar(&configPath, "config", "config.yaml", "Config file to load")
+	fs.StringVar(&req.Frontend, "frontend", defaultFrontend, "Frontend whose cookie is minted")
+	fs.StringVar(&req.Host, "host", "", "Host the cookie is valid for")
+	fs.StringVar(&req.Src, "src", "", "Source address the cookie is valid for")
+	fs.IntVar(&req.Level, "level", 1, "Level of the cookie")
+	fs.StringVar(&req.TTL, "ttl", "", "Lifetime of the cookie, defaults to the duration of the level")
+	fs.BoolVar(&req.SSL, "ssl", false, "Set the Secure attribute in the secure: auto mode")
+	fs.BoolVar(&setCookie, "set-cookie", false, "Print the Set-Cookie value instead of the cookie")
+	_ = fs.Parse(arguments)
+
+	cfg := loadConfig()
+	if len(cfg.Secret) != 32 {
+		Fatal("provided secret has invalid length", "have", len(cfg.Secret), "need", 32)
+	}
+
+	b := newInstance(cfg, cfg.AsIPLists())
+	f, ok := b.c[req.Frontend]
+	if !ok {
+		Fatal("unknown frontend", "frontend", req.Frontend)
+	}
+
+	resp, err := f.mint(&req)
+	if err != nil {
+		Fatal("failed minting cookie", "error", err)
+	}
+
+	if setCookie {
+		fmt.Fprintln(os.Stdout, resp.SetCookie)
+	} else {
+		fmt.Fprintln(os.Stdout, resp.Token)
+	}
+}
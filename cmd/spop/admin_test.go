@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DropMorePackets/berghain"
+)
+
+func TestAdminMint(t *testing.T) {
+	const key = "0123456789abcdef0123456789abcdef"
+	bh := challengeBerghain()
+	bh.TrustedDomains = []string{"example.com"}
+	i := &instance{c: map[string]*frontend{defaultFrontend: {bh: bh}}}
+	h := i.adminHandler([]byte(key))
+
+	mint := func(auth, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/mint", strings.NewReader(body))
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := mint("", `{"host": "example.com", "src": "192.0.2.1", "level": 1}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("without key: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if w := mint("Bearer "+key[1:], `{"host": "example.com", "src": "192.0.2.1", "level": 1}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong key: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	for _, tt := range []struct {
+		name string
+		body string
+	}{
+		{name: "unknown frontend", body: `{"frontend": "other", "host": "example.com", "src": "192.0.2.1", "level": 1}`},
+		{name: "invalid address", body: `{"host": "example.com", "src": "nope", "level": 1}`},
+		{name: "unknown level", body: `{"host": "example.com", "src": "192.0.2.1", "level": 2}`},
+		{name: "invalid ttl", body: `{"host": "example.com", "src": "192.0.2.1", "level": 1, "ttl": "-1h"}`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := mint("Bearer "+key, tt.body); w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+			}
+		})
+	}
+
+	w := mint("Bearer "+key, `{"host": "www.Example.com:443", "src": "192.0.2.1", "level": 1, "ttl": "720h"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	var resp mintResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(resp.SetCookie, "berghain="+resp.Token+"; Domain=example.com;") {
+		t.Errorf("set_cookie = %s", resp.SetCookie)
+	}
+
+	// the cookie is bound to the trusted domain, like those of challenges
+	ri := berghain.RequestIdentifier{SrcAddr: netip.MustParseAddr("192.0.2.1"), Host: []byte("example.com"), Level: 1}
+	claims, err := bh.ValidateCookie(ri, []byte(resp.Token))
+	if err != nil {
+		t.Fatalf("minted cookie not valid: %v", err)
+	}
+	if claims.ExpiresIn() < 719*time.Hour {
+		t.Errorf("cookie expires in %v, want 720h", claims.ExpiresIn())
+	}
+	if resp.Expires != claims.ExpiresAt.Unix() {
+		t.Errorf("expires = %d, cookie expires at %d", resp.Expires, claims.ExpiresAt.Unix())
+	}
+}
+
+func TestAdminRevoke(t *testing.T) {
+	const key = "0123456789abcdef0123456789abcdef"
+	bh := challengeBerghain()
+	i := &instance{c: map[string]*frontend{defaultFrontend: {bh: bh}}}
+	h := i.adminHandler([]byte(key))
+
+	revoke := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/revoke", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	ri := berghain.RequestIdentifier{SrcAddr: netip.MustParseAddr("192.0.2.1"), Host: []byte("example.com"), Level: 1}
+	cookie := berghain.AcquireCookieBuffer()
+	defer berghain.ReleaseCookieBuffer(cookie)
+	if err := ri.ToCookie(bh, cookie); err != nil {
+		t.Fatal(err)
+	}
+	body := `{"host": "example.com", "src": "192.0.2.1", "cookie": "` + string(cookie.ReadBytes()) + `"}`
+
+	if w := revoke(body); w.Code != http.StatusBadRequest {
+		t.Errorf("without revocations: status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	rev, err := berghain.NewRevocations(berghain.RevocationConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bh.Revocations = rev
+
+	// the cookie is bound to the source address
+	if w := revoke(`{"host": "example.com", "src": "192.0.2.2", "cookie": "` + string(cookie.ReadBytes()) + `"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("other address: status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	if w := revoke(body); w.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	if _, err := bh.ValidateCookie(ri, cookie.ReadBytes()); !errors.Is(err, berghain.ErrRevoked) {
+		t.Errorf("ValidateCookie error = %v, want %v", err, berghain.ErrRevoked)
+	}
+}
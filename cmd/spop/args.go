@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/bits"
+	"strings"
+	"sync"
+
+	"github.com/dropmorepackets/haproxy-go/pkg/encoding"
+)
+
+// spoeArg is a set of known SPOE message arguments.
+type spoeArg uint32
+
+const (
+	argFrontend spoeArg = 1 << iota
+	argLevel
+	argSrc
+	argHost
+	argCookie
+	argCookies
+	argMethod
+	argBody
+	argSession
+	argVersion
+	argSSL
+	argPath
+	argUserAgent
+	argSignature
+	argSignatureInput
+	argSignatureAgent
+	argAuthorization
+)
+
+// spoeArgNames is indexed by the bit position of an argument.
+var spoeArgNames = [...]string{
+	"frontend",
+	"level",
+	"src",
+	"host",
+	"cookie",
+	"cookies",
+	"method",
+	"body",
+	"session",
+	"version",
+	"ssl",
+	"path",
+	"ua",
+	"signature",
+	"signature_input",
+	"signature_agent",
+	"authorization",
+}
+
+func lookupSPOEArg(name []byte) spoeArg {
+	for i, n := range spoeArgNames {
+		if string(name) == n {
+			return 1 << i
+		}
+	}
+	return 0
+}
+
+func (a spoeArg) String() string {
+	var names []string
+	for a != 0 {
+		i := bits.TrailingZeros32(uint32(a))
+		names = append(names, spoeArgNames[i])
+		a &^= 1 << i
+	}
+	return strings.Join(names, ",")
+}
+
+var (
+	errMissingArgument   = errors.New("missing SPOP argument")
+	errDuplicateArgument = errors.New("duplicate SPOP argument")
+	errArgumentType      = errors.New("invalid SPOP argument type")
+)
+
+// spoeArgs holds the arguments of a SPOE message by name, so HAProxy may send
+// them in any order. Arguments sent as null count as present with their zero
+// value, as HAProxy sends null for fetches without a result, e.g. a missing
+// header. Byte values alias the message and are only valid while it is handled.
+type spoeArgs struct {
+	set spoeArg
+
+	frontend []byte
+	level    int64
+	src      []byte
+	host     []byte
+	cookie   []byte
+	cookies  []byte
+	method   []byte
+	body     []byte
+	session  []byte
+	version  []byte
+	ssl      bool
+	path     []byte
+	ua       []byte
+
+	signature      []byte
+	signatureInput []byte
+	signatureAgent []byte
+
+	authorization []byte
+}
+
+var spoeArgsPool = sync.Pool{
+	New: func() any {
+		return &spoeArgs{}
+	},
+}
+
+func acquireSPOEArgs() *spoeArgs {
+	return spoeArgsPool.Get().(*spoeArgs)
+}
+
+func releaseSPOEArgs(a *spoeArgs) {
+	*a = spoeArgs{}
+	spoeArgsPool.Put(a)
+}
+
+// unknownSPOEArgs holds the names of unknown arguments already logged. The
+// names come from the HAProxy config, so the set stays small. It is a plain
+// map, as only map lookups by string(name) never allocate.
+var unknownSPOEArgs = struct {
+	sync.RWMutex
+	names map[string]struct{}
+}{names: make(map[string]struct{})}
+
+// warnUnknownSPOEArg logs an unknown argument the first time it is seen.
+func warnUnknownSPOEArg(ctx context.Context, name []byte) {
+	unknownSPOEArgs.RLock()
+	_, seen := unknownSPOEArgs.names[string(name)]
+	unknownSPOEArgs.RUnlock()
+	if seen {
+		return
+	}
+
+	unknownSPOEArgs.Lock()
+	_, seen = unknownSPOEArgs.names[string(name)]
+	if !seen {
+		unknownSPOEArgs.names[string(name)] = struct{}{}
+	}
+	unknownSPOEArgs.Unlock()
+	if !seen {
+		slog.WarnContext(ctx, "ignoring unknown SPOP argument", "have", name)
+	}
+}
+
+// decode reads all arguments of the message. Unknown arguments are logged once
+// and skipped, so HAProxy configs can send arguments newer agents understand.
+func (a *spoeArgs) decode(ctx context.Context, m *encoding.Message) error {
+	k := encoding.AcquireKVEntry()
+	defer encoding.ReleaseKVEntry(k)
+
+	for m.KV.Next(k) {
+		arg := lookupSPOEArg(k.NameBytes())
+		if arg == 0 {
+			warnUnknownSPOEArg(ctx, k.NameBytes())
+			continue
+		}
+		if a.set&arg != 0 {
+			return fmt.Errorf("%w: %s", errDuplicateArgument, arg)
+		}
+		if err := a.setValue(arg, k); err != nil {
+			return err
+		}
+		a.set |= arg
+	}
+
+	if err := m.KV.Error(); err != nil {
+		return fmt.Errorf("reading KV: %w", err)
+	}
+
+	return nil
+}
+
+func (a *spoeArgs) setValue(arg spoeArg, k *encoding.KVEntry) error {
+	t := k.Type()
+
+	switch arg {
+	case argLevel:
+		switch t {
+		case encoding.DataTypeNull, encoding.DataTypeInt32, encoding.DataTypeInt64,
+			encoding.DataTypeUInt32, encoding.DataTypeUInt64:
+			a.level = k.ValueInt()
+			return nil
+		}
+	case argSSL:
+		switch t {
+		case encoding.DataTypeNull, encoding.DataTypeBool:
+			a.ssl = k.ValueBool()
+			return nil
+		}
+	case argSrc:
+		switch t {
+		case encoding.DataTypeNull, encoding.DataTypeIPV4, encoding.DataTypeIPV6, encoding.DataTypeBinary:
+			a.src = k.ValueBytes()
+			return nil
+		}
+	default:
+		switch t {
+		case encoding.DataTypeNull, encoding.DataTypeString, encoding.DataTypeBinary:
+			*a.bytesValue(arg) = k.ValueBytes()
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %s has data type %d", errArgumentType, arg, t)
+}
+
+func (a *spoeArgs) bytesValue(arg spoeArg) *[]byte {
+	switch arg {
+	case argFrontend:
+		return &a.frontend
+	case argHost:
+		return &a.host
+	case argCookie:
+		return &a.cookie
+	case argCookies:
+		return &a.cookies
+	case argMethod:
+		return &a.method
+	case argBody:
+		return &a.body
+	case argSession:
+		return &a.session
+	case argVersion:
+		return &a.version
+	case argPath:
+		return &a.path
+	case argUserAgent:
+		return &a.ua
+	case argSignature:
+		return &a.signature
+	case argSignatureInput:
+		return &a.signatureInput
+	case argSignatureAgent:
+		return &a.signatureAgent
+	case argAuthorization:
+		return &a.authorization
+	default:
+		panic("argument without bytes value: " + arg.String())
+	}
+}
+
+// has reports whether any of the arguments was sent.
+func (a *spoeArgs) has(args spoeArg) bool {
+	return a.set&args != 0
+}
+
+// require returns an error naming all of the arguments that were not sent.
+func (a *spoeArgs) require(args spoeArg) error {
+	if missing := args &^ a.set; missing != 0 {
+		return fmt.Errorf("%w: %s", errMissingArgument, missing)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/dropmorepackets/haproxy-go/pkg/encoding"
+)
+
+func encodeMessage(t testing.TB, writes ...func(*encoding.KVWriter) error) *encoding.Message {
+	t.Helper()
+
+	writer := encoding.NewKVWriter(make([]byte, 2048), 0)
+	for _, write := range writes {
+		if err := write(writer); err != nil {
+			t.Fatalf("encode message: %v", err)
+		}
+	}
+
+	return &encoding.Message{KV: encoding.NewKVScanner(writer.Bytes(), len(writes))}
+}
+
+func TestSPOEArgsDecode(t *testing.T) {
+	src := netip.MustParseAddr("192.0.2.1").AsSlice()
+	level := func(w *encoding.KVWriter) error { return w.SetInt64("level", 2) }
+	source := func(w *encoding.KVWriter) error { return w.SetBinary("src", src) }
+	host := func(w *encoding.KVWriter) error { return w.SetString("host", "example.com") }
+	cookie := func(w *encoding.KVWriter) error { return w.SetNull("cookie") }
+
+	tests := []struct {
+		name    string
+		writes  []func(*encoding.KVWriter) error
+		wantErr error
+	}{
+		{name: "configured order", writes: []func(*encoding.KVWriter) error{level, source, host, cookie}},
+		{name: "any order", writes: []func(*encoding.KVWriter) error{cookie, host, level, source}},
+		{
+			name: "unknown argument",
+			writes: []func(*encoding.KVWriter) error{level, source, host, cookie, func(w *encoding.KVWriter) error {
+				return w.SetString("ja4", "t13d1516h2_8daaf6152771_02713d6af862")
+			}},
+		},
+		{name: "duplicate argument", writes: []func(*encoding.KVWriter) error{level, source, level}, wantErr: errDuplicateArgument},
+		{
+			name: "invalid type",
+			writes: []func(*encoding.KVWriter) error{func(w *encoding.KVWriter) error {
+				return w.SetString("level", "2")
+			}},
+			wantErr: errArgumentType,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := acquireSPOEArgs()
+			defer releaseSPOEArgs(args)
+
+			err := args.decode(context.Background(), encodeMessage(t, tt.writes...))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("decode() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if err := args.require(argLevel | argSrc | argHost | argCookie); err != nil {
+				t.Fatalf("require() error = %v", err)
+			}
+			if args.level != 2 || string(args.host) != "example.com" || string(args.src) != string(src) || args.cookie != nil {
+				t.Errorf("decoded args = %+v", args)
+			}
+		})
+	}
+}
+
+func TestSPOEArgsDecodeUnknownLoggedOnce(t *testing.T) {
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+
+	for i := 0; i < 3; i++ {
+		args := acquireSPOEArgs()
+		message := encodeMessage(t, func(w *encoding.KVWriter) error { return w.SetString("logged-once", "x") })
+		if err := args.decode(context.Background(), message); err != nil {
+			t.Fatal(err)
+		}
+		releaseSPOEArgs(args)
+	}
+
+	if n := strings.Count(buf.String(), "ignoring unknown SPOP argument"); n != 1 {
+		t.Errorf("logged the unknown argument %d times, want once:\n%s", n, buf.String())
+	}
+}
+
+func TestSPOEArgsRequire(t *testing.T) {
+	args := acquireSPOEArgs()
+	defer releaseSPOEArgs(args)
+
+	message := encodeMessage(t, func(w *encoding.KVWriter) error { return w.SetInt64("level", 1) })
+	if err := args.decode(context.Background(), message); err != nil {
+		t.Fatal(err)
+	}
+
+	err := args.require(argLevel | argSrc | argHost)
+	if !errors.Is(err, errMissingArgument) {
+		t.Fatalf("require() error = %v, want %v", err, errMissingArgument)
+	}
+	if want := "missing SPOP argument: src,host"; err.Error() != want {
+		t.Errorf("require() error = %q, want %q", err, want)
+	}
+}
+
+func TestSPOEArgsDecodeAllocs(t *testing.T) {
+	src := netip.MustParseAddr("192.0.2.1").AsSlice()
+	writer := encoding.NewKVWriter(make([]byte, 2048), 0)
+	for _, write := range []func() error{
+		func() error { return writer.SetString("cookies", "a=b; berghain=c") },
+		func() error { return writer.SetString("host", "example.com") },
+		func() error { return writer.SetBinary("src", src) },
+		func() error { return writer.SetInt64("level", 1) },
+		func() error { return writer.SetString("frontend", "fe") },
+		func() error { return writer.SetString("an-argument-name-newer-agents-understand", "ignored") },
+	} {
+		if err := write(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		args := acquireSPOEArgs()
+		scanner := encoding.AcquireKVScanner(writer.Bytes(), 6)
+		if err := args.decode(context.Background(), &encoding.Message{KV: scanner}); err != nil {
+			t.Fatal(err)
+		}
+		encoding.ReleaseKVScanner(scanner)
+		releaseSPOEArgs(args)
+	})
+	if allocs != 0 {
+		t.Errorf("decode allocates %v times per message", allocs)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DropMorePackets/berghain"
+)
+
+// Outcomes of audit events.
+const (
+	auditOutcomeIssued  = "issued"
+	auditOutcomeCleared = "cleared"
+	auditOutcomeFailed  = "failed"
+)
+
+// Validators of clearances not issued by a challenge.
+const (
+	auditValidatorPrivacyPass = "privacy_pass"
+	auditValidatorMint        = "mint"
+)
+
+// auditEvent is a clearance issued or a challenge failed, written as one
+// JSON line. The support log records issued challenges as well.
+type auditEvent struct {
+	Time      time.Time `json:"time"`
+	Frontend  string    `json:"frontend"`
+	Host      string    `json:"host"`
+	Src       string    `json:"src"`
+	Level     uint8     `json:"level"`
+	Validator string    `json:"validator"`
+	Outcome   string    `json:"outcome"`
+	ErrorCode string    `json:"error_code,omitempty"`
+	SupportID string    `json:"support_id,omitempty"`
+}
+
+// auditSink writes encoded events, one per call.
+type auditSink interface {
+	write(line []byte) error
+	io.Closer
+}
+
+// auditLog queues events for a single writer, so recording never blocks on
+// the sink. All methods are no-ops on a nil receiver, which is used when
+// auditing is disabled.
+type auditLog struct {
+	sink    auditSink
+	events  chan auditEvent
+	dropped atomic.Uint64
+}
+
+func newAuditLog(sink auditSink, queueSize int) *auditLog {
+	return &auditLog{sink: sink, events: make(chan auditEvent, queueSize)}
+}
+
+// record queues the event. Events recorded while the queue is full are
+// dropped and reported with the next write.
+func (a *auditLog) record(e auditEvent) {
+	if a == nil {
+		return
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	select {
+	case a.events <- e:
+	default:
+		a.dropped.Add(1)
+	}
+}
+
+// challengeEvent returns the event of a challenge message, issued unless
+// it cleared the client or failed with code.
+func (f *frontend) challengeEvent(ri *berghain.RequestIdentifier, supportID []byte, cleared bool, code berghain.ErrorCode) auditEvent {
+	e := auditEvent{
+		Time:      time.Now(),
+		Frontend:  f.name,
+		Host:      string(ri.Host),
+		Src:       ri.SrcAddr.String(),
+		Level:     ri.Level,
+		Validator: f.bh.LevelConfig(ri.Level).Type.String(),
+		Outcome:   auditOutcomeIssued,
+	}
+	switch {
+	case code != "":
+		e.Outcome, e.ErrorCode = auditOutcomeFailed, string(code)
+	case cleared:
+		e.Outcome = auditOutcomeCleared
+	}
+	if berghain.ValidSupportID(supportID) {
+		e.SupportID = normalizeSupportID(string(supportID))
+	}
+	return e
+}
+
+// challenged records the event of a challenge message. Challenges issued
+// without a clearance are not audited.
+func (a *auditLog) challenged(e auditEvent) {
+	if a == nil || e.Outcome == auditOutcomeIssued {
+		return
+	}
+	a.record(e)
+}
+
+// cleared records a clearance issued without a challenge.
+func (a *auditLog) cleared(f *frontend, ri *berghain.RequestIdentifier, level uint8, validator string) {
+	if a == nil {
+		return
+	}
+
+	a.record(auditEvent{
+		Frontend:  f.name,
+		Host:      string(ri.Host),
+		Src:       ri.SrcAddr.String(),
+		Level:     level,
+		Validator: validator,
+		Outcome:   auditOutcomeCleared,
+	})
+}
+
+// run writes the queued events until the context is done, then writes the
+// remaining ones and closes the sink.
+func (a *auditLog) run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer func() {
+		if err := a.sink.Close(); err != nil {
+			slog.Error("failed closing audit log", "error", err)
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			for len(a.events) > 0 {
+				a.write(<-a.events)
+			}
+			return
+		case e := <-a.events:
+			a.write(e)
+		}
+	}
+}
+
+func (a *auditLog) write(e auditEvent) {
+	if dropped := a.dropped.Swap(0); dropped > 0 {
+		slog.Warn("dropped audit events, the queue was full", "events", dropped)
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		slog.Error("failed encoding audit event", "error", err)
+		return
+	}
+	if err := a.sink.write(append(line, '\n')); err != nil {
+		slog.Error("failed writing audit event", "error", err)
+	}
+}
+
+// auditFile appends events to a file, which is rotated to path.1 up to
+// path.<maxBackups> once it would grow beyond maxSize.
+type auditFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	f    *os.File
+	size int64
+}
+
+func openAuditFile(path string, maxSize int64, maxBackups int) (*auditFile, error) {
+	af := &auditFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := af.open(); err != nil {
+		return nil, err
+	}
+	return af, nil
+}
+
+func (af *auditFile) open() error {
+	f, err := os.OpenFile(af.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	af.f, af.size = f, fi.Size()
+	return nil
+}
+
+func (af *auditFile) write(line []byte) error {
+	if af.f == nil {
+		// a previous rotation failed to reopen the file
+		if err := af.open(); err != nil {
+			return err
+		}
+	}
+	if af.size > 0 && af.size+int64(len(line)) > af.maxSize {
+		if err := af.rotate(); err != nil {
+			return fmt.Errorf("rotating %s: %w", af.path, err)
+		}
+	}
+
+	n, err := af.f.Write(line)
+	af.size += int64(n)
+	return err
+}
+
+func (af *auditFile) rotate() error {
+	if err := af.Close(); err != nil {
+		return err
+	}
+
+	if af.maxBackups > 0 {
+		for i := af.maxBackups - 1; i > 0; i-- {
+			err := os.Rename(fmt.Sprintf("%s.%d", af.path, i), fmt.Sprintf("%s.%d", af.path, i+1))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		if err := os.Rename(af.path, af.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Truncate(af.path, 0); err != nil {
+		return err
+	}
+
+	return af.open()
+}
+
+func (af *auditFile) Close() error {
+	if af.f == nil {
+		return nil
+	}
+
+	f := af.f
+	af.f = nil
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
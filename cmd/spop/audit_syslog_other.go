@@ -0,0 +1,23 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"errors"
+	"runtime"
+)
+
+// auditSyslog is not available, log/syslog does not support this system.
+type auditSyslog struct{}
+
+func dialAuditSyslog(address, tag string) (*auditSyslog, error) {
+	return nil, errors.New("syslog is not supported on " + runtime.GOOS)
+}
+
+func (as *auditSyslog) write(line []byte) error {
+	return nil
+}
+
+func (as *auditSyslog) Close() error {
+	return nil
+}
@@ -0,0 +1,34 @@
+//go:build !windows && !plan9
+
+package main
+
+import "log/syslog"
+
+// auditSyslog sends events to the local syslog daemon.
+type auditSyslog struct {
+	w *syslog.Writer
+}
+
+// dialAuditSyslog connects to the syslog socket at address, the default
+// local socket if it is empty.
+func dialAuditSyslog(address, tag string) (*auditSyslog, error) {
+	network := ""
+	if address != "" {
+		network = "unixgram"
+	}
+
+	w, err := syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &auditSyslog{w: w}, nil
+}
+
+func (as *auditSyslog) write(line []byte) error {
+	// syslog frames messages itself
+	return as.w.Info(string(line[:len(line)-1]))
+}
+
+func (as *auditSyslog) Close() error {
+	return as.w.Close()
+}
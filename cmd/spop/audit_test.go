@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dropmorepackets/haproxy-go/pkg/encoding"
+
+	"github.com/DropMorePackets/berghain"
+)
+
+// memorySink keeps written lines for inspection.
+type memorySink struct {
+	lines  []string
+	closed bool
+}
+
+func (m *memorySink) write(line []byte) error {
+	m.lines = append(m.lines, string(line))
+	return nil
+}
+
+func (m *memorySink) Close() error {
+	m.closed = true
+	return nil
+}
+
+// auditEvents returns the events queued by the audit log.
+func auditEvents(a *auditLog) []auditEvent {
+	var events []auditEvent
+	for len(a.events) > 0 {
+		events = append(events, <-a.events)
+	}
+	return events
+}
+
+func TestAuditChallenge(t *testing.T) {
+	const session = "bh@123e4567-e89b-12d3-a456-426614174000"
+	src := netip.MustParseAddr("192.0.2.1").AsSlice()
+	f := frontend{name: "shop", bh: challengeBerghain(), audit: newAuditLog(&memorySink{}, 16)}
+
+	for _, optional := range [][]func(*encoding.KVWriter) error{
+		{func(w *encoding.KVWriter) error { return w.SetString("session", session) }},
+		// without a session the none validator fails
+		nil,
+	} {
+		message := challengeMessage(t, src, "example.com", optional...)
+		f.HandleSPOEChallenge(context.Background(), encoding.NewActionWriter(make([]byte, 2048), 0), messageArgs(t, message))
+	}
+
+	events := auditEvents(f.audit)
+	if len(events) != 2 {
+		t.Fatalf("recorded %d events, want 2: %+v", len(events), events)
+	}
+
+	cleared, failed := events[0], events[1]
+	if cleared.Time.IsZero() {
+		t.Error("event without time")
+	}
+	want := auditEvent{
+		Time:      cleared.Time,
+		Frontend:  "shop",
+		Host:      "example.com",
+		Src:       "192.0.2.1",
+		Level:     1,
+		Validator: "none",
+		Outcome:   auditOutcomeCleared,
+		SupportID: session,
+	}
+	if cleared != want {
+		t.Errorf("cleared = %+v, want %+v", cleared, want)
+	}
+	want.Time, want.Outcome, want.ErrorCode, want.SupportID = failed.Time, auditOutcomeFailed, string(berghain.ErrorCodeInternal), ""
+	if failed != want {
+		t.Errorf("failed = %+v, want %+v", failed, want)
+	}
+}
+
+func TestAuditLogDropsWhenFull(t *testing.T) {
+	sink := &memorySink{}
+	a := newAuditLog(sink, 1)
+	a.record(auditEvent{Outcome: auditOutcomeCleared})
+	a.record(auditEvent{Outcome: auditOutcomeFailed})
+
+	if got := a.dropped.Load(); got != 1 {
+		t.Errorf("dropped = %d, want 1", got)
+	}
+
+	// the remaining event is written on shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	a.run(ctx, &wg)
+
+	if len(sink.lines) != 1 || !strings.Contains(sink.lines[0], `"outcome":"cleared"`) || !strings.HasSuffix(sink.lines[0], "}\n") {
+		t.Errorf("lines = %q", sink.lines)
+	}
+	if !sink.closed {
+		t.Error("sink not closed")
+	}
+
+	// disabled audit logs ignore events
+	var disabled *auditLog
+	disabled.record(auditEvent{})
+	disabled.cleared(nil, nil, 1, auditValidatorMint)
+}
+
+func TestAuditFileRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	line := []byte(strings.Repeat("x", 9) + "\n")
+
+	af, err := openAuditFile(path, 25, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// two lines fit, every further pair starts a new file
+	for i := 0; i < 7; i++ {
+		if err := af.write(line); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+	}
+	if err := af.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]int{"audit.jsonl": 1, "audit.jsonl.1": 2, "audit.jsonl.2": 2} {
+		if got := countLines(t, filepath.Join(filepath.Dir(path), name)); got != want {
+			t.Errorf("%s has %d lines, want %d", name, got, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("more than max_backups files kept: %v", err)
+	}
+
+	// reopening appends to the current file
+	af, err = openAuditFile(path, 25, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := af.write(line); err != nil {
+		t.Fatal(err)
+	}
+	af.Close()
+	if got := countLines(t, path); got != 2 {
+		t.Errorf("reopened file has %d lines, want 2", got)
+	}
+}
+
+func countLines(t *testing.T, path string) int {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	n := 0
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		n++
+	}
+	return n
+}
+
+func TestAuditEventJSON(t *testing.T) {
+	b, err := json.Marshal(auditEvent{Frontend: "shop", Outcome: auditOutcomeCleared})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{`"time":`, `"frontend":"shop"`, `"host":`, `"src":`, `"level":0`, `"validator":`, `"outcome":"cleared"`} {
+		if !strings.Contains(string(b), field) {
+			t.Errorf("%s missing %s", b, field)
+		}
+	}
+	if strings.Contains(string(b), "error_code") || strings.Contains(string(b), "support_id") {
+		t.Errorf("%s contains empty optional fields", b)
+	}
+}
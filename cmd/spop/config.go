@@ -1,8 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
+	"slices"
 	"strings"
 	"time"
 
@@ -16,6 +27,565 @@ type Config struct {
 	Listen   string                    `yaml:"listen"`
 	Default  FrontendConfig            `yaml:"default"`
 	Frontend map[string]FrontendConfig `yaml:"frontend"`
+	GeoIP    *GeoIPConfig              `yaml:"geoip"`
+
+	IPLists []IPListConfig `yaml:"ip_lists"`
+	// IPListsReloadInterval is how often the lists are checked for changes,
+	// defaults to a minute.
+	IPListsReloadInterval time.Duration `yaml:"ip_lists_reload_interval"`
+
+	Reputation *ReputationConfig `yaml:"reputation"`
+
+	Revocation *RevocationConfig `yaml:"revocation"`
+
+	VerifiedBots *VerifiedBotsConfig `yaml:"verified_bots"`
+
+	SignatureAgents []SignatureAgentConfig `yaml:"signature_agents"`
+	// SignatureAgentsReloadInterval is how often the key directories are
+	// checked for changes, defaults to a minute.
+	SignatureAgentsReloadInterval time.Duration `yaml:"signature_agents_reload_interval"`
+	// SignatureMaxValidity bounds how long a signature is accepted after it
+	// was created, defaults to five minutes.
+	SignatureMaxValidity time.Duration `yaml:"signature_max_validity"`
+
+	PrivacyPass *PrivacyPassConfig `yaml:"privacy_pass"`
+
+	BypassTokens []BypassTokenConfig `yaml:"bypass_tokens"`
+
+	Admin *AdminConfig `yaml:"admin"`
+
+	Metrics *MetricsConfig `yaml:"metrics"`
+
+	Tracing *TracingConfig `yaml:"tracing"`
+
+	Health *HealthConfig `yaml:"health"`
+
+	Log *LogConfig `yaml:"log"`
+
+	Audit *AuditConfig `yaml:"audit"`
+
+	Support *SupportConfig `yaml:"support"`
+
+	// hash is the SHA-256 digest of the config file, reported on /status.
+	hash [sha256.Size]byte
+}
+
+type LogConfig struct {
+	// Frontends override the -loglevel flag for the messages of a
+	// frontend, e.g. debug for one of them.
+	Frontends map[string]string `yaml:"frontends"`
+	Sampling  LogSamplingConfig `yaml:"sampling"`
+}
+
+type LogSamplingConfig struct {
+	// Burst is the number of records with the same level and message
+	// logged per Interval, zero disables sampling.
+	Burst int `yaml:"burst"`
+	// Interval defaults to a second.
+	Interval time.Duration `yaml:"interval"`
+}
+
+func (c LogConfig) AsLogHandler(base *logHandler) *logHandler {
+	lh := *base
+	lh.frontends = make(map[string]slog.Level, len(c.Frontends))
+	for name, level := range c.Frontends {
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(level)); err != nil {
+			Fatal("invalid log level", "frontend", name, "level", level)
+		}
+		lh.frontends[name] = l
+	}
+
+	if c.Sampling.Burst < 0 {
+		Fatal("log sampling burst cannot be negative", "burst", c.Sampling.Burst)
+	}
+	lh.sampler = newLogSampler(c.Sampling.Burst, c.Sampling.Interval)
+
+	return &lh
+}
+
+type AuditConfig struct {
+	// QueueSize bounds the events waiting to be written, events recorded
+	// while it is full are dropped. It defaults to 4096.
+	QueueSize int `yaml:"queue_size"`
+	// Either File or Syslog receives the events.
+	File   *AuditFileConfig   `yaml:"file"`
+	Syslog *AuditSyslogConfig `yaml:"syslog"`
+}
+
+type AuditFileConfig struct {
+	// Path is the JSONL file events are appended to.
+	Path string `yaml:"path"`
+	// MaxSizeMB is the size the file is rotated at, 100 by default.
+	MaxSizeMB int `yaml:"max_size_mb"`
+	// MaxBackups is the number of rotated files kept, 5 by default.
+	MaxBackups *int `yaml:"max_backups"`
+}
+
+type AuditSyslogConfig struct {
+	// Address is the local syslog socket, e.g. /dev/log. The default
+	// sockets are tried if it is empty.
+	Address string `yaml:"address"`
+	// Tag defaults to berghain.
+	Tag string `yaml:"tag"`
+}
+
+func (c AuditConfig) AsAuditLog() *auditLog {
+	if (c.File == nil) == (c.Syslog == nil) {
+		Fatal("audit needs either a file or a syslog sink")
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = 4096
+	}
+
+	var sink auditSink
+	if c.File != nil {
+		maxSize, maxBackups := c.File.MaxSizeMB, 5
+		if maxSize <= 0 {
+			maxSize = 100
+		}
+		if c.File.MaxBackups != nil {
+			maxBackups = *c.File.MaxBackups
+		}
+
+		af, err := openAuditFile(c.File.Path, int64(maxSize)<<20, maxBackups)
+		if err != nil {
+			Fatal("failed opening audit log", "path", c.File.Path, "error", err)
+		}
+		sink = af
+	} else {
+		tag := c.Syslog.Tag
+		if tag == "" {
+			tag = "berghain"
+		}
+
+		as, err := dialAuditSyslog(c.Syslog.Address, tag)
+		if err != nil {
+			Fatal("failed connecting to syslog", "address", c.Syslog.Address, "error", err)
+		}
+		sink = as
+	}
+
+	return newAuditLog(sink, c.QueueSize)
+}
+
+type SupportConfig struct {
+	// MaxEntries is the number of recent challenge events kept for
+	// lookups by support ID, 10000 by default.
+	MaxEntries int `yaml:"max_entries"`
+}
+
+func (c SupportConfig) AsSupportLog() *supportLog {
+	if c.MaxEntries <= 0 {
+		c.MaxEntries = 10000
+	}
+	return newSupportLog(c.MaxEntries)
+}
+
+type HealthConfig struct {
+	// Listen is the address of the HTTP endpoint serving /healthz, /readyz
+	// and /status, e.g. 127.0.0.1:9004.
+	Listen string `yaml:"listen"`
+	// CheckCaptcha makes readiness depend on reaching the siteverify
+	// endpoints of all captcha levels.
+	CheckCaptcha bool `yaml:"check_captcha"`
+	// CaptchaCheckInterval defaults to 30 seconds.
+	CaptchaCheckInterval time.Duration `yaml:"captcha_check_interval"`
+}
+
+type MetricsConfig struct {
+	// Listen is the address of the HTTP endpoint serving /metrics in the
+	// Prometheus text format, e.g. 127.0.0.1:9003.
+	Listen string `yaml:"listen"`
+}
+
+type AdminConfig struct {
+	// Listen is the address of the admin HTTP endpoint, e.g.
+	// 127.0.0.1:9002. It should not be reachable from the internet.
+	Listen string `yaml:"listen"`
+	// Key authenticates admin requests as Bearer token, separate from
+	// the secret the cookies are signed with.
+	Key string `yaml:"key"`
+}
+
+// minAdminKeyLength is the length of 16 random bytes encoded as base64.
+const minAdminKeyLength = 22
+
+func (c AdminConfig) AsKey() []byte {
+	if c.Listen == "" {
+		Fatal("admin endpoint needs a listen address")
+	}
+	if len(c.Key) < minAdminKeyLength {
+		Fatal("admin key too short", "have", len(c.Key), "need", minAdminKeyLength)
+	}
+	return []byte(c.Key)
+}
+
+type BypassTokenConfig struct {
+	Label string `yaml:"label"`
+	// SHA256 is the hex encoded SHA-256 digest of the token.
+	SHA256 string `yaml:"sha256"`
+	// Frontends are the frontends accepting the token, all if empty.
+	Frontends []string `yaml:"frontends"`
+	Hosts     []string `yaml:"hosts"`
+	CIDRs     []string `yaml:"cidrs"`
+	// Expires is an RFC 3339 time or a date, the token never expires if
+	// empty.
+	Expires string `yaml:"expires"`
+}
+
+// AsBypassTokens returns the bypass tokens accepted by the frontend, nil if
+// there are none.
+func (c Config) AsBypassTokens(frontend string) *berghain.BypassTokens {
+	var tokens []berghain.BypassToken
+	for _, tc := range c.BypassTokens {
+		for _, name := range tc.Frontends {
+			if _, ok := c.Frontend[name]; !ok && name != defaultFrontend {
+				Fatal("bypass token refers to unknown frontend", "token", tc.Label, "frontend", name)
+			}
+		}
+		if len(tc.Frontends) > 0 && !slices.Contains(tc.Frontends, frontend) {
+			continue
+		}
+
+		t := berghain.BypassToken{Label: tc.Label, Hosts: tc.Hosts}
+
+		hash, err := hex.DecodeString(tc.SHA256)
+		if err != nil || len(hash) != len(t.Hash) {
+			Fatal("invalid bypass token hash, want a hex encoded sha256 digest", "token", tc.Label)
+		}
+		copy(t.Hash[:], hash)
+
+		for _, cidr := range tc.CIDRs {
+			p, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				Fatal("invalid bypass token cidr", "token", tc.Label, "error", err)
+			}
+			t.CIDRs = append(t.CIDRs, p)
+		}
+
+		if tc.Expires != "" {
+			if t.Expires, err = time.Parse(time.RFC3339, tc.Expires); err != nil {
+				if t.Expires, err = time.Parse(time.DateOnly, tc.Expires); err != nil {
+					Fatal("invalid bypass token expiry", "token", tc.Label, "expires", tc.Expires)
+				}
+			}
+		}
+
+		tokens = append(tokens, t)
+	}
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	b, err := berghain.NewBypassTokens(tokens)
+	if err != nil {
+		Fatal("invalid bypass tokens", "error", err)
+	}
+
+	return b
+}
+
+type PrivacyPassConfig struct {
+	Issuers []TokenIssuerConfig `yaml:"issuers"`
+	// Window is how often the redemption context of challenges changes,
+	// defaults to five minutes.
+	Window time.Duration `yaml:"window"`
+	// ReloadInterval is how often the issuer directories are checked for
+	// changes, defaults to a minute.
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+type TokenIssuerConfig struct {
+	// Name is the host name of the issuer, the issuer_name of challenges.
+	Name string `yaml:"name"`
+	// Directory is the path of a local copy of the issuer directory.
+	Directory string `yaml:"directory"`
+}
+
+func (c PrivacyPassConfig) AsPrivacyPass(secret []byte) *berghain.PrivacyPass {
+	var issuers []*berghain.TokenIssuer
+	for _, ic := range c.Issuers {
+		if ic.Name == "" {
+			Fatal("token issuers need a name")
+		}
+
+		keys, err := berghain.OpenIssuerDirectory(ic.Directory)
+		if err != nil {
+			Fatal("failed loading token issuer keys", "issuer", ic.Name, "error", err)
+		}
+		issuers = append(issuers, &berghain.TokenIssuer{Name: ic.Name, Keys: keys})
+	}
+	if len(issuers) == 0 {
+		Fatal("privacy pass needs at least one issuer")
+	}
+
+	p, err := berghain.NewPrivacyPass(secret, issuers)
+	if err != nil {
+		Fatal("failed setting up privacy pass", "error", err)
+	}
+	p.Window = c.Window
+
+	return p
+}
+
+type SignatureAgentConfig struct {
+	Name string `yaml:"name"`
+	// URL is the Signature-Agent header value of the agent, optional.
+	URL string `yaml:"url"`
+	// Directory is the path of a local copy of the key directory.
+	Directory string `yaml:"directory"`
+	// Allow lets signed requests pass validation without a cookie.
+	Allow bool `yaml:"allow"`
+}
+
+func (c Config) AsSignatureVerifier() *berghain.SignatureVerifier {
+	if c.SignatureMaxValidity < 0 {
+		Fatal("signature max validity cannot be negative", "max_validity", c.SignatureMaxValidity)
+	}
+
+	v := &berghain.SignatureVerifier{MaxValidity: c.SignatureMaxValidity}
+	for _, ac := range c.SignatureAgents {
+		if ac.Name == "" || slices.ContainsFunc(v.Agents, func(a *berghain.SignatureAgent) bool { return a.Name == ac.Name }) {
+			Fatal("signature agents need a unique name", "name", ac.Name)
+		}
+
+		keys, err := berghain.OpenKeyDirectory(ac.Directory)
+		if err != nil {
+			Fatal("failed loading signature agent keys", "agent", ac.Name, "error", err)
+		}
+
+		v.Agents = append(v.Agents, &berghain.SignatureAgent{
+			Name:  ac.Name,
+			URL:   ac.URL,
+			Keys:  keys,
+			Allow: ac.Allow,
+		})
+	}
+
+	// policy rules may only refer to configured agents
+	policies := []*PolicyConfig{c.Default.Policy}
+	for _, fc := range c.Frontend {
+		policies = append(policies, fc.Policy)
+	}
+	for _, p := range policies {
+		if p == nil {
+			continue
+		}
+		for _, r := range p.Rules {
+			for _, name := range r.SignatureAgents {
+				if !slices.ContainsFunc(c.SignatureAgents, func(a SignatureAgentConfig) bool { return a.Name == name }) {
+					Fatal("policy refers to unknown signature agent", "rule", r.Name, "agent", name)
+				}
+			}
+		}
+	}
+
+	return v
+}
+
+type VerifiedBotsConfig struct {
+	Bots []BotConfig `yaml:"bots"`
+	// Wait is how long a request waits for a DNS verification, zero does
+	// not wait.
+	Wait time.Duration `yaml:"wait"`
+	// Timeout bounds a DNS verification.
+	Timeout     time.Duration `yaml:"timeout"`
+	CacheTTL    time.Duration `yaml:"cache_ttl"`
+	NegativeTTL time.Duration `yaml:"negative_ttl"`
+	// ReloadInterval is how often the range files are checked for
+	// changes, defaults to a minute.
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+type BotConfig struct {
+	Name       string   `yaml:"name"`
+	UserAgents []string `yaml:"user_agents"`
+	Suffixes   []string `yaml:"suffixes"`
+	// Ranges are paths of published range JSON files or plain ip lists.
+	Ranges []string `yaml:"ranges"`
+}
+
+func (c VerifiedBotsConfig) AsBotVerifier() *berghain.BotVerifier {
+	var bots []*berghain.Bot
+	for _, bc := range c.Bots {
+		b := &berghain.Bot{
+			Name:       bc.Name,
+			UserAgents: bc.UserAgents,
+			Suffixes:   bc.Suffixes,
+		}
+		for _, path := range bc.Ranges {
+			l, err := berghain.OpenIPList(bc.Name, path, berghain.ListActionAllow, 0)
+			if err != nil {
+				Fatal("failed loading verified bot ranges", "bot", bc.Name, "error", err)
+			}
+			b.Ranges = append(b.Ranges, l)
+		}
+		bots = append(bots, b)
+	}
+
+	v, err := berghain.NewBotVerifier(bots)
+	if err != nil {
+		Fatal("invalid verified bots", "error", err)
+	}
+	v.Wait = c.Wait
+	v.Timeout = c.Timeout
+	v.CacheTTL = c.CacheTTL
+	v.NegativeTTL = c.NegativeTTL
+
+	return v
+}
+
+type ReputationConfig struct {
+	Threshold       float64       `yaml:"threshold"`
+	PrefixThreshold float64       `yaml:"prefix_threshold"`
+	PrefixV4        int           `yaml:"prefix_v4"`
+	PrefixV6        int           `yaml:"prefix_v6"`
+	Level           int           `yaml:"level"`
+	HalfLife        time.Duration `yaml:"half_life"`
+	MaxEntries      int           `yaml:"max_entries"`
+	// Snapshot is the path of a file the scores are saved to every
+	// SnapshotInterval and on shutdown, and loaded from on startup.
+	Snapshot string `yaml:"snapshot"`
+	// SnapshotInterval defaults to five minutes.
+	SnapshotInterval time.Duration `yaml:"snapshot_interval"`
+	// PruneInterval is how often decayed scores are dropped, defaults to a
+	// minute.
+	PruneInterval time.Duration `yaml:"prune_interval"`
+}
+
+func (c ReputationConfig) AsReputation() *berghain.Reputation {
+	if c.Level < 1 || c.Level > 255 {
+		Fatal("invalid reputation level", "level", c.Level)
+	}
+
+	r, err := berghain.NewReputation(berghain.ReputationConfig{
+		Threshold:       c.Threshold,
+		PrefixThreshold: c.PrefixThreshold,
+		PrefixBitsV4:    c.PrefixV4,
+		PrefixBitsV6:    c.PrefixV6,
+		Level:           uint8(c.Level),
+		HalfLife:        c.HalfLife,
+		MaxEntries:      c.MaxEntries,
+	})
+	if err != nil {
+		Fatal("invalid reputation config", "error", err)
+	}
+
+	if c.Snapshot != "" {
+		if err := r.LoadFile(c.Snapshot); err != nil {
+			Fatal("failed loading reputation snapshot", "error", err)
+		}
+	}
+
+	return r
+}
+
+type TracingConfig struct {
+	// Endpoint is the OTLP/HTTP traces endpoint of the collector, e.g.
+	// http://127.0.0.1:4318/v1/traces.
+	Endpoint string `yaml:"endpoint"`
+	// Headers are sent with every export, e.g. for authentication.
+	Headers map[string]string `yaml:"headers"`
+	// SampleRatio is the share of SPOE messages traced, from 0 to 1.
+	SampleRatio float64 `yaml:"sample_ratio"`
+	// ServiceName defaults to berghain.
+	ServiceName string `yaml:"service_name"`
+}
+
+func (c TracingConfig) AsTracer() *tracer {
+	u, err := url.Parse(c.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		Fatal("tracing endpoint must be a http or https URL", "endpoint", c.Endpoint)
+	}
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		Fatal("tracing sample ratio must be between 0 and 1", "sample_ratio", c.SampleRatio)
+	}
+	if c.ServiceName == "" {
+		c.ServiceName = "berghain"
+	}
+
+	return &tracer{
+		endpoint:    c.Endpoint,
+		headers:     c.Headers,
+		sampleRatio: c.SampleRatio,
+		serviceName: c.ServiceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		spans:       make(chan *span, traceQueueSize),
+	}
+}
+
+type RevocationConfig struct {
+	MaxEntries int `yaml:"max_entries"`
+	// CooldownLevel is the minimum level of the address of a revoked cookie
+	// for Cooldown, zero disables cool-downs.
+	CooldownLevel int           `yaml:"cooldown_level"`
+	Cooldown      time.Duration `yaml:"cooldown"`
+	// PruneInterval is how often expired revocations are dropped, defaults
+	// to a minute.
+	PruneInterval time.Duration `yaml:"prune_interval"`
+}
+
+func (c RevocationConfig) AsRevocations() *berghain.Revocations {
+	if c.CooldownLevel < 0 || c.CooldownLevel > 255 {
+		Fatal("invalid revocation cool-down level", "level", c.CooldownLevel)
+	}
+
+	r, err := berghain.NewRevocations(berghain.RevocationConfig{
+		MaxEntries:    c.MaxEntries,
+		CooldownLevel: uint8(c.CooldownLevel),
+		Cooldown:      c.Cooldown,
+	})
+	if err != nil {
+		Fatal("invalid revocation config", "error", err)
+	}
+
+	return r
+}
+
+type IPListConfig struct {
+	Name string `yaml:"name"`
+	// Path of a file with one address or prefix per line.
+	Path string `yaml:"path"`
+	// Action is allow, deny or level, which is implied by a level.
+	Action string `yaml:"action"`
+	Level  int    `yaml:"level"`
+}
+
+func (c Config) AsIPLists() berghain.IPLists {
+	var lists berghain.IPLists
+	names := make(map[string]bool)
+
+	for _, lc := range c.IPLists {
+		if lc.Name == "" || names[lc.Name] {
+			Fatal("ip lists need a unique name", "name", lc.Name)
+		}
+		names[lc.Name] = true
+
+		var action berghain.ListAction
+		switch lc.Action {
+		case "allow":
+			action = berghain.ListActionAllow
+		case "deny":
+			action = berghain.ListActionDeny
+		case "level", "":
+			action = berghain.ListActionLevel
+		default:
+			Fatal("unknown ip list action", "list", lc.Name, "action", lc.Action)
+		}
+
+		if lc.Level < 0 || lc.Level > 255 || action != berghain.ListActionLevel && lc.Level != 0 {
+			Fatal("invalid ip list level", "list", lc.Name, "level", lc.Level)
+		}
+
+		l, err := berghain.OpenIPList(lc.Name, lc.Path, action, uint8(lc.Level))
+		if err != nil {
+			Fatal("failed loading ip list", "error", err)
+		}
+		lists = append(lists, l)
+	}
+
+	return lists
 }
 
 type Secret []byte
@@ -33,12 +603,96 @@ func (s *Secret) UnmarshalYAML(b []byte) error {
 	return nil
 }
 
+type GeoIPConfig struct {
+	// Country and ASN are paths to MaxMind DB files, e.g. GeoLite2-Country
+	// and GeoLite2-ASN. Either may be omitted.
+	Country string `yaml:"country"`
+	ASN     string `yaml:"asn"`
+	// ReloadInterval is how often the files are checked for changes,
+	// defaults to a minute.
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+func (c GeoIPConfig) AsGeoIP() *berghain.GeoIP {
+	var paths []string
+	for _, p := range []string{c.Country, c.ASN} {
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+
+	g, err := berghain.OpenGeoIP(paths...)
+	if err != nil {
+		Fatal("failed loading geoip databases", "error", err)
+	}
+
+	return g
+}
+
 type FrontendConfig struct {
-	Levels         []LevelConfig `yaml:"levels"`
-	TrustedDomains []string      `yaml:"trusted_domains"`
+	Levels         []LevelConfig        `yaml:"levels"`
+	TrustedDomains []string             `yaml:"trusted_domains"`
+	Cookie         CookieConfig         `yaml:"cookie"`
+	Policy         *PolicyConfig        `yaml:"policy"`
+	TrustedTokens  []TrustedTokenConfig `yaml:"trusted_tokens"`
+}
+
+type TrustedTokenConfig struct {
+	Name string `yaml:"name"`
+	// Cookie is the name of the cookie carrying the token. Without it,
+	// the authorization argument is read as Bearer token.
+	Cookie string `yaml:"cookie"`
+	// Algorithm is HS256 or EdDSA.
+	Algorithm string `yaml:"algorithm"`
+	// Key is the base64 encoded HS256 secret, or the Ed25519 public key
+	// for EdDSA, raw and base64 encoded or in PEM.
+	Key string `yaml:"key"`
+	// Claims are required claim values, e.g. iss and aud.
+	Claims map[string]string `yaml:"claims"`
 }
 
-func (fc FrontendConfig) AsBerghain(s []byte) *berghain.Berghain {
+func (c TrustedTokenConfig) AsTrustedToken() *berghain.TrustedToken {
+	t := &berghain.TrustedToken{
+		Name:   c.Name,
+		Cookie: c.Cookie,
+		Claims: c.Claims,
+	}
+	if t.Name == "" {
+		Fatal("trusted tokens need a name")
+	}
+
+	switch c.Algorithm {
+	case "HS256":
+		t.Algorithm = berghain.TokenAlgorithmHS256
+	case "EdDSA":
+		t.Algorithm = berghain.TokenAlgorithmEdDSA
+	default:
+		Fatal("unsupported trusted token algorithm", "token", c.Name, "algorithm", c.Algorithm)
+	}
+
+	if block, _ := pem.Decode([]byte(c.Key)); block != nil {
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		key, ok := pub.(ed25519.PublicKey)
+		if err != nil || !ok {
+			Fatal("invalid trusted token key, want an Ed25519 public key", "token", c.Name, "error", err)
+		}
+		t.Key = key
+	} else {
+		key, err := base64.StdEncoding.DecodeString(c.Key)
+		if err != nil {
+			Fatal("invalid trusted token key, want base64", "token", c.Name, "error", err)
+		}
+		t.Key = key
+	}
+
+	if err := t.Validate(); err != nil {
+		Fatal("invalid trusted token", "error", err)
+	}
+
+	return t
+}
+
+func (fc FrontendConfig) AsBerghain(s []byte, lists berghain.IPLists) *berghain.Berghain {
 	b := berghain.NewBerghain(s)
 
 	for _, c := range fc.Levels {
@@ -46,10 +700,186 @@ func (fc FrontendConfig) AsBerghain(s []byte) *berghain.Berghain {
 	}
 
 	b.TrustedDomains = fc.TrustedDomains
+	b.Cookie = fc.Cookie.AsCookieConfig()
+
+	if b.Cookie.HostOnly() && len(b.TrustedDomains) > 0 {
+		Fatal("the __Host- cookie prefix cannot be combined with trusted_domains", "prefix", b.Cookie.Prefix)
+	}
+
+	b.IPLists = lists
+
+	for _, tc := range fc.TrustedTokens {
+		b.TrustedTokens = append(b.TrustedTokens, tc.AsTrustedToken())
+	}
+
+	if fc.Policy != nil {
+		b.Policy = fc.Policy.AsPolicy(len(b.Levels), lists)
+	}
 
 	return b
 }
 
+type PolicyConfig struct {
+	// Timezone of the rule time windows, defaults to UTC.
+	Timezone string             `yaml:"timezone"`
+	Rules    []PolicyRuleConfig `yaml:"rules"`
+}
+
+type PolicyRuleConfig struct {
+	Name       string   `yaml:"name"`
+	Paths      []string `yaml:"paths"`
+	Methods    []string `yaml:"methods"`
+	Hosts      []string `yaml:"hosts"`
+	UserAgents []string `yaml:"user_agents"`
+	CIDRs      []string `yaml:"cidrs"`
+	// IPLists are names of ip_lists entries.
+	IPLists []string `yaml:"ip_lists"`
+	// Countries and ASNs require the geoip section.
+	Countries []string `yaml:"countries"`
+	ASNs      []uint32 `yaml:"asns"`
+	// Times are daily windows like 22:00-06:00.
+	Times []string `yaml:"times"`
+	// SignatureAgents are names of signature_agents entries.
+	SignatureAgents []string `yaml:"signature_agents"`
+
+	// Action is allow, deny or level, which is implied by a level.
+	Action string `yaml:"action"`
+	Level  int    `yaml:"level"`
+}
+
+func (c PolicyConfig) AsPolicy(levels int, lists berghain.IPLists) *berghain.Policy {
+	loc := time.UTC
+	if c.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(c.Timezone); err != nil {
+			Fatal("invalid policy timezone", "timezone", c.Timezone, "error", err)
+		}
+	}
+
+	rules := make([]berghain.PolicyRule, 0, len(c.Rules))
+	for _, rc := range c.Rules {
+		r := berghain.PolicyRule{
+			Name:       rc.Name,
+			Paths:      rc.Paths,
+			Methods:    rc.Methods,
+			Hosts:      rc.Hosts,
+			UserAgents: rc.UserAgents,
+			Countries:  rc.Countries,
+			ASNs:       rc.ASNs,
+
+			SignatureAgents: rc.SignatureAgents,
+		}
+
+		switch rc.Action {
+		case "allow":
+			r.Action = berghain.PolicyActionAllow
+		case "deny":
+			r.Action = berghain.PolicyActionDeny
+		case "level", "":
+			r.Action = berghain.PolicyActionLevel
+		default:
+			Fatal("unknown policy action", "rule", rc.Name, "action", rc.Action)
+		}
+
+		if rc.Level < 0 || rc.Level > levels {
+			Fatal("policy level must refer to a configured level", "rule", rc.Name, "level", rc.Level, "levels", levels)
+		}
+		r.Level = uint8(rc.Level)
+
+		for _, cidr := range rc.CIDRs {
+			p, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				Fatal("invalid policy cidr", "rule", rc.Name, "error", err)
+			}
+			r.CIDRs = append(r.CIDRs, p.Masked())
+		}
+
+		for _, name := range rc.IPLists {
+			i := slices.IndexFunc(lists, func(l *berghain.IPList) bool { return l.Name == name })
+			if i < 0 {
+				Fatal("policy refers to unknown ip list", "rule", rc.Name, "list", name)
+			}
+			r.IPLists = append(r.IPLists, lists[i])
+		}
+
+		for _, tw := range rc.Times {
+			w, err := berghain.ParseTimeWindow(tw)
+			if err != nil {
+				Fatal("invalid policy time window", "rule", rc.Name, "error", err)
+			}
+			r.Times = append(r.Times, w)
+		}
+
+		rules = append(rules, r)
+	}
+
+	p, err := berghain.NewPolicy(rules, loc)
+	if err != nil {
+		Fatal("invalid policy", "error", err)
+	}
+
+	return p
+}
+
+type CookieConfig struct {
+	Name string `yaml:"name"`
+	// Prefix is empty, __Host- or __Secure-.
+	Prefix string `yaml:"prefix"`
+	// Secure is auto, always or never. auto sets the attribute for
+	// requests HAProxy reports as TLS via the ssl argument.
+	Secure string `yaml:"secure"`
+	// SameSite is lax, strict, none or default to omit the attribute.
+	SameSite string `yaml:"same_site"`
+	// HTTPOnly defaults to true.
+	HTTPOnly    *bool `yaml:"http_only"`
+	Partitioned bool  `yaml:"partitioned"`
+	// Session omits Max-Age instead of deriving it from the level duration.
+	Session bool `yaml:"session"`
+}
+
+func (c CookieConfig) AsCookieConfig() berghain.CookieConfig {
+	cc := berghain.CookieConfig{
+		Name:        c.Name,
+		Prefix:      c.Prefix,
+		Partitioned: c.Partitioned,
+		Session:     c.Session,
+	}
+
+	switch c.Secure {
+	case "", "auto":
+		cc.Secure = berghain.CookieSecureAuto
+	case "always":
+		cc.Secure = berghain.CookieSecureAlways
+	case "never":
+		cc.Secure = berghain.CookieSecureNever
+	default:
+		Fatal("unknown cookie secure mode", "secure", c.Secure)
+	}
+
+	switch c.SameSite {
+	case "", "lax":
+		cc.SameSite = http.SameSiteLaxMode
+	case "strict":
+		cc.SameSite = http.SameSiteStrictMode
+	case "none":
+		cc.SameSite = http.SameSiteNoneMode
+	case "default":
+		cc.SameSite = http.SameSiteDefaultMode
+	default:
+		Fatal("unknown cookie same_site mode", "same_site", c.SameSite)
+	}
+
+	if c.HTTPOnly != nil {
+		cc.ScriptAccess = !*c.HTTPOnly
+	}
+
+	if err := cc.Validate(); err != nil {
+		Fatal("invalid cookie config", "error", err)
+	}
+
+	return cc
+}
+
 type LevelConfig struct {
 	Countdown *int          `yaml:"countdown"`
 	Duration  time.Duration `yaml:"duration"`
@@ -66,20 +896,49 @@ type LevelConfig struct {
 	// to the request identity. Provider test keys report a fixed
 	// hostname, so tests need this; production setups do not.
 	SkipHostnameCheck bool `yaml:"skip_hostname_check"`
+
+	RateLimits RateLimitsConfig `yaml:"rate_limits"`
+}
+
+// RateLimitsConfig holds rates like 10/1m, empty rates are not limited.
+type RateLimitsConfig struct {
+	GetPerIP        string `yaml:"get_per_ip"`
+	PostPerIP       string `yaml:"post_per_ip"`
+	GetPerFrontend  string `yaml:"get_per_frontend"`
+	PostPerFrontend string `yaml:"post_per_frontend"`
+}
+
+func (c RateLimitsConfig) AsChallengeRateLimits() berghain.ChallengeRateLimits {
+	parse := func(name, s string) berghain.Rate {
+		if s == "" {
+			return berghain.Rate{}
+		}
+		r, err := berghain.ParseRate(s)
+		if err != nil {
+			Fatal("invalid rate limit", "limit", name, "error", err)
+		}
+		return r
+	}
+
+	return berghain.ChallengeRateLimits{
+		GetPerIP:        parse("get_per_ip", c.GetPerIP),
+		PostPerIP:       parse("post_per_ip", c.PostPerIP),
+		GetPerFrontend:  parse("get_per_frontend", c.GetPerFrontend),
+		PostPerFrontend: parse("post_per_frontend", c.PostPerFrontend),
+	}
 }
 
 func (c LevelConfig) AsLevelConfig() *berghain.LevelConfig {
 	var lc berghain.LevelConfig
 
 	lc.Duration = c.Duration
+	lc.RateLimits = c.RateLimits.AsChallengeRateLimits()
 
 	if c.Countdown == nil {
 		// no level specific countdown was provided
 		lc.Countdown = 3
-	} else if *c.Countdown > 9 {
-		// template string currently only allows one digit
-		//   and JavaScript does not allow zero padding of integers in JSON
-		Fatal("countdown too high, cannot proceed", "countdown_have", *c.Countdown, "countdown_max", 9)
+	} else if *c.Countdown < 0 {
+		Fatal("countdown cannot be negative", "countdown_have", *c.Countdown)
 	} else {
 		lc.Countdown = *c.Countdown
 	}
@@ -122,15 +981,16 @@ func loadConfig() Config {
 		Fatal("missing config path", "path", configPath)
 	}
 
-	f, err := os.Open(configPath)
+	b, err := os.ReadFile(configPath)
 	if err != nil {
 		Fatal("failed opening config", "path", configPath, "error", err)
 	}
 
 	var c Config
-	if err := yaml.NewDecoder(f).Decode(&c); err != nil {
+	if err := yaml.NewDecoder(bytes.NewReader(b)).Decode(&c); err != nil {
 		Fatal("failed reading config", "path", configPath, "error", err)
 	}
+	c.hash = sha256.Sum256(b)
 
 	return c
 }
@@ -9,6 +9,7 @@ import (
 	"net/netip"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/dropmorepackets/haproxy-go/pkg/buffer"
 	"github.com/dropmorepackets/haproxy-go/pkg/encoding"
@@ -17,48 +18,40 @@ import (
 )
 
 type frontend struct {
-	bh *berghain.Berghain
-}
-
-func readExpectedKVEntry(ctx context.Context, m *encoding.Message, k *encoding.KVEntry, name string) error {
-	// read frontend
-	if !m.KV.Next(k) {
-		if err := m.KV.Error(); err != nil {
-			slog.ErrorContext(ctx, "error while reading KV", "error", err)
-			return errors.New("generic error while reading KV")
-		}
+	name string
+	bh   *berghain.Berghain
 
-		slog.ErrorContext(ctx, "missing SPOP argument", "want", name, "have", "nil")
-		return errors.New("missing SPOP argument while reading KV")
-	}
+	// metrics is nil if metrics are disabled.
+	metrics *frontendMetrics
+	// audit is nil if auditing is disabled.
+	audit *auditLog
+	// support is nil if support lookups are disabled.
+	support *supportLog
 
-	if !k.NameEquals(name) {
-		slog.ErrorContext(ctx, "invalid SPOP argument order", "want", name, "have", k.NameBytes())
-		return errors.New("invalid SPOP argument order while reading KV")
-	}
+	// messages are the logged values of the known SPOE messages.
+	messages [len(spoeMessages)]logMessage
 
-	return nil
+	// withoutPolicy reports policy messages once if the frontend has no policy.
+	withoutPolicy sync.Once
 }
 
-func addOptionalSessionToContext(ctx context.Context, m *encoding.Message, k *encoding.KVEntry) (context.Context, []byte) {
-	if !m.KV.Next(k) {
-		if err := m.KV.Error(); err != nil {
-			slog.ErrorContext(ctx, "error while reading optional session argument", "error", err)
-		}
-		return ctx, nil
-	}
-
-	if !k.NameEquals("session") {
-		slog.WarnContext(ctx, "ignoring unexpected optional SPOP argument", "have", k.NameBytes())
-		return ctx, nil
+func newFrontend(name string, bh *berghain.Berghain) *frontend {
+	f := &frontend{name: name, bh: bh}
+	for i, m := range spoeMessages {
+		f.messages[i] = logMessage{frontend: name, handler: m}
 	}
+	return f
+}
 
-	if id := k.ValueBytes(); berghain.ValidSupportID(id) {
-		return context.WithValue(ctx, "session", string(id)), id
+// logMessage returns the logged values of the message name. Only unknown
+// messages are allocated.
+func (f *frontend) logMessage(name []byte) *logMessage {
+	for i := range f.messages {
+		if f.messages[i].handler == string(name) {
+			return &f.messages[i]
+		}
 	}
-
-	slog.DebugContext(ctx, "ignoring invalid session id")
-	return ctx, nil
+	return &logMessage{frontend: f.name, handler: string(name)}
 }
 
 const hostBufferLength = 256
@@ -168,48 +161,151 @@ func getDomainAttr(host []byte) string {
 	}
 }
 
-func (f *frontend) HandleSPOEValidate(ctx context.Context, w *encoding.ActionWriter, m *encoding.Message) {
-	k := encoding.AcquireKVEntry()
-	defer encoding.ReleaseKVEntry(k)
+// headerBufPool holds buffers for the Set-Cookie and WWW-Authenticate values.
+var headerBufPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, 512)
+		return &b
+	},
+}
+
+var errHostTooLong = errors.New("host length too big")
+
+// readHost reads the host argument and maps it to its trusted domain, if any.
+func (f *frontend) readHost(ctx context.Context, args *spoeArgs) ([]byte, error) {
+	host, err := f.identityHost(args.host)
+	if err != nil {
+		slog.ErrorContext(ctx, "host length too big")
+		return nil, err
+	}
+
+	return host, nil
+}
+
+// identityHost returns the host cookies for a Host header value are bound to.
+func (f *frontend) identityHost(host []byte) ([]byte, error) {
+	host = normalizeHost(host)
+	if len(host) > hostBufferLength {
+		return nil, errHostTooLong
+	}
+
+	if td := getTrustedDomain(host, f.bh.TrustedDomains); td != nil {
+		host = td
+	}
+
+	return host, nil
+}
 
+func (f *frontend) HandleSPOEValidate(ctx context.Context, w *encoding.ActionWriter, args *spoeArgs) {
 	var ri berghain.RequestIdentifier
 
-	if err := readExpectedKVEntry(ctx, m, k, "level"); err != nil {
+	if err := args.require(argLevel); err != nil {
+		slog.ErrorContext(ctx, "invalid validate message", "error", err)
 		return
 	}
-	ri.Level = uint8(k.ValueInt())
-	ctx = context.WithValue(ctx, "level", int(ri.Level))
+	ri.Level = uint8(args.level)
+	ctx = context.WithValue(ctx, logKeyLevel, int(ri.Level))
 	if ri.Level == 0 {
 		// berghain is disabled, just exit early and ignore everything...
 		return
 	}
 
-	if err := readExpectedKVEntry(ctx, m, k, "src"); err != nil {
+	// the result is counted at the level the cookie is checked against
+	result := validateResultError
+	defer func() { f.metrics.validated(ri.Level, result) }()
+
+	if err := args.require(argSrc | argHost); err != nil {
+		slog.ErrorContext(ctx, "invalid validate message", "error", err)
+		return
+	}
+	if !args.has(argCookie | argCookies) {
+		slog.ErrorContext(ctx, "invalid validate message", "error", errMissingArgument, "want", argCookie|argCookies)
 		return
 	}
+
 	// AddrFromSlice copies the underlying data
-	addr, ok := netip.AddrFromSlice(k.ValueBytes())
+	addr, ok := netip.AddrFromSlice(args.src)
 	if !ok {
 		slog.ErrorContext(ctx, "cant read netip.Address from message")
 		return
 	}
-	ctx = context.WithValue(ctx, "src", addr.String())
+	ctx = context.WithValue(ctx, logKeySrc, addr.String())
 	ri.SrcAddr = addr
+	f.lookupGeoIP(ctx, w, addr)
 
-	if err := readExpectedKVEntry(ctx, m, k, "host"); err != nil {
-		return
+	if list := f.bh.ApplyIPLists(&ri); list != nil {
+		ctx = context.WithValue(ctx, logKeyList, list.Name)
+		if err := setListResult(w, list); err != nil {
+			slog.ErrorContext(ctx, "failed setting ip list actions", "error", err)
+			return
+		}
+
+		// the list decides, the cookie is not looked at
+		switch list.Action {
+		case berghain.ListActionAllow:
+			result = grantedByList
+			setGranted(ctx, w, result)
+			return
+		case berghain.ListActionDeny:
+			result = validateResultDenied
+			if err := w.SetBool(encoding.VarScopeTransaction, "valid", false); err != nil {
+				slog.ErrorContext(ctx, "failed setting action 'valid'", "error", err)
+			}
+			return
+		}
 	}
-	host := normalizeHost(k.ValueBytes())
-	ctx = context.WithValue(ctx, "host", string(host))
-	if len(host) > hostBufferLength {
-		slog.ErrorContext(ctx, "host length too big")
+
+	if f.bh.BypassTokens != nil && args.has(argAuthorization) {
+		token, err := f.bh.BypassTokens.Match(args.authorization, normalizeHost(args.host), addr, time.Now())
+		if err == nil {
+			slog.InfoContext(ctx, "request passed with bypass token", "token", token.Label)
+			if err := w.SetString(encoding.VarScopeTransaction, "bypass_token", token.Label); err != nil {
+				slog.ErrorContext(ctx, "failed setting action 'bypass_token'", "error", err)
+				return
+			}
+			result = grantedByBypassToken
+			setGranted(ctx, w, result)
+			return
+		}
+		slog.DebugContext(ctx, "bypass token not valid", "error", err)
+	}
+
+	if agent := f.verifySignature(ctx, w, args); agent != nil && agent.Allow {
+		result = grantedBySignature
+		setGranted(ctx, w, result)
 		return
 	}
 
-	td := getTrustedDomain(host, f.bh.TrustedDomains)
-	if td != nil {
-		host = td
+	if f.bh.Bots != nil && args.has(argUserAgent) {
+		if bot := f.bh.Bots.Verify(ctx, args.ua, addr); bot != nil {
+			// verified crawlers are not challenged
+			if err := w.SetString(encoding.VarScopeTransaction, "verified_bot", bot.Name); err != nil {
+				slog.ErrorContext(ctx, "failed setting action 'verified_bot'", "error", err)
+				return
+			}
+			result = grantedByVerifiedBot
+			setGranted(ctx, w, result)
+			return
+		}
+	}
+
+	f.bh.ApplyReputation(&ri)
+	f.bh.ApplyRevocations(&ri)
+	raised := ri.Level != uint8(args.level)
+	if raised {
+		// report the level the cookie is checked against, raised by a
+		// level list, the reputation or a revocation cool-down of the address
+		if err := w.SetInt64(encoding.VarScopeTransaction, "level", int64(ri.Level)); err != nil {
+			slog.ErrorContext(ctx, "failed setting action 'level'", "error", err)
+			return
+		}
+	}
+
+	host, err := f.readHost(ctx, args)
+	if err != nil {
+		return
 	}
+	ctx = context.WithValue(ctx, logKeyHost, string(host))
 
 	hostBuf := acquireHostBuf()
 	defer releaseHostBuf(hostBuf)
@@ -217,61 +313,343 @@ func (f *frontend) HandleSPOEValidate(ctx context.Context, w *encoding.ActionWri
 	copy(hostBuf.WriteNBytes(len(host)), host)
 	ri.Host = hostBuf.ReadBytes()
 
-	if err := readExpectedKVEntry(ctx, m, k, "cookie"); err != nil {
-		return
+	// the whole Cookie header lets the agent pick the configured cookie name
+	cookie := args.cookie
+	if args.has(argCookies) {
+		cookie = f.bh.Cookie.Find(args.cookies)
 	}
-	err := f.bh.IsValidCookie(ri, k.ValueBytes())
+	claims, err := f.bh.ValidateCookie(ri, cookie)
 	if err != nil {
 		slog.DebugContext(ctx, "cookie not valid", "error", err)
 	}
-	isValidCookie := err == nil
 
-	if err := w.SetBool(encoding.VarScopeTransaction, "valid", isValidCookie); err != nil {
+	var grantedBy string
+	switch {
+	case err == nil:
+		grantedBy = grantedByCookie
+	// trusted tokens carry no level, so they do not pass addresses whose
+	// level was raised, e.g. by failing challenges
+	case !raised && f.verifyTrustedToken(ctx, w, args):
+		grantedBy = grantedByTrustedToken
+	case f.bh.PrivacyPass != nil && f.redeemPrivateToken(ctx, w, &ri, args):
+		grantedBy = grantedByPrivateToken
+	}
+
+	if grantedBy != "" {
+		result = grantedBy
+		setGranted(ctx, w, grantedBy)
+		// the reason explains rejected requests only
+		err = nil
+	} else {
+		result = berghain.CookieErrorReason(err)
+		if err := w.SetBool(encoding.VarScopeTransaction, "valid", false); err != nil {
+			slog.ErrorContext(ctx, "failed setting action 'valid'", "error", err)
+			return
+		}
+	}
+
+	if err := setValidationResult(w, claims, err); err != nil {
+		slog.ErrorContext(ctx, "failed setting validation result actions", "error", err)
+	}
+}
+
+// Mechanisms granting access in validate messages, reported in
+// txn.berghain.granted_by.
+const (
+	grantedByCookie       = "cookie"
+	grantedByList         = "list"
+	grantedByBypassToken  = "bypass_token"
+	grantedBySignature    = "signature_agent"
+	grantedByVerifiedBot  = "verified_bot"
+	grantedByTrustedToken = "trusted_token"
+	grantedByPrivateToken = "private_token"
+)
+
+// setGranted marks the request valid and reports the mechanism that granted
+// access.
+func setGranted(ctx context.Context, w *encoding.ActionWriter, mechanism string) {
+	if err := w.SetBool(encoding.VarScopeTransaction, "valid", true); err != nil {
 		slog.ErrorContext(ctx, "failed setting action 'valid'", "error", err)
 		return
 	}
+	if err := w.SetString(encoding.VarScopeTransaction, "granted_by", mechanism); err != nil {
+		slog.ErrorContext(ctx, "failed setting action 'granted_by'", "error", err)
+	}
+}
+
+// verifyTrustedToken checks the application-issued tokens of the frontend
+// and exposes the first valid one as txn.berghain.trusted_token.
+func (f *frontend) verifyTrustedToken(ctx context.Context, w *encoding.ActionWriter, args *spoeArgs) bool {
+	now := time.Now()
+	for _, t := range f.bh.TrustedTokens {
+		token := t.Find(args.cookies, args.authorization)
+		if len(token) == 0 {
+			continue
+		}
+
+		if err := t.Verify(token, now); err != nil {
+			slog.DebugContext(ctx, "trusted token not valid", "token", t.Name, "error", err)
+			continue
+		}
+
+		if err := w.SetString(encoding.VarScopeTransaction, "trusted_token", t.Name); err != nil {
+			slog.ErrorContext(ctx, "failed setting action 'trusted_token'", "error", err)
+			return false
+		}
+		return true
+	}
+
+	return false
+}
+
+// issueCookie writes the cookie of redeemed tokens, tests replace it to fail.
+var issueCookie = berghain.RequestIdentifier.ToCookie
+
+// redeemPrivateToken redeems the Privacy Pass token of the request and issues
+// a cookie in its place, so the client does not spend a token per request.
+// Clients without a valid token are challenged for one with the
+// WWW-Authenticate value in txn.berghain.private_token.
+func (f *frontend) redeemPrivateToken(ctx context.Context, w *encoding.ActionWriter, ri *berghain.RequestIdentifier, args *spoeArgs) bool {
+	// tokens are bound to the origin the client sees, not the trusted domain
+	origin := normalizeHost(args.host)
+	now := time.Now()
+
+	if args.has(argAuthorization) {
+		issuer, err := f.bh.PrivacyPass.Redeem(args.authorization, origin, now)
+		if err == nil {
+			// the token is spent already, but without a cookie the client
+			// has to pass a regular challenge
+			token := berghain.AcquireCookieBuffer()
+			defer berghain.ReleaseCookieBuffer(token)
+			if err := issueCookie(*ri, f.bh, token); err != nil {
+				slog.ErrorContext(ctx, "failed issuing cookie for private token", "error", err)
+				return false
+			}
+
+			if err := w.SetString(encoding.VarScopeTransaction, "private_token_issuer", issuer.Name); err != nil {
+				slog.ErrorContext(ctx, "failed setting action 'private_token_issuer'", "error", err)
+				return false
+			}
+			f.setToken(w, ri, token.ReadBytes(), args.ssl)
+			f.audit.cleared(f, ri, ri.Level, auditValidatorPrivacyPass)
+			return true
+		}
+		slog.DebugContext(ctx, "private token not valid", "error", err)
+	}
+
+	b := headerBufPool.Get().(*[]byte)
+	*b = f.bh.PrivacyPass.AppendChallenge((*b)[:0], origin, now)
+	if err := w.SetStringBytes(encoding.VarScopeTransaction, "private_token", *b); err != nil {
+		slog.ErrorContext(ctx, "failed setting action 'private_token'", "error", err)
+	}
+	headerBufPool.Put(b)
+
+	return false
+}
+
+// setToken exposes an issued cookie value as txn.berghain.token and the
+// Set-Cookie value as txn.berghain.set_cookie.
+func (f *frontend) setToken(w *encoding.ActionWriter, ri *berghain.RequestIdentifier, token []byte, tls bool) {
+	_ = w.SetStringBytes(encoding.VarScopeTransaction, "token", token)
+
+	var domain []byte
+	if bytes.Contains(ri.Host, []byte(".")) {
+		domain = ri.Host
+	}
+
+	b := headerBufPool.Get().(*[]byte)
+	*b = f.bh.Cookie.AppendSetCookie((*b)[:0], token, domain, f.bh.LevelConfig(ri.Level).Duration, tls)
+	_ = w.SetStringBytes(encoding.VarScopeTransaction, "set_cookie", *b)
+	headerBufPool.Put(b)
+}
+
+// setListResult reports the ip list containing the source address.
+func setListResult(w *encoding.ActionWriter, list *berghain.IPList) error {
+	if err := w.SetString(encoding.VarScopeTransaction, "list", list.Name); err != nil {
+		return err
+	}
+	return w.SetString(encoding.VarScopeTransaction, "list_action", list.Action.String())
+}
+
+// setValidationResult exposes why a cookie was rejected and, for authentic
+// cookies, its level and remaining lifetime. The cookie does not carry a
+// support ID, so none can be reported here.
+func setValidationResult(w *encoding.ActionWriter, claims berghain.CookieClaims, validationErr error) error {
+	if validationErr != nil {
+		if err := w.SetString(encoding.VarScopeTransaction, "reason", berghain.CookieErrorReason(validationErr)); err != nil {
+			return err
+		}
+	}
+
+	if claims.Level == 0 {
+		// the cookie is not authentic, its claims cannot be trusted
+		return nil
+	}
+
+	if err := w.SetInt64(encoding.VarScopeTransaction, "cookie_level", int64(claims.Level)); err != nil {
+		return err
+	}
+
+	return w.SetInt64(encoding.VarScopeTransaction, "expires_in", int64(claims.ExpiresIn()/time.Second))
+}
+
+// lookupGeoIP exposes the country and ASN of the address, if known, as
+// txn.berghain.country and txn.berghain.asn.
+func (f *frontend) lookupGeoIP(ctx context.Context, w *encoding.ActionWriter, addr netip.Addr) berghain.GeoIPResult {
+	if f.bh.GeoIP == nil {
+		return berghain.GeoIPResult{}
+	}
+
+	geo := f.bh.GeoIP.Lookup(addr)
+	if geo.Country != "" {
+		if err := w.SetString(encoding.VarScopeTransaction, "country", geo.Country); err != nil {
+			slog.ErrorContext(ctx, "failed setting action 'country'", "error", err)
+		}
+	}
+	if geo.ASN != 0 {
+		if err := w.SetInt64(encoding.VarScopeTransaction, "asn", int64(geo.ASN)); err != nil {
+			slog.ErrorContext(ctx, "failed setting action 'asn'", "error", err)
+		}
+	}
+
+	return geo
+}
+
+// verifySignature verifies the Web Bot Auth signature of the request, if any,
+// and exposes the agent that signed it as txn.berghain.signature_agent.
+func (f *frontend) verifySignature(ctx context.Context, w *encoding.ActionWriter, args *spoeArgs) *berghain.SignatureAgent {
+	if f.bh.Signatures == nil || !args.has(argSignatureInput) {
+		return nil
+	}
+
+	agent, err := f.bh.Signatures.Verify(&berghain.SignedRequest{
+		Method:         args.method,
+		Authority:      args.host,
+		Path:           args.path,
+		TLS:            args.ssl,
+		Signature:      args.signature,
+		SignatureInput: args.signatureInput,
+		SignatureAgent: args.signatureAgent,
+		Time:           time.Now(),
+	})
+	if err != nil {
+		slog.DebugContext(ctx, "signature not valid", "error", err)
+		return nil
+	}
+
+	if err := w.SetString(encoding.VarScopeTransaction, "signature_agent", agent.Name); err != nil {
+		slog.ErrorContext(ctx, "failed setting action 'signature_agent'", "error", err)
+	}
+
+	return agent
 }
 
-func (f *frontend) HandleSPOEChallenge(ctx context.Context, w *encoding.ActionWriter, m *encoding.Message) {
-	k := encoding.AcquireKVEntry()
-	defer encoding.ReleaseKVEntry(k)
+// HandleSPOEPolicy decides the level of a request with the policy of the
+// frontend. A level rule sets req.berghain.level, an allow rule unsets it so
+// the request is not challenged. A deny rule sets the highest level, so the
+// request is at least challenged if HAProxy does not deny it. The action and
+// rule are reported, so HAProxy can deny requests and log the decision.
+func (f *frontend) HandleSPOEPolicy(ctx context.Context, w *encoding.ActionWriter, args *spoeArgs) {
+	if f.bh.Policy == nil {
+		f.withoutPolicy.Do(func() {
+			slog.WarnContext(ctx, "policy message for frontend without policy, ignoring further ones")
+		})
+		return
+	}
+
+	if err := args.require(argSrc); err != nil {
+		slog.ErrorContext(ctx, "invalid policy message", "error", err)
+		return
+	}
+
+	// AddrFromSlice copies the underlying data
+	addr, ok := netip.AddrFromSlice(args.src)
+	if !ok {
+		slog.ErrorContext(ctx, "cant read netip.Address from message")
+		return
+	}
+
+	geo := f.lookupGeoIP(ctx, w, addr)
+
+	var signatureAgent string
+	if agent := f.verifySignature(ctx, w, args); agent != nil {
+		signatureAgent = agent.Name
+	}
+
+	d := f.bh.Policy.Decide(&berghain.PolicyRequest{
+		Method:    args.method,
+		Path:      args.path,
+		Host:      normalizeHost(args.host),
+		UserAgent: args.ua,
+		SrcAddr:   addr,
+		Time:      time.Now(),
+		Country:   geo.Country,
+		ASN:       geo.ASN,
+
+		SignatureAgent: signatureAgent,
+	})
 
+	var err error
+	switch d.Action {
+	case berghain.PolicyActionNone:
+		return
+	case berghain.PolicyActionLevel:
+		err = w.SetInt64(encoding.VarScopeRequest, "level", int64(d.Level))
+	case berghain.PolicyActionAllow:
+		err = w.Unset(encoding.VarScopeRequest, "level")
+	case berghain.PolicyActionDeny:
+		err = w.SetInt64(encoding.VarScopeRequest, "level", int64(len(f.bh.Levels)))
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "failed setting policy level", "error", err)
+		return
+	}
+
+	if err := w.SetString(encoding.VarScopeTransaction, "policy", d.Action.String()); err != nil {
+		slog.ErrorContext(ctx, "failed setting action 'policy'", "error", err)
+		return
+	}
+	if err := w.SetString(encoding.VarScopeTransaction, "policy_rule", d.Rule); err != nil {
+		slog.ErrorContext(ctx, "failed setting action 'policy_rule'", "error", err)
+	}
+}
+
+func (f *frontend) HandleSPOEChallenge(ctx context.Context, w *encoding.ActionWriter, args *spoeArgs) {
 	var ri berghain.RequestIdentifier
 
-	if err := readExpectedKVEntry(ctx, m, k, "level"); err != nil {
+	if err := args.require(argLevel); err != nil {
+		slog.ErrorContext(ctx, "invalid challenge message", "error", err)
 		return
 	}
-	ri.Level = uint8(k.ValueInt())
+	ri.Level = uint8(args.level)
 	if ri.Level == 0 {
 		// berghain is disabled, just exit early and ignore everything...
 		return
 	}
 
-	if err := readExpectedKVEntry(ctx, m, k, "src"); err != nil {
+	if err := args.require(argSrc | argHost | argMethod | argBody); err != nil {
+		slog.ErrorContext(ctx, "invalid challenge message", "error", err)
 		return
 	}
+
 	// AddrFromSlice copies the underlying data
-	addr, ok := netip.AddrFromSlice(k.ValueBytes())
+	addr, ok := netip.AddrFromSlice(args.src)
 	if !ok {
 		slog.ErrorContext(ctx, "cant read netip.Address from message")
 		return
 	}
 	ri.SrcAddr = addr
+	// level lists, the reputation and revocation cool-downs must raise the
+	// level of the issued token as well
+	f.bh.ApplyIPLists(&ri)
+	f.bh.ApplyReputation(&ri)
+	f.bh.ApplyRevocations(&ri)
 
-	if err := readExpectedKVEntry(ctx, m, k, "host"); err != nil {
-		return
-	}
-	host := normalizeHost(k.ValueBytes())
-	if len(host) > hostBufferLength {
-		slog.ErrorContext(ctx, "host length too big")
+	host, err := f.readHost(ctx, args)
+	if err != nil {
 		return
 	}
 
-	td := getTrustedDomain(host, f.bh.TrustedDomains)
-	if td != nil {
-		host = td
-	}
-
 	_ = w.SetString(encoding.VarScopeTransaction, "domain", getDomainAttr(host))
 
 	hostBuf := acquireHostBuf()
@@ -285,38 +663,121 @@ func (f *frontend) HandleSPOEChallenge(ctx context.Context, w *encoding.ActionWr
 
 	req.Identifier = &ri
 
-	if err := readExpectedKVEntry(ctx, m, k, "method"); err != nil {
-		return
-	}
+	unsupportedMethod := false
 	switch {
-	case string(k.ValueBytes()) == http.MethodGet:
+	case string(args.method) == http.MethodGet:
 		req.Method = http.MethodGet
-	case string(k.ValueBytes()) == http.MethodPost:
+	case string(args.method) == http.MethodPost:
 		req.Method = http.MethodPost
 	default:
-		_ = w.SetString(encoding.VarScopeTransaction, "response", "unsupported request method")
-		return
+		unsupportedMethod = true
 	}
 
-	if err := readExpectedKVEntry(ctx, m, k, "body"); err != nil {
-		return
+	req.Body = args.body
+	// the version stated by the page, missing for pages cached before versioning
+	req.Protocol = berghain.NegotiateProtocol(args.version)
+	if args.has(argSession) {
+		if berghain.ValidSupportID(args.session) {
+			req.SupportID = args.session
+		} else {
+			slog.DebugContext(ctx, "ignoring invalid session id")
+		}
 	}
-	req.Body = k.ValueBytes()
-	ctx, req.SupportID = addOptionalSessionToContext(ctx, m, k)
 
 	resp := berghain.AcquireValidatorResponse()
 	defer berghain.ReleaseValidatorResponse(resp)
 
-	err := f.bh.LevelConfig(ri.Level).Type.RunValidator(f.bh, req, resp)
+	if unsupportedMethod {
+		err = berghain.ErrInvalidMethod
+	} else if err = f.bh.AllowChallenge(&ri, req.Method); err == nil {
+		typ := f.bh.LevelConfig(ri.Level).Type
+		ctx = context.WithValue(ctx, logKeyValidator, typ.String())
+		vctx, span := startSpan(ctx, "RunValidator", spanKindInternal)
+		span.setString("berghain.validator.type", typ.String())
+		span.setInt("berghain.level", int64(ri.Level))
+		if span != nil && berghain.ValidSupportID(req.SupportID) {
+			span.setString("berghain.support_id", string(req.SupportID))
+		}
+		req.Context = vctx
+
+		err = typ.RunValidator(f.bh, req, resp)
+		span.setError(err)
+		span.finish()
+		if resp.ProviderLatency > 0 {
+			// tokens rejected before the provider was asked are not counted
+			unavailable := err != nil && berghain.ChallengeErrorCode(req.Method, err) == berghain.ErrorCodeCaptchaUnavailable
+			f.metrics.captchaVerified(ri.Level, resp.ProviderLatency, unavailable)
+		}
+	}
 	if berghain.ValidSupportID(req.SupportID) {
-		ctx = context.WithValue(ctx, "session", string(req.SupportID))
+		ctx = context.WithValue(ctx, logKeySession, string(req.SupportID))
 	}
+	var code berghain.ErrorCode
 	if err != nil {
-		slog.ErrorContext(ctx, "validator failed", "error", err)
+		code = berghain.WriteFailure(req, resp, err)
+		slog.ErrorContext(ctx, "validator failed", "error", err, "code", code)
+		f.bh.RecordFailure(ri.SrcAddr, code)
+		f.metrics.challenged(ri.Level, string(code))
+		_ = w.SetString(encoding.VarScopeTransaction, "failure", string(code))
+		if retryAfter := berghain.FailureRetryAfter(code, err); retryAfter > 0 {
+			_ = w.SetInt64(encoding.VarScopeTransaction, "retry_after", int64(retryAfter))
+		}
 	}
 
 	_ = w.SetStringBytes(encoding.VarScopeTransaction, "response", resp.Body.ReadBytes())
-	if resp.Token.Len() > 0 {
-		_ = w.SetStringBytes(encoding.VarScopeTransaction, "token", resp.Token.ReadBytes())
+	cleared := resp.Token.Len() > 0
+	if cleared {
+		f.metrics.challenged(ri.Level, challengeResultSolved)
+		f.setToken(w, &ri, resp.Token.ReadBytes(), args.ssl)
+	} else if err == nil {
+		f.metrics.challenged(ri.Level, challengeResultIssued)
+	}
+	if f.audit != nil || f.support != nil {
+		e := f.challengeEvent(&ri, req.SupportID, cleared, code)
+		f.audit.challenged(e)
+		f.support.record(e)
+	}
+}
+
+// HandleSPOERevoke revokes the cookie of a request, sent when the backend
+// signals abuse from the session.
+func (f *frontend) HandleSPOERevoke(ctx context.Context, w *encoding.ActionWriter, args *spoeArgs) {
+	if err := args.require(argSrc | argHost); err != nil {
+		slog.ErrorContext(ctx, "invalid revoke message", "error", err)
+		return
+	}
+	if !args.has(argCookie | argCookies) {
+		slog.ErrorContext(ctx, "invalid revoke message", "error", errMissingArgument, "want", argCookie|argCookies)
+		return
+	}
+
+	addr, ok := netip.AddrFromSlice(args.src)
+	if !ok {
+		slog.ErrorContext(ctx, "cant read netip.Address from message")
+		return
+	}
+	ctx = context.WithValue(ctx, logKeySrc, addr.String())
+
+	host, err := f.readHost(ctx, args)
+	if err != nil {
+		return
+	}
+	ctx = context.WithValue(ctx, logKeyHost, string(host))
+
+	cookie := args.cookie
+	if args.has(argCookies) {
+		cookie = f.bh.Cookie.Find(args.cookies)
+	}
+
+	ri := berghain.RequestIdentifier{SrcAddr: addr, Host: host}
+	if err := f.bh.RevokeCookie(ri, cookie); err != nil {
+		slog.WarnContext(ctx, "failed revoking cookie", "error", err)
+		_ = w.SetBool(encoding.VarScopeTransaction, "revoked", false)
+		return
+	}
+
+	slog.InfoContext(ctx, "revoked cookie")
+	if err := w.SetBool(encoding.VarScopeTransaction, "revoked", true); err != nil {
+		slog.ErrorContext(ctx, "failed setting action 'revoked'", "error", err)
 	}
 }
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// health reports the state of the agent to orchestrators. The config is
+// loaded once it exists, the agent is ready once the SPOP listener is bound
+// and, if enabled, all captcha providers are reachable.
+type health struct {
+	started    time.Time
+	configHash string
+	i          *instance
+
+	listening atomic.Bool
+
+	// captcha maps the siteverify endpoints to their last check, nil if
+	// they are not checked.
+	captcha map[string]*captchaCheck
+	mu      sync.RWMutex
+	client  *http.Client
+}
+
+type captchaCheck struct {
+	Reachable bool      `json:"reachable"`
+	Checked   time.Time `json:"checked"`
+	Error     string    `json:"error,omitempty"`
+}
+
+func newHealth(cfg Config, i *instance) *health {
+	h := &health{
+		started:    time.Now(),
+		configHash: hex.EncodeToString(cfg.hash[:]),
+		i:          i,
+		client:     &http.Client{Timeout: 5 * time.Second},
+	}
+
+	if cfg.Health.CheckCaptcha {
+		h.captcha = make(map[string]*captchaCheck)
+		for _, f := range i.c {
+			for _, lc := range f.bh.Levels {
+				if u := lc.CaptchaURL(); u != "" {
+					h.captcha[u] = &captchaCheck{}
+				}
+			}
+		}
+	}
+
+	return h
+}
+
+// runCaptchaChecks checks the captcha providers every interval until the
+// context is done.
+func (h *health) runCaptchaChecks(ctx context.Context, wg *sync.WaitGroup, interval time.Duration) {
+	defer wg.Done()
+
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		h.checkCaptcha(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// checkCaptcha posts an empty verification to every siteverify endpoint.
+// Providers reject it, but any answer below 500 shows they are reachable.
+func (h *health) checkCaptcha(ctx context.Context) {
+	h.mu.RLock()
+	urls := make([]string, 0, len(h.captcha))
+	for u := range h.captcha {
+		urls = append(urls, u)
+	}
+	h.mu.RUnlock()
+
+	for _, u := range urls {
+		c := captchaCheck{Checked: time.Now()}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(""))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			var resp *http.Response
+			if resp, err = h.client.Do(req); err == nil {
+				_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+				resp.Body.Close()
+				if resp.StatusCode >= http.StatusInternalServerError {
+					err = fmt.Errorf("status %d", resp.StatusCode)
+				}
+			}
+		}
+
+		if err != nil {
+			c.Error = err.Error()
+			slog.WarnContext(ctx, "captcha provider not reachable", "url", redactURL(u), "error", err)
+		} else {
+			c.Reachable = true
+		}
+
+		h.mu.Lock()
+		h.captcha[u] = &c
+		h.mu.Unlock()
+	}
+}
+
+// redactURL drops the query of a siteverify URL, which is never needed to
+// tell providers apart.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	u.RawQuery, u.User = "", nil
+	return u.String()
+}
+
+// ready reports whether the agent can serve requests, and the reasons if not.
+func (h *health) ready() (bool, []string) {
+	var reasons []string
+	if !h.listening.Load() {
+		reasons = append(reasons, "spop listener not bound")
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for u, c := range h.captcha {
+		switch {
+		case c.Checked.IsZero():
+			reasons = append(reasons, "captcha provider not checked yet: "+redactURL(u))
+		case !c.Reachable:
+			reasons = append(reasons, "captcha provider not reachable: "+redactURL(u))
+		}
+	}
+	slices.Sort(reasons)
+
+	return len(reasons) == 0, reasons
+}
+
+type statusLevel struct {
+	Level    int    `json:"level"`
+	Type     string `json:"type"`
+	Duration string `json:"duration"`
+}
+
+type statusFrontend struct {
+	Name   string        `json:"name"`
+	Levels []statusLevel `json:"levels"`
+}
+
+type status struct {
+	ConfigHash       string                  `json:"config_hash"`
+	Started          time.Time               `json:"started"`
+	UptimeSeconds    int64                   `json:"uptime_seconds"`
+	Ready            bool                    `json:"ready"`
+	NotReady         []string                `json:"not_ready,omitempty"`
+	Frontends        []statusFrontend        `json:"frontends"`
+	CaptchaProviders map[string]captchaCheck `json:"captcha_providers,omitempty"`
+}
+
+func (h *health) status() status {
+	s := status{
+		ConfigHash:    h.configHash,
+		Started:       h.started,
+		UptimeSeconds: int64(time.Since(h.started).Seconds()),
+	}
+	s.Ready, s.NotReady = h.ready()
+
+	for name, f := range h.i.c {
+		sf := statusFrontend{Name: name, Levels: []statusLevel{}}
+		for n, lc := range f.bh.Levels {
+			sf.Levels = append(sf.Levels, statusLevel{Level: n + 1, Type: lc.Type.String(), Duration: lc.Duration.String()})
+		}
+		s.Frontends = append(s.Frontends, sf)
+	}
+	slices.SortFunc(s.Frontends, func(a, b statusFrontend) int { return strings.Compare(a.Name, b.Name) })
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if len(h.captcha) > 0 {
+		s.CaptchaProviders = make(map[string]captchaCheck, len(h.captcha))
+		for u, c := range h.captcha {
+			s.CaptchaProviders[redactURL(u)] = *c
+		}
+	}
+
+	return s
+}
+
+// handler serves /healthz for liveness, /readyz for readiness and /status.
+func (h *health) handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok\n")
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		ok, reasons := h.ready()
+		if !ok {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = io.WriteString(w, strings.Join(reasons, "\n")+"\n")
+			return
+		}
+		_, _ = io.WriteString(w, "ok\n")
+	})
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(h.status())
+	})
+
+	return mux
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DropMorePackets/berghain"
+)
+
+func TestHealth(t *testing.T) {
+	up := true
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up {
+			http.Error(w, "down", http.StatusBadGateway)
+			return
+		}
+		// providers reject verifications without a secret
+		_, _ = w.Write([]byte(`{"success": false, "error-codes": ["missing-input-secret"]}`))
+	}))
+	defer provider.Close()
+
+	captcha := challengeBerghain()
+	captcha.Levels = append(captcha.Levels, &berghain.LevelConfig{
+		Duration:         time.Hour,
+		Type:             berghain.ValidationTypeTurnstile,
+		CaptchaVerifyURL: provider.URL + "/siteverify?region=eu",
+	})
+	i := &instance{c: map[string]*frontend{
+		defaultFrontend: {name: defaultFrontend, bh: challengeBerghain()},
+		"shop":          {name: "shop", bh: captcha},
+	}}
+
+	cfg := Config{Health: &HealthConfig{CheckCaptcha: true}}
+	h := newHealth(cfg, i)
+	srv := h.handler()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	if w := get("/healthz"); w.Code != http.StatusOK {
+		t.Errorf("/healthz status = %d", w.Code)
+	}
+
+	w := get("/readyz")
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "spop listener not bound") || !strings.Contains(w.Body.String(), "not checked yet") {
+		t.Errorf("/readyz before start = %d %s", w.Code, w.Body)
+	}
+
+	h.listening.Store(true)
+	h.checkCaptcha(context.Background())
+	if w := get("/readyz"); w.Code != http.StatusOK {
+		t.Errorf("/readyz when ready = %d %s", w.Code, w.Body)
+	}
+
+	up = false
+	h.checkCaptcha(context.Background())
+	w = get("/readyz")
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "not reachable: "+provider.URL+"/siteverify\n") {
+		t.Errorf("/readyz with provider down = %d %s", w.Code, w.Body)
+	}
+
+	var s status
+	w = get("/status")
+	if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Ready || len(s.ConfigHash) != 64 || len(s.Frontends) != 2 || s.Frontends[1].Name != "shop" {
+		t.Errorf("status = %+v", s)
+	}
+	if levels := s.Frontends[1].Levels; len(levels) != 2 || levels[1] != (statusLevel{Level: 2, Type: "turnstile", Duration: "1h0m0s"}) {
+		t.Errorf("levels = %+v", levels)
+	}
+	if c := s.CaptchaProviders[provider.URL+"/siteverify"]; c.Reachable || c.Error != "status 502" {
+		t.Errorf("captcha providers = %+v", s.CaptchaProviders)
+	}
+}
@@ -1,13 +1,30 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/dropmorepackets/haproxy-go/pkg/buffer"
 	"github.com/dropmorepackets/haproxy-go/pkg/encoding"
 
 	"github.com/DropMorePackets/berghain"
@@ -131,7 +148,7 @@ func TestHandleSPOEChallengeRejectsInvalidInput(t *testing.T) {
 			actions := encoding.NewActionWriter(make([]byte, 2048), 0)
 			f := frontend{bh: challengeBerghain()}
 
-			f.HandleSPOEChallenge(context.Background(), actions, message)
+			f.HandleSPOEChallenge(context.Background(), actions, messageArgs(t, message))
 
 			if actions.Off() != 0 {
 				t.Fatalf("invalid challenge input produced %d bytes of actions", actions.Off())
@@ -140,7 +157,868 @@ func TestHandleSPOEChallengeRejectsInvalidInput(t *testing.T) {
 	}
 }
 
-func challengeMessage(t *testing.T, src []byte, host string) *encoding.Message {
+func TestHandleSPOEChallengeNegotiatesProtocol(t *testing.T) {
+	const session = "bh@123e4567-e89b-12d3-a456-426614174000"
+	src := netip.MustParseAddr("192.0.2.1").AsSlice()
+
+	tests := []struct {
+		name    string
+		version string
+		want    berghain.ProtocolVersion
+	}{
+		{name: "unversioned page", want: 0},
+		{name: "version 1", version: "1", want: 0},
+		{name: "version 2", version: "2", want: berghain.ProtocolV2},
+		{name: "future version", version: "7", want: berghain.ProtocolLatest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message := challengeMessage(t, src, "example.com",
+				func(w *encoding.KVWriter) error { return w.SetString("session", session) },
+				func(w *encoding.KVWriter) error {
+					if tt.version == "" {
+						return w.SetNull("version")
+					}
+					return w.SetString("version", tt.version)
+				},
+			)
+			actions := encoding.NewActionWriter(make([]byte, 2048), 0)
+			f := frontend{bh: challengeBerghain()}
+
+			f.HandleSPOEChallenge(context.Background(), actions, messageArgs(t, message))
+
+			response, ok := actionValues(t, actions)["response"].(string)
+			if !ok {
+				t.Fatalf("no response action set")
+			}
+			var challenge berghain.Challenge
+			if err := json.Unmarshal([]byte(response), &challenge); err != nil {
+				t.Fatalf("decode response %q: %v", response, err)
+			}
+			if challenge.Version != tt.want || challenge.SupportID != session {
+				t.Errorf("challenge = %+v, want version %d and support ID %s", challenge, tt.want, session)
+			}
+		})
+	}
+}
+
+func TestHandleSPOEChallengeReportsFailure(t *testing.T) {
+	src := netip.MustParseAddr("192.0.2.1").AsSlice()
+	// Without a session the none validator cannot issue a challenge.
+	message := challengeMessage(t, src, "example.com")
+	actions := encoding.NewActionWriter(make([]byte, 2048), 0)
+	f := frontend{bh: challengeBerghain()}
+
+	f.HandleSPOEChallenge(context.Background(), actions, messageArgs(t, message))
+
+	values := actionValues(t, actions)
+	if got := values["failure"]; got != string(berghain.ErrorCodeInternal) {
+		t.Errorf("failure = %v, want %s", got, berghain.ErrorCodeInternal)
+	}
+	if _, ok := values["token"]; ok {
+		t.Errorf("failed challenge must not set a token")
+	}
+
+	var failure berghain.Failure
+	if err := json.Unmarshal([]byte(values["response"].(string)), &failure); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if failure.Error != berghain.ErrorCodeInternal {
+		t.Errorf("failure = %+v", failure)
+	}
+}
+
+func TestHandleSPOEChallengeRateLimited(t *testing.T) {
+	const session = "bh@123e4567-e89b-12d3-a456-426614174000"
+	src := netip.MustParseAddr("192.0.2.1").AsSlice()
+	bh := challengeBerghain()
+	bh.Levels[0].RateLimits.GetPerIP = berghain.Rate{Requests: 1, Per: time.Minute}
+	f := frontend{bh: bh}
+
+	for i, wantLimited := range []bool{false, true} {
+		message := challengeMessage(t, src, "example.com",
+			func(w *encoding.KVWriter) error { return w.SetString("session", session) },
+		)
+		actions := encoding.NewActionWriter(make([]byte, 2048), 0)
+
+		f.HandleSPOEChallenge(context.Background(), actions, messageArgs(t, message))
+
+		values := actionValues(t, actions)
+		if limited := values["failure"] == string(berghain.ErrorCodeRateLimited); limited != wantLimited {
+			t.Fatalf("request %d: failure = %v, want limited %v", i, values["failure"], wantLimited)
+		}
+		if !wantLimited {
+			continue
+		}
+		if retryAfter, ok := values["retry_after"].(int64); !ok || retryAfter < 1 || retryAfter > 60 {
+			t.Errorf("retry_after = %v, want 1-60", values["retry_after"])
+		}
+		if _, ok := values["token"]; ok {
+			t.Errorf("rate limited challenge must not set a token")
+		}
+	}
+}
+
+func TestHandleSPOEValidateSetsResult(t *testing.T) {
+	src := netip.MustParseAddr("192.0.2.1")
+	bh := challengeBerghain()
+
+	cookie := berghain.AcquireCookieBuffer()
+	defer berghain.ReleaseCookieBuffer(cookie)
+	ri := berghain.RequestIdentifier{SrcAddr: src, Host: []byte("example.com"), Level: 1}
+	if err := ri.ToCookie(bh, cookie); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		host       string
+		arg        string
+		cookie     string
+		wantValid  bool
+		wantReason any
+		wantLevel  any
+	}{
+		{name: "valid", host: "example.com", arg: "cookie", cookie: string(cookie.ReadBytes()), wantValid: true, wantLevel: int64(1)},
+		{name: "missing", host: "example.com", arg: "cookie", wantReason: "empty"},
+		{name: "other host", host: "example.org", arg: "cookie", cookie: string(cookie.ReadBytes()), wantReason: "invalid_hmac"},
+		{name: "cookie header", host: "example.com", arg: "cookies", cookie: "a=b; berghain=" + string(cookie.ReadBytes()) + "; c=d", wantValid: true, wantLevel: int64(1)},
+		{name: "cookie header without cookie", host: "example.com", arg: "cookies", cookie: "a=b", wantReason: "empty"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writer := encoding.NewKVWriter(make([]byte, 2048), 0)
+			for _, write := range []func() error{
+				func() error { return writer.SetInt64("level", 1) },
+				func() error { return writer.SetBinary("src", src.AsSlice()) },
+				func() error { return writer.SetString("host", tt.host) },
+				func() error { return writer.SetString(tt.arg, tt.cookie) },
+			} {
+				if err := write(); err != nil {
+					t.Fatalf("encode validate message: %v", err)
+				}
+			}
+			message := &encoding.Message{KV: encoding.NewKVScanner(writer.Bytes(), 4)}
+			actions := encoding.NewActionWriter(make([]byte, 2048), 0)
+			f := frontend{bh: bh}
+
+			f.HandleSPOEValidate(context.Background(), actions, messageArgs(t, message))
+
+			values := actionValues(t, actions)
+			if values["valid"] != tt.wantValid {
+				t.Errorf("valid = %v, want %v", values["valid"], tt.wantValid)
+			}
+			if values["reason"] != tt.wantReason {
+				t.Errorf("reason = %v, want %v", values["reason"], tt.wantReason)
+			}
+			if values["cookie_level"] != tt.wantLevel {
+				t.Errorf("cookie_level = %v, want %v", values["cookie_level"], tt.wantLevel)
+			}
+			if expiresIn, ok := values["expires_in"].(int64); tt.wantValid && (!ok || expiresIn <= 0 || expiresIn > 60) {
+				t.Errorf("expires_in = %v, want within the level duration", values["expires_in"])
+			}
+		})
+	}
+}
+
+func TestHandleSPOEChallengeSetsCookie(t *testing.T) {
+	src := netip.MustParseAddr("192.0.2.1").AsSlice()
+	tests := []struct {
+		name   string
+		cookie berghain.CookieConfig
+		host   string
+		tls    bool
+		want   string
+	}{
+		{
+			name: "default",
+			host: "example.com",
+			want: "berghain=%s; Domain=example.com; Path=/; Max-Age=60; HttpOnly; SameSite=Lax",
+		},
+		{
+			name: "default over tls",
+			host: "example.com",
+			tls:  true,
+			want: "berghain=%s; Domain=example.com; Path=/; Max-Age=60; Secure; HttpOnly; SameSite=Lax",
+		},
+		{
+			name: "single label host",
+			host: "localhost",
+			want: "berghain=%s; Path=/; Max-Age=60; HttpOnly; SameSite=Lax",
+		},
+		{
+			name:   "host prefix",
+			cookie: berghain.CookieConfig{Prefix: berghain.CookiePrefixHost, Secure: berghain.CookieSecureAlways, SameSite: http.SameSiteStrictMode},
+			host:   "example.com",
+			want:   "__Host-berghain=%s; Path=/; Max-Age=60; Secure; HttpOnly; SameSite=Strict",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message := challengeMessage(t, src, tt.host,
+				func(w *encoding.KVWriter) error {
+					return w.SetString("session", "bh@123e4567-e89b-12d3-a456-426614174000")
+				},
+				func(w *encoding.KVWriter) error { return w.SetBool("ssl", tt.tls) },
+			)
+			actions := encoding.NewActionWriter(make([]byte, 2048), 0)
+			bh := challengeBerghain()
+			bh.Cookie = tt.cookie
+			f := frontend{bh: bh}
+
+			f.HandleSPOEChallenge(context.Background(), actions, messageArgs(t, message))
+
+			values := actionValues(t, actions)
+			token, ok := values["token"].(string)
+			if !ok {
+				t.Fatalf("no token issued: %v", values)
+			}
+			if got, want := values["set_cookie"], fmt.Sprintf(tt.want, token); got != want {
+				t.Errorf("set_cookie = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestHandleSPOEValidateSetsGeoIP(t *testing.T) {
+	geoIP, err := berghain.OpenGeoIP("../../testdata/geoip/country.mmdb", "../../testdata/geoip/asn.mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		src  string
+		want map[string]any
+	}{
+		{src: "192.0.2.1", want: map[string]any{"country": "DE", "asn": int64(64500)}},
+		{src: "198.51.100.1", want: map[string]any{"country": "US"}},
+		{src: "203.0.113.1", want: map[string]any{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			message := encodeMessage(t,
+				func(w *encoding.KVWriter) error { return w.SetInt64("level", 1) },
+				func(w *encoding.KVWriter) error { return w.SetBinary("src", netip.MustParseAddr(tt.src).AsSlice()) },
+				func(w *encoding.KVWriter) error { return w.SetString("host", "example.com") },
+				func(w *encoding.KVWriter) error { return w.SetNull("cookie") },
+			)
+			actions := encoding.NewActionWriter(make([]byte, 2048), 0)
+			bh := challengeBerghain()
+			bh.GeoIP = geoIP
+			f := frontend{bh: bh}
+
+			f.HandleSPOEValidate(context.Background(), actions, messageArgs(t, message))
+
+			values := actionValues(t, actions)
+			for _, k := range []string{"country", "asn"} {
+				if values[k] != tt.want[k] {
+					t.Errorf("%s = %v, want %v", k, values[k], tt.want[k])
+				}
+			}
+		})
+	}
+}
+
+func TestHandleSPOEValidateIPLists(t *testing.T) {
+	dir := t.TempDir()
+	open := func(name, content string, action berghain.ListAction, level uint8) *berghain.IPList {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		l, err := berghain.OpenIPList(name, path, action, level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+
+	bh := challengeBerghain()
+	bh.Levels = append(bh.Levels, &berghain.LevelConfig{Duration: time.Minute, Type: berghain.ValidationTypePOW})
+	bh.IPLists = berghain.IPLists{
+		open("drop", "192.0.2.0/24\n", berghain.ListActionDeny, 0),
+		open("office", "198.51.100.0/24\n", berghain.ListActionAllow, 0),
+		open("tor", "203.0.113.0/24\n", berghain.ListActionLevel, 2),
+	}
+
+	cookieFor := func(src string, level uint8) string {
+		cookie := berghain.AcquireCookieBuffer()
+		defer berghain.ReleaseCookieBuffer(cookie)
+		ri := berghain.RequestIdentifier{SrcAddr: netip.MustParseAddr(src), Host: []byte("example.com"), Level: level}
+		if err := ri.ToCookie(bh, cookie); err != nil {
+			t.Fatal(err)
+		}
+		return string(cookie.ReadBytes())
+	}
+
+	tests := []struct {
+		name       string
+		src        string
+		cookie     string
+		wantValid  bool
+		wantList   any
+		wantAction any
+		wantReason any
+	}{
+		{name: "denied with valid cookie", src: "192.0.2.1", cookie: cookieFor("192.0.2.1", 1), wantList: "drop", wantAction: "deny"},
+		{name: "allowed without cookie", src: "198.51.100.1", wantValid: true, wantList: "office", wantAction: "allow"},
+		{name: "raised level", src: "203.0.113.1", cookie: cookieFor("203.0.113.1", 1), wantList: "tor", wantAction: "level", wantReason: "level_too_low"},
+		{name: "raised level with cookie", src: "203.0.113.1", cookie: cookieFor("203.0.113.1", 2), wantValid: true, wantList: "tor", wantAction: "level"},
+		{name: "not listed", src: "192.0.3.1", cookie: cookieFor("192.0.3.1", 1), wantValid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message := encodeMessage(t,
+				func(w *encoding.KVWriter) error { return w.SetInt64("level", 1) },
+				func(w *encoding.KVWriter) error { return w.SetBinary("src", netip.MustParseAddr(tt.src).AsSlice()) },
+				func(w *encoding.KVWriter) error { return w.SetString("host", "example.com") },
+				func(w *encoding.KVWriter) error { return w.SetString("cookie", tt.cookie) },
+			)
+			actions := encoding.NewActionWriter(make([]byte, 2048), 0)
+			f := frontend{bh: bh}
+
+			f.HandleSPOEValidate(context.Background(), actions, messageArgs(t, message))
+
+			values := actionValues(t, actions)
+			if values["valid"] != tt.wantValid {
+				t.Errorf("valid = %v, want %v", values["valid"], tt.wantValid)
+			}
+			if values["list"] != tt.wantList || values["list_action"] != tt.wantAction {
+				t.Errorf("list = %v/%v, want %v/%v", values["list"], values["list_action"], tt.wantList, tt.wantAction)
+			}
+			if values["reason"] != tt.wantReason {
+				t.Errorf("reason = %v, want %v", values["reason"], tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestHandleSPOEValidateVerifiedBot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "googlebot.json")
+	if err := os.WriteFile(path, []byte(`{"prefixes": [{"ipv4Prefix": "192.0.2.0/24"}]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ranges, err := berghain.OpenIPList("googlebot", path, berghain.ListActionAllow, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bots, err := berghain.NewBotVerifier([]*berghain.Bot{{Name: "googlebot", UserAgents: []string{"googlebot"}, Ranges: berghain.IPLists{ranges}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bh := challengeBerghain()
+	bh.Bots = bots
+	f := frontend{bh: bh}
+
+	tests := []struct {
+		name      string
+		src       string
+		ua        string
+		wantValid bool
+		wantBot   any
+	}{
+		{name: "verified", src: "192.0.2.1", ua: "Googlebot/2.1", wantValid: true, wantBot: "googlebot"},
+		{name: "spoofed", src: "198.51.100.1", ua: "Googlebot/2.1"},
+		{name: "browser", src: "192.0.2.1", ua: "Mozilla/5.0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message := encodeMessage(t,
+				func(w *encoding.KVWriter) error { return w.SetInt64("level", 1) },
+				func(w *encoding.KVWriter) error { return w.SetBinary("src", netip.MustParseAddr(tt.src).AsSlice()) },
+				func(w *encoding.KVWriter) error { return w.SetString("host", "example.com") },
+				func(w *encoding.KVWriter) error { return w.SetNull("cookies") },
+				func(w *encoding.KVWriter) error { return w.SetString("ua", tt.ua) },
+			)
+			actions := encoding.NewActionWriter(make([]byte, 2048), 0)
+
+			f.HandleSPOEValidate(context.Background(), actions, messageArgs(t, message))
+
+			values := actionValues(t, actions)
+			if values["valid"] != tt.wantValid || values["verified_bot"] != tt.wantBot {
+				t.Errorf("valid = %v, verified_bot = %v, want %v, %v", values["valid"], values["verified_bot"], tt.wantValid, tt.wantBot)
+			}
+		})
+	}
+}
+
+func TestHandleSPOEValidateSignatureAgent(t *testing.T) {
+	const agentURL = "https://signer.example.com"
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	pub := key.Public().(ed25519.PublicKey)
+
+	path := filepath.Join(t.TempDir(), "keys.json")
+	jwks := `{"keys": [{"kty": "OKP", "crv": "Ed25519", "x": "` + base64.RawURLEncoding.EncodeToString(pub) + `"}]}`
+	if err := os.WriteFile(path, []byte(jwks), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := berghain.OpenKeyDirectory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bh := challengeBerghain()
+	bh.Signatures = &berghain.SignatureVerifier{Agents: []*berghain.SignatureAgent{
+		{Name: "signer", URL: agentURL, Keys: keys, Allow: true},
+	}}
+	f := frontend{bh: bh}
+
+	now := time.Now().Unix()
+	params := fmt.Sprintf(`("@authority" "signature-agent");created=%d;expires=%d;keyid="%s";tag="web-bot-auth"`, now, now+60, berghain.JWKThumbprint(pub))
+	base := "\"@authority\": example.com\n\"signature-agent\": \"" + agentURL + "\"\n\"@signature-params\": " + params
+	signature := "sig1=:" + base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(base))) + ":"
+
+	for _, tt := range []struct {
+		name      string
+		signature string
+		wantValid bool
+		wantAgent any
+	}{
+		{name: "signed", signature: signature, wantValid: true, wantAgent: "signer"},
+		{name: "invalid signature", signature: "sig1=:" + base64.StdEncoding.EncodeToString(make([]byte, 64)) + ":"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			message := encodeMessage(t,
+				func(w *encoding.KVWriter) error { return w.SetInt64("level", 1) },
+				func(w *encoding.KVWriter) error {
+					return w.SetBinary("src", netip.MustParseAddr("192.0.2.1").AsSlice())
+				},
+				func(w *encoding.KVWriter) error { return w.SetString("host", "example.com") },
+				func(w *encoding.KVWriter) error { return w.SetNull("cookies") },
+				func(w *encoding.KVWriter) error { return w.SetString("signature", tt.signature) },
+				func(w *encoding.KVWriter) error { return w.SetString("signature_input", "sig1="+params) },
+				func(w *encoding.KVWriter) error { return w.SetString("signature_agent", `"`+agentURL+`"`) },
+			)
+			actions := encoding.NewActionWriter(make([]byte, 2048), 0)
+
+			f.HandleSPOEValidate(context.Background(), actions, messageArgs(t, message))
+
+			values := actionValues(t, actions)
+			if values["valid"] != tt.wantValid || values["signature_agent"] != tt.wantAgent {
+				t.Errorf("valid = %v, signature_agent = %v, want %v, %v", values["valid"], values["signature_agent"], tt.wantValid, tt.wantAgent)
+			}
+		})
+	}
+}
+
+func TestHandleSPOEValidateTrustedToken(t *testing.T) {
+	secret := []byte(strings.Repeat("k", 32))
+	bh := challengeBerghain()
+	bh.TrustedTokens = []*berghain.TrustedToken{{Name: "app", Cookie: "session", Algorithm: berghain.TokenAlgorithmHS256, Key: secret}}
+	bh.Levels = append(bh.Levels, &berghain.LevelConfig{Duration: time.Minute, Type: berghain.ValidationTypePOW})
+	rep, err := berghain.NewReputation(berghain.ReputationConfig{Threshold: 1, Level: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bh.Reputation = rep
+	bh.RecordFailure(netip.MustParseAddr("192.0.2.66"), berghain.ErrorCodeInvalidSolution)
+	f := frontend{bh: bh}
+
+	signed := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"sub":"42","exp":%d}`, time.Now().Add(time.Hour).Unix())))
+	m := hmac.New(sha256.New, secret)
+	m.Write([]byte(signed))
+	jwt := signed + "." + base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+
+	cookie := berghain.AcquireCookieBuffer()
+	defer berghain.ReleaseCookieBuffer(cookie)
+	ri := berghain.RequestIdentifier{SrcAddr: netip.MustParseAddr("192.0.2.1"), Host: []byte("example.com"), Level: 1}
+	if err := ri.ToCookie(bh, cookie); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name          string
+		src           string
+		cookies       string
+		wantValid     bool
+		wantGrantedBy any
+		wantToken     any
+		wantReason    any
+	}{
+		{name: "session token", cookies: "session=" + jwt, wantValid: true, wantGrantedBy: "trusted_token", wantToken: "app"},
+		{name: "cookie first", cookies: "session=" + jwt + "; berghain=" + string(cookie.ReadBytes()), wantValid: true, wantGrantedBy: "cookie"},
+		{name: "forged session token", cookies: "session=" + signed + ".c2lnbmF0dXJl", wantReason: "empty"},
+		{name: "neither", cookies: "other=1", wantReason: "empty"},
+		// the reputation raised the level of the address
+		{name: "raised level", src: "192.0.2.66", cookies: "session=" + jwt, wantReason: "empty"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			message := encodeMessage(t,
+				func(w *encoding.KVWriter) error { return w.SetInt64("level", 1) },
+				func(w *encoding.KVWriter) error {
+					src := tt.src
+					if src == "" {
+						src = "192.0.2.1"
+					}
+					return w.SetBinary("src", netip.MustParseAddr(src).AsSlice())
+				},
+				func(w *encoding.KVWriter) error { return w.SetString("host", "example.com") },
+				func(w *encoding.KVWriter) error { return w.SetString("cookies", tt.cookies) },
+			)
+			actions := encoding.NewActionWriter(make([]byte, 2048), 0)
+
+			f.HandleSPOEValidate(context.Background(), actions, messageArgs(t, message))
+
+			values := actionValues(t, actions)
+			if values["valid"] != tt.wantValid || values["granted_by"] != tt.wantGrantedBy || values["trusted_token"] != tt.wantToken {
+				t.Errorf("valid = %v, granted_by = %v, trusted_token = %v, want %v, %v, %v",
+					values["valid"], values["granted_by"], values["trusted_token"], tt.wantValid, tt.wantGrantedBy, tt.wantToken)
+			}
+			if values["reason"] != tt.wantReason {
+				t.Errorf("reason = %v, want %v", values["reason"], tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestHandleSPOEValidateBypassToken(t *testing.T) {
+	bh := challengeBerghain()
+	var err error
+	bh.BypassTokens, err = berghain.NewBypassTokens([]berghain.BypassToken{
+		{Label: "smoke tests", Hash: sha256.Sum256([]byte("secret")), Hosts: []string{"example.com"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := frontend{bh: bh}
+
+	for _, tt := range []struct {
+		name          string
+		host          string
+		authorization string
+		wantValid     bool
+		wantToken     any
+	}{
+		{name: "valid", host: "Example.com:443", authorization: "Bearer secret", wantValid: true, wantToken: "smoke tests"},
+		{name: "other host", host: "example.org", authorization: "Bearer secret"},
+		{name: "wrong token", host: "example.com", authorization: "Bearer guess"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			message := encodeMessage(t,
+				func(w *encoding.KVWriter) error { return w.SetInt64("level", 1) },
+				func(w *encoding.KVWriter) error {
+					return w.SetBinary("src", netip.MustParseAddr("192.0.2.1").AsSlice())
+				},
+				func(w *encoding.KVWriter) error { return w.SetString("host", tt.host) },
+				func(w *encoding.KVWriter) error { return w.SetNull("cookies") },
+				func(w *encoding.KVWriter) error { return w.SetString("authorization", tt.authorization) },
+			)
+			actions := encoding.NewActionWriter(make([]byte, 2048), 0)
+
+			f.HandleSPOEValidate(context.Background(), actions, messageArgs(t, message))
+
+			values := actionValues(t, actions)
+			if values["valid"] != tt.wantValid || values["bypass_token"] != tt.wantToken {
+				t.Errorf("valid = %v, bypass_token = %v, want %v, %v", values["valid"], values["bypass_token"], tt.wantValid, tt.wantToken)
+			}
+		})
+	}
+}
+
+func TestHandleSPOEValidatePrivacyPass(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenKey, err := berghain.MarshalTokenKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "issuer.json")
+	dir := `{"token-keys": [{"token-type": 2, "token-key": "` + base64.URLEncoding.EncodeToString(tokenKey) + `"}]}`
+	if err := os.WriteFile(path, []byte(dir), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := berghain.OpenIssuerDirectory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bh := challengeBerghain()
+	bh.PrivacyPass, err = berghain.NewPrivacyPass(make([]byte, 32), []*berghain.TokenIssuer{{Name: "issuer.example.net", Keys: keys}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := frontend{bh: bh}
+
+	validate := func(authorization string) map[string]any {
+		message := encodeMessage(t,
+			func(w *encoding.KVWriter) error { return w.SetInt64("level", 1) },
+			func(w *encoding.KVWriter) error {
+				return w.SetBinary("src", netip.MustParseAddr("192.0.2.1").AsSlice())
+			},
+			func(w *encoding.KVWriter) error { return w.SetString("host", "example.com") },
+			func(w *encoding.KVWriter) error { return w.SetNull("cookies") },
+			func(w *encoding.KVWriter) error { return w.SetString("authorization", authorization) },
+		)
+		actions := encoding.NewActionWriter(make([]byte, 2048), 0)
+		f.HandleSPOEValidate(context.Background(), actions, messageArgs(t, message))
+		return actionValues(t, actions)
+	}
+
+	values := validate("")
+	challenge, ok := values["private_token"].(string)
+	if values["valid"] != false || !ok {
+		t.Fatalf("valid = %v, private_token = %v, want a challenge", values["valid"], values["private_token"])
+	}
+
+	// the token a client fetches for the challenge, the finalized blind
+	// signature is a plain RSASSA-PSS signature of the token input
+	m := regexp.MustCompile(`challenge="([^"]+)"`).FindStringSubmatch(challenge)
+	if m == nil {
+		t.Fatalf("no challenge in %q", challenge)
+	}
+	rawChallenge, err := base64.URLEncoding.DecodeString(m[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(rawChallenge)
+	keyID := sha256.Sum256(tokenKey)
+	fetchToken := func(nonce byte) string {
+		t.Helper()
+		token := append([]byte{0, 2}, bytes.Repeat([]byte{nonce}, 32)...)
+		token = append(append(token, digest[:]...), keyID[:]...)
+		msg := sha512.Sum384(token)
+		sig, err := rsa.SignPSS(rand.Reader, key, crypto.SHA384, msg[:], &rsa.PSSOptions{SaltLength: 48})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return `PrivateToken token="` + base64.URLEncoding.EncodeToString(append(token, sig...)) + `"`
+	}
+	authorization := fetchToken(0)
+
+	values = validate(authorization)
+	if values["valid"] != true || values["private_token_issuer"] != "issuer.example.net" {
+		t.Errorf("valid = %v, private_token_issuer = %v, want true, issuer.example.net", values["valid"], values["private_token_issuer"])
+	}
+	if setCookie, _ := values["set_cookie"].(string); !strings.HasPrefix(setCookie, "berghain=") {
+		t.Errorf("set_cookie = %v, want a cookie", values["set_cookie"])
+	}
+
+	if values := validate(authorization); values["valid"] != false {
+		t.Errorf("replayed token: valid = %v, want false", values["valid"])
+	}
+
+	// a redeemed token does not pass the request without a cookie
+	issueCookie = func(berghain.RequestIdentifier, *berghain.Berghain, *buffer.SliceBuffer) error {
+		return errors.New("no cookie")
+	}
+	t.Cleanup(func() { issueCookie = berghain.RequestIdentifier.ToCookie })
+
+	values = validate(fetchToken(1))
+	if values["valid"] != false || values["private_token_issuer"] != nil || values["set_cookie"] != nil {
+		t.Errorf("valid = %v, private_token_issuer = %v, set_cookie = %v, want false and neither set", values["valid"], values["private_token_issuer"], values["set_cookie"])
+	}
+}
+
+func TestHandleSPOEReputation(t *testing.T) {
+	const session = "bh@123e4567-e89b-12d3-a456-426614174000"
+	src := netip.MustParseAddr("192.0.2.1")
+
+	bh := berghain.NewBerghain(make([]byte, 32))
+	bh.Levels = []*berghain.LevelConfig{
+		{Duration: time.Minute, Type: berghain.ValidationTypePOW},
+		{Duration: time.Minute, Type: berghain.ValidationTypePOW},
+	}
+	rep, err := berghain.NewReputation(berghain.ReputationConfig{Threshold: 2, Level: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bh.Reputation = rep
+	f := frontend{bh: bh}
+
+	validate := func() map[string]any {
+		t.Helper()
+		cookie := berghain.AcquireCookieBuffer()
+		defer berghain.ReleaseCookieBuffer(cookie)
+		ri := berghain.RequestIdentifier{SrcAddr: src, Host: []byte("example.com"), Level: 1}
+		if err := ri.ToCookie(bh, cookie); err != nil {
+			t.Fatal(err)
+		}
+
+		message := encodeMessage(t,
+			func(w *encoding.KVWriter) error { return w.SetInt64("level", 1) },
+			func(w *encoding.KVWriter) error { return w.SetBinary("src", src.AsSlice()) },
+			func(w *encoding.KVWriter) error { return w.SetString("host", "example.com") },
+			func(w *encoding.KVWriter) error { return w.SetString("cookie", string(cookie.ReadBytes())) },
+		)
+		actions := encoding.NewActionWriter(make([]byte, 2048), 0)
+		f.HandleSPOEValidate(context.Background(), actions, messageArgs(t, message))
+		return actionValues(t, actions)
+	}
+
+	if values := validate(); values["valid"] != true || values["level"] != nil {
+		t.Fatalf("validate before failures = %v", values)
+	}
+
+	for i := 0; i < 2; i++ {
+		message := encodeMessage(t,
+			func(w *encoding.KVWriter) error { return w.SetInt64("level", 1) },
+			func(w *encoding.KVWriter) error { return w.SetBinary("src", src.AsSlice()) },
+			func(w *encoding.KVWriter) error { return w.SetString("host", "example.com") },
+			func(w *encoding.KVWriter) error { return w.SetString("method", http.MethodPost) },
+			func(w *encoding.KVWriter) error { return w.SetString("body", "garbage") },
+			func(w *encoding.KVWriter) error { return w.SetString("session", session) },
+		)
+		actions := encoding.NewActionWriter(make([]byte, 2048), 0)
+		f.HandleSPOEChallenge(context.Background(), actions, messageArgs(t, message))
+		if got := actionValues(t, actions)["failure"]; got != string(berghain.ErrorCodeInvalidSolution) {
+			t.Fatalf("failure = %v, want %s", got, berghain.ErrorCodeInvalidSolution)
+		}
+	}
+
+	values := validate()
+	if values["valid"] != false || values["reason"] != "level_too_low" {
+		t.Errorf("validate after failures = %v, want level_too_low", values)
+	}
+	if values["level"] != int64(2) {
+		t.Errorf("level = %v, want 2", values["level"])
+	}
+}
+
+func TestHandleSPOERevoke(t *testing.T) {
+	src := netip.MustParseAddr("192.0.2.1")
+
+	bh := berghain.NewBerghain(make([]byte, 32))
+	bh.Levels = []*berghain.LevelConfig{
+		{Duration: time.Minute, Type: berghain.ValidationTypePOW},
+		{Duration: time.Minute, Type: berghain.ValidationTypePOW},
+	}
+	rev, err := berghain.NewRevocations(berghain.RevocationConfig{CooldownLevel: 2, Cooldown: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bh.Revocations = rev
+	f := frontend{bh: bh}
+
+	cookie := berghain.AcquireCookieBuffer()
+	defer berghain.ReleaseCookieBuffer(cookie)
+	ri := berghain.RequestIdentifier{SrcAddr: src, Host: []byte("example.com"), Level: 1}
+	if err := ri.ToCookie(bh, cookie); err != nil {
+		t.Fatal(err)
+	}
+	cookies := "other=1; berghain=" + string(cookie.ReadBytes())
+
+	send := func(handle func(context.Context, *encoding.ActionWriter, *spoeArgs), optional ...func(*encoding.KVWriter) error) map[string]any {
+		t.Helper()
+		message := encodeMessage(t, append([]func(*encoding.KVWriter) error{
+			func(w *encoding.KVWriter) error { return w.SetBinary("src", src.AsSlice()) },
+			func(w *encoding.KVWriter) error { return w.SetString("host", "example.com") },
+			func(w *encoding.KVWriter) error { return w.SetString("cookies", cookies) },
+		}, optional...)...)
+		actions := encoding.NewActionWriter(make([]byte, 2048), 0)
+		handle(context.Background(), actions, messageArgs(t, message))
+		return actionValues(t, actions)
+	}
+	validate := func() map[string]any {
+		t.Helper()
+		return send(f.HandleSPOEValidate, func(w *encoding.KVWriter) error { return w.SetInt64("level", 1) })
+	}
+
+	if values := validate(); values["valid"] != true {
+		t.Fatalf("validate before revocation = %v", values)
+	}
+
+	if values := send(f.HandleSPOERevoke); values["revoked"] != true {
+		t.Fatalf("revoke = %v", values)
+	}
+
+	values := validate()
+	if values["valid"] != false || values["reason"] != "revoked" {
+		t.Errorf("validate after revocation = %v, want revoked", values)
+	}
+	if values["level"] != int64(2) {
+		t.Errorf("level = %v, want 2", values["level"])
+	}
+}
+
+func TestHandleSPOEPolicy(t *testing.T) {
+	policy, err := berghain.NewPolicy([]berghain.PolicyRule{
+		{Name: "feeds", Paths: []string{"/feed.xml"}, Action: berghain.PolicyActionAllow},
+		{Name: "scrapers", UserAgents: []string{"python-requests"}, Action: berghain.PolicyActionDeny},
+		{Name: "browsers", UserAgents: []string{"mozilla/"}, Hosts: []string{"example.com"}, Action: berghain.PolicyActionLevel, Level: 1},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		ua   string
+		want map[string]any
+	}{
+		{name: "no match", path: "/", ua: "curl/8.0", want: map[string]any{}},
+		{name: "allow", path: "/feed.xml", ua: "Mozilla/5.0", want: map[string]any{"level": unsetVar{}, "policy": "allow", "policy_rule": "feeds"}},
+		{name: "deny", path: "/", ua: "python-requests/2.31", want: map[string]any{"level": int64(1), "policy": "deny", "policy_rule": "scrapers"}},
+		{name: "level", path: "/", ua: "Mozilla/5.0", want: map[string]any{"level": int64(1), "policy": "level", "policy_rule": "browsers"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message := encodeMessage(t,
+				func(w *encoding.KVWriter) error { return w.SetString("ua", tt.ua) },
+				func(w *encoding.KVWriter) error { return w.SetString("host", "Example.com:443") },
+				func(w *encoding.KVWriter) error { return w.SetString("path", tt.path) },
+				func(w *encoding.KVWriter) error { return w.SetString("method", http.MethodGet) },
+				func(w *encoding.KVWriter) error {
+					return w.SetBinary("src", netip.MustParseAddr("192.0.2.1").AsSlice())
+				},
+			)
+			actions := encoding.NewActionWriter(make([]byte, 2048), 0)
+			bh := challengeBerghain()
+			bh.Policy = policy
+			f := frontend{bh: bh}
+
+			f.HandleSPOEPolicy(context.Background(), actions, messageArgs(t, message))
+
+			values := actionValues(t, actions)
+			if len(values) != len(tt.want) {
+				t.Errorf("actions = %v, want %v", values, tt.want)
+			}
+			for k, v := range tt.want {
+				if values[k] != v {
+					t.Errorf("%s = %v, want %v", k, values[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleSPOEPolicyWithoutPolicyLoggedOnce(t *testing.T) {
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+
+	f := frontend{bh: challengeBerghain()}
+	for i := 0; i < 3; i++ {
+		message := encodeMessage(t, func(w *encoding.KVWriter) error {
+			return w.SetBinary("src", netip.MustParseAddr("192.0.2.1").AsSlice())
+		})
+		actions := encoding.NewActionWriter(make([]byte, 2048), 0)
+		f.HandleSPOEPolicy(context.Background(), actions, messageArgs(t, message))
+
+		if values := actionValues(t, actions); len(values) != 0 {
+			t.Errorf("actions = %v, want none", values)
+		}
+	}
+
+	if n := strings.Count(buf.String(), "policy message for frontend without policy"); n != 1 {
+		t.Errorf("logged the missing policy %d times, want once:\n%s", n, buf.String())
+	}
+}
+
+func challengeMessage(t *testing.T, src []byte, host string, optional ...func(*encoding.KVWriter) error) *encoding.Message {
 	t.Helper()
 
 	writer := encoding.NewKVWriter(make([]byte, 2048), 0)
@@ -155,8 +1033,66 @@ func challengeMessage(t *testing.T, src []byte, host string) *encoding.Message {
 			t.Fatalf("encode challenge message: %v", err)
 		}
 	}
+	for _, write := range optional {
+		if err := write(writer); err != nil {
+			t.Fatalf("encode optional challenge argument: %v", err)
+		}
+	}
+
+	return &encoding.Message{KV: encoding.NewKVScanner(writer.Bytes(), 5+len(optional))}
+}
+
+// messageArgs decodes the arguments of a message as the agent does.
+func messageArgs(t *testing.T, m *encoding.Message) *spoeArgs {
+	t.Helper()
+
+	args := acquireSPOEArgs()
+	t.Cleanup(func() { releaseSPOEArgs(args) })
+	if err := args.decode(context.Background(), m); err != nil {
+		t.Fatalf("decode message: %v", err)
+	}
+
+	return args
+}
+
+// unsetVar marks variables unset by a handler in actionValues.
+type unsetVar struct{}
+
+// actionValues decodes the set-var and unset-var actions written by a handler.
+func actionValues(t *testing.T, w *encoding.ActionWriter) map[string]any {
+	t.Helper()
+
+	values := make(map[string]any)
+	b := w.Bytes()
+	for len(b) > 0 {
+		// action type, number of arguments and variable scope
+		if len(b) < 3 || b[0] != byte(encoding.ActionTypeSetVar) && b[0] != byte(encoding.ActionTypeUnsetVar) {
+			t.Fatalf("unexpected action: %x", b)
+		}
+		unset := b[0] == byte(encoding.ActionTypeUnsetVar)
+		b = b[3:]
+
+		if unset {
+			l, n, err := encoding.Varint(b)
+			if err != nil || uint64(len(b)-n) < l {
+				t.Fatalf("decode unset action: %x", b)
+			}
+			values[string(b[n:n+int(l)])] = unsetVar{}
+			b = b[n+int(l):]
+			continue
+		}
+
+		k := encoding.AcquireKVEntry()
+		scanner := encoding.NewKVScanner(b, 1)
+		if !scanner.Next(k) {
+			t.Fatalf("decode action: %v", scanner.Error())
+		}
+		values[string(k.NameBytes())] = k.Value()
+		b = b[len(b)-scanner.RemainingBuf():]
+		encoding.ReleaseKVEntry(k)
+	}
 
-	return &encoding.Message{KV: encoding.NewKVScanner(writer.Bytes(), 5)}
+	return values
 }
 
 func challengeBerghain() *berghain.Berghain {
@@ -2,31 +2,184 @@ package main
 
 import (
 	"context"
+	"io"
 	"log/slog"
 	"os"
+	"sync"
+	"time"
 )
 
+// logKey is the type of the context keys whose values are added to every
+// log record.
+type logKey int
+
+const (
+	// logKeyMessage is the *logMessage of the handled SPOE message.
+	logKeyMessage logKey = iota
+	logKeyHost
+	logKeyList
+	logKeySession
+	logKeySrc
+	logKeyValidator
+	// logKeyLevel is the requested level, an int. It is logged as
+	// required_level, slog logs the record level as level.
+	logKeyLevel
+)
+
+var logKeyNames = [...]string{
+	logKeyHost:      "host",
+	logKeyList:      "list",
+	logKeySession:   "session",
+	logKeySrc:       "src",
+	logKeyValidator: "validator",
+	logKeyLevel:     "required_level",
+}
+
+// logMessage holds the frontend and handler of a SPOE message. Frontends keep
+// one per handled message, so HandleSPOE adds both with a single context value
+// without allocating them.
+type logMessage struct {
+	frontend string
+	handler  string
+}
+
+// logHandler adds the context values to the records of the wrapped handler,
+// applies per-frontend levels and samples repeated records.
 type logHandler struct {
-	*slog.TextHandler
+	inner slog.Handler
+
+	// level applies to records without a frontend override.
+	level     slog.Leveler
+	frontends map[string]slog.Level
+
+	sampler *logSampler
+}
+
+// newLogHandler returns a handler writing text or json records to w. The
+// inner handler accepts all levels, Enabled decides.
+func newLogHandler(w io.Writer, format string, level slog.Leveler) *logHandler {
+	opts := &slog.HandlerOptions{Level: slog.Level(-8)}
+
+	var inner slog.Handler
+	if format == "json" {
+		inner = slog.NewJSONHandler(w, opts)
+	} else {
+		inner = slog.NewTextHandler(w, opts)
+	}
+
+	return &logHandler{inner: inner, level: level}
+}
+
+func (lh *logHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	min := lh.level.Level()
+	if len(lh.frontends) > 0 && ctx != nil {
+		if m, ok := ctx.Value(logKeyMessage).(*logMessage); ok {
+			if l, ok := lh.frontends[m.frontend]; ok {
+				min = l
+			}
+		}
+	}
+	return level >= min
 }
 
 func (lh *logHandler) Handle(ctx context.Context, r slog.Record) error {
-	for _, k := range []string{
-		"handler",
-		"host",
-		"session",
-		"src",
-		"validator",
-	} {
-		if handler, ok := ctx.Value(k).(string); ok {
-			r.AddAttrs(slog.String(k, handler))
+	suppressed, ok := lh.sampler.allow(r.Level, r.Message, r.Time)
+	if !ok {
+		return nil
+	}
+	if suppressed > 0 {
+		r.AddAttrs(slog.Uint64("suppressed", suppressed))
+	}
+
+	if m, ok := ctx.Value(logKeyMessage).(*logMessage); ok {
+		r.AddAttrs(slog.String("frontend", m.frontend), slog.String("handler", m.handler))
+	}
+	// all keys between logKeyMessage and logKeyLevel hold strings
+	for k := logKeyHost; k < logKeyLevel; k++ {
+		if v, ok := ctx.Value(k).(string); ok {
+			r.AddAttrs(slog.String(logKeyNames[k], v))
 		}
 	}
-	if level, ok := ctx.Value("level").(int); ok {
-		r.AddAttrs(slog.Int("level", level))
+	if level, ok := ctx.Value(logKeyLevel).(int); ok {
+		r.AddAttrs(slog.Int(logKeyNames[logKeyLevel], level))
+	}
+
+	return lh.inner.Handle(ctx, r)
+}
+
+func (lh *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *lh
+	c.inner = lh.inner.WithAttrs(attrs)
+	return &c
+}
+
+func (lh *logHandler) WithGroup(name string) slog.Handler {
+	c := *lh
+	c.inner = lh.inner.WithGroup(name)
+	return &c
+}
+
+// logSampler lets at most burst records with the same level and message pass
+// per interval. The first record passing after others were dropped reports
+// how many were suppressed. A nil sampler lets all records pass.
+type logSampler struct {
+	burst    int
+	interval time.Duration
+
+	mu      sync.Mutex
+	windows map[logSampleKey]*logWindow
+}
+
+type logSampleKey struct {
+	level   slog.Level
+	message string
+}
+
+type logWindow struct {
+	start      time.Time
+	count      int
+	suppressed uint64
+}
+
+func newLogSampler(burst int, interval time.Duration) *logSampler {
+	if burst <= 0 {
+		return nil
+	}
+	if interval <= 0 {
+		interval = time.Second
+	}
+	return &logSampler{burst: burst, interval: interval, windows: make(map[logSampleKey]*logWindow)}
+}
+
+// allow reports whether a record at now passes, and the number of records
+// suppressed since the last one that passed.
+func (s *logSampler) allow(level slog.Level, message string, now time.Time) (uint64, bool) {
+	if s == nil {
+		return 0, true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// messages are constant strings, so the number of windows is bounded
+	w := s.windows[logSampleKey{level, message}]
+	if w == nil {
+		w = &logWindow{start: now}
+		s.windows[logSampleKey{level, message}] = w
+	}
+	if now.Sub(w.start) >= s.interval {
+		w.start, w.count = now, 0
+	}
+
+	if w.count >= s.burst {
+		w.suppressed++
+		return 0, false
 	}
+	w.count++
 
-	return lh.TextHandler.Handle(ctx, r)
+	suppressed := w.suppressed
+	w.suppressed = 0
+	return suppressed, true
 }
 
 func Fatal(message string, args ...any) {
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogHandlerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	log := slog.New(newLogHandler(&buf, "json", slog.LevelInfo))
+
+	ctx := context.WithValue(context.Background(), logKeyMessage, &logMessage{frontend: "shop", handler: "validate"})
+	ctx = context.WithValue(ctx, logKeySrc, "192.0.2.1")
+	ctx = context.WithValue(ctx, logKeyLevel, 2)
+	log.With("component", "test").InfoContext(ctx, "validated", "valid", true)
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("record %q is not json: %v", buf.String(), err)
+	}
+	for k, want := range map[string]any{
+		"msg":            "validated",
+		"frontend":       "shop",
+		"handler":        "validate",
+		"src":            "192.0.2.1",
+		"level":          "INFO",
+		"required_level": float64(2),
+		"valid":          true,
+		"component":      "test",
+	} {
+		if record[k] != want {
+			t.Errorf("%s = %v, want %v", k, record[k], want)
+		}
+	}
+	// duplicate keys would be collapsed by Unmarshal
+	if n := strings.Count(buf.String(), `"level":`); n != 1 {
+		t.Errorf("record has %d level keys: %s", n, buf.String())
+	}
+}
+
+func TestLogHandlerFrontendLevels(t *testing.T) {
+	var buf bytes.Buffer
+	lh := LogConfig{Frontends: map[string]string{"shop": "debug", "quiet": "error"}}.AsLogHandler(newLogHandler(&buf, "text", slog.LevelInfo))
+	log := slog.New(lh)
+
+	frontend := func(name string) context.Context {
+		return context.WithValue(context.Background(), logKeyMessage, &logMessage{frontend: name})
+	}
+
+	log.DebugContext(context.Background(), "no frontend")
+	log.DebugContext(frontend("default"), "default frontend")
+	log.DebugContext(frontend("shop"), "debug frontend")
+	log.WarnContext(frontend("quiet"), "quiet frontend")
+	log.InfoContext(frontend("default"), "info")
+
+	got := buf.String()
+	for _, msg := range []string{"no frontend", "default frontend", "quiet frontend"} {
+		if strings.Contains(got, msg) {
+			t.Errorf("%q was logged", msg)
+		}
+	}
+	for _, msg := range []string{"msg=\"debug frontend\" frontend=shop", "msg=info frontend=default"} {
+		if !strings.Contains(got, msg) {
+			t.Errorf("%q was not logged:\n%s", msg, got)
+		}
+	}
+}
+
+func TestLogSampler(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := newLogSampler(2, time.Second)
+
+	for i, want := range []bool{true, true, false, false} {
+		if _, ok := s.allow(slog.LevelError, "failed", now); ok != want {
+			t.Errorf("record %d passed = %v, want %v", i, ok, want)
+		}
+	}
+	if _, ok := s.allow(slog.LevelWarn, "failed", now); !ok {
+		t.Error("record with another level was dropped")
+	}
+	if _, ok := s.allow(slog.LevelError, "other", now); !ok {
+		t.Error("record with another message was dropped")
+	}
+
+	suppressed, ok := s.allow(slog.LevelError, "failed", now.Add(time.Second))
+	if !ok || suppressed != 2 {
+		t.Errorf("next window: passed %v, suppressed %d, want 2", ok, suppressed)
+	}
+	if suppressed, _ := s.allow(slog.LevelError, "failed", now.Add(time.Second)); suppressed != 0 {
+		t.Errorf("suppressed reported twice: %d", suppressed)
+	}
+
+	if newLogSampler(0, time.Second) != nil {
+		t.Error("zero burst does not disable sampling")
+	}
+}
+
+func TestLogHandlerSampling(t *testing.T) {
+	var buf bytes.Buffer
+	lh := LogConfig{Sampling: LogSamplingConfig{Burst: 1, Interval: time.Hour}}.AsLogHandler(newLogHandler(&buf, "text", slog.LevelInfo))
+	log := slog.New(lh)
+
+	for i := 0; i < 100; i++ {
+		log.Error("validator failed")
+	}
+	if n := strings.Count(buf.String(), "validator failed"); n != 1 {
+		t.Errorf("logged %d records, want 1", n)
+	}
+}
@@ -11,9 +11,12 @@ import (
 	"os"
 	"os/signal"
 	"sync"
+	"time"
 
 	"github.com/dropmorepackets/haproxy-go/pkg/encoding"
 	"github.com/dropmorepackets/haproxy-go/spop"
+
+	"github.com/DropMorePackets/berghain"
 )
 
 var (
@@ -22,12 +25,25 @@ var (
 
 func main() {
 	var (
-		logLevelArg string
-		pprofArg    bool
+		logLevelArg  string
+		logFormatArg string
+		pprofArg     bool
 	)
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "mint":
+			runMint(os.Args[2:])
+			return
+		case "support":
+			runSupport(os.Args[2:])
+			return
+		}
+	}
+
 	flag.StringVar(&configPath, "config", "config.yaml", "Config file to load")
 	flag.StringVar(&logLevelArg, "loglevel", "info", "Logging level")
+	flag.StringVar(&logFormatArg, "logformat", "text", "Logging format, text or json")
 	flag.BoolVar(&pprofArg, "pprof", false, "Enable pprof listener")
 	flag.Parse()
 
@@ -38,11 +54,11 @@ func main() {
 		Fatal("invalid log level, cannot proceed")
 	}
 
-	slog.SetDefault(slog.New(&logHandler{
-		TextHandler: slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
-			Level: logLevel,
-		}),
-	}))
+	if logFormatArg != "text" && logFormatArg != "json" {
+		Fatal("invalid log format, cannot proceed", "format", logFormatArg)
+	}
+
+	slog.SetDefault(slog.New(newLogHandler(os.Stderr, logFormatArg, logLevel)))
 
 	// Optionally start a http server to serve the default pprof handlers.
 	if pprofArg {
@@ -89,14 +105,153 @@ func runBerghain(wg *sync.WaitGroup, ctx context.Context) error {
 		Fatal("provided secret has invalid length", "have", len(cfg.Secret), "need", 32)
 	}
 
-	b := instance{
-		c: map[string]*frontend{
-			defaultFrontend: {bh: cfg.Default.AsBerghain(cfg.Secret)},
-		},
+	lists := cfg.AsIPLists()
+	b := newInstance(cfg, lists)
+
+	if cfg.Log != nil {
+		for name := range cfg.Log.Frontends {
+			if b.c[name] == nil {
+				Fatal("log level configured for unknown frontend", "frontend", name)
+			}
+		}
+		if lh, ok := slog.Default().Handler().(*logHandler); ok {
+			slog.SetDefault(slog.New(cfg.Log.AsLogHandler(lh)))
+		}
 	}
 
-	for fName, config := range cfg.Frontend {
-		b.c[fName] = &frontend{bh: config.AsBerghain(cfg.Secret)}
+	var h *health
+	if cfg.Health != nil {
+		h = newHealth(cfg, &b)
+		wg.Add(1)
+		go serveHTTP(ctx, wg, "health", cfg.Health.Listen, h.handler())
+
+		if cfg.Health.CheckCaptcha {
+			wg.Add(1)
+			go h.runCaptchaChecks(ctx, wg, cfg.Health.CaptchaCheckInterval)
+		}
+	}
+
+	for name, f := range b.c {
+		f.bh.BypassTokens = cfg.AsBypassTokens(name)
+	}
+
+	if cfg.GeoIP != nil {
+		geoIP := cfg.GeoIP.AsGeoIP()
+		for _, f := range b.c {
+			f.bh.GeoIP = geoIP
+		}
+
+		wg.Add(1)
+		go reloadFiles(ctx, wg, "geoip databases", cfg.GeoIP.ReloadInterval, geoIP.Reload)
+	}
+
+	for _, l := range lists {
+		for name, f := range b.c {
+			if l.Action == berghain.ListActionLevel && int(l.Level) > len(f.bh.Levels) {
+				Fatal("ip list level must refer to a configured level", "list", l.Name, "frontend", name, "level", l.Level, "levels", len(f.bh.Levels))
+			}
+		}
+	}
+
+	if len(lists) > 0 {
+		wg.Add(1)
+		go reloadFiles(ctx, wg, "ip lists", cfg.IPListsReloadInterval, lists.Reload)
+	}
+
+	if cfg.VerifiedBots != nil {
+		bots := cfg.VerifiedBots.AsBotVerifier()
+		for _, f := range b.c {
+			f.bh.Bots = bots
+		}
+
+		wg.Add(1)
+		go reloadFiles(ctx, wg, "verified bot ranges", cfg.VerifiedBots.ReloadInterval, bots.Reload)
+	}
+
+	if signatures := cfg.AsSignatureVerifier(); len(signatures.Agents) > 0 {
+		for _, f := range b.c {
+			f.bh.Signatures = signatures
+		}
+
+		wg.Add(1)
+		go reloadFiles(ctx, wg, "signature agent keys", cfg.SignatureAgentsReloadInterval, signatures.Reload)
+	}
+
+	if cfg.PrivacyPass != nil {
+		privacyPass := cfg.PrivacyPass.AsPrivacyPass(cfg.Secret)
+		for _, f := range b.c {
+			f.bh.PrivacyPass = privacyPass
+		}
+
+		wg.Add(1)
+		go reloadFiles(ctx, wg, "token issuer keys", cfg.PrivacyPass.ReloadInterval, privacyPass.Reload)
+	}
+
+	if cfg.Reputation != nil {
+		rep := cfg.Reputation.AsReputation()
+		for name, f := range b.c {
+			if cfg.Reputation.Level > len(f.bh.Levels) {
+				Fatal("reputation level must refer to a configured level", "frontend", name, "level", cfg.Reputation.Level, "levels", len(f.bh.Levels))
+			}
+			f.bh.Reputation = rep
+		}
+
+		wg.Add(1)
+		go pruneReputation(ctx, wg, rep, cfg.Reputation.PruneInterval)
+
+		if cfg.Reputation.Snapshot != "" {
+			wg.Add(1)
+			go snapshotReputation(ctx, wg, rep, cfg.Reputation.Snapshot, cfg.Reputation.SnapshotInterval)
+		}
+	}
+
+	if cfg.Revocation != nil {
+		rev := cfg.Revocation.AsRevocations()
+		for name, f := range b.c {
+			if cfg.Revocation.CooldownLevel > len(f.bh.Levels) {
+				Fatal("revocation cool-down level must refer to a configured level", "frontend", name, "level", cfg.Revocation.CooldownLevel, "levels", len(f.bh.Levels))
+			}
+			f.bh.Revocations = rev
+		}
+
+		wg.Add(1)
+		go pruneRevocations(ctx, wg, rev, cfg.Revocation.PruneInterval)
+	}
+
+	if cfg.Audit != nil {
+		audit := cfg.Audit.AsAuditLog()
+		for _, f := range b.c {
+			f.audit = audit
+		}
+
+		wg.Add(1)
+		go audit.run(ctx, wg)
+	}
+
+	if cfg.Support != nil {
+		b.support = cfg.Support.AsSupportLog()
+		for _, f := range b.c {
+			f.support = b.support
+		}
+	}
+
+	if cfg.Admin != nil {
+		wg.Add(1)
+		go serveHTTP(ctx, wg, "admin", cfg.Admin.Listen, b.adminHandler(cfg.Admin.AsKey()))
+	}
+
+	if cfg.Tracing != nil {
+		b.tracer = cfg.Tracing.AsTracer()
+		for _, f := range b.c {
+			// captcha verifications are recorded as child spans
+			f.bh.HTTPClient = &http.Client{
+				Timeout:   5 * time.Second,
+				Transport: tracingTransport{base: http.DefaultTransport},
+			}
+		}
+
+		wg.Add(1)
+		go b.tracer.run(ctx, wg)
 	}
 
 	network, address := ParseListener(cfg.Listen)
@@ -105,6 +260,22 @@ func runBerghain(wg *sync.WaitGroup, ctx context.Context) error {
 		return err
 	}
 	defer listen.Close()
+	if h != nil {
+		h.listening.Store(true)
+	}
+
+	if cfg.Metrics != nil {
+		b.conns = &connMetrics{}
+		for _, f := range b.c {
+			f.metrics = newFrontendMetrics(f.bh)
+		}
+		listen = countingListener{Listener: listen, m: b.conns}
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", b.metricsHandler())
+		wg.Add(1)
+		go serveHTTP(ctx, wg, "metrics", cfg.Metrics.Listen, mux)
+	}
 
 	slog.InfoContext(ctx, "Listening for SPOP requests", "type", network, "address", address)
 
@@ -118,6 +289,27 @@ func runBerghain(wg *sync.WaitGroup, ctx context.Context) error {
 
 type instance struct {
 	c map[string]*frontend
+
+	// conns is nil if metrics are disabled.
+	conns *connMetrics
+	// tracer is nil if tracing is disabled.
+	tracer *tracer
+	// support is nil if support lookups are disabled.
+	support *supportLog
+}
+
+func newInstance(cfg Config, lists berghain.IPLists) instance {
+	b := instance{
+		c: map[string]*frontend{
+			defaultFrontend: newFrontend(defaultFrontend, cfg.Default.AsBerghain(cfg.Secret, lists)),
+		},
+	}
+
+	for fName, config := range cfg.Frontend {
+		b.c[fName] = newFrontend(fName, config.AsBerghain(cfg.Secret, lists))
+	}
+
+	return b
 }
 
 const defaultFrontend = "default"
@@ -137,35 +329,47 @@ func (i *instance) Frontend(b []byte) *frontend {
 }
 
 func (i *instance) HandleSPOE(ctx context.Context, w *encoding.ActionWriter, m *encoding.Message) {
-	const SPOEMessageNameValidate, SPOEMessageNameChallenge = "validate", "challenge"
-
-	k := encoding.AcquireKVEntry()
-	defer encoding.ReleaseKVEntry(k)
+	const SPOEMessageNameValidate, SPOEMessageNameChallenge, SPOEMessageNamePolicy, SPOEMessageNameRevoke = "validate", "challenge", "policy", "revoke"
 
-	// read frontend
-	if !m.KV.Next(k) {
-		if err := m.KV.Error(); err != nil {
-			slog.ErrorContext(ctx, "error while reading KV", "error", err)
-			return
-		}
+	args := acquireSPOEArgs()
+	defer releaseSPOEArgs(args)
 
-		slog.ErrorContext(ctx, "failed reading fronted argument")
+	if err := args.decode(ctx, m); err != nil {
+		slog.ErrorContext(ctx, "failed reading SPOP arguments", "error", err)
+		return
 	}
 
-	if !k.NameEquals("frontend") {
-		slog.ErrorContext(ctx, "invalid SPOP argument order", "error", "expected frontend")
-	}
+	// a missing frontend argument selects the default frontend
+	f := i.Frontend(args.frontend)
 
-	f := i.Frontend(k.ValueBytes())
+	lm := f.logMessage(m.NameBytes())
+	ctx = context.WithValue(ctx, logKeyMessage, lm)
+	h := lm.handler
 
-	h := string(m.NameBytes())
+	start := time.Now()
+	defer func() { f.metrics.handled(h, time.Since(start)) }()
 
-	ctx = context.WithValue(ctx, "handler", h)
+	ctx, span := i.tracer.startTrace(ctx, "HandleSPOE", spanKindServer)
+	defer span.finish()
+	if span != nil {
+		span.setString("berghain.message", h)
+		span.setString("berghain.frontend", f.name)
+		if args.has(argLevel) {
+			span.setInt("berghain.level", args.level)
+		}
+		if args.has(argSession) && berghain.ValidSupportID(args.session) {
+			span.setString("berghain.support_id", string(args.session))
+		}
+	}
 
 	switch h {
 	case SPOEMessageNameValidate:
-		f.HandleSPOEValidate(ctx, w, m)
+		f.HandleSPOEValidate(ctx, w, args)
 	case SPOEMessageNameChallenge:
-		f.HandleSPOEChallenge(ctx, w, m)
+		f.HandleSPOEChallenge(ctx, w, args)
+	case SPOEMessageNamePolicy:
+		f.HandleSPOEPolicy(ctx, w, args)
+	case SPOEMessageNameRevoke:
+		f.HandleSPOERevoke(ctx, w, args)
 	}
 }
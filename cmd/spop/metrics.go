@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DropMorePackets/berghain"
+)
+
+// Metrics are kept in fixed arrays of atomics, indexed by frontend, level and
+// result, so recording them neither locks nor allocates. They are rendered in
+// the Prometheus text format.
+
+// latencyBuckets are the upper bounds of the histogram buckets.
+var latencyBuckets = [...]time.Duration{
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+}
+
+type histogram struct {
+	// counts are not cumulative, the last one counts observations above
+	// all buckets.
+	counts [len(latencyBuckets) + 1]atomic.Uint64
+	sum    atomic.Int64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(latencyBuckets) && d > latencyBuckets[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.sum.Add(int64(d))
+}
+
+// validateResult is a result of validate messages, either the mechanism that
+// granted access or the reason the request is not valid.
+type validateResult struct {
+	name  string
+	valid bool
+}
+
+const (
+	// validateResultDenied is reported for addresses on a deny list.
+	validateResultDenied = "list_deny"
+	// validateResultError is reported for messages that could not be
+	// handled, e.g. because of missing arguments.
+	validateResultError = "error"
+)
+
+var validateResults = [...]validateResult{
+	{grantedByCookie, true},
+	{grantedByList, true},
+	{grantedByBypassToken, true},
+	{grantedBySignature, true},
+	{grantedByVerifiedBot, true},
+	{grantedByTrustedToken, true},
+	{grantedByPrivateToken, true},
+	{"empty", false},
+	{"invalid_length", false},
+	{"invalid_encoding", false},
+	{"invalid_hmac", false},
+	{"revoked", false},
+	{"level_too_low", false},
+	{"expired", false},
+	{"internal", false},
+	{validateResultDenied, false},
+	{validateResultError, false},
+}
+
+const (
+	challengeResultIssued = "issued"
+	challengeResultSolved = "solved"
+)
+
+// challengeResults are the results of challenge messages, the failures are
+// reported with their error code.
+var challengeResults = [...]string{
+	challengeResultIssued,
+	challengeResultSolved,
+	string(berghain.ErrorCodeExpired),
+	string(berghain.ErrorCodeInvalidSolution),
+	string(berghain.ErrorCodeCaptchaUnavailable),
+	string(berghain.ErrorCodeReplayed),
+	string(berghain.ErrorCodeRateLimited),
+	string(berghain.ErrorCodeInvalidRequest),
+	string(berghain.ErrorCodeInternal),
+}
+
+// spoeMessages are the messages whose handler latency is recorded.
+var spoeMessages = [...]string{"validate", "challenge", "policy", "revoke"}
+
+// resultIndex returns the index of name in names, -1 if it is unknown.
+func resultIndex(names []string, name string) int {
+	for i, n := range names {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+var validateResultNames = func() []string {
+	names := make([]string, len(validateResults))
+	for i, r := range validateResults {
+		names[i] = r.name
+	}
+	return names
+}()
+
+type levelMetrics struct {
+	typ berghain.ValidationType
+
+	validate  [len(validateResults)]atomic.Uint64
+	challenge [len(challengeResults)]atomic.Uint64
+
+	captcha       histogram
+	captchaErrors atomic.Uint64
+}
+
+// frontendMetrics are the metrics of one frontend. All methods are no-ops on
+// a nil receiver, which is used when metrics are disabled.
+type frontendMetrics struct {
+	levels   []levelMetrics
+	handlers [len(spoeMessages)]histogram
+}
+
+func newFrontendMetrics(bh *berghain.Berghain) *frontendMetrics {
+	m := &frontendMetrics{levels: make([]levelMetrics, len(bh.Levels))}
+	for i, l := range bh.Levels {
+		m.levels[i].typ = l.Type
+	}
+	return m
+}
+
+func (m *frontendMetrics) level(level uint8) *levelMetrics {
+	if m == nil || level == 0 || int(level) > len(m.levels) {
+		return nil
+	}
+	return &m.levels[level-1]
+}
+
+// validated counts a validate message at the level the cookie was checked
+// against.
+func (m *frontendMetrics) validated(level uint8, result string) {
+	if l := m.level(level); l != nil {
+		if i := resultIndex(validateResultNames, result); i >= 0 {
+			l.validate[i].Add(1)
+		}
+	}
+}
+
+// challenged counts a challenge message at the level of the challenge.
+func (m *frontendMetrics) challenged(level uint8, result string) {
+	if l := m.level(level); l != nil {
+		if i := resultIndex(challengeResults[:], result); i >= 0 {
+			l.challenge[i].Add(1)
+		}
+	}
+}
+
+// captchaVerified records the latency of a captcha token verification and
+// whether the provider failed to answer.
+func (m *frontendMetrics) captchaVerified(level uint8, d time.Duration, failed bool) {
+	if l := m.level(level); l != nil {
+		l.captcha.observe(d)
+		if failed {
+			l.captchaErrors.Add(1)
+		}
+	}
+}
+
+// handled records the latency of a SPOE message handler.
+func (m *frontendMetrics) handled(message string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	if i := resultIndex(spoeMessages[:], message); i >= 0 {
+		m.handlers[i].observe(d)
+	}
+}
+
+// connMetrics count the SPOP connections of HAProxy.
+type connMetrics struct {
+	active   atomic.Int64
+	accepted atomic.Uint64
+}
+
+// countingListener counts the connections it accepts.
+type countingListener struct {
+	net.Listener
+	m *connMetrics
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	// the agent only tunes the buffers of unwrapped TCP connections
+	if tcp, ok := c.(*net.TCPConn); ok {
+		_ = tcp.SetWriteBuffer(math.MaxUint16)
+		_ = tcp.SetReadBuffer(math.MaxUint16)
+	}
+
+	l.m.active.Add(1)
+	l.m.accepted.Add(1)
+	return &countedConn{Conn: c, m: l.m}, nil
+}
+
+type countedConn struct {
+	net.Conn
+	m    *connMetrics
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { c.m.active.Add(-1) })
+	return c.Conn.Close()
+}
+
+// metricsHandler serves the metrics of all frontends.
+func (i *instance) metricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		i.writeMetrics(w)
+	})
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (i *instance) writeMetrics(out io.Writer) {
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+
+	names := make([]string, 0, len(i.c))
+	for name, f := range i.c {
+		if f.metrics != nil {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	// forEachLevel calls fn with the labels of each configured level.
+	forEachLevel := func(fn func(labels string, l *levelMetrics)) {
+		for _, name := range names {
+			m := i.c[name].metrics
+			for n := range m.levels {
+				l := &m.levels[n]
+				fn(fmt.Sprintf(`frontend="%s",level="%d",type="%s"`, labelEscaper.Replace(name), n+1, l.typ), l)
+			}
+		}
+	}
+
+	writeHeader(w, "berghain_validate_total", "counter", "Validate messages by the mechanism granting access or the reason the request is not valid.")
+	forEachLevel(func(labels string, l *levelMetrics) {
+		for n, r := range validateResults {
+			fmt.Fprintf(w, "berghain_validate_total{%s,valid=\"%t\",result=\"%s\"} %d\n", labels, r.valid, r.name, l.validate[n].Load())
+		}
+	})
+
+	writeHeader(w, "berghain_challenge_total", "counter", "Challenge messages by result, failures are reported with their error code.")
+	forEachLevel(func(labels string, l *levelMetrics) {
+		for n, r := range challengeResults {
+			fmt.Fprintf(w, "berghain_challenge_total{%s,result=\"%s\"} %d\n", labels, r, l.challenge[n].Load())
+		}
+	})
+
+	writeHeader(w, "berghain_captcha_verify_duration_seconds", "histogram", "Latency of captcha token verifications with the provider.")
+	forEachLevel(func(labels string, l *levelMetrics) {
+		if l.typ.IsCaptcha() {
+			writeHistogram(w, "berghain_captcha_verify_duration_seconds", labels, &l.captcha)
+		}
+	})
+
+	writeHeader(w, "berghain_captcha_verify_errors_total", "counter", "Captcha token verifications the provider failed to answer.")
+	forEachLevel(func(labels string, l *levelMetrics) {
+		if l.typ.IsCaptcha() {
+			fmt.Fprintf(w, "berghain_captcha_verify_errors_total{%s} %d\n", labels, l.captchaErrors.Load())
+		}
+	})
+
+	writeHeader(w, "berghain_spoe_handler_duration_seconds", "histogram", "Latency of SPOE message handlers.")
+	for _, name := range names {
+		m := i.c[name].metrics
+		for n, message := range spoeMessages {
+			labels := fmt.Sprintf(`frontend="%s",message="%s"`, labelEscaper.Replace(name), message)
+			writeHistogram(w, "berghain_spoe_handler_duration_seconds", labels, &m.handlers[n])
+		}
+	}
+
+	if i.conns != nil {
+		writeHeader(w, "berghain_spoe_connections", "gauge", "Open SPOP connections.")
+		fmt.Fprintf(w, "berghain_spoe_connections %d\n", i.conns.active.Load())
+		writeHeader(w, "berghain_spoe_connections_total", "counter", "Accepted SPOP connections.")
+		fmt.Fprintf(w, "berghain_spoe_connections_total %d\n", i.conns.accepted.Load())
+	}
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeHistogram(w io.Writer, name, labels string, h *histogram) {
+	var count uint64
+	for n, le := range latencyBuckets {
+		count += h.counts[n].Load()
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, strconv.FormatFloat(le.Seconds(), 'g', -1, 64), count)
+	}
+	count += h.counts[len(latencyBuckets)].Load()
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, count)
+	fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels, strconv.FormatFloat(time.Duration(h.sum.Load()).Seconds(), 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, count)
+}
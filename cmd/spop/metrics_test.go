@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dropmorepackets/haproxy-go/pkg/encoding"
+
+	"github.com/DropMorePackets/berghain"
+)
+
+func TestFrontendMetricsDoNotAllocate(t *testing.T) {
+	m := newFrontendMetrics(challengeBerghain())
+
+	allocs := testing.AllocsPerRun(100, func() {
+		m.validated(1, grantedByCookie)
+		m.validated(1, berghain.CookieErrorReason(berghain.ErrExpired))
+		m.challenged(1, challengeResultSolved)
+		m.handled("validate", time.Millisecond)
+	})
+	if allocs != 0 {
+		t.Errorf("recording metrics allocates %v times", allocs)
+	}
+
+	// unknown levels and disabled metrics are ignored
+	m.validated(2, grantedByCookie)
+	(*frontendMetrics)(nil).validated(1, grantedByCookie)
+}
+
+func TestHandleSPOEAllocs(t *testing.T) {
+	src := netip.MustParseAddr("192.0.2.1")
+	bh := challengeBerghain()
+	// metrics and tracing are disabled
+	i := &instance{c: map[string]*frontend{defaultFrontend: newFrontend(defaultFrontend, bh)}}
+
+	cookie := berghain.AcquireCookieBuffer()
+	defer berghain.ReleaseCookieBuffer(cookie)
+	ri := berghain.RequestIdentifier{SrcAddr: src, Host: []byte("example.com"), Level: 1}
+	if err := ri.ToCookie(bh, cookie); err != nil {
+		t.Fatal(err)
+	}
+
+	kv := encoding.NewKVWriter(make([]byte, 2048), 0)
+	for _, write := range []func() error{
+		func() error { return kv.SetInt64("level", 1) },
+		func() error { return kv.SetBinary("src", src.AsSlice()) },
+		func() error { return kv.SetString("host", "example.com") },
+		func() error { return kv.SetString("cookie", string(cookie.ReadBytes())) },
+	} {
+		if err := write(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	message := make([]byte, 16)
+	n, err := encoding.PutBytes(message, []byte("validate"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	message = append(append(message[:n], 4), kv.Bytes()...)
+
+	actions := make([]byte, 2048)
+	handle := func(handle func(context.Context, *encoding.ActionWriter, *encoding.Message)) float64 {
+		return testing.AllocsPerRun(100, func() {
+			scanner := encoding.AcquireMessageScanner(message)
+			m := encoding.AcquireMessage()
+			if !scanner.Next(m) {
+				t.Fatal(scanner.Error())
+			}
+			w := encoding.AcquireActionWriter(actions, 0)
+			handle(context.Background(), w, m)
+			encoding.ReleaseActionWriter(w)
+			encoding.ReleaseKVScanner(m.KV)
+			encoding.ReleaseMessage(m)
+			encoding.ReleaseMessageScanner(scanner)
+		})
+	}
+
+	validate := handle(func(ctx context.Context, w *encoding.ActionWriter, m *encoding.Message) {
+		args := acquireSPOEArgs()
+		defer releaseSPOEArgs(args)
+		if err := args.decode(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+		i.c[defaultFrontend].HandleSPOEValidate(ctx, w, args)
+	})
+	// the frontend and handler are logged with a single context value
+	if allocs := handle(i.HandleSPOE); allocs > validate+1 {
+		t.Errorf("HandleSPOE allocates %v times per message, the validate handler %v times", allocs, validate)
+	}
+}
+
+func TestHandleSPOEValidateMetrics(t *testing.T) {
+	src := netip.MustParseAddr("192.0.2.1")
+	bh := challengeBerghain()
+	f := &frontend{bh: bh, metrics: newFrontendMetrics(bh)}
+
+	cookie := berghain.AcquireCookieBuffer()
+	defer berghain.ReleaseCookieBuffer(cookie)
+	ri := berghain.RequestIdentifier{SrcAddr: src, Host: []byte("example.com"), Level: 1}
+	if err := ri.ToCookie(bh, cookie); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []string{string(cookie.ReadBytes()), "", "garbage"} {
+		c := c
+		message := encodeMessage(t,
+			func(w *encoding.KVWriter) error { return w.SetInt64("level", 1) },
+			func(w *encoding.KVWriter) error { return w.SetBinary("src", src.AsSlice()) },
+			func(w *encoding.KVWriter) error { return w.SetString("host", "example.com") },
+			func(w *encoding.KVWriter) error { return w.SetString("cookie", c) },
+		)
+		actions := encoding.NewActionWriter(make([]byte, 2048), 0)
+		f.HandleSPOEValidate(context.Background(), actions, messageArgs(t, message))
+	}
+
+	i := &instance{c: map[string]*frontend{defaultFrontend: f}, conns: &connMetrics{}}
+	var out strings.Builder
+	i.writeMetrics(&out)
+
+	for _, want := range []string{
+		`berghain_validate_total{frontend="default",level="1",type="none",valid="true",result="cookie"} 1`,
+		`berghain_validate_total{frontend="default",level="1",type="none",valid="false",result="empty"} 1`,
+		`berghain_validate_total{frontend="default",level="1",type="none",valid="false",result="invalid_length"} 1`,
+		`berghain_validate_total{frontend="default",level="1",type="none",valid="false",result="expired"} 0`,
+		`berghain_challenge_total{frontend="default",level="1",type="none",result="issued"} 0`,
+		`berghain_spoe_handler_duration_seconds_count{frontend="default",message="validate"} 0`,
+		"# TYPE berghain_spoe_connections gauge\nberghain_spoe_connections 0\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("metrics do not contain %q", want)
+		}
+	}
+	if strings.Contains(out.String(), "berghain_captcha_verify_errors_total{") {
+		t.Error("captcha metrics reported without captcha levels")
+	}
+}
+
+func TestWriteHistogram(t *testing.T) {
+	var h histogram
+	h.observe(50 * time.Microsecond)
+	h.observe(3 * time.Millisecond)
+	h.observe(time.Minute)
+
+	var out strings.Builder
+	writeHistogram(&out, "h", `a="b"`, &h)
+
+	for _, want := range []string{
+		`h_bucket{a="b",le="0.0001"} 1`,
+		`h_bucket{a="b",le="0.005"} 2`,
+		`h_bucket{a="b",le="5"} 2`,
+		`h_bucket{a="b",le="+Inf"} 3`,
+		`h_sum{a="b"} 60.00305`,
+		`h_count{a="b"} 3`,
+	} {
+		if !strings.Contains(out.String(), want+"\n") {
+			t.Errorf("histogram does not contain %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestCountingListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m connMetrics
+	cl := countingListener{Listener: l, m: &m}
+	defer cl.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	c, err := cl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.active.Load() != 1 || m.accepted.Load() != 1 {
+		t.Errorf("after accept: active %d, accepted %d", m.active.Load(), m.accepted.Load())
+	}
+
+	// closing again does not count twice
+	_ = c.Close()
+	_ = c.Close()
+	if m.active.Load() != 0 || m.accepted.Load() != 1 {
+		t.Errorf("after close: active %d, accepted %d", m.active.Load(), m.accepted.Load())
+	}
+}
+
+func TestHandleSPOEChallengeCaptchaMetrics(t *testing.T) {
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"success": true, "hostname": "example.com"}`)
+	}))
+	defer provider.Close()
+
+	bh := berghain.NewBerghain(make([]byte, 32))
+	bh.Levels = []*berghain.LevelConfig{{
+		Duration:         time.Minute,
+		Type:             berghain.ValidationTypeTurnstile,
+		CaptchaSitekey:   "sitekey",
+		CaptchaSecret:    "secret",
+		CaptchaVerifyURL: provider.URL,
+	}}
+	f := &frontend{bh: bh, metrics: newFrontendMetrics(bh)}
+
+	verifications := func() uint64 {
+		var n uint64
+		for i := range f.metrics.levels[0].captcha.counts {
+			n += f.metrics.levels[0].captcha.counts[i].Load()
+		}
+		return n
+	}
+
+	post := func(body string) {
+		t.Helper()
+		message := encodeMessage(t,
+			func(w *encoding.KVWriter) error { return w.SetInt64("level", 1) },
+			func(w *encoding.KVWriter) error {
+				return w.SetBinary("src", netip.MustParseAddr("192.0.2.1").AsSlice())
+			},
+			func(w *encoding.KVWriter) error { return w.SetString("host", "example.com") },
+			func(w *encoding.KVWriter) error { return w.SetString("method", http.MethodPost) },
+			func(w *encoding.KVWriter) error { return w.SetString("body", body) },
+		)
+		actions := encoding.NewActionWriter(make([]byte, 2048), 0)
+		f.HandleSPOEChallenge(context.Background(), actions, messageArgs(t, message))
+	}
+
+	// rejected before the provider is asked
+	post("")
+	if n := verifications(); n != 0 {
+		t.Errorf("empty token recorded %d provider verifications, want 0", n)
+	}
+
+	post("widget-token")
+	if n := verifications(); n != 1 {
+		t.Errorf("recorded %d provider verifications, want 1", n)
+	}
+}
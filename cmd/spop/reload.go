@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/DropMorePackets/berghain"
+)
+
+// reloadFiles periodically picks up replaced data files, e.g. geoip databases
+// after geoipupdate ran or refreshed ip lists.
+func reloadFiles(ctx context.Context, wg *sync.WaitGroup, name string, interval time.Duration, reload func() (bool, error)) {
+	defer wg.Done()
+
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		changed, err := reload()
+		if err != nil {
+			slog.ErrorContext(ctx, "failed reloading "+name, "error", err)
+		}
+		if changed {
+			slog.InfoContext(ctx, "reloaded "+name)
+		}
+	}
+}
+
+// snapshotReputation periodically saves the reputation scores, and once more
+// on shutdown, so they survive restarts.
+func snapshotReputation(ctx context.Context, wg *sync.WaitGroup, rep *berghain.Reputation, path string, interval time.Duration) {
+	defer wg.Done()
+
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := rep.SaveFile(path); err != nil {
+				slog.Error("failed saving reputation snapshot", "error", err)
+			}
+			return
+		case <-t.C:
+		}
+
+		if err := rep.SaveFile(path); err != nil {
+			slog.ErrorContext(ctx, "failed saving reputation snapshot", "error", err)
+		}
+	}
+}
+
+// pruneRevocations periodically drops revoked cookies that expired and
+// cool-downs that ended.
+func pruneRevocations(ctx context.Context, wg *sync.WaitGroup, rev *berghain.Revocations, interval time.Duration) {
+	defer wg.Done()
+
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			rev.Prune(now)
+		}
+	}
+}
+
+// pruneReputation periodically drops scores that decayed, so addresses that
+// failed once do not hold entries until the next snapshot.
+func pruneReputation(ctx context.Context, wg *sync.WaitGroup, rep *berghain.Reputation, interval time.Duration) {
+	defer wg.Done()
+
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			rep.Prune(now)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DropMorePackets/berghain"
+)
+
+// supportLog keeps the recent challenge events in a ring, indexed by the
+// support ID shown on the challenge page. All methods are no-ops on a nil
+// receiver, which is used when support lookups are disabled.
+type supportLog struct {
+	mu     sync.Mutex
+	events []auditEvent
+	// next is the sequence number of the next event, its slot is
+	// next % len(events).
+	next uint64
+	// index maps support IDs to the sequence numbers of their events,
+	// oldest first.
+	index map[string][]uint64
+}
+
+// normalizeSupportID lower-cases the hex digits of a valid support ID, which
+// pages may present in either case, so lookups match the events recorded.
+func normalizeSupportID(id string) string {
+	return strings.ToLower(id)
+}
+
+func newSupportLog(maxEntries int) *supportLog {
+	return &supportLog{
+		events: make([]auditEvent, maxEntries),
+		index:  make(map[string][]uint64),
+	}
+}
+
+// record adds the event, replacing the oldest one once the ring is full.
+// Events without a support ID cannot be looked up and are ignored.
+func (s *supportLog) record(e auditEvent) {
+	if s == nil || e.SupportID == "" {
+		return
+	}
+	e.SupportID = normalizeSupportID(e.SupportID)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	slot := s.next % uint64(len(s.events))
+	if s.next >= uint64(len(s.events)) {
+		// the replaced event is the oldest of its support ID
+		old := s.events[slot].SupportID
+		if seqs := s.index[old][1:]; len(seqs) > 0 {
+			s.index[old] = seqs
+		} else {
+			delete(s.index, old)
+		}
+	}
+
+	s.events[slot] = e
+	s.index[e.SupportID] = append(s.index[e.SupportID], s.next)
+	s.next++
+}
+
+// lookup returns the events of the support ID, oldest first.
+func (s *supportLog) lookup(id string) []auditEvent {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seqs := s.index[normalizeSupportID(id)]
+	events := make([]auditEvent, len(seqs))
+	for n, seq := range seqs {
+		events[n] = s.events[seq%uint64(len(s.events))]
+	}
+	return events
+}
+
+type supportResponse struct {
+	ID     string       `json:"id"`
+	Events []auditEvent `json:"events"`
+}
+
+func (i *instance) handleSupport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if i.support == nil {
+		http.Error(w, "support lookups are disabled", http.StatusNotFound)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if !berghain.ValidSupportID([]byte(id)) {
+		http.Error(w, "invalid support id", http.StatusBadRequest)
+		return
+	}
+	id = normalizeSupportID(id)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(supportResponse{ID: id, Events: i.support.lookup(id)})
+}
+
+// searchAuditFiles returns the events of the support ID in the audit log at
+// path and its rotated files.
+func searchAuditFiles(path, id string) ([]auditEvent, error) {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{path}
+	for _, name := range matches {
+		// rotated files are numbered, anything else is not ours
+		if _, err := strconv.Atoi(strings.TrimPrefix(name, path+".")); err == nil {
+			names = append(names, name)
+		}
+	}
+
+	var events []auditEvent
+	for _, name := range names {
+		found, err := searchAuditFile(name, id)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		events = append(events, found...)
+	}
+	return events, nil
+}
+
+func searchAuditFile(name, id string) ([]auditEvent, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	id = normalizeSupportID(id)
+
+	var events []auditEvent
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// only decode lines mentioning the support ID, in either case
+		if !bytes.Contains(bytes.ToLower(s.Bytes()), []byte(id)) {
+			continue
+		}
+
+		var e auditEvent
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if normalizeSupportID(e.SupportID) == id {
+			events = append(events, e)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return events, nil
+}
+
+// queryAdminSupport asks the running agent for the events of the support ID.
+func queryAdminSupport(listen, key, id string) ([]auditEvent, error) {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+
+	u := url.URL{Scheme: "http", Host: net.JoinHostPort(host, port), Path: "/support", RawQuery: url.Values{"id": {id}}.Encode()}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+key)
+
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("admin endpoint responded with status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	var sr supportResponse
+	if err := json.NewDecoder(resp.Body).Decode(&sr); err != nil {
+		return nil, err
+	}
+	return sr.Events, nil
+}
+
+// mergeEvents sorts the events by time and drops those found in both the
+// agent and the audit log.
+func mergeEvents(events []auditEvent) []auditEvent {
+	slices.SortStableFunc(events, func(a, b auditEvent) int { return a.Time.Compare(b.Time) })
+	return slices.CompactFunc(events, func(a, b auditEvent) bool {
+		a.Time, b.Time = a.Time.UTC(), b.Time.UTC()
+		return a == b
+	})
+}
+
+// writeSupportEvents prints one line per event, explaining what happened to
+// the challenges of a support ID.
+func writeSupportEvents(w io.Writer, id string, events []auditEvent) {
+	if len(events) == 0 {
+		fmt.Fprintf(w, "no events for %s\n", id)
+		return
+	}
+
+	for _, e := range events {
+		var what string
+		switch e.Outcome {
+		case auditOutcomeIssued:
+			what = "challenge issued"
+		case auditOutcomeCleared:
+			what = "solved, clearance issued"
+		case auditOutcomeFailed:
+			what = "failed: " + e.ErrorCode
+		default:
+			what = e.Outcome
+		}
+
+		fmt.Fprintf(w, "%s  %-28s frontend=%s host=%s src=%s level=%d validator=%s\n",
+			e.Time.UTC().Format(time.RFC3339), what, e.Frontend, e.Host, e.Src, e.Level, e.Validator)
+	}
+}
+
+// runSupport implements the support subcommand, which looks up a support ID
+// in the running agent and the audit logs.
+func runSupport(arguments []string) {
+	var adminListen, auditPath string
+
+	fs := flag.NewFlagSet("support", flag.ExitOnError)
+	fs.StringVar(&configPath, "config", "config.yaml", "Config file to load")
+	fs.StringVar(&adminListen, "admin", "", "Admin endpoint to query, defaults to the one of the config")
+	fs.StringVar(&auditPath, "audit", "", "Audit log to search, defaults to the one of the config")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s support [flags] <support id>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(arguments)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	id := fs.Arg(0)
+	if !berghain.ValidSupportID([]byte(id)) {
+		Fatal("invalid support id", "id", id)
+	}
+	id = normalizeSupportID(id)
+
+	cfg := loadConfig()
+
+	var events []auditEvent
+	searched := false
+
+	if cfg.Admin != nil && (cfg.Support != nil || adminListen != "") {
+		if adminListen == "" {
+			adminListen = cfg.Admin.Listen
+		}
+		found, err := queryAdminSupport(adminListen, string(cfg.Admin.AsKey()), id)
+		if err != nil {
+			Fatal("failed querying the admin endpoint", "address", adminListen, "error", err)
+		}
+		events = append(events, found...)
+		searched = true
+	}
+
+	if auditPath == "" && cfg.Audit != nil && cfg.Audit.File != nil {
+		auditPath = cfg.Audit.File.Path
+	}
+	if auditPath != "" {
+		found, err := searchAuditFiles(auditPath, id)
+		if err != nil {
+			Fatal("failed searching the audit log", "path", auditPath, "error", err)
+		}
+		events = append(events, found...)
+		searched = true
+	}
+
+	if !searched {
+		Fatal("nothing to search, configure admin with support or an audit file")
+	}
+
+	writeSupportEvents(os.Stdout, id, mergeEvents(events))
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dropmorepackets/haproxy-go/pkg/encoding"
+
+	"github.com/DropMorePackets/berghain"
+)
+
+const (
+	supportIDA = "bh@123e4567-e89b-12d3-a456-426614174000"
+	supportIDB = "bh@123e4567-e89b-12d3-a456-426614174001"
+)
+
+func TestSupportLogRing(t *testing.T) {
+	s := newSupportLog(3)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	event := func(n int, id string) auditEvent {
+		return auditEvent{Time: start.Add(time.Duration(n) * time.Second), SupportID: id, Outcome: auditOutcomeIssued}
+	}
+
+	s.record(event(0, supportIDA))
+	s.record(event(1, supportIDB))
+	s.record(event(2, supportIDA))
+	// events without a support ID are not kept
+	s.record(auditEvent{Outcome: auditOutcomeCleared})
+
+	if got := s.lookup(supportIDA); len(got) != 2 || got[0] != event(0, supportIDA) || got[1] != event(2, supportIDA) {
+		t.Errorf("lookup(A) = %+v", got)
+	}
+
+	// the ring replaces the oldest events
+	s.record(event(3, supportIDB))
+	s.record(event(4, supportIDB))
+	s.record(event(5, supportIDB))
+
+	if got := s.lookup(supportIDA); len(got) != 0 {
+		t.Errorf("lookup(A) after eviction = %+v", got)
+	}
+	if got := s.lookup(supportIDB); len(got) != 3 || got[0] != event(3, supportIDB) || got[2] != event(5, supportIDB) {
+		t.Errorf("lookup(B) = %+v", got)
+	}
+	if len(s.index) != 1 {
+		t.Errorf("index keeps %d support IDs, want 1", len(s.index))
+	}
+
+	// support IDs match in either case
+	upperB := "bh@" + strings.ToUpper(supportIDB[3:])
+	s.record(event(6, upperB))
+	if got := s.lookup(supportIDB); len(got) != 3 || got[2] != event(6, supportIDB) {
+		t.Errorf("lookup(B) after upper-case record = %+v", got)
+	}
+	if got := s.lookup(upperB); len(got) != 3 {
+		t.Errorf("lookup(upper-case B) = %+v", got)
+	}
+
+	var disabled *supportLog
+	disabled.record(event(0, supportIDA))
+	if got := disabled.lookup(supportIDA); got != nil {
+		t.Errorf("disabled lookup = %+v", got)
+	}
+}
+
+func TestSupportChallenge(t *testing.T) {
+	src := netip.MustParseAddr("192.0.2.1").AsSlice()
+	bh := challengeBerghain()
+	// pow issues a challenge before clearing
+	bh.Levels[0].Type = berghain.ValidationTypePOW
+	f := frontend{name: "shop", bh: bh, support: newSupportLog(16)}
+
+	message := challengeMessage(t, src, "example.com",
+		func(w *encoding.KVWriter) error { return w.SetString("session", supportIDA) },
+	)
+	f.HandleSPOEChallenge(context.Background(), encoding.NewActionWriter(make([]byte, 2048), 0), messageArgs(t, message))
+
+	got := f.support.lookup(supportIDA)
+	if len(got) != 1 {
+		t.Fatalf("recorded %d events, want 1", len(got))
+	}
+	if got[0].Outcome != auditOutcomeIssued || got[0].Frontend != "shop" || got[0].Validator != "pow" || got[0].Src != "192.0.2.1" {
+		t.Errorf("event = %+v", got[0])
+	}
+}
+
+func TestAdminSupport(t *testing.T) {
+	const key = "0123456789abcdef0123456789abcdef"
+	i := &instance{c: map[string]*frontend{defaultFrontend: {bh: challengeBerghain()}}}
+	h := i.adminHandler([]byte(key))
+
+	lookup := func(query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/support"+query, nil)
+		r.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := lookup("?id=" + supportIDA); w.Code != http.StatusNotFound {
+		t.Errorf("disabled: status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	i.support = newSupportLog(16)
+	i.support.record(auditEvent{Time: time.Unix(1, 0).UTC(), SupportID: supportIDA, Outcome: auditOutcomeFailed, ErrorCode: "expired"})
+
+	if w := lookup("?id=nope"); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid id: status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	w := lookup("?id=" + supportIDA)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	var resp supportResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ID != supportIDA || len(resp.Events) != 1 || resp.Events[0].ErrorCode != "expired" {
+		t.Errorf("response = %+v", resp)
+	}
+
+	w = lookup("?id=bh@" + strings.ToUpper(supportIDA[3:]))
+	resp = supportResponse{}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ID != supportIDA || len(resp.Events) != 1 {
+		t.Errorf("upper-case id: response = %+v", resp)
+	}
+}
+
+func TestSearchAuditFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.jsonl")
+
+	line := func(e auditEvent) string {
+		b, err := json.Marshal(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b) + "\n"
+	}
+	cleared := auditEvent{Time: time.Unix(2, 0).UTC(), SupportID: supportIDA, Outcome: auditOutcomeCleared}
+	failed := auditEvent{Time: time.Unix(1, 0).UTC(), SupportID: supportIDA, Outcome: auditOutcomeFailed, ErrorCode: "expired"}
+	other := auditEvent{Time: time.Unix(3, 0).UTC(), SupportID: supportIDB, Outcome: auditOutcomeCleared}
+
+	for name, content := range map[string]string{
+		"audit.jsonl":      line(cleared) + line(other),
+		"audit.jsonl.1":    line(failed),
+		"audit.jsonl.gz":   "not ours " + supportIDA,
+		"other.jsonl":      line(failed),
+		"audit.jsonl.2.gz": "not ours " + supportIDA,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	events, err := searchAuditFiles(path, "bh@"+strings.ToUpper(supportIDA[3:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the agent knows the clearance as well
+	events = mergeEvents(append(events, cleared))
+	if len(events) != 2 || events[0] != failed || events[1] != cleared {
+		t.Fatalf("events = %+v", events)
+	}
+
+	var out bytes.Buffer
+	writeSupportEvents(&out, supportIDA, events)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], "failed: expired") || !strings.Contains(lines[1], "solved, clearance issued") {
+		t.Errorf("output:\n%s", out.String())
+	}
+
+	out.Reset()
+	writeSupportEvents(&out, supportIDB, nil)
+	if !strings.HasPrefix(out.String(), "no events for") {
+		t.Errorf("output without events: %q", out.String())
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Traces are exported to an OpenTelemetry collector with OTLP over HTTP in
+// the JSON encoding, see
+// https://opentelemetry.io/docs/specs/otlp/#otlphttp. Spans are only created
+// for sampled traces, so unsampled messages neither allocate nor export.
+
+// spanKind is the OTLP span kind.
+type spanKind int
+
+const (
+	spanKindInternal spanKind = 1
+	spanKindServer   spanKind = 2
+	spanKindClient   spanKind = 3
+)
+
+const (
+	// traceBatchSize is the number of spans exported at once.
+	traceBatchSize = 512
+	// traceQueueSize bounds the spans waiting for export, spans ending
+	// while it is full are dropped.
+	traceQueueSize = 4 * traceBatchSize
+	// traceExportInterval is how often queued spans are exported.
+	traceExportInterval = 5 * time.Second
+)
+
+type tracer struct {
+	endpoint    string
+	headers     map[string]string
+	sampleRatio float64
+	serviceName string
+	client      *http.Client
+
+	spans   chan *span
+	dropped atomic.Uint64
+}
+
+type spanAttr struct {
+	key string
+	str string
+	num int64
+	// isNum selects num over str.
+	isNum bool
+}
+
+// span is a span of a sampled trace. All methods are no-ops on a nil
+// receiver, which is used for unsampled traces and disabled tracing.
+type span struct {
+	t *tracer
+
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     spanKind
+	start    time.Time
+	end      time.Time
+	attrs    []spanAttr
+	err      error
+}
+
+type spanKey struct{}
+
+// spanFromContext returns the span of the context, nil if there is none.
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// startTrace starts the root span of a trace if the trace is sampled.
+func (t *tracer) startTrace(ctx context.Context, name string, kind spanKind) (context.Context, *span) {
+	if t == nil || rand.Float64() >= t.sampleRatio {
+		return ctx, nil
+	}
+
+	s := &span{t: t, name: name, kind: kind, start: time.Now()}
+	randomID(s.traceID[:])
+	randomID(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// startSpan starts a child of the span of the context. Without one, the trace
+// is not sampled and no span is started.
+func startSpan(ctx context.Context, name string, kind spanKind) (context.Context, *span) {
+	parent := spanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+
+	s := &span{t: parent.t, traceID: parent.traceID, parentID: parent.spanID, name: name, kind: kind, start: time.Now()}
+	randomID(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// randomID fills IDs of 8 or 16 bytes, all zero IDs are invalid.
+func randomID(b []byte) {
+	for i := 0; i < len(b); i += 8 {
+		v := rand.Uint64()
+		for v == 0 {
+			v = rand.Uint64()
+		}
+		binary.BigEndian.PutUint64(b[i:], v)
+	}
+}
+
+func (s *span) setString(key, value string) {
+	if s != nil {
+		s.attrs = append(s.attrs, spanAttr{key: key, str: value})
+	}
+}
+
+func (s *span) setInt(key string, value int64) {
+	if s != nil {
+		s.attrs = append(s.attrs, spanAttr{key: key, num: value, isNum: true})
+	}
+}
+
+// setError marks the span as failed.
+func (s *span) setError(err error) {
+	if s != nil {
+		s.err = err
+	}
+}
+
+// finish ends the span and queues it for export.
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+
+	s.end = time.Now()
+	select {
+	case s.t.spans <- s:
+	default:
+		s.t.dropped.Add(1)
+	}
+}
+
+// tracingTransport records the requests of captcha verifications as client
+// spans. The trace context is not propagated to the providers.
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+func (tt tracingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	_, s := startSpan(r.Context(), r.Method, spanKindClient)
+	defer s.finish()
+
+	if s != nil {
+		s.setString("http.request.method", r.Method)
+		s.setString("server.address", r.URL.Hostname())
+		s.setString("url.full", r.URL.Scheme+"://"+r.URL.Host+r.URL.Path)
+	}
+
+	resp, err := tt.base.RoundTrip(r)
+	if err != nil {
+		s.setError(err)
+		return nil, err
+	}
+
+	s.setInt("http.response.status_code", int64(resp.StatusCode))
+	if resp.StatusCode >= http.StatusInternalServerError {
+		s.setError(fmt.Errorf("status %d", resp.StatusCode))
+	}
+	return resp, nil
+}
+
+// run exports the queued spans until the context is done, then exports the
+// remaining ones.
+func (t *tracer) run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	tick := time.NewTicker(traceExportInterval)
+	defer tick.Stop()
+
+	batch := make([]*span, 0, traceBatchSize)
+	export := func(ctx context.Context) {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.export(ctx, batch); err != nil {
+			slog.ErrorContext(ctx, "failed exporting traces", "error", err, "spans", len(batch))
+		}
+		if dropped := t.dropped.Swap(0); dropped > 0 {
+			slog.WarnContext(ctx, "dropped spans, the export queue was full", "spans", dropped)
+		}
+		clear(batch)
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			for len(t.spans) > 0 && len(batch) < traceBatchSize {
+				batch = append(batch, <-t.spans)
+			}
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			export(shutdownCtx)
+			cancel()
+			return
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) == traceBatchSize {
+				export(ctx)
+			}
+		case <-tick.C:
+			export(ctx)
+		}
+	}
+}
+
+func (t *tracer) export(ctx context.Context, spans []*span) error {
+	body, err := json.Marshal(t.request(spans))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// The OTLP JSON encoding, int64 values are encoded as strings and IDs as hex.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttr `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID      string      `json:"traceId"`
+		SpanID       string      `json:"spanId"`
+		ParentSpanID string      `json:"parentSpanId,omitempty"`
+		Name         string      `json:"name"`
+		Kind         spanKind    `json:"kind"`
+		Start        string      `json:"startTimeUnixNano"`
+		End          string      `json:"endTimeUnixNano"`
+		Attributes   []otlpAttr  `json:"attributes,omitempty"`
+		Status       *otlpStatus `json:"status,omitempty"`
+	}
+	otlpAttr struct {
+		Key   string        `json:"key"`
+		Value otlpAttrValue `json:"value"`
+	}
+	otlpAttrValue struct {
+		String *string `json:"stringValue,omitempty"`
+		Int    string  `json:"intValue,omitempty"`
+	}
+	otlpStatus struct {
+		// Code 2 is STATUS_CODE_ERROR.
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+func stringAttr(key, value string) otlpAttr {
+	return otlpAttr{Key: key, Value: otlpAttrValue{String: &value}}
+}
+
+func (t *tracer) request(spans []*span) otlpRequest {
+	out := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		o := otlpSpan{
+			TraceID: hex.EncodeToString(s.traceID[:]),
+			SpanID:  hex.EncodeToString(s.spanID[:]),
+			Name:    s.name,
+			Kind:    s.kind,
+			Start:   strconv.FormatInt(s.start.UnixNano(), 10),
+			End:     strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parentID != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for _, a := range s.attrs {
+			if a.isNum {
+				o.Attributes = append(o.Attributes, otlpAttr{Key: a.key, Value: otlpAttrValue{Int: strconv.FormatInt(a.num, 10)}})
+			} else {
+				o.Attributes = append(o.Attributes, stringAttr(a.key, a.str))
+			}
+		}
+		if s.err != nil {
+			o.Status = &otlpStatus{Code: 2, Message: s.err.Error()}
+		}
+		out[i] = o
+	}
+
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttr{stringAttr("service.name", t.serviceName)}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/DropMorePackets/berghain/cmd/spop"},
+			Spans: out,
+		}},
+	}}}
+}
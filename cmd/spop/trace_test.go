@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/dropmorepackets/haproxy-go/pkg/encoding"
+
+	"github.com/DropMorePackets/berghain"
+)
+
+func testTracer(ratio float64, endpoint string) *tracer {
+	return (TracingConfig{Endpoint: endpoint, SampleRatio: ratio}).AsTracer()
+}
+
+func TestTracerSampling(t *testing.T) {
+	ctx := context.Background()
+
+	if _, s := (*tracer)(nil).startTrace(ctx, "HandleSPOE", spanKindServer); s != nil {
+		t.Error("disabled tracer started a span")
+	}
+	if got, s := testTracer(0, "http://127.0.0.1:4318/v1/traces").startTrace(ctx, "HandleSPOE", spanKindServer); s != nil || got != ctx {
+		t.Error("unsampled trace started a span")
+	}
+	if _, s := startSpan(ctx, "RunValidator", spanKindInternal); s != nil {
+		t.Error("child span started without a sampled parent")
+	}
+
+	// spans of unsampled traces are no-ops
+	var s *span
+	s.setString("k", "v")
+	s.setInt("k", 1)
+	s.finish()
+}
+
+func TestTraceChallengeCaptcha(t *testing.T) {
+	const session = "bh@123e4567-e89b-12d3-a456-426614174000"
+
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"success": true, "hostname": "example.com"}`)
+	}))
+	defer provider.Close()
+
+	bh := berghain.NewBerghain(make([]byte, 32))
+	bh.Levels = []*berghain.LevelConfig{{
+		Duration:         time.Minute,
+		Type:             berghain.ValidationTypeTurnstile,
+		CaptchaSitekey:   "sitekey",
+		CaptchaSecret:    "secret",
+		CaptchaVerifyURL: provider.URL + "/siteverify?unused=1",
+	}}
+	bh.HTTPClient = &http.Client{Transport: tracingTransport{base: http.DefaultTransport}}
+	f := &frontend{name: "shop", bh: bh}
+
+	tr := testTracer(1, "http://127.0.0.1:4318/v1/traces")
+	ctx, root := tr.startTrace(context.Background(), "HandleSPOE", spanKindServer)
+
+	src := netip.MustParseAddr("192.0.2.1")
+	message := encodeMessage(t,
+		func(w *encoding.KVWriter) error { return w.SetInt64("level", 1) },
+		func(w *encoding.KVWriter) error { return w.SetBinary("src", src.AsSlice()) },
+		func(w *encoding.KVWriter) error { return w.SetString("host", "example.com") },
+		func(w *encoding.KVWriter) error { return w.SetString("method", http.MethodPost) },
+		func(w *encoding.KVWriter) error { return w.SetString("body", "widget-token") },
+		func(w *encoding.KVWriter) error { return w.SetString("session", session) },
+	)
+	actions := encoding.NewActionWriter(make([]byte, 2048), 0)
+	f.HandleSPOEChallenge(ctx, actions, messageArgs(t, message))
+	if values := actionValues(t, actions); values["set_cookie"] == nil {
+		t.Fatalf("captcha not solved: %v", values)
+	}
+	root.finish()
+
+	spans := map[string]*span{}
+	for len(tr.spans) > 0 {
+		s := <-tr.spans
+		spans[s.name] = s
+	}
+
+	validator, client := spans["RunValidator"], spans[http.MethodPost]
+	if validator == nil || client == nil || spans["HandleSPOE"] == nil {
+		t.Fatalf("spans = %v", spans)
+	}
+	if validator.parentID != root.spanID || client.parentID != validator.spanID || client.traceID != root.traceID {
+		t.Error("spans are not linked to their parents")
+	}
+	if client.kind != spanKindClient || client.err != nil {
+		t.Errorf("client span kind %d, error %v", client.kind, client.err)
+	}
+
+	attrs := func(s *span) map[string]any {
+		m := map[string]any{}
+		for _, a := range s.attrs {
+			if a.isNum {
+				m[a.key] = a.num
+			} else {
+				m[a.key] = a.str
+			}
+		}
+		return m
+	}
+	if got := attrs(validator); got["berghain.validator.type"] != "turnstile" || got["berghain.level"] != int64(1) || got["berghain.support_id"] != session {
+		t.Errorf("validator span attributes = %v", got)
+	}
+	if got := attrs(client); got["http.response.status_code"] != int64(http.StatusOK) || got["url.full"] != provider.URL+"/siteverify" {
+		t.Errorf("client span attributes = %v", got)
+	}
+}
+
+func TestTracerExport(t *testing.T) {
+	var got otlpRequest
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" || r.Header.Get("X-Token") != "secret" {
+			t.Errorf("unexpected export request %s %v", r.URL, r.Header)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer collector.Close()
+
+	tr := testTracer(1, collector.URL+"/v1/traces")
+	tr.headers = map[string]string{"X-Token": "secret"}
+
+	ctx, root := tr.startTrace(context.Background(), "HandleSPOE", spanKindServer)
+	root.setString("berghain.frontend", "shop")
+	_, child := startSpan(ctx, "RunValidator", spanKindInternal)
+	child.setInt("berghain.level", 2)
+	child.setError(berghain.ErrExpired)
+	child.finish()
+	root.finish()
+
+	if err := tr.export(context.Background(), []*span{<-tr.spans, <-tr.spans}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got.ResourceSpans) != 1 || len(got.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("export = %+v", got)
+	}
+	if res := got.ResourceSpans[0].Resource.Attributes; len(res) != 1 || *res[0].Value.String != "berghain" {
+		t.Errorf("resource attributes = %+v", res)
+	}
+	spans := got.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("spans = %+v", spans)
+	}
+	c, r := spans[0], spans[1]
+	if len(c.TraceID) != 32 || c.TraceID != r.TraceID || c.ParentSpanID != r.SpanID || r.ParentSpanID != "" {
+		t.Errorf("span ids: child %+v, root %+v", c, r)
+	}
+	if c.Status == nil || c.Status.Code != 2 || c.Attributes[0].Value.Int != "2" {
+		t.Errorf("child span = %+v", c)
+	}
+	if *r.Attributes[0].Value.String != "shop" || r.Kind != spanKindServer {
+		t.Errorf("root span = %+v", r)
+	}
+}
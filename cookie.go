@@ -0,0 +1,164 @@
+package berghain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultCookieName is the name of the clearance cookie if none is configured.
+const DefaultCookieName = "berghain"
+
+// CookieSecure controls the Secure attribute of the clearance cookie.
+type CookieSecure int
+
+const (
+	// CookieSecureAuto sets the Secure attribute for requests received over TLS.
+	CookieSecureAuto CookieSecure = iota
+	CookieSecureAlways
+	CookieSecureNever
+)
+
+// Cookie name prefixes with special meaning to browsers, see
+// https://datatracker.ietf.org/doc/html/draft-ietf-httpbis-rfc6265bis#name-cookie-name-prefixes
+const (
+	CookiePrefixHost   = "__Host-"
+	CookiePrefixSecure = "__Secure-"
+)
+
+// CookieConfig describes the Set-Cookie value issued together with a token.
+// The zero value issues a cookie named DefaultCookieName with HttpOnly,
+// SameSite=Lax and a Max-Age matching the level duration.
+type CookieConfig struct {
+	// Name of the cookie without the prefix, defaults to DefaultCookieName.
+	Name string
+	// Prefix is empty, CookiePrefixHost or CookiePrefixSecure.
+	Prefix string
+	Secure CookieSecure
+	// SameSite defaults to http.SameSiteLaxMode, http.SameSiteDefaultMode
+	// omits the attribute.
+	SameSite http.SameSite
+	// ScriptAccess omits the HttpOnly attribute.
+	ScriptAccess bool
+	// Partitioned sets the CHIPS Partitioned attribute.
+	Partitioned bool
+	// Session omits Max-Age, the cookie is dropped when the browser closes.
+	Session bool
+}
+
+var errInvalidCookieConfig = errors.New("invalid cookie config")
+
+// Validate reports configurations browsers would reject.
+func (c *CookieConfig) Validate() error {
+	for _, ch := range []byte(c.Name) {
+		// RFC 6265 cookie-name is an RFC 2616 token
+		if ch <= ' ' || ch >= 0x7f || bytes.IndexByte([]byte(`()<>@,;:\"/[]?={}`), ch) >= 0 {
+			return fmt.Errorf("%w: name %q contains %q", errInvalidCookieConfig, c.Name, ch)
+		}
+	}
+
+	secure := c.Secure == CookieSecureAlways
+	switch c.Prefix {
+	case "":
+	case CookiePrefixHost, CookiePrefixSecure:
+		if !secure {
+			return fmt.Errorf("%w: prefix %s requires the Secure attribute to always be set", errInvalidCookieConfig, c.Prefix)
+		}
+	default:
+		return fmt.Errorf("%w: unknown prefix %q", errInvalidCookieConfig, c.Prefix)
+	}
+
+	if c.SameSite == http.SameSiteNoneMode && !secure {
+		return fmt.Errorf("%w: SameSite=None requires the Secure attribute to always be set", errInvalidCookieConfig)
+	}
+	if c.Partitioned && !secure {
+		return fmt.Errorf("%w: Partitioned requires the Secure attribute to always be set", errInvalidCookieConfig)
+	}
+
+	return nil
+}
+
+// HostOnly reports whether the cookie must not carry a Domain attribute.
+func (c *CookieConfig) HostOnly() bool {
+	return c.Prefix == CookiePrefixHost
+}
+
+func (c *CookieConfig) name() string {
+	if c.Name == "" {
+		return DefaultCookieName
+	}
+	return c.Name
+}
+
+// AppendSetCookie appends the Set-Cookie value for the token to dst. The
+// domain is omitted for host-only cookies, maxAge is the level duration and
+// tls tells whether the request was received over TLS.
+func (c *CookieConfig) AppendSetCookie(dst, token, domain []byte, maxAge time.Duration, tls bool) []byte {
+	dst = append(dst, c.Prefix...)
+	dst = append(dst, c.name()...)
+	dst = append(dst, '=')
+	dst = append(dst, token...)
+
+	if len(domain) > 0 && !c.HostOnly() {
+		dst = append(dst, "; Domain="...)
+		dst = append(dst, domain...)
+	}
+
+	dst = append(dst, "; Path=/"...)
+
+	if !c.Session {
+		dst = append(dst, "; Max-Age="...)
+		dst = strconv.AppendInt(dst, int64(maxAge/time.Second), 10)
+	}
+
+	if c.Secure == CookieSecureAlways || c.Secure == CookieSecureAuto && tls {
+		dst = append(dst, "; Secure"...)
+	}
+
+	if !c.ScriptAccess {
+		dst = append(dst, "; HttpOnly"...)
+	}
+
+	switch c.SameSite {
+	case 0, http.SameSiteLaxMode:
+		dst = append(dst, "; SameSite=Lax"...)
+	case http.SameSiteStrictMode:
+		dst = append(dst, "; SameSite=Strict"...)
+	case http.SameSiteNoneMode:
+		dst = append(dst, "; SameSite=None"...)
+	}
+
+	if c.Partitioned {
+		dst = append(dst, "; Partitioned"...)
+	}
+
+	return dst
+}
+
+// Find returns the value of the configured cookie in a Cookie header, or nil.
+func (c *CookieConfig) Find(header []byte) []byte {
+	return findCookie(header, c.Prefix, c.name())
+}
+
+// findCookie returns the value of the cookie named prefix and name in a
+// Cookie header, or nil.
+func findCookie(header []byte, prefix, name string) []byte {
+	for len(header) > 0 {
+		var pair []byte
+		pair, header, _ = bytes.Cut(header, []byte(";"))
+		pair = bytes.TrimLeft(pair, " \t")
+
+		key, value, ok := bytes.Cut(pair, []byte("="))
+		if !ok || len(key) != len(prefix)+len(name) {
+			continue
+		}
+		if string(key[:len(prefix)]) == prefix && string(key[len(prefix):]) == name {
+			return bytes.TrimRight(value, " \t")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package berghain
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCookieConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  CookieConfig
+		wantErr bool
+	}{
+		{name: "zero value", config: CookieConfig{}},
+		{name: "custom name", config: CookieConfig{Name: "bh_clearance"}},
+		{name: "name with separator", config: CookieConfig{Name: "bh;x"}, wantErr: true},
+		{name: "name with space", config: CookieConfig{Name: "bh x"}, wantErr: true},
+		{name: "host prefix", config: CookieConfig{Prefix: CookiePrefixHost, Secure: CookieSecureAlways}},
+		{name: "host prefix without secure", config: CookieConfig{Prefix: CookiePrefixHost}, wantErr: true},
+		{name: "secure prefix never secure", config: CookieConfig{Prefix: CookiePrefixSecure, Secure: CookieSecureNever}, wantErr: true},
+		{name: "unknown prefix", config: CookieConfig{Prefix: "__Foo-", Secure: CookieSecureAlways}, wantErr: true},
+		{name: "samesite none", config: CookieConfig{SameSite: http.SameSiteNoneMode, Secure: CookieSecureAlways}},
+		{name: "samesite none without secure", config: CookieConfig{SameSite: http.SameSiteNoneMode}, wantErr: true},
+		{name: "partitioned without secure", config: CookieConfig{Partitioned: true}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, errInvalidCookieConfig) {
+				t.Errorf("Validate() error = %v, want errInvalidCookieConfig", err)
+			}
+		})
+	}
+}
+
+func TestCookieConfig_AppendSetCookie(t *testing.T) {
+	tests := []struct {
+		name   string
+		config CookieConfig
+		domain string
+		tls    bool
+		want   string
+	}{
+		{
+			name: "zero value",
+			want: "berghain=tok; Path=/; Max-Age=1800; HttpOnly; SameSite=Lax",
+		},
+		{
+			name:   "domain and tls",
+			domain: "example.com",
+			tls:    true,
+			want:   "berghain=tok; Domain=example.com; Path=/; Max-Age=1800; Secure; HttpOnly; SameSite=Lax",
+		},
+		{
+			name:   "never secure",
+			config: CookieConfig{Secure: CookieSecureNever},
+			tls:    true,
+			want:   "berghain=tok; Path=/; Max-Age=1800; HttpOnly; SameSite=Lax",
+		},
+		{
+			name:   "host prefix drops domain",
+			config: CookieConfig{Prefix: CookiePrefixHost, Secure: CookieSecureAlways},
+			domain: "example.com",
+			want:   "__Host-berghain=tok; Path=/; Max-Age=1800; Secure; HttpOnly; SameSite=Lax",
+		},
+		{
+			name:   "everything",
+			config: CookieConfig{Name: "bh", Prefix: CookiePrefixSecure, Secure: CookieSecureAlways, SameSite: http.SameSiteNoneMode, ScriptAccess: true, Partitioned: true, Session: true},
+			domain: "example.com",
+			want:   "__Secure-bh=tok; Domain=example.com; Path=/; Secure; SameSite=None; Partitioned",
+		},
+		{
+			name:   "omitted samesite",
+			config: CookieConfig{SameSite: http.SameSiteDefaultMode},
+			want:   "berghain=tok; Path=/; Max-Age=1800; HttpOnly",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.config.AppendSetCookie(nil, []byte("tok"), []byte(tt.domain), 30*time.Minute, tt.tls)
+			if string(got) != tt.want {
+				t.Errorf("AppendSetCookie() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCookieConfig_Find(t *testing.T) {
+	tests := []struct {
+		name   string
+		config CookieConfig
+		header string
+		want   string
+	}{
+		{name: "only cookie", header: "berghain=abc", want: "abc"},
+		{name: "among others", header: "a=1; berghain=abc; b=2", want: "abc"},
+		{name: "without spaces", header: "a=1;berghain=abc;b=2", want: "abc"},
+		{name: "suffix match", header: "xberghain=abc", want: ""},
+		{name: "missing", header: "a=1; b=2", want: ""},
+		{name: "empty", header: "", want: ""},
+		{name: "prefixed", config: CookieConfig{Prefix: CookiePrefixHost}, header: "berghain=x; __Host-berghain=abc", want: "abc"},
+		{name: "prefix required", config: CookieConfig{Prefix: CookiePrefixHost}, header: "berghain=abc", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.config.Find([]byte(tt.header)); string(got) != tt.want {
+				t.Errorf("Find(%q) = %q, want %q", tt.header, got, tt.want)
+			}
+		})
+	}
+}
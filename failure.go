@@ -0,0 +1,102 @@
+package berghain
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrorCode is the stable, user-facing code of a failed challenge request.
+// Unlike error messages, codes do not change between releases, so the page
+// and support staff can rely on them.
+type ErrorCode string
+
+const (
+	ErrorCodeExpired            ErrorCode = "expired"
+	ErrorCodeInvalidSolution    ErrorCode = "invalid_solution"
+	ErrorCodeCaptchaUnavailable ErrorCode = "captcha_unavailable"
+	ErrorCodeReplayed           ErrorCode = "replayed"
+	ErrorCodeRateLimited        ErrorCode = "rate_limited"
+	ErrorCodeInvalidRequest     ErrorCode = "invalid_request"
+	ErrorCodeInternal           ErrorCode = "internal"
+)
+
+var (
+	ErrInvalidMethod = fmt.Errorf("invalid method")
+	ErrRateLimited   = fmt.Errorf("rate limited")
+)
+
+// ChallengeErrorCode maps an error returned by RunValidator to its code.
+// Errors without a dedicated code count as invalid solutions for
+// submissions and as internal errors for challenge requests.
+func ChallengeErrorCode(method string, err error) ErrorCode {
+	switch {
+	case errors.Is(err, ErrExpired):
+		return ErrorCodeExpired
+	case errors.Is(err, errCaptchaUnavailable):
+		return ErrorCodeCaptchaUnavailable
+	case errors.Is(err, errCaptchaReplayed):
+		return ErrorCodeReplayed
+	case errors.Is(err, ErrRateLimited):
+		return ErrorCodeRateLimited
+	case errors.Is(err, ErrInvalidMethod):
+		return ErrorCodeInvalidRequest
+	case errors.Is(err, errResponseTooLarge):
+		return ErrorCodeInternal
+	case method == http.MethodPost:
+		return ErrorCodeInvalidSolution
+	default:
+		return ErrorCodeInternal
+	}
+}
+
+// RetryAfter returns the number of seconds after which a client should retry,
+// or -1 if retrying cannot succeed.
+func (c ErrorCode) RetryAfter() int {
+	switch c {
+	case ErrorCodeExpired, ErrorCodeInvalidSolution, ErrorCodeReplayed:
+		// a fresh challenge can be solved right away
+		return 0
+	case ErrorCodeCaptchaUnavailable, ErrorCodeInternal:
+		return 5
+	case ErrorCodeRateLimited:
+		return 30
+	default:
+		return -1
+	}
+}
+
+// Failure is the JSON payload answering a failed challenge request.
+type Failure struct {
+	// Version is set from ProtocolV2 on.
+	Version ProtocolVersion `json:"v,omitempty"`
+	Error   ErrorCode       `json:"e"`
+	// RetryAfter is the number of seconds after which the client should
+	// fetch a new challenge, -1 if retrying cannot succeed.
+	RetryAfter int `json:"a"`
+	// SupportID is set whenever the failed request could be attributed.
+	SupportID string `json:"i,omitempty"`
+}
+
+// WriteFailure replaces the response body with a Failure describing err and
+// returns its code. A token issued before the failure is discarded.
+func WriteFailure(req *ValidatorRequest, resp *ValidatorResponse, err error) ErrorCode {
+	code := ChallengeErrorCode(req.Method, err)
+
+	resp.Body.Reset()
+	resp.Token.Reset()
+
+	w := newJSONWriter(resp.Body)
+	if req.Protocol >= ProtocolV2 {
+		w.Int("v", int(req.Protocol))
+	}
+	w.String("e", []byte(code))
+	w.Int("a", FailureRetryAfter(code, err))
+	if ValidSupportID(req.SupportID) {
+		w.String("i", req.SupportID)
+	}
+	// The failure is small and cannot exceed the response buffer.
+	_ = w.Close()
+
+	return code
+}
@@ -0,0 +1,88 @@
+package berghain
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestChallengeErrorCode(t *testing.T) {
+	tests := []struct {
+		method string
+		err    error
+		want   ErrorCode
+	}{
+		{http.MethodPost, ErrExpired, ErrorCodeExpired},
+		{http.MethodPost, errInvalidSolution, ErrorCodeInvalidSolution},
+		{http.MethodPost, ErrInvalidHMAC, ErrorCodeInvalidSolution},
+		{http.MethodPost, fmt.Errorf("%w: boom", errCaptchaUnavailable), ErrorCodeCaptchaUnavailable},
+		{http.MethodPost, fmt.Errorf("%w: timeout-or-duplicate", errCaptchaReplayed), ErrorCodeReplayed},
+		{http.MethodPost, ErrRateLimited, ErrorCodeRateLimited},
+		{http.MethodGet, ErrRateLimited, ErrorCodeRateLimited},
+		{"PUT", ErrInvalidMethod, ErrorCodeInvalidRequest},
+		{http.MethodGet, ErrInvalidLength, ErrorCodeInternal},
+		{http.MethodGet, errResponseTooLarge, ErrorCodeInternal},
+	}
+
+	for _, tt := range tests {
+		if got := ChallengeErrorCode(tt.method, tt.err); got != tt.want {
+			t.Errorf("ChallengeErrorCode(%s, %v) = %s, want %s", tt.method, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestWriteFailure(t *testing.T) {
+	req, resp := AcquireValidatorRequest(), AcquireValidatorResponse()
+	defer ReleaseValidatorRequest(req)
+	defer ReleaseValidatorResponse(resp)
+
+	req.Method = http.MethodPost
+	req.Protocol = ProtocolV2
+	req.SupportID = []byte("bh@123e4567-e89b-12d3-a456-426614174000")
+	copy(resp.Body.WriteNBytes(4), "junk")
+	copy(resp.Token.WriteNBytes(4), "junk")
+
+	if code := WriteFailure(req, resp, ErrExpired); code != ErrorCodeExpired {
+		t.Errorf("code = %s, want %s", code, ErrorCodeExpired)
+	}
+
+	var failure Failure
+	if err := json.Unmarshal(resp.Body.ReadBytes(), &failure); err != nil {
+		t.Fatalf("decode %q: %v", resp.Body.ReadBytes(), err)
+	}
+
+	want := Failure{
+		Version:    ProtocolV2,
+		Error:      ErrorCodeExpired,
+		RetryAfter: 0,
+		SupportID:  string(req.SupportID),
+	}
+	if failure != want {
+		t.Errorf("failure = %+v, want %+v", failure, want)
+	}
+	if resp.Token.Len() != 0 {
+		t.Errorf("failure must discard the token")
+	}
+}
+
+func TestWriteFailure_withoutSupportID(t *testing.T) {
+	req, resp := AcquireValidatorRequest(), AcquireValidatorResponse()
+	defer ReleaseValidatorRequest(req)
+	defer ReleaseValidatorResponse(resp)
+
+	req.Method = "PUT"
+
+	WriteFailure(req, resp, ErrInvalidMethod)
+
+	var failure Failure
+	if err := json.Unmarshal(resp.Body.ReadBytes(), &failure); err != nil {
+		t.Fatalf("decode %q: %v", resp.Body.ReadBytes(), err)
+	}
+	if failure.Version != 0 || failure.SupportID != "" || failure.RetryAfter != -1 {
+		t.Errorf("unexpected failure: %+v", failure)
+	}
+	if failure.Error != ErrorCodeInvalidRequest {
+		t.Errorf("code = %s, want %s", failure.Error, ErrorCodeInvalidRequest)
+	}
+}
@@ -0,0 +1,170 @@
+package berghain
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoIPResult holds the signals found for an address. Fields are zero if
+// unknown or if no loaded database provides them.
+type GeoIPResult struct {
+	// Country is the ISO 3166-1 alpha-2 code of the country.
+	Country string
+	// ASN is the autonomous system number announcing the address.
+	ASN uint32
+}
+
+// mmdbRecord covers the fields used from GeoLite2/GeoIP2 Country, City and
+// ASN databases, so any of them can be loaded.
+type mmdbRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	ASN uint32 `maxminddb:"autonomous_system_number"`
+}
+
+// GeoIP looks up addresses in local MaxMind DB files. The files are read
+// into memory, so they can be replaced on disk and picked up with Reload.
+type GeoIP struct {
+	files []*geoIPFile
+}
+
+type geoIPFile struct {
+	path string
+	db   atomic.Pointer[geoIPDB]
+}
+
+type geoIPDB struct {
+	reader  *maxminddb.Reader
+	modTime time.Time
+	size    int64
+
+	// records caches decoded records by their data offset. Databases are
+	// normalized, many networks share a record, so the cache is bounded
+	// by the number of distinct records in the file.
+	mu      sync.RWMutex
+	records map[uintptr]GeoIPResult
+}
+
+// OpenGeoIP loads the given MaxMind DB files, e.g. a country and an ASN
+// database. Later files take precedence for fields found in several files.
+func OpenGeoIP(paths ...string) (*GeoIP, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("no geoip database given")
+	}
+
+	g := &GeoIP{}
+	for _, p := range paths {
+		f := &geoIPFile{path: p}
+		if _, err := f.load(); err != nil {
+			return nil, err
+		}
+		g.files = append(g.files, f)
+	}
+
+	return g, nil
+}
+
+// load reads the file if it changed since it was last read.
+func (f *geoIPFile) load() (bool, error) {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return false, fmt.Errorf("geoip database %s: %w", f.path, err)
+	}
+
+	if old := f.db.Load(); old != nil && old.modTime.Equal(fi.ModTime()) && old.size == fi.Size() {
+		return false, nil
+	}
+
+	b, err := os.ReadFile(f.path)
+	if err != nil {
+		return false, fmt.Errorf("geoip database %s: %w", f.path, err)
+	}
+
+	r, err := maxminddb.FromBytes(b)
+	if err != nil {
+		return false, fmt.Errorf("geoip database %s: %w", f.path, err)
+	}
+
+	f.db.Store(&geoIPDB{
+		reader:  r,
+		modTime: fi.ModTime(),
+		size:    fi.Size(),
+		records: make(map[uintptr]GeoIPResult),
+	})
+
+	return true, nil
+}
+
+// Reload reads all files that changed on disk since they were last read and
+// reports whether any did. Files that fail to load keep their previous data.
+func (g *GeoIP) Reload() (bool, error) {
+	var changed bool
+	var errs []error
+	for _, f := range g.files {
+		c, err := f.load()
+		changed = changed || c
+		errs = append(errs, err)
+	}
+
+	return changed, errors.Join(errs...)
+}
+
+// Lookup returns the signals for the address. Addresses not contained in any
+// database yield the zero value.
+func (g *GeoIP) Lookup(addr netip.Addr) GeoIPResult {
+	var res GeoIPResult
+	for _, f := range g.files {
+		r := f.db.Load().lookup(addr)
+		if r.Country != "" {
+			res.Country = r.Country
+		}
+		if r.ASN != 0 {
+			res.ASN = r.ASN
+		}
+	}
+
+	return res
+}
+
+func (db *geoIPDB) lookup(addr netip.Addr) GeoIPResult {
+	var offset uintptr
+	var err error
+	if addr = addr.Unmap(); addr.Is4() {
+		ip := addr.As4()
+		offset, err = db.reader.LookupOffset(net.IP(ip[:]))
+	} else {
+		ip := addr.As16()
+		offset, err = db.reader.LookupOffset(net.IP(ip[:]))
+	}
+	if err != nil || offset == maxminddb.NotFound {
+		return GeoIPResult{}
+	}
+
+	db.mu.RLock()
+	res, ok := db.records[offset]
+	db.mu.RUnlock()
+	if ok {
+		return res
+	}
+
+	var rec mmdbRecord
+	if err := db.reader.Decode(offset, &rec); err != nil {
+		return GeoIPResult{}
+	}
+	res = GeoIPResult{Country: rec.Country.ISOCode, ASN: rec.ASN}
+
+	db.mu.Lock()
+	db.records[offset] = res
+	db.mu.Unlock()
+
+	return res
+}
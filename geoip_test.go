@@ -0,0 +1,328 @@
+package berghain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+var updateFixtures = flag.Bool("update", false, "regenerate the testdata fixtures")
+
+// The fixtures are small MaxMind DB files generated by mmdbWrite, shared with
+// the agent tests. Regenerate them with go test -run TestGeoIPFixtures -update.
+var geoIPFixtures = []struct {
+	path    string
+	dbType  string
+	records []mmdbFixtureRecord
+}{
+	{
+		path:   "testdata/geoip/country.mmdb",
+		dbType: "GeoLite2-Country",
+		records: []mmdbFixtureRecord{
+			{netip.MustParsePrefix("192.0.2.0/24"), map[string]any{"country": map[string]any{"iso_code": "DE"}}},
+			{netip.MustParsePrefix("198.51.100.0/24"), map[string]any{"country": map[string]any{"iso_code": "US"}}},
+			{netip.MustParsePrefix("2001:db8::/32"), map[string]any{"country": map[string]any{"iso_code": "NL"}}},
+		},
+	},
+	{
+		path:   "testdata/geoip/asn.mmdb",
+		dbType: "GeoLite2-ASN",
+		records: []mmdbFixtureRecord{
+			{netip.MustParsePrefix("192.0.2.0/25"), map[string]any{"autonomous_system_number": uint32(64500), "autonomous_system_organization": "Example Hosting"}},
+			{netip.MustParsePrefix("2001:db8:1::/48"), map[string]any{"autonomous_system_number": uint32(64501), "autonomous_system_organization": "Example Transit"}},
+		},
+	},
+}
+
+func TestGeoIPFixtures(t *testing.T) {
+	for _, f := range geoIPFixtures {
+		want := mmdbWrite(f.dbType, f.records)
+		r, err := maxminddb.FromBytes(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Verify(); err != nil {
+			t.Fatalf("%s: %v", f.path, err)
+		}
+
+		if *updateFixtures {
+			if err := os.MkdirAll(filepath.Dir(f.path), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(f.path, want, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+
+		got, err := os.ReadFile(f.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s is outdated, regenerate it with -update", f.path)
+		}
+	}
+}
+
+func TestGeoIP_Lookup(t *testing.T) {
+	g, err := OpenGeoIP("testdata/geoip/country.mmdb", "testdata/geoip/asn.mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		addr string
+		want GeoIPResult
+	}{
+		{addr: "192.0.2.1", want: GeoIPResult{Country: "DE", ASN: 64500}},
+		{addr: "192.0.2.200", want: GeoIPResult{Country: "DE"}},
+		{addr: "::ffff:192.0.2.1", want: GeoIPResult{Country: "DE", ASN: 64500}},
+		{addr: "198.51.100.7", want: GeoIPResult{Country: "US"}},
+		{addr: "2001:db8:1::1", want: GeoIPResult{Country: "NL", ASN: 64501}},
+		{addr: "2001:db8:2::1", want: GeoIPResult{Country: "NL"}},
+		{addr: "203.0.113.1", want: GeoIPResult{}},
+		{addr: "2001:db9::1", want: GeoIPResult{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			addr := netip.MustParseAddr(tt.addr)
+			// the second lookup is served from the record cache
+			for i := 0; i < 2; i++ {
+				if got := g.Lookup(addr); got != tt.want {
+					t.Errorf("Lookup(%s) = %+v, want %+v", addr, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestGeoIP_Reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	write := func(country string, mtime time.Time) {
+		t.Helper()
+		b := mmdbWrite("GeoLite2-Country", []mmdbFixtureRecord{
+			{netip.MustParsePrefix("192.0.2.0/24"), map[string]any{"country": map[string]any{"iso_code": country}}},
+		})
+		if err := os.WriteFile(path, b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Now().Add(-time.Hour)
+	write("DE", start)
+	g, err := OpenGeoIP(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := netip.MustParseAddr("192.0.2.1")
+
+	if changed, err := g.Reload(); changed || err != nil {
+		t.Fatalf("Reload() of unchanged file = %v, %v", changed, err)
+	}
+
+	write("FR", start.Add(time.Minute))
+	if changed, err := g.Reload(); !changed || err != nil {
+		t.Fatalf("Reload() of changed file = %v, %v", changed, err)
+	}
+	if got := g.Lookup(addr).Country; got != "FR" {
+		t.Errorf("country after reload = %s, want FR", got)
+	}
+
+	if err := os.WriteFile(path, []byte("garbage"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Reload(); err == nil {
+		t.Errorf("Reload() of corrupt file succeeded")
+	}
+	if got := g.Lookup(addr).Country; got != "FR" {
+		t.Errorf("country after failed reload = %s, want FR", got)
+	}
+}
+
+func TestGeoIP_LookupAllocs(t *testing.T) {
+	g, err := OpenGeoIP("testdata/geoip/country.mmdb", "testdata/geoip/asn.mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v4, v6 := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8:1::1")
+	g.Lookup(v4)
+	g.Lookup(v6)
+
+	if allocs := testing.AllocsPerRun(100, func() {
+		g.Lookup(v4)
+		g.Lookup(v6)
+	}); allocs != 0 {
+		t.Errorf("Lookup allocates %v times", allocs)
+	}
+}
+
+func BenchmarkGeoIP_Lookup(b *testing.B) {
+	g, err := OpenGeoIP("testdata/geoip/country.mmdb", "testdata/geoip/asn.mmdb")
+	if err != nil {
+		b.Fatal(err)
+	}
+	addr := netip.MustParseAddr("192.0.2.1")
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		g.Lookup(addr)
+	}
+}
+
+type mmdbFixtureRecord struct {
+	prefix netip.Prefix
+	data   map[string]any
+}
+
+// mmdbWrite builds an IPv6 MaxMind DB with 24 bit records, see
+// https://maxmind.github.io/MaxMind-DB/. IPv4 networks are stored in ::/96.
+func mmdbWrite(dbType string, records []mmdbFixtureRecord) []byte {
+	const empty = -1
+
+	// each node holds two records, a child node index or a data offset
+	type record struct {
+		node int
+		data int
+	}
+	nodes := [][2]record{{{data: empty}, {data: empty}}}
+
+	var data []byte
+	for _, r := range records {
+		offset := len(data)
+		data = mmdbEncode(data, r.data)
+
+		var ip [16]byte
+		bits := r.prefix.Bits()
+		if r.prefix.Addr().Is4() {
+			a := r.prefix.Addr().As4()
+			copy(ip[12:], a[:])
+			bits += 96
+		} else {
+			ip = r.prefix.Addr().As16()
+		}
+
+		node := 0
+		for i := 0; i < bits; i++ {
+			bit := ip[i/8] >> (7 - i%8) & 1
+			if i == bits-1 {
+				nodes[node][bit] = record{data: offset}
+				break
+			}
+			if nodes[node][bit].node == 0 {
+				nodes = append(nodes, [2]record{{data: empty}, {data: empty}})
+				nodes[node][bit] = record{node: len(nodes) - 1}
+			}
+			node = nodes[node][bit].node
+		}
+	}
+
+	var b []byte
+	for _, n := range nodes {
+		for _, r := range n {
+			v := len(nodes)
+			switch {
+			case r.node != 0:
+				v = r.node
+			case r.data != empty:
+				v = len(nodes) + 16 + r.data
+			}
+			b = append(b, byte(v>>16), byte(v>>8), byte(v))
+		}
+	}
+
+	b = append(b, make([]byte, 16)...)
+	b = append(b, data...)
+	b = append(b, "\xab\xcd\xefMaxMind.com"...)
+	return mmdbEncode(b, map[string]any{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(1767225600),
+		"database_type":               dbType,
+		"description":                 map[string]any{"en": "berghain test fixture"},
+		"languages":                   []string{"en"},
+		"ip_version":                  uint16(6),
+		"node_count":                  uint32(len(nodes)),
+		"record_size":                 uint16(24),
+	})
+}
+
+func mmdbEncode(b []byte, v any) []byte {
+	switch v := v.(type) {
+	case string:
+		b = mmdbControl(b, 2, len(v))
+		return append(b, v...)
+	case uint16:
+		return mmdbUint(b, 5, uint64(v))
+	case uint32:
+		return mmdbUint(b, 6, uint64(v))
+	case uint64:
+		return mmdbUint(b, 9, v)
+	case []string:
+		b = mmdbControl(b, 11, len(v))
+		for _, e := range v {
+			b = mmdbEncode(b, e)
+		}
+		return b
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+
+		b = mmdbControl(b, 7, len(v))
+		for _, k := range keys {
+			b = mmdbEncode(b, k)
+			b = mmdbEncode(b, v[k])
+		}
+		return b
+	default:
+		panic("unsupported mmdb type")
+	}
+}
+
+func mmdbUint(b []byte, typ int, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	payload := bytes.TrimLeft(buf[:], "\x00")
+	b = mmdbControl(b, typ, len(payload))
+	return append(b, payload...)
+}
+
+func mmdbControl(b []byte, typ, size int) []byte {
+	var ctrl byte
+	if typ <= 7 {
+		ctrl = byte(typ) << 5
+	}
+
+	var extra []byte
+	switch {
+	case size < 29:
+		ctrl |= byte(size)
+	case size < 285:
+		ctrl |= 29
+		extra = []byte{byte(size - 29)}
+	default:
+		ctrl |= 30
+		extra = []byte{byte((size - 285) >> 8), byte(size - 285)}
+	}
+
+	b = append(b, ctrl)
+	if typ > 7 {
+		b = append(b, byte(typ-7))
+	}
+	return append(b, extra...)
+}
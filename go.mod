@@ -7,4 +7,7 @@ toolchain go1.23.2
 require (
 	github.com/dropmorepackets/haproxy-go v0.0.7
 	github.com/goccy/go-yaml v1.18.0
+	github.com/oschwald/maxminddb-golang v1.13.1
 )
+
+require golang.org/x/sys v0.21.0 // indirect
@@ -1,13 +1,15 @@
 package berghain
 
 import (
-	"bytes"
+	"crypto/hmac"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net/netip"
 	"sync"
+	"time"
 
 	"github.com/dropmorepackets/haproxy-go/pkg/buffer"
 )
@@ -75,6 +77,38 @@ func (ri RequestIdentifier) WriteTo(h io.Writer) (int64, error) {
 }
 
 func (ri RequestIdentifier) ToCookie(b *Berghain, enc *buffer.SliceBuffer) error {
+	return ri.writeCookie(b, enc, tc.Now().Add(b.LevelConfig(ri.Level).Duration))
+}
+
+var errInvalidMint = errors.New("invalid cookie mint request")
+
+// MintCookie writes a cookie for the request identity at level that expires
+// after ttl, independently of the duration of the level, and returns the
+// expiration written to the cookie. It lets trusted applications grant
+// clearance to users they already know. The host has to be the one validate
+// messages check, i.e. the trusted domain if the host is part of one.
+func (b *Berghain) MintCookie(ri RequestIdentifier, level uint8, ttl time.Duration, enc *buffer.SliceBuffer) (time.Time, error) {
+	switch {
+	case !ri.SrcAddr.IsValid():
+		return time.Time{}, fmt.Errorf("%w: missing source address", errInvalidMint)
+	case len(ri.Host) == 0:
+		return time.Time{}, fmt.Errorf("%w: missing host", errInvalidMint)
+	case level == 0 || int(level) > len(b.Levels):
+		return time.Time{}, fmt.Errorf("%w: level %d is not configured", errInvalidMint, level)
+	case ttl <= 0:
+		return time.Time{}, fmt.Errorf("%w: ttl must be positive", errInvalidMint)
+	}
+
+	ri.Level = level
+	// the expiration is stored in seconds
+	expiresAt := time.Unix(tc.Now().Add(ttl).Unix(), 0)
+	if err := ri.writeCookie(b, enc, expiresAt); err != nil {
+		return time.Time{}, err
+	}
+	return expiresAt, nil
+}
+
+func (ri RequestIdentifier) writeCookie(b *Berghain, enc *buffer.SliceBuffer, expireAt time.Time) error {
 	raw := AcquireCookieBuffer()
 	defer ReleaseCookieBuffer(raw)
 
@@ -109,8 +143,7 @@ func (ri RequestIdentifier) ToCookie(b *Berghain, enc *buffer.SliceBuffer) error
 	// Write a spacer to the output.
 	enc.WriteNBytes(1)[0] = '|'
 
-	// Calculate the expiration of the cookie, write it to the buffer and hash.
-	expireAt := tc.Now().Add(b.LevelConfig(ri.Level).Duration)
+	// Write the expiration of the cookie to the buffer and hash.
 	binary.LittleEndian.PutUint64(raw.WriteNBytes(8), uint64(expireAt.Unix()))
 	if _, err := h.Write(raw.ReadBytes()); err != nil {
 		return err
@@ -132,23 +165,75 @@ func (ri RequestIdentifier) ToCookie(b *Berghain, enc *buffer.SliceBuffer) error
 }
 
 var (
-	ErrEmpty         = fmt.Errorf("empty")
-	ErrInvalidLength = fmt.Errorf("invalid length")
-	ErrLevelTooLow   = fmt.Errorf("cookie level too low")
-	ErrExpired       = fmt.Errorf("expired")
-	ErrInvalidHMAC   = fmt.Errorf("invalid hmac")
+	ErrEmpty           = fmt.Errorf("empty")
+	ErrInvalidLength   = fmt.Errorf("invalid length")
+	ErrInvalidEncoding = fmt.Errorf("invalid encoding")
+	ErrLevelTooLow     = fmt.Errorf("cookie level too low")
+	ErrExpired         = fmt.Errorf("expired")
+	ErrInvalidHMAC     = fmt.Errorf("invalid hmac")
+	ErrRevoked         = fmt.Errorf("revoked")
 )
 
+// CookieErrorReason returns the stable reason reported to HAProxy for an
+// error returned by ValidateCookie, or an empty string for a valid cookie.
+func CookieErrorReason(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrEmpty):
+		return "empty"
+	case errors.Is(err, ErrInvalidLength):
+		return "invalid_length"
+	case errors.Is(err, ErrInvalidEncoding):
+		return "invalid_encoding"
+	case errors.Is(err, ErrLevelTooLow):
+		return "level_too_low"
+	case errors.Is(err, ErrExpired):
+		return "expired"
+	case errors.Is(err, ErrInvalidHMAC):
+		return "invalid_hmac"
+	case errors.Is(err, ErrRevoked):
+		return "revoked"
+	default:
+		return "internal"
+	}
+}
+
+// CookieClaims are the values vouched for by an authentic cookie.
+type CookieClaims struct {
+	Level     uint8
+	ExpiresAt time.Time
+
+	// sum is the decoded HMAC of the cookie, revocations are keyed on it.
+	sum revokedSum
+}
+
+// ExpiresIn returns the time left until the cookie expires,
+// negative durations for expired cookies.
+func (c CookieClaims) ExpiresIn() time.Duration {
+	return c.ExpiresAt.Sub(tc.Now())
+}
+
 func (b *Berghain) IsValidCookie(ri RequestIdentifier, cookie []byte) error {
+	_, err := b.ValidateCookie(ri, cookie)
+	return err
+}
+
+// ValidateCookie validates the cookie like IsValidCookie and also returns its
+// claims. Claims are only returned for authentic cookies, so a reason like
+// ErrExpired, ErrLevelTooLow or ErrRevoked cannot be forged.
+func (b *Berghain) ValidateCookie(ri RequestIdentifier, cookie []byte) (CookieClaims, error) {
+	var claims CookieClaims
+
 	lc := len(cookie)
 
 	if lc == 0 {
 		// cookie either not set or set with empty value
-		return ErrEmpty
+		return claims, ErrEmpty
 	}
 
 	if lc != encodedCookieSize {
-		return ErrInvalidLength
+		return claims, ErrInvalidLength
 	}
 
 	dec := AcquireCookieBuffer()
@@ -158,7 +243,7 @@ func (b *Berghain) IsValidCookie(ri RequestIdentifier, cookie []byte) error {
 	defer b.releaseHMAC(h)
 
 	if _, err := h.Write(ri.Host); err != nil {
-		return err
+		return claims, err
 	}
 
 	// Write SrcAddr first to the buffer and then to the hash.
@@ -166,7 +251,7 @@ func (b *Berghain) IsValidCookie(ri RequestIdentifier, cookie []byte) error {
 	addrSlice := dec.WriteBytes()[:0] // reset capacity to zero
 	addrSlice = ri.SrcAddr.AppendTo(addrSlice)
 	if _, err := h.Write(addrSlice); err != nil {
-		return err
+		return claims, err
 	}
 	dec.Reset()
 
@@ -176,45 +261,51 @@ func (b *Berghain) IsValidCookie(ri RequestIdentifier, cookie []byte) error {
 	cookieBuf.AdvanceR(1) // Separator
 	levelArea := dec.WriteNBytes(hex.DecodedLen(len(cookieLevel)))
 	if _, err := hex.Decode(levelArea, cookieLevel); err != nil {
-		return err
+		return claims, ErrInvalidEncoding
 	}
 
-	// Untrusted input is compared!
-	if ri.Level > dec.ReadBytes()[0] {
-		return ErrLevelTooLow
+	if _, err := h.Write(levelArea); err != nil {
+		return claims, err
 	}
 
-	if _, err := h.Write(dec.ReadBytes()); err != nil {
-		return err
-	}
-	dec.Reset()
-
 	cookieExpiration := cookieBuf.ReadNBytes(hex.EncodedLen(8))
 	cookieBuf.AdvanceR(1) // Separator
 	expirArea := dec.WriteNBytes(hex.DecodedLen(len(cookieExpiration)))
 	if _, err := hex.Decode(expirArea, cookieExpiration); err != nil {
-		return err
+		return claims, ErrInvalidEncoding
 	}
 
-	// Untrusted input is decoded and compared!
-	if uint64(tc.Now().Unix()) > binary.LittleEndian.Uint64(dec.ReadBytes()) {
-		return ErrExpired
+	if _, err := h.Write(expirArea); err != nil {
+		return claims, err
 	}
 
-	if _, err := h.Write(dec.ReadBytes()); err != nil {
-		return err
-	}
-	dec.Reset()
-
 	cookieSum := cookieBuf.ReadBytes()
 	sumArea := dec.WriteNBytes(hex.DecodedLen(len(cookieSum)))
 	if _, err := hex.Decode(sumArea, cookieSum); err != nil {
-		return err
+		return claims, ErrInvalidEncoding
 	}
 
-	if !bytes.Equal(h.Sum(nil), dec.ReadBytes()) {
-		return ErrInvalidHMAC
+	if !hmac.Equal(h.Sum(nil), sumArea) {
+		return claims, ErrInvalidHMAC
 	}
 
-	return nil
+	// The level and expiration are authentic from here on.
+	expireAt := binary.LittleEndian.Uint64(expirArea)
+	claims.Level = levelArea[0]
+	claims.ExpiresAt = time.Unix(int64(expireAt), 0)
+	copy(claims.sum[:], sumArea)
+
+	if b.Revocations != nil && b.Revocations.Revoked(claims.sum[:]) {
+		return claims, ErrRevoked
+	}
+
+	if ri.Level > claims.Level {
+		return claims, ErrLevelTooLow
+	}
+
+	if uint64(tc.Now().Unix()) > expireAt {
+		return claims, ErrExpired
+	}
+
+	return claims, nil
 }
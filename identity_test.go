@@ -1,7 +1,14 @@
 package berghain
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding"
+	"errors"
+	"fmt"
+	"hash"
 	"net/netip"
+	"sync"
 	"testing"
 	"time"
 )
@@ -34,6 +41,12 @@ func BenchmarkRequestIdentifier_ToCookie(b *testing.B) {
 	})
 }
 
+// benchmarkCookieHosts cover hosts within and beyond a SHA-256 block.
+var benchmarkCookieHosts = []string{
+	"example.com",
+	"a-rather-long-subdomain.of-a-long-registered-domain.example.com",
+}
+
 func BenchmarkRequestIdentifier_IsValidCookie(b *testing.B) {
 	bh := NewBerghain(generateSecret(b))
 
@@ -44,24 +57,270 @@ func BenchmarkRequestIdentifier_IsValidCookie(b *testing.B) {
 		},
 	}
 
-	var ri = RequestIdentifier{
+	for _, host := range benchmarkCookieHosts {
+		var ri = RequestIdentifier{
+			SrcAddr: netip.MustParseAddr("1.2.3.4"),
+			Host:    []byte(host),
+			Level:   1,
+		}
+
+		cb := AcquireCookieBuffer()
+		if err := ri.ToCookie(bh, cb); err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(fmt.Sprintf("host=%d", len(host)), func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := bh.IsValidCookie(ri, cb.ReadBytes()); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+		ReleaseCookieBuffer(cb)
+	}
+}
+
+// midstateHMAC is the cached midstate alternative to acquireHMAC compared by
+// BenchmarkCookieHMAC: the SHA-256 states after the inner key pad and the
+// host, and after the outer key pad, restored for every cookie.
+type midstateHMAC struct {
+	inner, outer []byte
+}
+
+func newMidstateHMAC(tb testing.TB, key, host []byte) midstateHMAC {
+	ipad, opad := make([]byte, sha256.BlockSize), make([]byte, sha256.BlockSize)
+	copy(ipad, key)
+	copy(opad, key)
+	for i := range ipad {
+		ipad[i] ^= 0x36
+		opad[i] ^= 0x5c
+	}
+
+	var m midstateHMAC
+	var err error
+	h := sha256.New()
+	h.Write(ipad)
+	h.Write(host)
+	if m.inner, err = h.(encoding.BinaryMarshaler).MarshalBinary(); err != nil {
+		tb.Fatal(err)
+	}
+	h.Reset()
+	h.Write(opad)
+	if m.outer, err = h.(encoding.BinaryMarshaler).MarshalBinary(); err != nil {
+		tb.Fatal(err)
+	}
+	return m
+}
+
+// sum appends the HMAC of the host and data to b, restoring the states into h.
+func (m midstateHMAC) sum(h hash.Hash, b, data []byte) []byte {
+	u := h.(encoding.BinaryUnmarshaler)
+	if err := u.UnmarshalBinary(m.inner); err != nil {
+		panic(err)
+	}
+	h.Write(data)
+	inner := h.Sum(b)
+	if err := u.UnmarshalBinary(m.outer); err != nil {
+		panic(err)
+	}
+	h.Write(inner[len(b):])
+	return h.Sum(b)
+}
+
+// BenchmarkCookieHMAC compares the pooled HMAC of cookies against restoring a
+// per host midstate. The host is the only input a midstate could cover, the
+// source address, level and expiration differ for every cookie.
+func BenchmarkCookieHMAC(b *testing.B) {
+	bh := NewBerghain(generateSecret(b))
+	data := append(netip.MustParseAddr("1.2.3.4").AppendTo(nil), 1, 0, 0, 0, 0, 0x65, 0x53, 0xf1, 0x00)
+
+	for _, s := range benchmarkCookieHosts {
+		host := []byte(s)
+		m := newMidstateHMAC(b, bh.secret, host)
+
+		h := bh.acquireHMAC()
+		h.Write(host)
+		h.Write(data)
+		want := append([]byte(nil), h.Sum(nil)...)
+		bh.releaseHMAC(h)
+		if got := m.sum(sha256.New(), nil, data); !bytes.Equal(got, want) {
+			b.Fatalf("midstate sum = %x, want %x", got, want)
+		}
+
+		b.Run(fmt.Sprintf("pooled/host=%d", len(host)), func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					h := bh.acquireHMAC()
+					h.Write(host)
+					h.Write(data)
+					h.Sum(nil)
+					bh.releaseHMAC(h)
+				}
+			})
+		})
+		b.Run(fmt.Sprintf("midstate/host=%d", len(host)), func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				h, sum := sha256.New(), make([]byte, 0, sha256.Size)
+				for pb.Next() {
+					m.sum(h, sum, data)
+				}
+			})
+		})
+		// the midstates of a cache have to be looked up by host first
+		var mu sync.RWMutex
+		cache := map[string]midstateHMAC{s: m}
+		b.Run(fmt.Sprintf("midstate-cache/host=%d", len(host)), func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				h, sum := sha256.New(), make([]byte, 0, sha256.Size)
+				for pb.Next() {
+					mu.RLock()
+					m := cache[string(host)]
+					mu.RUnlock()
+					m.sum(h, sum, data)
+				}
+			})
+		})
+	}
+}
+
+func TestBerghain_ValidateCookie(t *testing.T) {
+	bh := NewBerghain(generateSecret(t))
+	bh.Levels = []*LevelConfig{
+		{Duration: time.Minute, Type: ValidationTypeNone},
+		{Duration: -time.Minute, Type: ValidationTypeNone},
+		{Duration: time.Minute, Type: ValidationTypeNone},
+	}
+
+	ri := RequestIdentifier{
 		SrcAddr: netip.MustParseAddr("1.2.3.4"),
 		Host:    []byte("example.com"),
 		Level:   1,
 	}
+	cookie := func(level uint8) []byte {
+		ri := ri
+		ri.Level = level
+		cb := AcquireCookieBuffer()
+		defer ReleaseCookieBuffer(cb)
+		if err := ri.ToCookie(bh, cb); err != nil {
+			t.Fatal(err)
+		}
+		return bytes.Clone(cb.ReadBytes())
+	}
+	// tamper replaces a hex digit, v == 0 picks a different valid digit.
+	tamper := func(c []byte, i int, v byte) []byte {
+		c = bytes.Clone(c)
+		if v == 0 {
+			v = '0'
+			if c[i] == '0' {
+				v = '1'
+			}
+		}
+		c[i] = v
+		return c
+	}
+
+	tests := []struct {
+		name       string
+		level      uint8
+		cookie     []byte
+		wantErr    error
+		wantReason string
+		wantClaims bool
+	}{
+		{name: "valid", level: 1, cookie: cookie(1), wantClaims: true},
+		{name: "higher level", level: 1, cookie: cookie(3), wantClaims: true},
+		{name: "upper-case hex", level: 1, cookie: bytes.ToUpper(cookie(1)), wantClaims: true},
+		{name: "empty", level: 1, wantErr: ErrEmpty, wantReason: "empty"},
+		{name: "short", level: 1, cookie: []byte("01|"), wantErr: ErrInvalidLength, wantReason: "invalid_length"},
+		{name: "level too low", level: 3, cookie: cookie(1), wantErr: ErrLevelTooLow, wantReason: "level_too_low", wantClaims: true},
+		{name: "expired", level: 1, cookie: cookie(2), wantErr: ErrExpired, wantReason: "expired", wantClaims: true},
+		{name: "forged level", level: 2, cookie: tamper(cookie(1), 1, '3'), wantErr: ErrInvalidHMAC, wantReason: "invalid_hmac"},
+		{name: "forged expiration", level: 1, cookie: tamper(cookie(2), 10, 0), wantErr: ErrInvalidHMAC, wantReason: "invalid_hmac"},
+		{name: "invalid hex", level: 1, cookie: tamper(cookie(1), 0, 'x'), wantErr: ErrInvalidEncoding, wantReason: "invalid_encoding"},
+		{name: "invalid hex sum", level: 1, cookie: tamper(cookie(1), encodedCookieSize-1, 'x'), wantErr: ErrInvalidEncoding, wantReason: "invalid_encoding"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ri := ri
+			ri.Level = tt.level
+
+			claims, err := bh.ValidateCookie(ri, tt.cookie)
+			if err != tt.wantErr {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if got := CookieErrorReason(err); got != tt.wantReason {
+				t.Errorf("reason = %q, want %q", got, tt.wantReason)
+			}
+			if got := claims.Level != 0; got != tt.wantClaims {
+				t.Errorf("claims = %+v, want claims: %v", claims, tt.wantClaims)
+			}
+		})
+	}
+}
+
+func TestCookieClaims_ExpiresIn(t *testing.T) {
+	c := CookieClaims{Level: 1, ExpiresAt: tc.Now().Add(time.Hour)}
+	if got := c.ExpiresIn(); got != time.Hour {
+		t.Errorf("ExpiresIn() = %v, want %v", got, time.Hour)
+	}
+}
+
+func TestBerghain_MintCookie(t *testing.T) {
+	bh := NewBerghain(generateSecret(t))
+	bh.Levels = []*LevelConfig{
+		{Duration: time.Minute, Type: ValidationTypeNone},
+		{Duration: time.Minute, Type: ValidationTypePOW},
+	}
+	ri := RequestIdentifier{
+		SrcAddr: netip.MustParseAddr("1.2.3.4"),
+		Host:    []byte("example.com"),
+	}
 
 	cb := AcquireCookieBuffer()
 	defer ReleaseCookieBuffer(cb)
-	if err := ri.ToCookie(bh, cb); err != nil {
-		b.Fatal(err)
+	expiresAt, err := bh.MintCookie(ri, 2, 30*24*time.Hour, cb)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	b.ResetTimer()
-	b.RunParallel(func(pb *testing.PB) {
-		for pb.Next() {
-			if err := bh.IsValidCookie(ri, cb.ReadBytes()); err != nil {
-				b.Fatal(err)
+	ri.Level = 2
+	claims, err := bh.ValidateCookie(ri, cb.ReadBytes())
+	if err != nil {
+		t.Fatalf("minted cookie not valid: %v", err)
+	}
+	// the expiration is stored in seconds
+	if expiresIn := claims.ExpiresIn(); claims.Level != 2 || expiresIn <= 30*24*time.Hour-2*time.Second || expiresIn > 30*24*time.Hour {
+		t.Errorf("claims = %+v, want level 2 expiring in 30 days", claims)
+	}
+	if !claims.ExpiresAt.Equal(expiresAt) {
+		t.Errorf("MintCookie() expires at %v, cookie at %v", expiresAt, claims.ExpiresAt)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		ri    RequestIdentifier
+		level uint8
+		ttl   time.Duration
+	}{
+		{name: "missing address", ri: RequestIdentifier{Host: ri.Host}, level: 1, ttl: time.Hour},
+		{name: "missing host", ri: RequestIdentifier{SrcAddr: ri.SrcAddr}, level: 1, ttl: time.Hour},
+		{name: "level zero", ri: ri, ttl: time.Hour},
+		{name: "unknown level", ri: ri, level: 3, ttl: time.Hour},
+		{name: "negative ttl", ri: ri, level: 1, ttl: -time.Hour},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cb := AcquireCookieBuffer()
+			defer ReleaseCookieBuffer(cb)
+			if _, err := bh.MintCookie(tt.ri, tt.level, tt.ttl, cb); !errors.Is(err, errInvalidMint) {
+				t.Errorf("MintCookie() = %v, want %v", err, errInvalidMint)
 			}
-		}
-	})
+		})
+	}
 }
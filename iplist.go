@@ -0,0 +1,299 @@
+package berghain
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// PrefixTrie is a set of prefixes answering whether an address is contained
+// in any of them. The zero value is an empty set.
+type PrefixTrie struct {
+	// nodes[0] is the IPv4 root and nodes[1] the IPv6 root, if present.
+	nodes []trieNode
+}
+
+type trieNode struct {
+	// child holds the node index of the children, zero if absent,
+	// as no node points back to a root.
+	child [2]uint32
+	// terminal marks the end of a prefix, its whole subtree is contained.
+	terminal bool
+}
+
+// NewPrefixTrie builds a trie of the prefixes. IPv4-mapped IPv6 prefixes are
+// treated as IPv4 prefixes.
+func NewPrefixTrie(prefixes []netip.Prefix) *PrefixTrie {
+	t := &PrefixTrie{nodes: make([]trieNode, 2)}
+	for _, p := range prefixes {
+		t.insert(p)
+	}
+	return t
+}
+
+func (t *PrefixTrie) insert(p netip.Prefix) {
+	addr, bits := p.Addr(), p.Bits()
+	if addr.Is4In6() && bits >= 96 {
+		addr, bits = addr.Unmap(), bits-96
+	}
+	ip := addr.As16()
+	root, offset := uint32(1), 0
+	if addr.Is4() {
+		root, offset = 0, 96
+	}
+
+	node := root
+	for i := 0; i < bits; i++ {
+		if t.nodes[node].terminal {
+			// a shorter prefix already contains this one
+			return
+		}
+
+		bit := ip[(offset+i)/8] >> (7 - (offset+i)%8) & 1
+		if t.nodes[node].child[bit] == 0 {
+			t.nodes = append(t.nodes, trieNode{})
+			t.nodes[node].child[bit] = uint32(len(t.nodes) - 1)
+		}
+		node = t.nodes[node].child[bit]
+	}
+
+	// drop the now contained longer prefixes
+	t.nodes[node] = trieNode{terminal: true}
+}
+
+// Contains reports whether the address is in any of the prefixes.
+func (t *PrefixTrie) Contains(addr netip.Addr) bool {
+	if t == nil || len(t.nodes) == 0 {
+		return false
+	}
+
+	addr = addr.Unmap()
+	ip := addr.As16()
+	node, offset, bits := uint32(1), 0, 128
+	if addr.Is4() {
+		node, offset, bits = 0, 96, 32
+	}
+
+	for i := 0; ; i++ {
+		n := &t.nodes[node]
+		if n.terminal {
+			return true
+		}
+		if i == bits {
+			return false
+		}
+
+		bit := ip[(offset+i)/8] >> (7 - (offset+i)%8) & 1
+		if node = n.child[bit]; node == 0 {
+			return false
+		}
+	}
+}
+
+// ListAction is what an IPList does with the addresses it contains.
+type ListAction uint8
+
+const (
+	// ListActionLevel raises the level of requests to at least the list level.
+	ListActionLevel ListAction = iota + 1
+	// ListActionAllow accepts requests without a valid cookie.
+	ListActionAllow
+	// ListActionDeny rejects requests.
+	ListActionDeny
+)
+
+func (a ListAction) String() string {
+	switch a {
+	case ListActionLevel:
+		return "level"
+	case ListActionAllow:
+		return "allow"
+	case ListActionDeny:
+		return "deny"
+	default:
+		return "unknown"
+	}
+}
+
+// IPList is a file-backed list of addresses and prefixes, one per line.
+// Anything after '#' or ';' is a comment, so Spamhaus DROP and Tor exit lists
+// can be used as they are. Files starting with '{' are read as published
+// crawler ranges, see ipRanges.
+type IPList struct {
+	Name   string
+	Action ListAction
+	// Level is the minimum level enforced by ListActionLevel.
+	Level uint8
+
+	path string
+	trie atomic.Pointer[PrefixTrie]
+
+	modTime time.Time
+	size    int64
+}
+
+// OpenIPList reads the list from the file at path.
+func OpenIPList(name, path string, action ListAction, level uint8) (*IPList, error) {
+	if action == ListActionLevel && level == 0 {
+		return nil, fmt.Errorf("ip list %s: level must be at least 1", name)
+	}
+
+	l := &IPList{Name: name, Action: action, Level: level, path: path}
+	if _, err := l.Reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Reload reads the file if it changed since it was last read and reports
+// whether it did. If the file fails to load, the list keeps its entries.
+// Reload must not be called concurrently.
+func (l *IPList) Reload() (bool, error) {
+	fi, err := os.Stat(l.path)
+	if err != nil {
+		return false, fmt.Errorf("ip list %s: %w", l.Name, err)
+	}
+
+	if l.trie.Load() != nil && l.modTime.Equal(fi.ModTime()) && l.size == fi.Size() {
+		return false, nil
+	}
+
+	f, err := os.Open(l.path)
+	if err != nil {
+		return false, fmt.Errorf("ip list %s: %w", l.Name, err)
+	}
+	defer f.Close()
+
+	prefixes, err := parseIPList(f)
+	if err != nil {
+		return false, fmt.Errorf("ip list %s: %w", l.Name, err)
+	}
+
+	l.trie.Store(NewPrefixTrie(prefixes))
+	l.modTime, l.size = fi.ModTime(), fi.Size()
+
+	return true, nil
+}
+
+func parseIPList(f *os.File) ([]netip.Prefix, error) {
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		return parseIPRanges(b)
+	}
+
+	var prefixes []netip.Prefix
+
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for line := 1; s.Scan(); line++ {
+		b := s.Bytes()
+		if i := bytes.IndexAny(b, "#;"); i >= 0 {
+			b = b[:i]
+		}
+		b = bytes.TrimSpace(b)
+		if len(b) == 0 {
+			continue
+		}
+
+		var p netip.Prefix
+		var err error
+		if bytes.IndexByte(b, '/') >= 0 {
+			p, err = netip.ParsePrefix(string(b))
+		} else {
+			var addr netip.Addr
+			addr, err = netip.ParseAddr(string(b))
+			p = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		prefixes = append(prefixes, p.Masked())
+	}
+
+	return prefixes, s.Err()
+}
+
+// ipRanges is the format of the address ranges published by Google and
+// Microsoft for their crawlers, e.g. googlebot.json and bingbot.json.
+type ipRanges struct {
+	Prefixes []struct {
+		IPv4Prefix string `json:"ipv4Prefix"`
+		IPv6Prefix string `json:"ipv6Prefix"`
+	} `json:"prefixes"`
+}
+
+func parseIPRanges(b []byte) ([]netip.Prefix, error) {
+	var r ipRanges
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, err
+	}
+
+	prefixes := make([]netip.Prefix, 0, len(r.Prefixes))
+	for _, e := range r.Prefixes {
+		for _, s := range []string{e.IPv4Prefix, e.IPv6Prefix} {
+			if s == "" {
+				continue
+			}
+			p, err := netip.ParsePrefix(s)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, p.Masked())
+		}
+	}
+
+	return prefixes, nil
+}
+
+// Contains reports whether the address is on the list.
+func (l *IPList) Contains(addr netip.Addr) bool {
+	return l.trie.Load().Contains(addr)
+}
+
+// IPLists are checked in order, the first list containing an address applies.
+type IPLists []*IPList
+
+// Match returns the first list containing the address, or nil.
+func (ls IPLists) Match(addr netip.Addr) *IPList {
+	for _, l := range ls {
+		if l.Contains(addr) {
+			return l
+		}
+	}
+	return nil
+}
+
+// Reload reloads all lists and reports whether any changed.
+func (ls IPLists) Reload() (bool, error) {
+	var changed bool
+	var errs []error
+	for _, l := range ls {
+		c, err := l.Reload()
+		changed = changed || c
+		errs = append(errs, err)
+	}
+
+	return changed, errors.Join(errs...)
+}
+
+// ApplyIPLists finds the first list containing the source address of ri and
+// returns it, or nil. Level lists raise ri.Level to the list level, so the
+// validate and challenge paths agree on the level of listed addresses.
+func (b *Berghain) ApplyIPLists(ri *RequestIdentifier) *IPList {
+	l := b.IPLists.Match(ri.SrcAddr)
+	if l != nil && l.Action == ListActionLevel {
+		ri.Level = max(ri.Level, l.Level)
+	}
+	return l
+}
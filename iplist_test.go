@@ -0,0 +1,177 @@
+package berghain
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPrefixTrie_Contains(t *testing.T) {
+	trie := NewPrefixTrie([]netip.Prefix{
+		netip.MustParsePrefix("192.0.2.0/24"),
+		netip.MustParsePrefix("198.51.100.7/32"),
+		netip.MustParsePrefix("203.0.113.0/25"),
+		netip.MustParsePrefix("203.0.113.0/24"),
+		netip.MustParsePrefix("2001:db8:1::/48"),
+		netip.MustParsePrefix("::ffff:10.0.0.0/104"),
+	})
+
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{addr: "192.0.2.0", want: true},
+		{addr: "192.0.2.255", want: true},
+		{addr: "192.0.3.0", want: false},
+		{addr: "198.51.100.7", want: true},
+		{addr: "198.51.100.8", want: false},
+		{addr: "203.0.113.200", want: true},
+		{addr: "::ffff:192.0.2.1", want: true},
+		{addr: "10.1.2.3", want: true},
+		{addr: "2001:db8:1:ffff::1", want: true},
+		{addr: "2001:db8:2::1", want: false},
+		{addr: "::c000:201", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			if got := trie.Contains(netip.MustParseAddr(tt.addr)); got != tt.want {
+				t.Errorf("Contains(%s) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+
+	var empty PrefixTrie
+	if empty.Contains(netip.MustParseAddr("192.0.2.1")) {
+		t.Errorf("empty trie contains an address")
+	}
+	if !NewPrefixTrie([]netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")}).Contains(netip.MustParseAddr("192.0.2.1")) {
+		t.Errorf("default route does not contain an address")
+	}
+}
+
+func writeIPList(t *testing.T, path, content string, mtime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIPList(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Now().Add(-time.Hour)
+
+	drop := filepath.Join(dir, "drop.txt")
+	writeIPList(t, drop, "; Spamhaus DROP List\n192.0.2.0/24 ; SBL000001\n", start)
+	tor := filepath.Join(dir, "tor.txt")
+	writeIPList(t, tor, "# exit nodes\n198.51.100.7\n2001:db8::7\n\n", start)
+
+	dropList, err := OpenIPList("drop", drop, ListActionDeny, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torList, err := OpenIPList("tor", tor, ListActionLevel, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lists := IPLists{dropList, torList}
+
+	for addr, want := range map[string]*IPList{
+		"192.0.2.9":    dropList,
+		"198.51.100.7": torList,
+		"2001:db8::7":  torList,
+		"2001:db8::8":  nil,
+	} {
+		if got := lists.Match(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("Match(%s) = %v, want %v", addr, got, want)
+		}
+	}
+
+	if changed, err := lists.Reload(); changed || err != nil {
+		t.Fatalf("Reload() of unchanged lists = %v, %v", changed, err)
+	}
+
+	writeIPList(t, tor, "198.51.100.8\n", start.Add(time.Minute))
+	if changed, err := lists.Reload(); !changed || err != nil {
+		t.Fatalf("Reload() of changed list = %v, %v", changed, err)
+	}
+	if lists.Match(netip.MustParseAddr("198.51.100.7")) != nil || lists.Match(netip.MustParseAddr("198.51.100.8")) != torList {
+		t.Errorf("reloaded list does not match its new entries")
+	}
+
+	writeIPList(t, tor, "not an address\n", start.Add(2*time.Minute))
+	if _, err := lists.Reload(); err == nil {
+		t.Fatalf("Reload() of invalid list succeeded")
+	}
+	if lists.Match(netip.MustParseAddr("198.51.100.8")) != torList {
+		t.Errorf("failed reload dropped the previous entries")
+	}
+}
+
+func TestOpenIPList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "list.txt")
+	writeIPList(t, path, "192.0.2.0/33\n", time.Now())
+
+	if _, err := OpenIPList("invalid", path, ListActionDeny, 0); err == nil {
+		t.Errorf("OpenIPList() of invalid prefix succeeded")
+	}
+	if _, err := OpenIPList("missing", path+".missing", ListActionDeny, 0); err == nil {
+		t.Errorf("OpenIPList() of missing file succeeded")
+	}
+	if _, err := OpenIPList("no level", path, ListActionLevel, 0); err == nil {
+		t.Errorf("OpenIPList() of level list without level succeeded")
+	}
+}
+
+func BenchmarkIPLists_Match(b *testing.B) {
+	prefixes := make([]netip.Prefix, 0, 4096)
+	for i := 0; i < 4096; i++ {
+		prefixes = append(prefixes, netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(i >> 8), byte(i), 1}), 32))
+	}
+	var l IPList
+	l.trie.Store(NewPrefixTrie(prefixes))
+	lists := IPLists{&l}
+	addr := netip.MustParseAddr("192.0.2.1")
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		lists.Match(addr)
+	}
+}
+
+func TestOpenIPList_Ranges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "googlebot.json")
+	writeIPList(t, path, `{
+  "creationTime": "2026-01-01T00:00:00.000000",
+  "prefixes": [
+    {"ipv6Prefix": "2001:db8:4801::/64"},
+    {"ipv4Prefix": "192.0.2.64/27"}
+  ]
+}`, time.Now())
+
+	l, err := OpenIPList("googlebot", path, ListActionAllow, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for addr, want := range map[string]bool{
+		"192.0.2.65":       true,
+		"192.0.2.1":        false,
+		"2001:db8:4801::1": true,
+		"2001:db8:4802::1": false,
+	} {
+		if got := l.Contains(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("Contains(%s) = %v, want %v", addr, got, want)
+		}
+	}
+
+	writeIPList(t, path, `{"prefixes": [{"ipv4Prefix": "192.0.2.0/33"}]}`, time.Now().Add(time.Minute))
+	if _, err := l.Reload(); err == nil {
+		t.Errorf("Reload() of invalid ranges succeeded")
+	}
+}
@@ -0,0 +1,126 @@
+package berghain
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/dropmorepackets/haproxy-go/pkg/buffer"
+)
+
+var errResponseTooLarge = errors.New("response exceeds buffer")
+
+// jsonWriter writes a flat JSON object into a response buffer without
+// allocating. Errors are sticky: once the buffer is exhausted all further
+// writes are dropped and Close reports the error.
+type jsonWriter struct {
+	b      *buffer.SliceBuffer
+	fields int
+	err    error
+}
+
+func newJSONWriter(b *buffer.SliceBuffer) jsonWriter {
+	w := jsonWriter{b: b}
+	w.raw("{")
+	return w
+}
+
+func (w *jsonWriter) reserve(n int) []byte {
+	if w.err != nil {
+		return nil
+	}
+	if n > len(w.b.WriteBytes()) {
+		w.err = errResponseTooLarge
+		return nil
+	}
+	return w.b.WriteNBytes(n)
+}
+
+func (w *jsonWriter) raw(s string) {
+	copy(w.reserve(len(s)), s)
+}
+
+func (w *jsonWriter) key(k string) {
+	if w.fields > 0 {
+		w.raw(",")
+	}
+	w.fields++
+
+	w.raw(`"`)
+	w.raw(k)
+	w.raw(`":`)
+}
+
+// Int writes an integer field.
+func (w *jsonWriter) Int(k string, v int) {
+	w.key(k)
+	if w.err != nil {
+		return
+	}
+
+	n := len(strconv.AppendInt(w.b.WriteBytes()[:0], int64(v), 10))
+	if n > len(w.b.WriteBytes()) {
+		// AppendInt had to grow the slice, so the value did not fit.
+		w.err = errResponseTooLarge
+		return
+	}
+	w.b.AdvanceW(n)
+}
+
+// Bool writes a boolean field.
+func (w *jsonWriter) Bool(k string, v bool) {
+	w.key(k)
+	if v {
+		w.raw("true")
+	} else {
+		w.raw("false")
+	}
+}
+
+// String writes a string field, escaping the value as needed.
+func (w *jsonWriter) String(k string, v []byte) {
+	w.key(k)
+	w.raw(`"`)
+
+	const hexDigits = "0123456789abcdef"
+	start := 0
+	for i, c := range v {
+		if c >= 0x20 && c != '"' && c != '\\' {
+			continue
+		}
+
+		copy(w.reserve(i-start), v[start:i])
+		switch c {
+		case '"', '\\':
+			copy(w.reserve(2), []byte{'\\', c})
+		case '\n':
+			w.raw(`\n`)
+		case '\r':
+			w.raw(`\r`)
+		case '\t':
+			w.raw(`\t`)
+		default:
+			copy(w.reserve(6), []byte{'\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xf]})
+		}
+		start = i + 1
+	}
+	copy(w.reserve(len(v)-start), v[start:])
+
+	w.raw(`"`)
+}
+
+// StringArea writes a string field of length n and returns its content for
+// the caller to fill in later. The content must not need escaping, which
+// holds for hex and the other ASCII encodings used by the validators.
+func (w *jsonWriter) StringArea(k string, n int) []byte {
+	w.key(k)
+	w.raw(`"`)
+	area := w.reserve(n)
+	w.raw(`"`)
+	return area
+}
+
+// Close terminates the object and returns the first error encountered.
+func (w *jsonWriter) Close() error {
+	w.raw("}")
+	return w.err
+}
@@ -0,0 +1,66 @@
+package berghain
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/dropmorepackets/haproxy-go/pkg/buffer"
+)
+
+func Test_jsonWriter(t *testing.T) {
+	b := buffer.NewSliceBuffer(256)
+
+	w := newJSONWriter(b)
+	w.Int("c", 120)
+	w.Int("n", -7)
+	w.Bool("b", true)
+	w.String("k", []byte("quote\" backslash\\ newline\n nul\x00"))
+	copy(w.StringArea("a", 4), "abcd")
+	if err := w.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	var got struct {
+		C int    `json:"c"`
+		N int    `json:"n"`
+		B bool   `json:"b"`
+		K string `json:"k"`
+		A string `json:"a"`
+	}
+	if err := json.Unmarshal(b.ReadBytes(), &got); err != nil {
+		t.Fatalf("decode %q: %v", b.ReadBytes(), err)
+	}
+
+	if got.C != 120 || got.N != -7 || !got.B || got.K != "quote\" backslash\\ newline\n nul\x00" || got.A != "abcd" {
+		t.Errorf("unexpected result: %+v", got)
+	}
+}
+
+func Test_jsonWriter_tooLarge(t *testing.T) {
+	for size := 0; size < len(`{"c":12345}`); size++ {
+		w := newJSONWriter(buffer.NewSliceBuffer(size))
+		w.Int("c", 12345)
+		if err := w.Close(); !errors.Is(err, errResponseTooLarge) {
+			t.Errorf("size %d: expected errResponseTooLarge, got %v", size, err)
+		}
+	}
+}
+
+func Benchmark_jsonWriter(b *testing.B) {
+	buf := buffer.NewSliceBuffer(1024)
+	id := []byte("bh@123e4567-e89b-12d3-a456-426614174000")
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		w := newJSONWriter(buf)
+		w.Int("c", 15)
+		w.Int("t", 1)
+		w.StringArea("r", 64)
+		w.String("i", id)
+		if err := w.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
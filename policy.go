@@ -0,0 +1,361 @@
+package berghain
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+)
+
+// PolicyAction is the outcome of a policy rule.
+type PolicyAction uint8
+
+const (
+	// PolicyActionNone is decided if no rule matched.
+	PolicyActionNone PolicyAction = iota
+	// PolicyActionLevel requires the level of the rule.
+	PolicyActionLevel
+	// PolicyActionAllow lets the request through without a challenge.
+	PolicyActionAllow
+	// PolicyActionDeny rejects the request.
+	PolicyActionDeny
+)
+
+func (a PolicyAction) String() string {
+	switch a {
+	case PolicyActionNone:
+		return "none"
+	case PolicyActionLevel:
+		return "level"
+	case PolicyActionAllow:
+		return "allow"
+	case PolicyActionDeny:
+		return "deny"
+	default:
+		return "unknown"
+	}
+}
+
+// TimeWindow is a daily time span, from Start up to but excluding End, given
+// as offsets from midnight. Windows with End before Start span midnight.
+type TimeWindow struct {
+	Start, End time.Duration
+}
+
+// ParseTimeWindow parses a window in the form "22:00-06:00".
+func ParseTimeWindow(s string) (TimeWindow, error) {
+	start, end, ok := strings.Cut(s, "-")
+	if !ok {
+		return TimeWindow{}, fmt.Errorf("time window %q: missing '-'", s)
+	}
+
+	var w TimeWindow
+	var err error
+	if w.Start, err = parseClock(start); err != nil {
+		return TimeWindow{}, fmt.Errorf("time window %q: %w", s, err)
+	}
+	if w.End, err = parseClock(end); err != nil {
+		return TimeWindow{}, fmt.Errorf("time window %q: %w", s, err)
+	}
+
+	return w, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (w TimeWindow) contains(t time.Time) bool {
+	h, m, s := t.Clock()
+	d := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(s)*time.Second
+
+	if w.Start <= w.End {
+		return d >= w.Start && d < w.End
+	}
+	return d >= w.Start || d < w.End
+}
+
+// PolicyRule assigns an action to the requests it matches. A request matches
+// if it matches every condition that is set, and it matches a condition if it
+// matches any of its values.
+type PolicyRule struct {
+	// Name identifies the rule in logs.
+	Name string
+
+	// Paths match case-insensitively and exactly, or by prefix if they end
+	// in '*'.
+	Paths []string
+	// Methods match case-sensitively, as HTTP methods do.
+	Methods []string
+	// Hosts match case-insensitively and exactly, or any subdomain if
+	// they start with "*.".
+	Hosts []string
+	// UserAgents match as case-insensitive substrings.
+	UserAgents []string
+	CIDRs      []netip.Prefix
+	// Countries are ISO 3166-1 alpha-2 codes, matched case-insensitively.
+	Countries []string
+	// ASNs are autonomous system numbers.
+	ASNs []uint32
+	// IPLists match if any of the lists contains the source address,
+	// regardless of the action of the list.
+	IPLists []*IPList
+	// Times are evaluated in the location of the policy.
+	Times []TimeWindow
+	// SignatureAgents are names of agents whose Web Bot Auth signature
+	// was verified.
+	SignatureAgents []string
+
+	Action PolicyAction
+	// Level is the level required by PolicyActionLevel.
+	Level uint8
+}
+
+// PolicyRequest holds the attributes of a request matched by a Policy.
+type PolicyRequest struct {
+	Method    []byte
+	Path      []byte
+	Host      []byte
+	UserAgent []byte
+	SrcAddr   netip.Addr
+	Time      time.Time
+
+	// Country and ASN are looked up by GeoIP, empty if unknown.
+	Country string
+	ASN     uint32
+
+	// SignatureAgent is the name of the agent that signed the request,
+	// empty if it is not signed or the signature is invalid.
+	SignatureAgent string
+}
+
+// PolicyDecision is the action of the first matching rule.
+type PolicyDecision struct {
+	Action PolicyAction
+	Level  uint8
+	// Rule is the name of the matching rule, empty if no rule matched.
+	Rule string
+}
+
+// Policy is an ordered list of rules, the first matching rule decides.
+type Policy struct {
+	rules    []PolicyRule
+	location *time.Location
+}
+
+var errInvalidPolicy = errors.New("invalid policy")
+
+// NewPolicy validates the rules and prepares them for matching. Time windows
+// are evaluated in loc, which defaults to UTC.
+func NewPolicy(rules []PolicyRule, loc *time.Location) (*Policy, error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	p := &Policy{
+		rules:    make([]PolicyRule, len(rules)),
+		location: loc,
+	}
+
+	for i, r := range rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("#%d", i+1)
+		}
+
+		switch r.Action {
+		case PolicyActionLevel:
+			if r.Level == 0 {
+				return nil, fmt.Errorf("%w: rule %s: level must be at least 1", errInvalidPolicy, r.Name)
+			}
+		case PolicyActionAllow, PolicyActionDeny:
+			if r.Level != 0 {
+				return nil, fmt.Errorf("%w: rule %s: level is only valid for the level action", errInvalidPolicy, r.Name)
+			}
+		default:
+			return nil, fmt.Errorf("%w: rule %s: missing action", errInvalidPolicy, r.Name)
+		}
+
+		for _, m := range r.Methods {
+			if !validMethod(m) {
+				return nil, fmt.Errorf("%w: rule %s: invalid method %q", errInvalidPolicy, r.Name, m)
+			}
+		}
+
+		// matching compares against lowercase values without allocating
+		r.Paths = lowerAll(r.Paths)
+		r.Hosts = lowerAll(r.Hosts)
+		r.UserAgents = lowerAll(r.UserAgents)
+		r.Countries = upperAll(r.Countries)
+		for _, ua := range r.UserAgents {
+			if ua == "" {
+				return nil, fmt.Errorf("%w: rule %s: empty user agent matches every request", errInvalidPolicy, r.Name)
+			}
+		}
+
+		p.rules[i] = r
+	}
+
+	return p, nil
+}
+
+func validMethod(m string) bool {
+	if m == "" {
+		return false
+	}
+	for _, c := range []byte(m) {
+		if c <= ' ' || c >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+func lowerAll(s []string) []string {
+	if len(s) == 0 {
+		return nil
+	}
+	l := make([]string, len(s))
+	for i, v := range s {
+		l[i] = strings.ToLower(v)
+	}
+	return l
+}
+
+func upperAll(s []string) []string {
+	if len(s) == 0 {
+		return nil
+	}
+	u := make([]string, len(s))
+	for i, v := range s {
+		u[i] = strings.ToUpper(v)
+	}
+	return u
+}
+
+// Decide returns the action of the first rule matching the request.
+func (p *Policy) Decide(req *PolicyRequest) PolicyDecision {
+	for i := range p.rules {
+		r := &p.rules[i]
+		if p.matches(r, req) {
+			return PolicyDecision{Action: r.Action, Level: r.Level, Rule: r.Name}
+		}
+	}
+
+	return PolicyDecision{}
+}
+
+func (p *Policy) matches(r *PolicyRule, req *PolicyRequest) bool {
+	if len(r.Methods) > 0 && !matchAny(r.Methods, req.Method, matchExact) {
+		return false
+	}
+	if len(r.Paths) > 0 && !matchAny(r.Paths, req.Path, matchPath) {
+		return false
+	}
+	if len(r.Hosts) > 0 && !matchAny(r.Hosts, req.Host, matchHost) {
+		return false
+	}
+	if len(r.UserAgents) > 0 && !matchAny(r.UserAgents, req.UserAgent, containsFold) {
+		return false
+	}
+	if len(r.CIDRs) > 0 && !matchPrefixes(r.CIDRs, req.SrcAddr) {
+		return false
+	}
+	if len(r.IPLists) > 0 && IPLists(r.IPLists).Match(req.SrcAddr) == nil {
+		return false
+	}
+	if len(r.Countries) > 0 && !slices.Contains(r.Countries, req.Country) {
+		return false
+	}
+	if len(r.ASNs) > 0 && !slices.Contains(r.ASNs, req.ASN) {
+		return false
+	}
+	if len(r.Times) > 0 && !matchTimes(r.Times, req.Time.In(p.location)) {
+		return false
+	}
+	if len(r.SignatureAgents) > 0 && !slices.Contains(r.SignatureAgents, req.SignatureAgent) {
+		return false
+	}
+	return true
+}
+
+func matchAny(patterns []string, v []byte, match func(pattern string, v []byte) bool) bool {
+	for _, p := range patterns {
+		if match(p, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchExact(pattern string, v []byte) bool {
+	return pattern == string(v)
+}
+
+// matchPath expects a lowercase pattern.
+func matchPath(pattern string, v []byte) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return len(v) >= len(prefix) && equalFold(v[:len(prefix)], prefix)
+	}
+	return equalFold(v, pattern)
+}
+
+// matchHost expects a lowercase pattern.
+func matchHost(pattern string, v []byte) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		// suffix keeps the leading dot, so only subdomains match
+		return len(v) > len(suffix) && equalFold(v[len(v)-len(suffix):], suffix)
+	}
+	return equalFold(v, pattern)
+}
+
+// containsFold reports whether v contains the lowercase pattern, ignoring
+// ASCII case.
+func containsFold(pattern string, v []byte) bool {
+	for i := 0; i+len(pattern) <= len(v); i++ {
+		if equalFold(v[i:i+len(pattern)], pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// equalFold compares v to the lowercase s, ignoring ASCII case in v.
+func equalFold(v []byte, s string) bool {
+	if len(v) != len(s) {
+		return false
+	}
+	for i, c := range v {
+		if c >= 'A' && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		if c != s[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func matchPrefixes(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchTimes(windows []TimeWindow, t time.Time) bool {
+	for _, w := range windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
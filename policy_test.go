@@ -0,0 +1,213 @@
+package berghain
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestPolicy_Decide(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("no timezone data: %v", err)
+	}
+
+	night, err := ParseTimeWindow("22:00-06:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewPolicy([]PolicyRule{
+		{Name: "feeds", Paths: []string{"/feed.xml", "/API/*"}, Action: PolicyActionAllow},
+		{Name: "scrapers", UserAgents: []string{"python-requests"}, Action: PolicyActionDeny},
+		{Name: "signed", SignatureAgents: []string{"signer"}, Action: PolicyActionLevel, Level: 1},
+		{Name: "ai", UserAgents: []string{"GPTBot", "ClaudeBot"}, Action: PolicyActionLevel, Level: 2},
+		{Name: "tools", UserAgents: []string{"curl/"}, Action: PolicyActionAllow},
+		{Name: "office", CIDRs: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}, Hosts: []string{"*.Example.com"}, Action: PolicyActionAllow},
+		{Name: "hosting", Countries: []string{"de"}, ASNs: []uint32{64500, 64501}, Action: PolicyActionLevel, Level: 2},
+		{Name: "night posts", Methods: []string{"POST"}, Times: []TimeWindow{night}, Action: PolicyActionLevel, Level: 3},
+		{Name: "browsers", UserAgents: []string{"mozilla/"}, Action: PolicyActionLevel, Level: 1},
+	}, berlin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	noon := time.Date(2026, 7, 1, 12, 0, 0, 0, berlin)
+	tests := []struct {
+		name string
+		req  PolicyRequest
+		want PolicyDecision
+	}{
+		{
+			name: "no match",
+			req:  PolicyRequest{Method: []byte("GET"), Path: []byte("/"), Time: noon},
+			want: PolicyDecision{},
+		},
+		{
+			name: "exact path",
+			req:  PolicyRequest{Path: []byte("/feed.xml"), UserAgent: []byte("python-requests/2.31"), Time: noon},
+			want: PolicyDecision{Action: PolicyActionAllow, Rule: "feeds"},
+		},
+		{
+			name: "path prefix",
+			req:  PolicyRequest{Path: []byte("/api/v1/items"), Time: noon},
+			want: PolicyDecision{Action: PolicyActionAllow, Rule: "feeds"},
+		},
+		{
+			name: "path ignores case",
+			req:  PolicyRequest{Path: []byte("/Feed.XML"), UserAgent: []byte("python-requests/2.31"), Time: noon},
+			want: PolicyDecision{Action: PolicyActionAllow, Rule: "feeds"},
+		},
+		{
+			name: "path prefix ignores case",
+			req:  PolicyRequest{Path: []byte("/api/V1/items"), Time: noon},
+			want: PolicyDecision{Action: PolicyActionAllow, Rule: "feeds"},
+		},
+		{
+			name: "path without prefix match",
+			req:  PolicyRequest{Path: []byte("/apis"), UserAgent: []byte("python-requests/2.31"), Time: noon},
+			want: PolicyDecision{Action: PolicyActionDeny, Rule: "scrapers"},
+		},
+		{
+			name: "user agent ignores case",
+			req:  PolicyRequest{UserAgent: []byte("Mozilla/5.0 (compatible; GPTBOT/1.2)"), Time: noon},
+			want: PolicyDecision{Action: PolicyActionLevel, Level: 2, Rule: "ai"},
+		},
+		{
+			name: "signature agent",
+			req:  PolicyRequest{UserAgent: []byte("Mozilla/5.0 (compatible; GPTBot/1.2)"), SignatureAgent: "signer", Time: noon},
+			want: PolicyDecision{Action: PolicyActionLevel, Level: 1, Rule: "signed"},
+		},
+		{
+			name: "earlier rule wins",
+			req:  PolicyRequest{UserAgent: []byte("curl/8.0 ClaudeBot"), Time: noon},
+			want: PolicyDecision{Action: PolicyActionLevel, Level: 2, Rule: "ai"},
+		},
+		{
+			name: "cidr and subdomain",
+			req:  PolicyRequest{Host: []byte("www.example.com"), SrcAddr: netip.MustParseAddr("192.0.2.7"), UserAgent: []byte("Mozilla/5.0"), Time: noon},
+			want: PolicyDecision{Action: PolicyActionAllow, Rule: "office"},
+		},
+		{
+			name: "cidr with v4-mapped address",
+			req:  PolicyRequest{Host: []byte("www.example.com"), SrcAddr: netip.MustParseAddr("::ffff:192.0.2.7"), Time: noon},
+			want: PolicyDecision{Action: PolicyActionAllow, Rule: "office"},
+		},
+		{
+			name: "cidr without host",
+			req:  PolicyRequest{Host: []byte("example.com"), SrcAddr: netip.MustParseAddr("192.0.2.7"), UserAgent: []byte("Mozilla/5.0"), Time: noon},
+			want: PolicyDecision{Action: PolicyActionLevel, Level: 1, Rule: "browsers"},
+		},
+		{
+			name: "country and asn",
+			req:  PolicyRequest{UserAgent: []byte("Mozilla/5.0"), Country: "DE", ASN: 64501, Time: noon},
+			want: PolicyDecision{Action: PolicyActionLevel, Level: 2, Rule: "hosting"},
+		},
+		{
+			name: "asn in other country",
+			req:  PolicyRequest{UserAgent: []byte("Mozilla/5.0"), Country: "US", ASN: 64501, Time: noon},
+			want: PolicyDecision{Action: PolicyActionLevel, Level: 1, Rule: "browsers"},
+		},
+		{
+			name: "window after midnight",
+			req:  PolicyRequest{Method: []byte("POST"), Time: time.Date(2026, 7, 1, 2, 30, 0, 0, berlin)},
+			want: PolicyDecision{Action: PolicyActionLevel, Level: 3, Rule: "night posts"},
+		},
+		{
+			name: "window in other timezone",
+			req:  PolicyRequest{Method: []byte("POST"), Time: time.Date(2026, 7, 1, 21, 30, 0, 0, time.UTC)},
+			want: PolicyDecision{Action: PolicyActionLevel, Level: 3, Rule: "night posts"},
+		},
+		{
+			name: "window end is exclusive",
+			req:  PolicyRequest{Method: []byte("POST"), Time: time.Date(2026, 7, 1, 6, 0, 0, 0, berlin)},
+			want: PolicyDecision{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.Decide(&tt.req); got != tt.want {
+				t.Errorf("Decide() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    PolicyRule
+		wantErr bool
+	}{
+		{name: "level", rule: PolicyRule{Action: PolicyActionLevel, Level: 1}},
+		{name: "level without level", rule: PolicyRule{Action: PolicyActionLevel}, wantErr: true},
+		{name: "allow with level", rule: PolicyRule{Action: PolicyActionAllow, Level: 1}, wantErr: true},
+		{name: "missing action", rule: PolicyRule{Paths: []string{"/"}}, wantErr: true},
+		{name: "empty user agent", rule: PolicyRule{Action: PolicyActionDeny, UserAgents: []string{""}}, wantErr: true},
+		{name: "invalid method", rule: PolicyRule{Action: PolicyActionDeny, Methods: []string{"GE T"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewPolicy([]PolicyRule{tt.rule}, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, errInvalidPolicy) {
+				t.Errorf("NewPolicy() error = %v, want errInvalidPolicy", err)
+			}
+		})
+	}
+}
+
+func TestParseTimeWindow(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    TimeWindow
+		wantErr bool
+	}{
+		{in: "08:00-18:30", want: TimeWindow{Start: 8 * time.Hour, End: 18*time.Hour + 30*time.Minute}},
+		{in: "22:00 - 06:00", want: TimeWindow{Start: 22 * time.Hour, End: 6 * time.Hour}},
+		{in: "08:00", wantErr: true},
+		{in: "25:00-06:00", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseTimeWindow(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseTimeWindow() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseTimeWindow() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func BenchmarkPolicy_Decide(b *testing.B) {
+	p, err := NewPolicy([]PolicyRule{
+		{UserAgents: []string{"gptbot", "claudebot", "ccbot", "bytespider"}, Action: PolicyActionLevel, Level: 2},
+		{Paths: []string{"/api/*"}, Action: PolicyActionAllow},
+		{UserAgents: []string{"mozilla/"}, Action: PolicyActionLevel, Level: 1},
+	}, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	req := PolicyRequest{
+		Method:    []byte("GET"),
+		Path:      []byte("/index.html"),
+		UserAgent: []byte("Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0 Safari/537.36"),
+		Time:      time.Now(),
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if d := p.Decide(&req); d.Level != 1 {
+			b.Fatalf("unexpected decision %+v", d)
+		}
+	}
+}
@@ -0,0 +1,469 @@
+package berghain
+
+import (
+	"cmp"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Privacy Pass lets clients prove they are not bots with anonymous tokens of
+// an issuer they trust, see RFC 9577 for the PrivateToken authentication
+// scheme and RFC 9578 for the publicly verifiable token type, which is
+// signed with RSA blind signatures (RFC 9474).
+
+// TokenTypeBlindRSA is the publicly verifiable token type of RFC 9578,
+// signed with RSABSSA-SHA384-PSS-Deterministic and a 2048 bit key.
+const TokenTypeBlindRSA = 0x0002
+
+const (
+	tokenNonceSize = 32
+	tokenKeyIDSize = sha256.Size
+	// tokenAuthenticatorSize is the size of a 2048 bit RSA signature.
+	tokenAuthenticatorSize = 256
+	tokenSize              = 2 + tokenNonceSize + sha256.Size + tokenKeyIDSize + tokenAuthenticatorSize
+	tokenSaltSize          = 48
+)
+
+// DefaultTokenWindow is how long a challenge stays redeemable.
+const DefaultTokenWindow = 5 * time.Minute
+
+var (
+	errTokenMissing   = errors.New("no private token")
+	errTokenInvalid   = errors.New("invalid private token")
+	errTokenKey       = errors.New("unknown token key")
+	errTokenChallenge = errors.New("token not issued for a current challenge")
+	errTokenSpent     = errors.New("private token already redeemed")
+)
+
+var (
+	oidRSAEncryption = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidRSASSAPSS     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 10}
+	oidSHA384        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidMGF1          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 8}
+)
+
+// IssuerDirectory is a locally cached Privacy Pass issuer directory, as
+// served at /.well-known/private-token-issuer-directory. Keys of other token
+// types are ignored. Keys are identified by the SHA-256 digest of their
+// encoding, the token_key_id of RFC 9578.
+type IssuerDirectory struct {
+	path string
+	keys atomic.Pointer[issuerKeys]
+
+	modTime time.Time
+	size    int64
+}
+
+type issuerKeys struct {
+	byID map[[tokenKeyIDSize]byte]*rsa.PublicKey
+	// offered are the token-key parameters of challenges, ordered by the
+	// time they become valid.
+	offered []offeredKey
+}
+
+type offeredKey struct {
+	notBefore int64
+	enc       string
+}
+
+// challenge returns the token-key parameter of challenges at now, the most
+// recent key that is valid. If no key is valid yet, the earliest one is
+// offered.
+func (k *issuerKeys) challenge(now time.Time) string {
+	c := k.offered[0].enc
+	for _, o := range k.offered[1:] {
+		if o.notBefore > now.Unix() {
+			break
+		}
+		c = o.enc
+	}
+	return c
+}
+
+// OpenIssuerDirectory reads the issuer directory at path.
+func OpenIssuerDirectory(path string) (*IssuerDirectory, error) {
+	d := &IssuerDirectory{path: path}
+	if _, err := d.Reload(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Reload reads the file if it changed since it was last read and reports
+// whether it did. If the file fails to load, the directory keeps its keys.
+// Reload must not be called concurrently.
+func (d *IssuerDirectory) Reload() (bool, error) {
+	fi, err := os.Stat(d.path)
+	if err != nil {
+		return false, fmt.Errorf("issuer directory %s: %w", d.path, err)
+	}
+
+	if d.keys.Load() != nil && d.modTime.Equal(fi.ModTime()) && d.size == fi.Size() {
+		return false, nil
+	}
+
+	b, err := os.ReadFile(d.path)
+	if err != nil {
+		return false, fmt.Errorf("issuer directory %s: %w", d.path, err)
+	}
+
+	keys, err := parseIssuerDirectory(b)
+	if err != nil {
+		return false, fmt.Errorf("issuer directory %s: %w", d.path, err)
+	}
+
+	d.keys.Store(keys)
+	d.modTime, d.size = fi.ModTime(), fi.Size()
+
+	return true, nil
+}
+
+func (d *IssuerDirectory) key(id []byte) *rsa.PublicKey {
+	return d.keys.Load().byID[[tokenKeyIDSize]byte(id)]
+}
+
+func parseIssuerDirectory(b []byte) (*issuerKeys, error) {
+	var dir struct {
+		TokenKeys []struct {
+			TokenType int    `json:"token-type"`
+			TokenKey  string `json:"token-key"`
+			// NotBefore is the unix time a key becomes valid, keys
+			// without it are valid immediately.
+			NotBefore int64 `json:"not-before"`
+		} `json:"token-keys"`
+	}
+	if err := json.Unmarshal(b, &dir); err != nil {
+		return nil, err
+	}
+
+	keys := &issuerKeys{byID: make(map[[tokenKeyIDSize]byte]*rsa.PublicKey)}
+	for _, k := range dir.TokenKeys {
+		if k.TokenType != TokenTypeBlindRSA {
+			continue
+		}
+
+		enc, err := decodeBase64URL(k.TokenKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid token key %q", k.TokenKey)
+		}
+		pub, err := parseTokenKey(enc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid token key %q: %w", k.TokenKey, err)
+		}
+
+		keys.byID[sha256.Sum256(enc)] = pub
+		keys.offered = append(keys.offered, offeredKey{
+			notBefore: k.NotBefore,
+			enc:       base64.URLEncoding.EncodeToString(enc),
+		})
+	}
+	if len(keys.byID) == 0 {
+		return nil, errors.New("no token keys of type 2")
+	}
+	slices.SortStableFunc(keys.offered, func(a, b offeredKey) int {
+		return cmp.Compare(a.notBefore, b.notBefore)
+	})
+
+	return keys, nil
+}
+
+// decodeBase64URL decodes base64url with or without padding, issuers use
+// both.
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+type subjectPublicKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+// parseTokenKey parses a token key, a SubjectPublicKeyInfo of an RSA key.
+// RFC 9578 uses the RSASSA-PSS algorithm identifier, which crypto/x509 does
+// not parse, plain rsaEncryption keys are accepted as well.
+func parseTokenKey(enc []byte) (*rsa.PublicKey, error) {
+	var spki subjectPublicKeyInfo
+	if rest, err := asn1.Unmarshal(enc, &spki); err != nil {
+		return nil, err
+	} else if len(rest) > 0 {
+		return nil, errors.New("trailing data")
+	}
+
+	if !spki.Algorithm.Algorithm.Equal(oidRSASSAPSS) && !spki.Algorithm.Algorithm.Equal(oidRSAEncryption) {
+		return nil, fmt.Errorf("unsupported algorithm %s", spki.Algorithm.Algorithm)
+	}
+
+	pub, err := x509.ParsePKCS1PublicKey(spki.PublicKey.RightAlign())
+	if err != nil {
+		return nil, err
+	}
+	if pub.Size() != tokenAuthenticatorSize {
+		return nil, fmt.Errorf("unsupported key size %d", pub.N.BitLen())
+	}
+
+	return pub, nil
+}
+
+// MarshalTokenKey encodes a public key as token key of RFC 9578, with the
+// RSASSA-PSS algorithm identifier and SHA-384 parameters, e.g. to write the
+// issuer directory of a test issuer.
+func MarshalTokenKey(pub *rsa.PublicKey) ([]byte, error) {
+	sha384, err := asn1.Marshal(pkix.AlgorithmIdentifier{Algorithm: oidSHA384})
+	if err != nil {
+		return nil, err
+	}
+	mgf1, err := asn1.Marshal(pkix.AlgorithmIdentifier{Algorithm: oidMGF1, Parameters: asn1.RawValue{FullBytes: sha384}})
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(struct {
+		Hash       asn1.RawValue `asn1:"explicit,tag:0"`
+		MGF        asn1.RawValue `asn1:"explicit,tag:1"`
+		SaltLength int           `asn1:"explicit,tag:2"`
+	}{
+		Hash:       asn1.RawValue{FullBytes: sha384},
+		MGF:        asn1.RawValue{FullBytes: mgf1},
+		SaltLength: tokenSaltSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	key := x509.MarshalPKCS1PublicKey(pub)
+	return asn1.Marshal(subjectPublicKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSASSAPSS, Parameters: asn1.RawValue{FullBytes: params}},
+		PublicKey: asn1.BitString{Bytes: key, BitLength: 8 * len(key)},
+	})
+}
+
+// TokenIssuer is a Privacy Pass issuer whose tokens are redeemed.
+type TokenIssuer struct {
+	// Name is the issuer_name of challenges, the host name of the issuer.
+	Name string
+	Keys *IssuerDirectory
+}
+
+// PrivacyPass issues PrivateToken challenges and redeems the tokens of the
+// issuers. Challenges carry a redemption context that changes every Window,
+// tokens are redeemable for challenges of the current and the previous
+// window, and the nonces of redeemed tokens are remembered as long.
+type PrivacyPass struct {
+	Issuers []*TokenIssuer
+	// Window defaults to DefaultTokenWindow.
+	Window time.Duration
+
+	key []byte
+
+	mu sync.Mutex
+	// spent holds the nonces of redeemed tokens challenged in spentWindow,
+	// previous those challenged in the window before.
+	spent, previous map[[tokenNonceSize]byte]struct{}
+	spentWindow     int64
+}
+
+// privacyPassKeyLabel separates the redemption context key from other uses
+// of the secret.
+const privacyPassKeyLabel = "berghain privacy pass redemption context"
+
+// NewPrivacyPass returns a PrivacyPass for the issuers. Redemption contexts
+// are derived from the secret, so challenges stay redeemable across restarts
+// and by every agent sharing the secret. Redeemed tokens are only tracked
+// per PrivacyPass, so each agent, and each agent after a restart, accepts a
+// token once.
+func NewPrivacyPass(secret []byte, issuers []*TokenIssuer) (*PrivacyPass, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("privacy pass needs a secret")
+	}
+
+	m := hmac.New(sha256.New, secret)
+	m.Write([]byte(privacyPassKeyLabel))
+	return &PrivacyPass{Issuers: issuers, key: m.Sum(nil)}, nil
+}
+
+// Reload reloads the issuer directories and reports whether any changed.
+func (p *PrivacyPass) Reload() (bool, error) {
+	var changed bool
+	var errs []error
+	for _, i := range p.Issuers {
+		c, err := i.Keys.Reload()
+		changed = changed || c
+		errs = append(errs, err)
+	}
+
+	return changed, errors.Join(errs...)
+}
+
+func (p *PrivacyPass) window(now time.Time) int64 {
+	w := p.Window
+	if w <= 0 {
+		w = DefaultTokenWindow
+	}
+	return now.UnixNano() / int64(w)
+}
+
+func (p *PrivacyPass) redemptionContext(window int64) []byte {
+	m := hmac.New(sha256.New, p.key)
+	_ = binary.Write(m, binary.BigEndian, window)
+	return m.Sum(nil)
+}
+
+// tokenChallenge encodes the TokenChallenge structure of RFC 9577.
+func tokenChallenge(issuer string, redemptionContext, origin []byte) []byte {
+	b := make([]byte, 0, 2+2+len(issuer)+1+len(redemptionContext)+2+len(origin))
+	b = binary.BigEndian.AppendUint16(b, TokenTypeBlindRSA)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(issuer)))
+	b = append(b, issuer...)
+	b = append(b, byte(len(redemptionContext)))
+	b = append(b, redemptionContext...)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(origin)))
+	return append(b, origin...)
+}
+
+// AppendChallenge appends the WWW-Authenticate value challenging a client
+// for a token of any of the issuers to redeem at origin, the host of the
+// request.
+func (p *PrivacyPass) AppendChallenge(dst, origin []byte, now time.Time) []byte {
+	ctx := p.redemptionContext(p.window(now))
+	for i, issuer := range p.Issuers {
+		if i > 0 {
+			dst = append(dst, ", "...)
+		}
+		dst = append(dst, `PrivateToken challenge="`...)
+		dst = append(dst, base64.URLEncoding.EncodeToString(tokenChallenge(issuer.Name, ctx, origin))...)
+		dst = append(dst, `", token-key="`...)
+		dst = append(dst, issuer.Keys.keys.Load().challenge(now)...)
+		dst = append(dst, '"')
+	}
+	return dst
+}
+
+// Redeem verifies the token of an Authorization header for a challenge at
+// origin and returns its issuer. Each token is redeemed once.
+func (p *PrivacyPass) Redeem(authorization, origin []byte, now time.Time) (*TokenIssuer, error) {
+	token, err := parsePrivateToken(authorization)
+	if err != nil {
+		return nil, err
+	}
+
+	if binary.BigEndian.Uint16(token) != TokenTypeBlindRSA {
+		return nil, fmt.Errorf("%w: unsupported token type %d", errTokenInvalid, binary.BigEndian.Uint16(token))
+	}
+	nonce := token[2 : 2+tokenNonceSize]
+	digest := token[2+tokenNonceSize : 2+tokenNonceSize+sha256.Size]
+	keyID := token[2+tokenNonceSize+sha256.Size : tokenSize-tokenAuthenticatorSize]
+
+	var issuer *TokenIssuer
+	var key *rsa.PublicKey
+	for _, i := range p.Issuers {
+		if k := i.Keys.key(keyID); k != nil {
+			issuer, key = i, k
+			break
+		}
+	}
+	if issuer == nil {
+		return nil, errTokenKey
+	}
+
+	window := p.window(now)
+	if !p.challengeMatches(issuer, origin, digest, window) {
+		if window--; !p.challengeMatches(issuer, origin, digest, window) {
+			return nil, errTokenChallenge
+		}
+	}
+
+	msg := sha512.Sum384(token[:tokenSize-tokenAuthenticatorSize])
+	opts := &rsa.PSSOptions{SaltLength: tokenSaltSize, Hash: crypto.SHA384}
+	if err := rsa.VerifyPSS(key, crypto.SHA384, msg[:], token[tokenSize-tokenAuthenticatorSize:], opts); err != nil {
+		return nil, fmt.Errorf("%w: %w", errTokenInvalid, err)
+	}
+
+	if !p.spend([tokenNonceSize]byte(nonce), window) {
+		return nil, errTokenSpent
+	}
+
+	return issuer, nil
+}
+
+func (p *PrivacyPass) challengeMatches(issuer *TokenIssuer, origin, digest []byte, window int64) bool {
+	sum := sha256.Sum256(tokenChallenge(issuer.Name, p.redemptionContext(window), origin))
+	return hmac.Equal(sum[:], digest)
+}
+
+// spend records the nonce of a token challenged in window and reports
+// whether it was not redeemed before.
+func (p *PrivacyPass) spend(nonce [tokenNonceSize]byte, window int64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch {
+	case window == p.spentWindow+1:
+		p.previous, p.spent = p.spent, nil
+		p.spentWindow = window
+	case window > p.spentWindow:
+		p.previous, p.spent = nil, nil
+		p.spentWindow = window
+	case window < p.spentWindow-1:
+		// the window never moves back, concurrent redemptions may finish
+		// late, and tokens of older windows are not redeemable anymore
+		return false
+	}
+
+	if _, ok := p.previous[nonce]; ok {
+		return false
+	}
+	if _, ok := p.spent[nonce]; ok {
+		return false
+	}
+
+	set := &p.spent
+	if window < p.spentWindow {
+		set = &p.previous
+	}
+	if *set == nil {
+		*set = make(map[[tokenNonceSize]byte]struct{})
+	}
+	(*set)[nonce] = struct{}{}
+
+	return true
+}
+
+// parsePrivateToken returns the token of a PrivateToken Authorization header.
+func parsePrivateToken(v []byte) ([]byte, error) {
+	scheme, params, _ := strings.Cut(strings.TrimSpace(string(v)), " ")
+	if !strings.EqualFold(scheme, "PrivateToken") {
+		return nil, errTokenMissing
+	}
+
+	for _, p := range strings.Split(params, ",") {
+		k, pv, _ := strings.Cut(strings.TrimSpace(p), "=")
+		if !strings.EqualFold(strings.TrimSpace(k), "token") {
+			continue
+		}
+		pv = strings.Trim(strings.TrimSpace(pv), `"`)
+
+		token, err := decodeBase64URL(pv)
+		if err != nil || len(token) != tokenSize {
+			return nil, fmt.Errorf("%w: malformed token", errTokenInvalid)
+		}
+		return token, nil
+	}
+
+	return nil, errTokenMissing
+}
@@ -0,0 +1,345 @@
+package berghain
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testIssuer stands in for a Privacy Pass issuer. It signs blinded token
+// requests as in RFC 9578, so it never sees the token it signs.
+type testIssuer struct {
+	name string
+	key  *rsa.PrivateKey
+	enc  []byte
+}
+
+var testIssuerKey = sync.OnceValue(func() *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return key
+})
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+
+	key := testIssuerKey()
+	enc, err := MarshalTokenKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testIssuer{name: "issuer.example.net", key: key, enc: enc}
+}
+
+func (i *testIssuer) directory(t *testing.T) *IssuerDirectory {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "issuer.json")
+	dir := `{"issuer-request-uri": "https://issuer.example.net/token-request", "token-keys": [
+		{"token-type": 1, "token-key": "dW5zdXBwb3J0ZWQ"},
+		{"token-type": 2, "token-key": "` + base64.URLEncoding.EncodeToString(i.enc) + `"}
+	]}`
+	if err := os.WriteFile(path, []byte(dir), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := OpenIssuerDirectory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// blindSign is the issuer side of the issuance protocol.
+func (i *testIssuer) blindSign(blinded *big.Int) *big.Int {
+	return new(big.Int).Exp(blinded, i.key.D, i.key.N)
+}
+
+var challengeParam = regexp.MustCompile(`challenge="([^"]+)", token-key="([^"]+)"`)
+
+// fetchToken plays the client: it requests a token from the issuer for the
+// first challenge of a WWW-Authenticate value and returns the Authorization
+// value redeeming it.
+func (i *testIssuer) fetchToken(t *testing.T, wwwAuthenticate string) string {
+	t.Helper()
+
+	m := challengeParam.FindStringSubmatch(wwwAuthenticate)
+	if m == nil {
+		t.Fatalf("no challenge in %q", wwwAuthenticate)
+	}
+	challenge, err := base64.URLEncoding.DecodeString(m[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenKey, err := base64.URLEncoding.DecodeString(m[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nonce := make([]byte, tokenNonceSize)
+	_, _ = rand.Read(nonce)
+	digest := sha256.Sum256(challenge)
+	keyID := sha256.Sum256(tokenKey)
+
+	input := binary.BigEndian.AppendUint16(nil, TokenTypeBlindRSA)
+	input = append(input, nonce...)
+	input = append(input, digest[:]...)
+	input = append(input, keyID[:]...)
+
+	// blind the PSS encoded message with r^e, sign it and unblind it
+	pub := &i.key.PublicKey
+	msg := sha512.Sum384(input)
+	encoded := new(big.Int).SetBytes(emsaPSSEncode(msg[:], pub.N.BitLen()-1))
+	r, err := rand.Int(rand.Reader, pub.N)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blinded := new(big.Int).Exp(r, big.NewInt(int64(pub.E)), pub.N)
+	blinded.Mul(blinded, encoded).Mod(blinded, pub.N)
+
+	sig := i.blindSign(blinded)
+	sig.Mul(sig, new(big.Int).ModInverse(r, pub.N)).Mod(sig, pub.N)
+
+	token := append(input, sig.FillBytes(make([]byte, tokenAuthenticatorSize))...)
+	return `PrivateToken token="` + base64.URLEncoding.EncodeToString(token) + `"`
+}
+
+// emsaPSSEncode is EMSA-PSS-ENCODE of RFC 8017 with SHA-384, MGF1 and a
+// random salt.
+func emsaPSSEncode(mHash []byte, emBits int) []byte {
+	emLen := (emBits + 7) / 8
+	salt := make([]byte, tokenSaltSize)
+	_, _ = rand.Read(salt)
+
+	h := sha512.New384()
+	h.Write(make([]byte, 8))
+	h.Write(mHash)
+	h.Write(salt)
+	hash := h.Sum(nil)
+
+	db := make([]byte, emLen-len(hash)-1)
+	db[len(db)-len(salt)-1] = 0x01
+	copy(db[len(db)-len(salt):], salt)
+
+	// MGF1
+	var mask []byte
+	for counter := uint32(0); len(mask) < len(db); counter++ {
+		h.Reset()
+		h.Write(hash)
+		_ = binary.Write(h, binary.BigEndian, counter)
+		mask = h.Sum(mask)
+	}
+	for i := range db {
+		db[i] ^= mask[i]
+	}
+	db[0] &= 0xff >> (8*emLen - emBits)
+
+	return append(append(db, hash...), 0xbc)
+}
+
+func TestPrivacyPass_Redeem(t *testing.T) {
+	issuer := newTestIssuer(t)
+	secret := generateSecret(t)
+	p, err := NewPrivacyPass(secret, []*TokenIssuer{{Name: issuer.name, Keys: issuer.directory(t)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	origin := []byte("example.com")
+
+	challenge := string(p.AppendChallenge(nil, origin, now))
+	authorization := issuer.fetchToken(t, challenge)
+
+	if _, err := p.Redeem([]byte(authorization), []byte("example.org"), now); !errors.Is(err, errTokenChallenge) {
+		t.Errorf("Redeem for other origin = %v, want %v", err, errTokenChallenge)
+	}
+	if _, err := p.Redeem([]byte(authorization), origin, now.Add(2*DefaultTokenWindow)); !errors.Is(err, errTokenChallenge) {
+		t.Errorf("Redeem after two windows = %v, want %v", err, errTokenChallenge)
+	}
+
+	got, err := p.Redeem([]byte(authorization), origin, now.Add(DefaultTokenWindow))
+	if err != nil {
+		t.Fatalf("Redeem: %v", err)
+	}
+	if got.Name != issuer.name {
+		t.Errorf("issuer = %s, want %s", got.Name, issuer.name)
+	}
+
+	if _, err := p.Redeem([]byte(authorization), origin, now.Add(DefaultTokenWindow)); !errors.Is(err, errTokenSpent) {
+		t.Errorf("second Redeem = %v, want %v", err, errTokenSpent)
+	}
+
+	// challenges are derived from the secret, spends are tracked per agent
+	restarted, err := NewPrivacyPass(secret, p.Issuers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restarted.Redeem([]byte(authorization), origin, now); err != nil {
+		t.Errorf("Redeem after restart = %v", err)
+	}
+	other, err := NewPrivacyPass(generateSecret(t), p.Issuers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Redeem([]byte(authorization), origin, now); !errors.Is(err, errTokenChallenge) {
+		t.Errorf("Redeem with other secret = %v, want %v", err, errTokenChallenge)
+	}
+}
+
+func TestPrivacyPass_RedeemInvalid(t *testing.T) {
+	issuer := newTestIssuer(t)
+	p, err := NewPrivacyPass(generateSecret(t), []*TokenIssuer{{Name: issuer.name, Keys: issuer.directory(t)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	origin := []byte("example.com")
+
+	token, _ := parsePrivateToken([]byte(issuer.fetchToken(t, string(p.AppendChallenge(nil, origin, now)))))
+	forged := append([]byte(nil), token...)
+	forged[len(forged)-1] ^= 1
+	otherKey := append([]byte(nil), token...)
+	otherKey[2+tokenNonceSize+sha256.Size] ^= 1
+
+	for _, tt := range []struct {
+		name          string
+		authorization string
+		want          error
+	}{
+		{name: "other scheme", authorization: "Bearer abc", want: errTokenMissing},
+		{name: "malformed", authorization: `PrivateToken token="abc"`, want: errTokenInvalid},
+		{name: "forged", authorization: `PrivateToken token="` + base64.URLEncoding.EncodeToString(forged) + `"`, want: errTokenInvalid},
+		{name: "unknown key", authorization: `PrivateToken token=` + base64.RawURLEncoding.EncodeToString(otherKey), want: errTokenKey},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := p.Redeem([]byte(tt.authorization), origin, now); !errors.Is(err, tt.want) {
+				t.Errorf("Redeem = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrivacyPass_Spend(t *testing.T) {
+	var p PrivacyPass
+	const window = 1000
+	a, b, c := [tokenNonceSize]byte{1}, [tokenNonceSize]byte{2}, [tokenNonceSize]byte{3}
+
+	if !p.spend(a, window) {
+		t.Fatal("spend in the current window = false")
+	}
+	// a token challenged in the previous window, redeemed late
+	if !p.spend(b, window-1) {
+		t.Fatal("spend in the previous window = false")
+	}
+	if p.spend(a, window) {
+		t.Error("replay in the current window after a late redemption = true")
+	}
+	if p.spend(b, window) {
+		t.Error("replay of the late redemption = true")
+	}
+	if p.spend(c, window-2) {
+		t.Error("spend two windows back = true")
+	}
+
+	if !p.spend(c, window+1) {
+		t.Fatal("spend in the next window = false")
+	}
+	if p.spend(a, window) {
+		t.Error("replay in the previous window after it moved on = true")
+	}
+	if p.spend(b, window-1) {
+		t.Error("spend in a window that expired = true")
+	}
+}
+
+func TestPrivacyPass_AppendChallenge(t *testing.T) {
+	issuer := newTestIssuer(t)
+	p, err := NewPrivacyPass(generateSecret(t), []*TokenIssuer{{Name: issuer.name, Keys: issuer.directory(t)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+
+	m := challengeParam.FindStringSubmatch(string(p.AppendChallenge(nil, []byte("example.com"), now)))
+	if m == nil {
+		t.Fatal("no challenge")
+	}
+	challenge, _ := base64.URLEncoding.DecodeString(m[1])
+	want := tokenChallenge(issuer.name, p.redemptionContext(p.window(now)), []byte("example.com"))
+	if string(challenge) != string(want) {
+		t.Errorf("challenge = %x, want %x", challenge, want)
+	}
+	if m[2] != base64.URLEncoding.EncodeToString(issuer.enc) {
+		t.Errorf("token-key = %s, want the issuer key", m[2])
+	}
+
+	if next := string(p.AppendChallenge(nil, []byte("example.com"), now.Add(DefaultTokenWindow))); next == m[0] {
+		t.Error("redemption context did not change with the window")
+	}
+}
+
+func TestIssuerKeys_Challenge(t *testing.T) {
+	issuer := newTestIssuer(t)
+	// the same key with the rsaEncryption identifier has another key ID
+	next, err := x509.MarshalPKIXPublicKey(&issuer.key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := base64.URLEncoding.EncodeToString(issuer.enc)
+	rotated := base64.URLEncoding.EncodeToString(next)
+
+	keys, err := parseIssuerDirectory([]byte(`{"token-keys": [
+		{"token-type": 2, "token-key": "` + rotated + `", "not-before": 2000},
+		{"token-type": 2, "token-key": "` + current + `", "not-before": 1000}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		now  int64
+		want string
+	}{
+		{name: "no key valid yet", now: 500, want: current},
+		{name: "current key", now: 1500, want: current},
+		{name: "rotated key", now: 2000, want: rotated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := keys.challenge(time.Unix(tt.now, 0)); got != tt.want {
+				t.Errorf("challenge = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTokenKey(t *testing.T) {
+	issuer := newTestIssuer(t)
+
+	pub, err := parseTokenKey(issuer.enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pub.Equal(&issuer.key.PublicKey) {
+		t.Error("parsed key differs")
+	}
+
+	if _, err := parseTokenKey(issuer.enc[:len(issuer.enc)-1]); err == nil {
+		t.Error("truncated key parsed")
+	}
+}
@@ -0,0 +1,188 @@
+package berghain
+
+import (
+	"fmt"
+
+	"github.com/dropmorepackets/haproxy-go/pkg/buffer"
+)
+
+// ProtocolVersion identifies a revision of the challenge protocol spoken
+// between the challenge page and the agent. Clients state the highest version
+// they understand on the challenge GET. Clients stating none are answered
+// with ProtocolV1, so interstitial pages cached before versioning keep working.
+type ProtocolVersion uint8
+
+const (
+	// ProtocolV1 is the original, unversioned protocol.
+	ProtocolV1 ProtocolVersion = 1
+	// ProtocolV2 adds the version field "v" to every challenge and the
+	// support ID to captcha challenges.
+	ProtocolV2 ProtocolVersion = 2
+
+	// ProtocolLatest is the highest version the agent speaks.
+	ProtocolLatest = ProtocolV2
+)
+
+// NegotiateProtocol returns the version to answer a client with, given the
+// version stated by the client. Missing or malformed values select
+// ProtocolV1, versions newer than ProtocolLatest are answered with the latest.
+func NegotiateProtocol(stated []byte) ProtocolVersion {
+	if len(stated) == 0 || len(stated) > 3 {
+		return ProtocolV1
+	}
+
+	v := 0
+	for _, c := range stated {
+		if c < '0' || c > '9' {
+			return ProtocolV1
+		}
+		v = v*10 + int(c-'0')
+	}
+
+	return ProtocolVersion(max(int(ProtocolV1), min(v, int(ProtocolLatest))))
+}
+
+// ChallengeType is the challenge type number "t" of the protocol. It differs
+// from ValidationType, which numbers the validators of the agent.
+type ChallengeType int
+
+const (
+	ChallengeTypeNone ChallengeType = iota
+	ChallengeTypePOW
+	// ChallengeTypePOWWorker is reserved for worker-based POW.
+	ChallengeTypePOWWorker
+	ChallengeTypeTurnstile
+	ChallengeTypeHCaptcha
+	ChallengeTypeReCaptcha
+)
+
+// ChallengeType returns the protocol challenge type of the validation type,
+// and whether it has one.
+func (v ValidationType) ChallengeType() (ChallengeType, bool) {
+	switch v {
+	case ValidationTypeNone:
+		return ChallengeTypeNone, true
+	case ValidationTypePOW:
+		return ChallengeTypePOW, true
+	case ValidationTypeTurnstile:
+		return ChallengeTypeTurnstile, true
+	case ValidationTypeHCaptcha:
+		return ChallengeTypeHCaptcha, true
+	case ValidationTypeReCaptcha:
+		return ChallengeTypeReCaptcha, true
+	default:
+		return 0, false
+	}
+}
+
+// Challenge is the JSON payload answering a challenge GET. The validators
+// write it without allocating, this type documents it for clients. The POST
+// solving it carries a Submission.
+type Challenge struct {
+	// Version is set from ProtocolV2 on.
+	Version   ProtocolVersion `json:"v,omitempty"`
+	Countdown int             `json:"c"`
+	Type      ChallengeType   `json:"t"`
+	// Random and Hash are set for POW challenges.
+	Random string `json:"r,omitempty"`
+	Hash   string `json:"s,omitempty"`
+	// Sitekey is set for captcha challenges.
+	Sitekey string `json:"k,omitempty"`
+	// SupportID is set for all challenges, except captcha challenges
+	// before ProtocolV2.
+	SupportID string `json:"i,omitempty"`
+}
+
+// Submission is the body of the POST solving a challenge. Its fields point
+// into the body, so the validators parse it without allocating. The format is
+// the same in all versions so far, the version is the one the page states on
+// the POST like on the challenge GET.
+//
+// A POW solution carries Random, Hash and the decimal Nonce separated by
+// dashes, where Nonce appended to Random hashes to a sum starting with two
+// zero bytes. A captcha solution carries the response token of the provider
+// widget.
+type Submission struct {
+	Version ProtocolVersion
+	Type    ChallengeType
+	// Random, Hash and Nonce are set for POW solutions, SupportID is the
+	// support ID embedded in Random.
+	Random    []byte
+	Hash      []byte
+	Nonce     []byte
+	SupportID []byte
+	// Token is set for captcha solutions.
+	Token []byte
+}
+
+// ParseSubmission parses the body of a POST solving a challenge of type t,
+// stating version v.
+func ParseSubmission(v ProtocolVersion, t ChallengeType, body []byte) (Submission, error) {
+	s := Submission{Version: v, Type: t}
+
+	switch t {
+	case ChallengeTypePOW:
+		if len(body) < validatorPOWMinSolutionLength || len(body) > validatorPOWMaxSolutionLength {
+			return s, ErrInvalidLength
+		}
+
+		b := buffer.NewSliceBufferWithSlice(body)
+		s.Random = b.ReadNBytes(len(validatorPOWRandom))
+		if separator := b.ReadNBytes(1); len(separator) != 1 || separator[0] != '-' {
+			return s, ErrInvalidLength
+		}
+		s.Hash = b.ReadNBytes(len(validatorPOWHash))
+		if separator := b.ReadNBytes(1); len(separator) != 1 || separator[0] != '-' {
+			return s, ErrInvalidLength
+		}
+		s.Nonce = b.ReadBytes()
+		for _, c := range s.Nonce {
+			if c < '0' || c > '9' {
+				return s, ErrInvalidLength
+			}
+		}
+		s.SupportID = s.Random[len(validatorPOWTimestamp):]
+	case ChallengeTypeTurnstile, ChallengeTypeHCaptcha, ChallengeTypeReCaptcha:
+		if len(body) == 0 {
+			return s, ErrEmpty
+		}
+		if len(body) > validatorCaptchaMaxTokenLength {
+			return s, ErrInvalidLength
+		}
+		s.Token = body
+	default:
+		return s, fmt.Errorf("challenge type %d takes no submission", t)
+	}
+
+	return s, nil
+}
+
+// AppendTo appends the body of the submission to b. The version is not part
+// of the body.
+func (s Submission) AppendTo(b []byte) []byte {
+	if s.Type != ChallengeTypePOW {
+		return append(b, s.Token...)
+	}
+
+	b = append(b, s.Random...)
+	b = append(b, '-')
+	b = append(b, s.Hash...)
+	b = append(b, '-')
+	return append(b, s.Nonce...)
+}
+
+// writeChallengeHeader starts a challenge with the fields common to all
+// challenge types.
+func writeChallengeHeader(w *jsonWriter, req *ValidatorRequest, lc *LevelConfig) error {
+	t, ok := lc.Type.ChallengeType()
+	if !ok {
+		return fmt.Errorf("validation type %d has no challenge type", lc.Type)
+	}
+
+	if req.Protocol >= ProtocolV2 {
+		w.Int("v", int(req.Protocol))
+	}
+	w.Int("c", lc.Countdown)
+	w.Int("t", int(t))
+	return nil
+}
@@ -0,0 +1,169 @@
+package berghain
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/netip"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNegotiateProtocol(t *testing.T) {
+	tests := []struct {
+		stated string
+		want   ProtocolVersion
+	}{
+		{stated: "", want: ProtocolV1},
+		{stated: "0", want: ProtocolV1},
+		{stated: "1", want: ProtocolV1},
+		{stated: "2", want: ProtocolV2},
+		{stated: "02", want: ProtocolV2},
+		{stated: "99", want: ProtocolLatest},
+		{stated: "1000", want: ProtocolV1},
+		{stated: "-2", want: ProtocolV1},
+		{stated: "v2", want: ProtocolV1},
+	}
+
+	for _, tt := range tests {
+		if got := NegotiateProtocol([]byte(tt.stated)); got != tt.want {
+			t.Errorf("NegotiateProtocol(%q) = %d, want %d", tt.stated, got, tt.want)
+		}
+	}
+}
+
+func TestValidationType_ChallengeType(t *testing.T) {
+	tests := []struct {
+		v    ValidationType
+		want ChallengeType
+	}{
+		{ValidationTypeNone, ChallengeTypeNone},
+		{ValidationTypePOW, ChallengeTypePOW},
+		{ValidationTypeTurnstile, ChallengeTypeTurnstile},
+		{ValidationTypeHCaptcha, ChallengeTypeHCaptcha},
+		{ValidationTypeReCaptcha, ChallengeTypeReCaptcha},
+	}
+
+	for _, tt := range tests {
+		if got, ok := tt.v.ChallengeType(); !ok || got != tt.want {
+			t.Errorf("%d.ChallengeType() = %d, %v, want %d", tt.v, got, ok, tt.want)
+		}
+	}
+
+	if _, ok := ValidationType(99).ChallengeType(); ok {
+		t.Error("unknown validation type has a challenge type")
+	}
+}
+
+func TestChallengeVersionField(t *testing.T) {
+	bh := NewBerghain(generateSecret(t))
+	bh.Levels = []*LevelConfig{
+		{Duration: time.Minute, Type: ValidationTypeNone},
+		{Duration: time.Minute, Type: ValidationTypePOW},
+	}
+
+	for _, level := range []uint8{1, 2} {
+		for _, protocol := range []ProtocolVersion{0, ProtocolV1, ProtocolV2} {
+			req, resp := AcquireValidatorRequest(), AcquireValidatorResponse()
+			req.Identifier = &RequestIdentifier{
+				SrcAddr: netip.MustParseAddr("1.2.3.4"),
+				Host:    []byte("example.com"),
+				Level:   level,
+			}
+			req.Method = http.MethodGet
+			req.Protocol = protocol
+			req.SupportID = []byte("bh@123e4567-e89b-12d3-a456-426614174000")
+
+			if err := bh.LevelConfig(level).Type.RunValidator(bh, req, resp); err != nil {
+				t.Fatalf("level %d protocol %d: validator failed: %v", level, protocol, err)
+			}
+
+			var challenge Challenge
+			if err := json.Unmarshal(resp.Body.ReadBytes(), &challenge); err != nil {
+				t.Fatalf("level %d protocol %d: decode: %v", level, protocol, err)
+			}
+
+			want := ProtocolVersion(0)
+			if protocol >= ProtocolV2 {
+				want = protocol
+			}
+			if challenge.Version != want {
+				t.Errorf("level %d protocol %d: version = %d, want %d", level, protocol, challenge.Version, want)
+			}
+
+			ReleaseValidatorRequest(req)
+			ReleaseValidatorResponse(resp)
+		}
+	}
+}
+
+// TestSubmission_RoundTrip parses the bodies web/ builds for the challenges
+// in testdata/submissions.json and writes them back.
+func TestSubmission_RoundTrip(t *testing.T) {
+	raw, err := os.ReadFile("testdata/submissions.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fixtures []struct {
+		Name      string
+		Challenge Challenge
+		Solution  string
+		Body      string
+	}
+	if err := json.Unmarshal(raw, &fixtures); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range fixtures {
+		t.Run(f.Name, func(t *testing.T) {
+			c := f.Challenge
+			sub, err := ParseSubmission(c.Version, c.Type, []byte(f.Body))
+			if err != nil {
+				t.Fatalf("ParseSubmission: %v", err)
+			}
+
+			want := Submission{Version: c.Version, Type: c.Type}
+			if c.Type == ChallengeTypePOW {
+				want.Random, want.Hash, want.Nonce, want.SupportID = []byte(c.Random), []byte(c.Hash), []byte(f.Solution), []byte(c.SupportID)
+			} else {
+				want.Token = []byte(f.Solution)
+			}
+			if !reflect.DeepEqual(sub, want) {
+				t.Errorf("ParseSubmission = %+v, want %+v", sub, want)
+			}
+
+			if got := string(sub.AppendTo(nil)); got != f.Body {
+				t.Errorf("AppendTo = %q, want %q", got, f.Body)
+			}
+		})
+	}
+}
+
+func TestParseSubmission_Invalid(t *testing.T) {
+	pow := validatorPOWRandom + "-" + validatorPOWHash + "-"
+	tests := []struct {
+		name string
+		t    ChallengeType
+		body string
+		want error
+	}{
+		{name: "pow short", t: ChallengeTypePOW, body: pow, want: ErrInvalidLength},
+		{name: "pow separator", t: ChallengeTypePOW, body: validatorPOWRandom + "+" + validatorPOWHash + "-1", want: ErrInvalidLength},
+		{name: "pow nonce", t: ChallengeTypePOW, body: pow + "1a", want: ErrInvalidLength},
+		{name: "captcha empty", t: ChallengeTypeTurnstile, want: ErrEmpty},
+		{name: "captcha long", t: ChallengeTypeHCaptcha, body: strings.Repeat("a", validatorCaptchaMaxTokenLength+1), want: ErrInvalidLength},
+	}
+
+	for _, tt := range tests {
+		if _, err := ParseSubmission(ProtocolLatest, tt.t, []byte(tt.body)); !errors.Is(err, tt.want) {
+			t.Errorf("%s: ParseSubmission = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	if _, err := ParseSubmission(ProtocolLatest, ChallengeTypeNone, nil); err == nil {
+		t.Error("ParseSubmission of a challenge type without submissions succeeded")
+	}
+}
@@ -0,0 +1,203 @@
+package berghain
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate allows Requests per Per, in bursts of up to Requests.
+// The zero value is no limit.
+type Rate struct {
+	Requests int
+	Per      time.Duration
+}
+
+// ParseRate parses rates like "10/1m" or "100/s".
+func ParseRate(s string) (Rate, error) {
+	n, per, ok := strings.Cut(s, "/")
+	if !ok {
+		return Rate{}, fmt.Errorf("invalid rate %q: missing /", s)
+	}
+
+	requests, err := strconv.Atoi(n)
+	if err != nil || requests <= 0 {
+		return Rate{}, fmt.Errorf("invalid rate %q: requests must be a positive number", s)
+	}
+
+	d, err := time.ParseDuration(per)
+	if err != nil {
+		// allow a bare unit, as in 100/s
+		d, err = time.ParseDuration("1" + per)
+	}
+	if err != nil || d <= 0 {
+		return Rate{}, fmt.Errorf("invalid rate %q: invalid period", s)
+	}
+
+	return Rate{Requests: requests, Per: d}, nil
+}
+
+func (r Rate) String() string {
+	if r.Requests == 0 {
+		return ""
+	}
+	return strconv.Itoa(r.Requests) + "/" + r.Per.String()
+}
+
+// ChallengeRateLimits bound the challenge requests of a level. GET requests
+// issue challenges, POST requests submit solutions, which for captcha types
+// costs a request to the provider. Zero rates disable a limit.
+type ChallengeRateLimits struct {
+	GetPerIP        Rate
+	PostPerIP       Rate
+	GetPerFrontend  Rate
+	PostPerFrontend Rate
+}
+
+// RateLimitError is returned for rate limited challenge requests.
+// It matches ErrRateLimited with errors.Is.
+type RateLimitError struct {
+	// RetryAfter is the time after which the request would be allowed.
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", ErrRateLimited, e.RetryAfter)
+}
+
+func (e *RateLimitError) Unwrap() error {
+	return ErrRateLimited
+}
+
+// maxRateLimitEntries bounds the number of per address limits kept by a
+// frontend. Once reached, limits that have fully recovered are evicted first.
+const maxRateLimitEntries = 100000
+
+type rateLimitKey struct {
+	level uint8
+	post  bool
+	// addr is invalid for the frontend limit
+	addr netip.Addr
+}
+
+// rateLimiter implements the generic cell rate algorithm: each key stores
+// the theoretical arrival time of its next request. The zero value is ready
+// to use.
+type rateLimiter struct {
+	mu  sync.Mutex
+	tat map[rateLimitKey]time.Time
+}
+
+// rateLimit is a rate applied to a key.
+type rateLimit struct {
+	key  rateLimitKey
+	rate Rate
+}
+
+// allow reports how long the request has to wait, zero if it is allowed.
+// The request is only charged against the limits if all of them allow it, so
+// a request rejected by one limit does not use up the others.
+func (l *rateLimiter) allow(now time.Time, limits ...rateLimit) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var wait time.Duration
+	for _, lim := range limits {
+		if lim.rate.Requests > 0 {
+			_, w := l.next(lim, now)
+			wait = max(wait, w)
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+
+	if l.tat == nil {
+		l.tat = make(map[rateLimitKey]time.Time)
+	}
+	for _, lim := range limits {
+		if lim.rate.Requests <= 0 {
+			continue
+		}
+		tat, _ := l.next(lim, now)
+		if _, ok := l.tat[lim.key]; !ok && len(l.tat) >= maxRateLimitEntries {
+			l.evict(now)
+		}
+		l.tat[lim.key] = tat
+	}
+	return 0
+}
+
+// next returns the theoretical arrival time of the key after the request,
+// and how long the request has to wait for it. l.mu must be held.
+func (l *rateLimiter) next(lim rateLimit, now time.Time) (time.Time, time.Duration) {
+	interval := lim.rate.Per / time.Duration(lim.rate.Requests)
+
+	tat := l.tat[lim.key]
+	if tat.Before(now) {
+		tat = now
+	}
+
+	tat = tat.Add(interval)
+	return tat, max(0, tat.Sub(now)-lim.rate.Per)
+}
+
+// evict drops a recovered entry, or the one closest to recovery among a
+// few, see Reputation.evict.
+func (l *rateLimiter) evict(now time.Time) {
+	var victim rateLimitKey
+	var earliest time.Time
+
+	n := 0
+	for k, tat := range l.tat {
+		if n == 0 || tat.Before(earliest) {
+			victim, earliest = k, tat
+		}
+		if n++; n == evictionSamples || tat.Before(now) {
+			break
+		}
+	}
+
+	delete(l.tat, victim)
+}
+
+// AllowChallenge applies the rate limits of the request level to a
+// challenge request of ri with the given method. Limited requests return a
+// *RateLimitError.
+func (b *Berghain) AllowChallenge(ri *RequestIdentifier, method string) error {
+	limits := b.LevelConfig(ri.Level).RateLimits
+	post := method == http.MethodPost
+
+	perIP, perFrontend := limits.GetPerIP, limits.GetPerFrontend
+	if post {
+		perIP, perFrontend = limits.PostPerIP, limits.PostPerFrontend
+	}
+
+	ipKey := rateLimitKey{level: ri.Level, post: post, addr: ri.SrcAddr.Unmap()}
+	frontendKey := rateLimitKey{level: ri.Level, post: post}
+	if wait := b.challengeLimiter.allow(tc.Now(),
+		rateLimit{key: ipKey, rate: perIP},
+		rateLimit{key: frontendKey, rate: perFrontend},
+	); wait > 0 {
+		return &RateLimitError{RetryAfter: wait}
+	}
+
+	return nil
+}
+
+// FailureRetryAfter returns the number of seconds after which a client should
+// retry a request that failed with err, or -1 if retrying cannot succeed.
+// Rate limited requests are told when the limit allows them again.
+func FailureRetryAfter(code ErrorCode, err error) int {
+	var rl *RateLimitError
+	if errors.As(err, &rl) {
+		return max(1, int(math.Ceil(rl.RetryAfter.Seconds())))
+	}
+	return code.RetryAfter()
+}
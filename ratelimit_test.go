@@ -0,0 +1,157 @@
+package berghain
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Rate
+		wantErr bool
+	}{
+		{in: "10/1m", want: Rate{Requests: 10, Per: time.Minute}},
+		{in: "100/s", want: Rate{Requests: 100, Per: time.Second}},
+		{in: "5/1h30m", want: Rate{Requests: 5, Per: 90 * time.Minute}},
+		{in: "10", wantErr: true},
+		{in: "0/1m", wantErr: true},
+		{in: "-1/1m", wantErr: true},
+		{in: "ten/1m", wantErr: true},
+		{in: "10/0s", wantErr: true},
+		{in: "10/fortnight", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseRate(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseRate(%q) = %v, %v, want %v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	var l rateLimiter
+	key := rateLimitKey{level: 1, addr: netip.MustParseAddr("192.0.2.1")}
+	rate := Rate{Requests: 3, Per: 3 * time.Second}
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if wait := l.allow(now, rateLimit{key: key, rate: rate}); wait != 0 {
+			t.Fatalf("request %d of burst waits %s", i, wait)
+		}
+	}
+	if wait := l.allow(now, rateLimit{key: key, rate: rate}); wait != time.Second {
+		t.Errorf("request after burst waits %s, want 1s", wait)
+	}
+
+	// one request per second recovers
+	now = now.Add(time.Second)
+	if wait := l.allow(now, rateLimit{key: key, rate: rate}); wait != 0 {
+		t.Errorf("request after recovery waits %s", wait)
+	}
+	if wait := l.allow(now, rateLimit{key: key, rate: rate}); wait == 0 {
+		t.Errorf("second request after recovery allowed")
+	}
+
+	if wait := l.allow(now, rateLimit{key: rateLimitKey{level: 1, addr: netip.MustParseAddr("192.0.2.2")}, rate: rate}); wait != 0 {
+		t.Errorf("other address waits %s", wait)
+	}
+	if wait := l.allow(now, rateLimit{key: key, rate: Rate{}}); wait != 0 {
+		t.Errorf("unlimited request waits %s", wait)
+	}
+
+	// a request rejected by one limit is not charged against the others
+	other := rateLimitKey{level: 1, addr: netip.MustParseAddr("192.0.2.3")}
+	if wait := l.allow(now, rateLimit{key: other, rate: rate}, rateLimit{key: key, rate: rate}); wait == 0 {
+		t.Errorf("request allowed past the exhausted limit")
+	}
+	if _, ok := l.tat[other]; ok {
+		t.Errorf("rejected request charged the other limit")
+	}
+}
+
+func TestBerghain_AllowChallenge(t *testing.T) {
+	b := NewBerghain(make([]byte, 32))
+	b.Levels = []*LevelConfig{{
+		Type: ValidationTypePOW,
+		RateLimits: ChallengeRateLimits{
+			GetPerIP:        Rate{Requests: 2, Per: time.Minute},
+			PostPerIP:       Rate{Requests: 1, Per: time.Minute},
+			PostPerFrontend: Rate{Requests: 2, Per: time.Minute},
+		},
+	}}
+
+	ri := func(addr string) *RequestIdentifier {
+		return &RequestIdentifier{SrcAddr: netip.MustParseAddr(addr), Level: 1}
+	}
+
+	tests := []struct {
+		addr    string
+		method  string
+		limited bool
+	}{
+		{"192.0.2.1", http.MethodGet, false},
+		{"::ffff:192.0.2.1", http.MethodGet, false},
+		{"192.0.2.1", http.MethodGet, true},
+		{"192.0.2.1", http.MethodPost, false},
+		{"192.0.2.1", http.MethodPost, true},
+		{"192.0.2.2", http.MethodPost, false},
+		// the frontend limit applies to all addresses
+		{"192.0.2.3", http.MethodPost, true},
+		{"192.0.2.3", http.MethodGet, false},
+	}
+
+	for i, tt := range tests {
+		err := b.AllowChallenge(ri(tt.addr), tt.method)
+		if limited := errors.Is(err, ErrRateLimited); limited != tt.limited {
+			t.Errorf("%d: %s %s limited = %v, want %v", i, tt.method, tt.addr, limited, tt.limited)
+		}
+		var rl *RateLimitError
+		if tt.limited && (!errors.As(err, &rl) || rl.RetryAfter <= 0) {
+			t.Errorf("%d: error %v has no retry after", i, err)
+		}
+	}
+}
+
+func TestWriteFailure_RateLimited(t *testing.T) {
+	req, resp := AcquireValidatorRequest(), AcquireValidatorResponse()
+	defer ReleaseValidatorRequest(req)
+	defer ReleaseValidatorResponse(resp)
+
+	req.Method = http.MethodGet
+	if code := WriteFailure(req, resp, &RateLimitError{RetryAfter: 1500 * time.Millisecond}); code != ErrorCodeRateLimited {
+		t.Errorf("code = %s, want %s", code, ErrorCodeRateLimited)
+	}
+
+	var failure Failure
+	if err := json.Unmarshal(resp.Body.ReadBytes(), &failure); err != nil {
+		t.Fatalf("decode %q: %v", resp.Body.ReadBytes(), err)
+	}
+	if failure.RetryAfter != 2 {
+		t.Errorf("retry after = %d, want 2", failure.RetryAfter)
+	}
+}
+
+func TestFailureRetryAfter(t *testing.T) {
+	tests := []struct {
+		code ErrorCode
+		err  error
+		want int
+	}{
+		{ErrorCodeRateLimited, &RateLimitError{RetryAfter: time.Millisecond}, 1},
+		{ErrorCodeRateLimited, &RateLimitError{RetryAfter: 10 * time.Second}, 10},
+		{ErrorCodeRateLimited, ErrRateLimited, ErrorCodeRateLimited.RetryAfter()},
+		{ErrorCodeInternal, errResponseTooLarge, 5},
+	}
+
+	for _, tt := range tests {
+		if got := FailureRetryAfter(tt.code, tt.err); got != tt.want {
+			t.Errorf("FailureRetryAfter(%s, %v) = %d, want %d", tt.code, tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package berghain
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ReputationConfig configures a Reputation.
+type ReputationConfig struct {
+	// Threshold is the failure score of a single address from which on its
+	// level is raised.
+	Threshold float64
+	// PrefixThreshold is the failure score of a prefix from which on the
+	// level of all its addresses is raised, zero disables prefix scores.
+	PrefixThreshold float64
+	// PrefixBitsV4 and PrefixBitsV6 are the prefix lengths scores are
+	// aggregated by, defaulting to 24 and 64.
+	PrefixBitsV4 int
+	PrefixBitsV6 int
+	// Level is the minimum level of addresses above a threshold.
+	Level uint8
+	// HalfLife is the time after which a score has decayed to half its
+	// value, defaults to 10 minutes.
+	HalfLife time.Duration
+	// MaxEntries bounds the number of scores kept, defaults to 100000.
+	// Once reached, low scores are evicted first.
+	MaxEntries int
+}
+
+// negligibleScore is the score below which an entry is dropped.
+const negligibleScore = 0.01
+
+// evictionSamples is the number of entries looked at to find one to evict.
+const evictionSamples = 8
+
+// Reputation keeps decaying failure scores per address and per prefix. Each
+// failure adds one to both scores, which then halve every HalfLife.
+type Reputation struct {
+	cfg ReputationConfig
+
+	mu     sync.RWMutex
+	scores map[netip.Prefix]reputationScore
+}
+
+type reputationScore struct {
+	score float64
+	// updated is the time the score was last decayed to
+	updated time.Time
+}
+
+func (s reputationScore) at(now time.Time, halfLife time.Duration) float64 {
+	dt := now.Sub(s.updated)
+	if dt <= 0 {
+		return s.score
+	}
+	return s.score * math.Exp2(-float64(dt)/float64(halfLife))
+}
+
+var errInvalidReputation = errors.New("invalid reputation config")
+
+// NewReputation returns an empty Reputation.
+func NewReputation(cfg ReputationConfig) (*Reputation, error) {
+	if cfg.PrefixBitsV4 == 0 {
+		cfg.PrefixBitsV4 = 24
+	}
+	if cfg.PrefixBitsV6 == 0 {
+		cfg.PrefixBitsV6 = 64
+	}
+	if cfg.HalfLife == 0 {
+		cfg.HalfLife = 10 * time.Minute
+	}
+	if cfg.MaxEntries == 0 {
+		cfg.MaxEntries = 100000
+	}
+
+	switch {
+	case cfg.Threshold <= 0:
+		return nil, fmt.Errorf("%w: threshold must be positive", errInvalidReputation)
+	case cfg.PrefixThreshold < 0:
+		return nil, fmt.Errorf("%w: prefix threshold cannot be negative", errInvalidReputation)
+	case cfg.PrefixBitsV4 < 0 || cfg.PrefixBitsV4 > 32 || cfg.PrefixBitsV6 < 0 || cfg.PrefixBitsV6 > 128:
+		return nil, fmt.Errorf("%w: invalid prefix length", errInvalidReputation)
+	case cfg.Level == 0:
+		return nil, fmt.Errorf("%w: level must be at least 1", errInvalidReputation)
+	case cfg.HalfLife < 0:
+		return nil, fmt.Errorf("%w: half life cannot be negative", errInvalidReputation)
+	case cfg.MaxEntries < 0:
+		return nil, fmt.Errorf("%w: max entries cannot be negative", errInvalidReputation)
+	}
+
+	return &Reputation{
+		cfg:    cfg,
+		scores: make(map[netip.Prefix]reputationScore),
+	}, nil
+}
+
+// keys returns the address and prefix the scores of addr are kept under.
+// The prefix is invalid if prefix scores are disabled.
+func (r *Reputation) keys(addr netip.Addr) (netip.Prefix, netip.Prefix) {
+	addr = addr.Unmap()
+	bits := r.cfg.PrefixBitsV6
+	if addr.Is4() {
+		bits = r.cfg.PrefixBitsV4
+	}
+
+	var prefix netip.Prefix
+	if r.cfg.PrefixThreshold > 0 {
+		// the error is impossible, bits is checked by NewReputation
+		prefix, _ = addr.Prefix(bits)
+	}
+
+	return netip.PrefixFrom(addr, addr.BitLen()), prefix
+}
+
+// Fail records a failure of the address at now.
+func (r *Reputation) Fail(addr netip.Addr, now time.Time) {
+	a, p := r.keys(addr)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.add(a, now)
+	if p.IsValid() {
+		r.add(p, now)
+	}
+}
+
+func (r *Reputation) add(key netip.Prefix, now time.Time) {
+	s, ok := r.scores[key]
+	if !ok && len(r.scores) >= r.cfg.MaxEntries {
+		r.evict(now)
+	}
+
+	r.scores[key] = reputationScore{score: s.at(now, r.cfg.HalfLife) + 1, updated: now}
+}
+
+// evict drops the lowest of a few entries. Map iteration starts at a random
+// entry, so this approximates evicting the lowest score without a full scan.
+func (r *Reputation) evict(now time.Time) {
+	var victim netip.Prefix
+	lowest := math.Inf(1)
+
+	n := 0
+	for k, s := range r.scores {
+		if score := s.at(now, r.cfg.HalfLife); score < lowest {
+			victim, lowest = k, score
+		}
+		if n++; n == evictionSamples {
+			break
+		}
+	}
+
+	delete(r.scores, victim)
+}
+
+// Scores returns the failure scores of the address and its prefix at now.
+func (r *Reputation) Scores(addr netip.Addr, now time.Time) (address, prefix float64) {
+	a, p := r.keys(addr)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.scores) == 0 {
+		return 0, 0
+	}
+
+	address = r.scores[a].at(now, r.cfg.HalfLife)
+	if p.IsValid() {
+		prefix = r.scores[p].at(now, r.cfg.HalfLife)
+	}
+
+	return address, prefix
+}
+
+// MinLevel returns the minimum level of the address at now, zero if neither
+// its score nor the score of its prefix passed their threshold.
+func (r *Reputation) MinLevel(addr netip.Addr, now time.Time) uint8 {
+	address, prefix := r.Scores(addr, now)
+	if address >= r.cfg.Threshold || r.cfg.PrefixThreshold > 0 && prefix >= r.cfg.PrefixThreshold {
+		return r.cfg.Level
+	}
+	return 0
+}
+
+// Len returns the number of scores kept.
+func (r *Reputation) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return len(r.scores)
+}
+
+// Prune drops the scores that have decayed to a negligible value at now.
+func (r *Reputation) Prune(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for k, s := range r.scores {
+		if s.at(now, r.cfg.HalfLife) < negligibleScore {
+			delete(r.scores, k)
+		}
+	}
+}
+
+type reputationSnapshot struct {
+	Scores []reputationSnapshotEntry `json:"scores"`
+}
+
+type reputationSnapshotEntry struct {
+	Prefix  netip.Prefix `json:"p"`
+	Score   float64      `json:"s"`
+	Updated time.Time    `json:"t"`
+}
+
+// WriteTo writes a JSON snapshot of the scores to w.
+func (r *Reputation) WriteTo(w io.Writer) (int64, error) {
+	var snap reputationSnapshot
+
+	r.mu.RLock()
+	snap.Scores = make([]reputationSnapshotEntry, 0, len(r.scores))
+	for k, s := range r.scores {
+		snap.Scores = append(snap.Scores, reputationSnapshotEntry{Prefix: k, Score: s.score, Updated: s.updated})
+	}
+	r.mu.RUnlock()
+
+	b, err := json.Marshal(snap)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+// ReadFrom adds the scores of a snapshot written by WriteTo. Scores keep
+// decaying from the time they were last updated, so a stale snapshot does
+// not raise levels for longer than the live scores would have.
+func (r *Reputation) ReadFrom(rd io.Reader) (int64, error) {
+	b, err := io.ReadAll(rd)
+	if err != nil {
+		return int64(len(b)), err
+	}
+
+	var snap reputationSnapshot
+	if err := json.Unmarshal(b, &snap); err != nil {
+		return int64(len(b)), fmt.Errorf("reading reputation snapshot: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, e := range snap.Scores {
+		if !e.Prefix.IsValid() || len(r.scores) >= r.cfg.MaxEntries {
+			continue
+		}
+		r.scores[e.Prefix.Masked()] = reputationScore{score: e.Score, updated: e.Updated}
+	}
+
+	return int64(len(b)), nil
+}
+
+// SaveFile prunes the scores and writes a snapshot to path. The file is
+// replaced atomically, so a crash cannot leave a partial snapshot behind.
+func (r *Reputation) SaveFile(path string) error {
+	r.Prune(time.Now())
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := r.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// LoadFile reads a snapshot written by SaveFile. A missing file is not an
+// error, as no snapshot exists before the first save.
+func (r *Reputation) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = r.ReadFrom(f)
+	return err
+}
+
+// failureCountsForReputation reports whether a challenge failure is blamed on
+// the client. Only invalid solutions and replays are, malformed requests are
+// as likely to come from broken pages or proxies.
+func failureCountsForReputation(code ErrorCode) bool {
+	switch code {
+	case ErrorCodeInvalidSolution, ErrorCodeReplayed:
+		return true
+	default:
+		return false
+	}
+}
+
+// RecordFailure feeds a failed challenge request of addr into the
+// reputation, if the failure is blamed on the client.
+func (b *Berghain) RecordFailure(addr netip.Addr, code ErrorCode) {
+	if b.Reputation != nil && failureCountsForReputation(code) {
+		b.Reputation.Fail(addr, tc.Now())
+	}
+}
+
+// ApplyReputation raises ri.Level to the minimum level of its source address
+// and reports whether it did.
+func (b *Berghain) ApplyReputation(ri *RequestIdentifier) bool {
+	if b.Reputation == nil {
+		return false
+	}
+
+	if l := b.Reputation.MinLevel(ri.SrcAddr, tc.Now()); l > ri.Level {
+		ri.Level = l
+		return true
+	}
+	return false
+}
@@ -0,0 +1,202 @@
+package berghain
+
+import (
+	"bytes"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testReputation(t testing.TB, cfg ReputationConfig) *Reputation {
+	t.Helper()
+	r, err := NewReputation(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestReputation_MinLevel(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := testReputation(t, ReputationConfig{Threshold: 3, PrefixThreshold: 5, Level: 2, HalfLife: time.Minute})
+
+	addr := netip.MustParseAddr("192.0.2.1")
+	for i := 0; i < 2; i++ {
+		r.Fail(addr, now)
+	}
+	if l := r.MinLevel(addr, now); l != 0 {
+		t.Errorf("MinLevel below threshold = %d, want 0", l)
+	}
+
+	r.Fail(addr, now)
+	if l := r.MinLevel(addr, now); l != 2 {
+		t.Errorf("MinLevel at threshold = %d, want 2", l)
+	}
+	if l := r.MinLevel(netip.MustParseAddr("::ffff:192.0.2.1"), now); l != 2 {
+		t.Errorf("MinLevel of mapped address = %d, want 2", l)
+	}
+
+	// one half life later the score is 1.5
+	if l := r.MinLevel(addr, now.Add(time.Minute)); l != 0 {
+		t.Errorf("MinLevel after decay = %d, want 0", l)
+	}
+	if a, _ := r.Scores(addr, now.Add(time.Minute)); a != 1.5 {
+		t.Errorf("score after one half life = %v, want 1.5", a)
+	}
+
+	// neighbours are raised once the prefix passes its threshold
+	neighbour := netip.MustParseAddr("192.0.2.200")
+	if l := r.MinLevel(neighbour, now); l != 0 {
+		t.Errorf("MinLevel of neighbour = %d, want 0", l)
+	}
+	r.Fail(netip.MustParseAddr("192.0.2.2"), now)
+	r.Fail(netip.MustParseAddr("192.0.2.3"), now)
+	if l := r.MinLevel(neighbour, now); l != 2 {
+		t.Errorf("MinLevel of neighbour in failing prefix = %d, want 2", l)
+	}
+	if l := r.MinLevel(netip.MustParseAddr("192.0.3.1"), now); l != 0 {
+		t.Errorf("MinLevel outside of prefix = %d, want 0", l)
+	}
+}
+
+func TestReputation_PrefixDisabled(t *testing.T) {
+	now := time.Now()
+	r := testReputation(t, ReputationConfig{Threshold: 1, Level: 1})
+
+	r.Fail(netip.MustParseAddr("2001:db8::1"), now)
+	if _, p := r.Scores(netip.MustParseAddr("2001:db8::2"), now); p != 0 {
+		t.Errorf("prefix score = %v, want 0", p)
+	}
+	if n := r.Len(); n != 1 {
+		t.Errorf("Len() = %d, want 1", n)
+	}
+}
+
+func TestReputation_Bounded(t *testing.T) {
+	now := time.Now()
+	r := testReputation(t, ReputationConfig{Threshold: 1, PrefixThreshold: 1, Level: 1, MaxEntries: 16})
+
+	for i := 0; i < 256; i++ {
+		r.Fail(netip.AddrFrom4([4]byte{192, 0, byte(i), 1}), now)
+	}
+	if n := r.Len(); n > 16 {
+		t.Errorf("Len() = %d, want at most 16", n)
+	}
+}
+
+func TestReputation_Prune(t *testing.T) {
+	now := time.Now()
+	r := testReputation(t, ReputationConfig{Threshold: 1, Level: 1, HalfLife: time.Minute})
+
+	r.Fail(netip.MustParseAddr("192.0.2.1"), now.Add(-time.Hour))
+	r.Fail(netip.MustParseAddr("192.0.2.2"), now)
+	r.Prune(now)
+	if n := r.Len(); n != 1 {
+		t.Errorf("Len() after prune = %d, want 1", n)
+	}
+}
+
+func TestReputation_Snapshot(t *testing.T) {
+	now := time.Now()
+	cfg := ReputationConfig{Threshold: 2, PrefixThreshold: 4, Level: 3}
+	r := testReputation(t, cfg)
+
+	addr := netip.MustParseAddr("2001:db8::1")
+	r.Fail(addr, now)
+	r.Fail(addr, now)
+
+	var buf bytes.Buffer
+	if _, err := r.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := testReputation(t, cfg)
+	if _, err := restored.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if l := restored.MinLevel(addr, now); l != 3 {
+		t.Errorf("MinLevel after restore = %d, want 3", l)
+	}
+	if _, p := restored.Scores(netip.MustParseAddr("2001:db8::2"), now); p != 2 {
+		t.Errorf("prefix score after restore = %v, want 2", p)
+	}
+
+	path := filepath.Join(t.TempDir(), "reputation.json")
+	fromFile := testReputation(t, cfg)
+	if err := fromFile.LoadFile(path); err != nil {
+		t.Fatalf("LoadFile() of missing snapshot = %v", err)
+	}
+	if err := r.SaveFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := fromFile.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if l := fromFile.MinLevel(addr, now); l != 3 {
+		t.Errorf("MinLevel after LoadFile = %d, want 3", l)
+	}
+}
+
+func TestNewReputation_Invalid(t *testing.T) {
+	for _, cfg := range []ReputationConfig{
+		{Level: 1},
+		{Threshold: 1},
+		{Threshold: 1, Level: 1, PrefixThreshold: -1},
+		{Threshold: 1, Level: 1, PrefixBitsV4: 33},
+		{Threshold: 1, Level: 1, HalfLife: -time.Second},
+	} {
+		if _, err := NewReputation(cfg); err == nil {
+			t.Errorf("NewReputation(%+v) succeeded", cfg)
+		}
+	}
+}
+
+func TestBerghain_RecordFailure(t *testing.T) {
+	b := NewBerghain(make([]byte, 32))
+	b.Reputation = testReputation(t, ReputationConfig{Threshold: 2, Level: 2})
+	addr := netip.MustParseAddr("192.0.2.1")
+
+	// failures not blamed on the client are ignored
+	b.RecordFailure(addr, ErrorCodeExpired)
+	b.RecordFailure(addr, ErrorCodeCaptchaUnavailable)
+	b.RecordFailure(addr, ErrorCodeInvalidRequest)
+	b.RecordFailure(addr, ErrorCodeInvalidSolution)
+
+	ri := RequestIdentifier{SrcAddr: addr, Level: 1}
+	if b.ApplyReputation(&ri) {
+		t.Fatalf("level raised after one counted failure")
+	}
+
+	b.RecordFailure(addr, ErrorCodeReplayed)
+	if !b.ApplyReputation(&ri) || ri.Level != 2 {
+		t.Errorf("level = %d, want 2", ri.Level)
+	}
+}
+
+func TestReputation_MinLevelAllocs(t *testing.T) {
+	now := time.Now()
+	r := testReputation(t, ReputationConfig{Threshold: 1, PrefixThreshold: 1, Level: 1})
+	addr := netip.MustParseAddr("192.0.2.1")
+	r.Fail(addr, now)
+
+	if allocs := testing.AllocsPerRun(100, func() {
+		r.MinLevel(addr, now)
+	}); allocs != 0 {
+		t.Errorf("MinLevel allocates %v times", allocs)
+	}
+}
+
+func BenchmarkReputation_MinLevel(b *testing.B) {
+	now := time.Now()
+	r := testReputation(b, ReputationConfig{Threshold: 1, PrefixThreshold: 1, Level: 1})
+	for i := 0; i < 1000; i++ {
+		r.Fail(netip.AddrFrom4([4]byte{192, 0, byte(i >> 8), byte(i)}), now)
+	}
+	addr := netip.MustParseAddr("192.0.2.1")
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.MinLevel(addr, now)
+	}
+}
@@ -0,0 +1,193 @@
+package berghain
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// RevocationConfig configures Revocations.
+type RevocationConfig struct {
+	// MaxEntries bounds the number of revoked cookies and of cool-downs
+	// kept, defaults to 100000. Once reached, the entries ending first are
+	// evicted.
+	MaxEntries int
+	// CooldownLevel is the minimum level of the address of a revoked
+	// cookie for Cooldown, zero disables cool-downs.
+	CooldownLevel uint8
+	Cooldown      time.Duration
+}
+
+// revokedSum is the decoded HMAC of a cookie, so revocations hold whatever
+// case its hex digits are presented in.
+type revokedSum [sha256.Size]byte
+
+// Revocations is a bounded deny set of cookies an application revoked, e.g.
+// after detecting abuse from a session. Revoked cookies are kept until they
+// expire.
+type Revocations struct {
+	cfg RevocationConfig
+
+	mu sync.RWMutex
+	// cookies maps revoked cookies to their expiration.
+	cookies map[revokedSum]time.Time
+	// cooldowns maps addresses to the end of their cool-down.
+	cooldowns map[netip.Addr]time.Time
+}
+
+var errInvalidRevocation = errors.New("invalid revocation config")
+
+// NewRevocations returns an empty Revocations.
+func NewRevocations(cfg RevocationConfig) (*Revocations, error) {
+	if cfg.MaxEntries == 0 {
+		cfg.MaxEntries = 100000
+	}
+
+	switch {
+	case cfg.MaxEntries < 0:
+		return nil, fmt.Errorf("%w: max entries cannot be negative", errInvalidRevocation)
+	case cfg.CooldownLevel > 0 && cfg.Cooldown <= 0:
+		return nil, fmt.Errorf("%w: a cool-down level needs a positive cool-down", errInvalidRevocation)
+	}
+
+	return &Revocations{
+		cfg:       cfg,
+		cookies:   make(map[revokedSum]time.Time),
+		cooldowns: make(map[netip.Addr]time.Time),
+	}, nil
+}
+
+// Revoke adds the cookie with the decoded HMAC sum, expiring at
+// expiresAt, to the deny set and starts a cool-down of addr at now.
+func (r *Revocations) Revoke(sum []byte, expiresAt time.Time, addr netip.Addr, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := revokedSum(sum)
+	if _, ok := r.cookies[key]; !ok && len(r.cookies) >= r.cfg.MaxEntries {
+		evictSoonest(r.cookies)
+	}
+	r.cookies[key] = expiresAt
+
+	if r.cfg.CooldownLevel == 0 {
+		return
+	}
+	addr = addr.Unmap()
+	if _, ok := r.cooldowns[addr]; !ok && len(r.cooldowns) >= r.cfg.MaxEntries {
+		evictSoonest(r.cooldowns)
+	}
+	r.cooldowns[addr] = now.Add(r.cfg.Cooldown)
+}
+
+// evictSoonest drops the entry ending first of a few entries. Map iteration
+// starts at a random entry, so this approximates evicting the entry ending
+// first without a full scan.
+func evictSoonest[K comparable](m map[K]time.Time) {
+	var victim K
+	var soonest time.Time
+
+	n := 0
+	for k, t := range m {
+		if n == 0 || t.Before(soonest) {
+			victim, soonest = k, t
+		}
+		if n++; n == evictionSamples {
+			break
+		}
+	}
+
+	delete(m, victim)
+}
+
+// Revoked reports whether the cookie with the decoded HMAC sum was
+// revoked.
+func (r *Revocations) Revoked(sum []byte) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.cookies) == 0 {
+		return false
+	}
+	_, ok := r.cookies[revokedSum(sum)]
+	return ok
+}
+
+// MinLevel returns the minimum level of the address at now, zero if it is
+// not cooling down.
+func (r *Revocations) MinLevel(addr netip.Addr, now time.Time) uint8 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.cooldowns) == 0 {
+		return 0
+	}
+	if until, ok := r.cooldowns[addr.Unmap()]; ok && now.Before(until) {
+		return r.cfg.CooldownLevel
+	}
+	return 0
+}
+
+// Len returns the number of revoked cookies and cool-downs kept.
+func (r *Revocations) Len() (cookies, cooldowns int) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return len(r.cookies), len(r.cooldowns)
+}
+
+// Prune drops the cookies that expired and the cool-downs that ended at now.
+func (r *Revocations) Prune(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for k, t := range r.cookies {
+		if now.After(t) {
+			delete(r.cookies, k)
+		}
+	}
+	for k, t := range r.cooldowns {
+		if !now.Before(t) {
+			delete(r.cooldowns, k)
+		}
+	}
+}
+
+var errNoRevocations = errors.New("revocation is not configured")
+
+// RevokeCookie revokes a cookie presented with the request. Only authentic
+// cookies that did not expire yet are revoked, the level is not checked.
+func (b *Berghain) RevokeCookie(ri RequestIdentifier, cookie []byte) error {
+	if b.Revocations == nil {
+		return errNoRevocations
+	}
+
+	ri.Level = 0
+	claims, err := b.ValidateCookie(ri, cookie)
+	if errors.Is(err, ErrRevoked) {
+		// revoking again restarts the cool-down
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	b.Revocations.Revoke(claims.sum[:], claims.ExpiresAt, ri.SrcAddr, tc.Now())
+	return nil
+}
+
+// ApplyRevocations raises ri.Level to the cool-down level of its source
+// address and reports whether it did.
+func (b *Berghain) ApplyRevocations(ri *RequestIdentifier) bool {
+	if b.Revocations == nil {
+		return false
+	}
+
+	if l := b.Revocations.MinLevel(ri.SrcAddr, tc.Now()); l > ri.Level {
+		ri.Level = l
+		return true
+	}
+	return false
+}
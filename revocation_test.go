@@ -0,0 +1,128 @@
+package berghain
+
+import (
+	"bytes"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func testRevocations(t testing.TB, cfg RevocationConfig) *Revocations {
+	t.Helper()
+	r, err := NewRevocations(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestNewRevocations_Invalid(t *testing.T) {
+	for _, cfg := range []RevocationConfig{
+		{MaxEntries: -1},
+		{CooldownLevel: 2},
+	} {
+		if _, err := NewRevocations(cfg); !errors.Is(err, errInvalidRevocation) {
+			t.Errorf("NewRevocations(%+v) error = %v, want %v", cfg, err, errInvalidRevocation)
+		}
+	}
+}
+
+func TestRevocations(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := testRevocations(t, RevocationConfig{MaxEntries: 4, CooldownLevel: 2, Cooldown: time.Minute})
+
+	sum := func(i byte) []byte { return bytes.Repeat([]byte{'a' + i}, len(revokedSum{})) }
+	addr := netip.MustParseAddr("192.0.2.1")
+
+	r.Revoke(sum(0), now.Add(time.Hour), addr, now)
+	if !r.Revoked(sum(0)) {
+		t.Error("revoked cookie not reported")
+	}
+	if r.Revoked(sum(1)) {
+		t.Error("other cookie reported as revoked")
+	}
+
+	if l := r.MinLevel(netip.MustParseAddr("::ffff:192.0.2.1"), now); l != 2 {
+		t.Errorf("MinLevel during cool-down = %d, want 2", l)
+	}
+	if l := r.MinLevel(addr, now.Add(time.Minute)); l != 0 {
+		t.Errorf("MinLevel after cool-down = %d, want 0", l)
+	}
+
+	for i := byte(1); i < 10; i++ {
+		r.Revoke(sum(i), now.Add(time.Duration(i)*time.Hour), netip.AddrFrom4([4]byte{192, 0, 2, i + 1}), now)
+	}
+	if cookies, cooldowns := r.Len(); cookies != 4 || cooldowns != 4 {
+		t.Errorf("Len = %d, %d, want bounded to 4", cookies, cooldowns)
+	}
+
+	r.Prune(now.Add(24 * time.Hour))
+	if cookies, cooldowns := r.Len(); cookies != 0 || cooldowns != 0 {
+		t.Errorf("Len after prune = %d, %d, want 0", cookies, cooldowns)
+	}
+}
+
+func TestBerghain_RevokeCookie(t *testing.T) {
+	bh := NewBerghain(generateSecret(t))
+	bh.Levels = []*LevelConfig{
+		{Duration: time.Minute, Type: ValidationTypeNone},
+		{Duration: time.Minute, Type: ValidationTypeNone},
+	}
+
+	ri := RequestIdentifier{
+		SrcAddr: netip.MustParseAddr("192.0.2.1"),
+		Host:    []byte("example.com"),
+		Level:   1,
+	}
+	cookie := AcquireCookieBuffer()
+	defer ReleaseCookieBuffer(cookie)
+	if err := ri.ToCookie(bh, cookie); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bh.RevokeCookie(ri, cookie.ReadBytes()); !errors.Is(err, errNoRevocations) {
+		t.Fatalf("RevokeCookie without revocations error = %v, want %v", err, errNoRevocations)
+	}
+
+	bh.Revocations = testRevocations(t, RevocationConfig{CooldownLevel: 2, Cooldown: time.Minute})
+
+	forged := bytes.Clone(cookie.ReadBytes())
+	// replace the last digit of the sum with another valid one
+	if forged[len(forged)-1] == '0' {
+		forged[len(forged)-1] = '1'
+	} else {
+		forged[len(forged)-1] = '0'
+	}
+	if err := bh.RevokeCookie(ri, forged); !errors.Is(err, ErrInvalidHMAC) {
+		t.Errorf("RevokeCookie of forged cookie error = %v, want %v", err, ErrInvalidHMAC)
+	}
+	if cookies, cooldowns := bh.Revocations.Len(); cookies != 0 || cooldowns != 0 {
+		t.Errorf("forged cookie was revoked")
+	}
+
+	if err := bh.RevokeCookie(ri, cookie.ReadBytes()); err != nil {
+		t.Fatalf("RevokeCookie error = %v", err)
+	}
+	_, err := bh.ValidateCookie(ri, cookie.ReadBytes())
+	if !errors.Is(err, ErrRevoked) {
+		t.Errorf("ValidateCookie of revoked cookie error = %v, want %v", err, ErrRevoked)
+	}
+	if reason := CookieErrorReason(err); reason != "revoked" {
+		t.Errorf("reason = %q, want revoked", reason)
+	}
+	// the sum is accepted in either case, so the revocation must hold for both
+	if _, err := bh.ValidateCookie(ri, bytes.ToUpper(cookie.ReadBytes())); !errors.Is(err, ErrRevoked) {
+		t.Errorf("ValidateCookie of upper-case revoked cookie error = %v, want %v", err, ErrRevoked)
+	}
+
+	// revoking again restarts the cool-down
+	if err := bh.RevokeCookie(ri, cookie.ReadBytes()); err != nil {
+		t.Errorf("RevokeCookie of revoked cookie error = %v", err)
+	}
+
+	raised := ri
+	if !bh.ApplyRevocations(&raised) || raised.Level != 2 {
+		t.Errorf("ApplyRevocations level = %d, want 2", raised.Level)
+	}
+}
@@ -0,0 +1,86 @@
+//go:build e2e
+
+package e2e
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const defaultFailuresURL = "http://localhost:18082"
+
+func failuresURL() string {
+	if value := os.Getenv("BERGHAIN_E2E_FAILURES_URL"); value != "" {
+		return strings.TrimRight(value, "/")
+	}
+	return defaultFailuresURL
+}
+
+// requestChallenge sends a challenge request and returns the response status,
+// its Retry-After header and the error code of the failure body.
+func requestChallenge(t *testing.T, method, body string) (int, string, string) {
+	t.Helper()
+
+	request, err := http.NewRequest(method, failuresURL()+"/cdn-cgi/challenge-platform/challenge", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Content-Type", "text/plain")
+	request.Header.Set("X-Berghain-Protocol", "2")
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatalf("%s challenge: %v", method, err)
+	}
+	defer response.Body.Close()
+
+	raw, err := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		t.Fatalf("read %s challenge: %v", method, err)
+	}
+	var failure struct {
+		Code string `json:"e"`
+	}
+	if err := json.Unmarshal(raw, &failure); err != nil {
+		t.Fatalf("decode %s challenge %q: %v", method, raw, err)
+	}
+
+	return response.StatusCode, response.Header.Get("Retry-After"), failure.Code
+}
+
+func requireRetryAfter(t *testing.T, value string) {
+	t.Helper()
+
+	if seconds, err := strconv.Atoi(value); err != nil || seconds < 1 {
+		t.Errorf("Retry-After = %q, want a positive number of seconds", value)
+	}
+}
+
+func TestChallengeFailuresCarryRetryAfter(t *testing.T) {
+	t.Run("captcha_unavailable", func(t *testing.T) {
+		status, retryAfter, code := requestChallenge(t, http.MethodPost, "widget-response-token")
+		if status != http.StatusServiceUnavailable || code != "captcha_unavailable" {
+			t.Fatalf("POST = %d %q, want %d captcha_unavailable", status, code, http.StatusServiceUnavailable)
+		}
+		requireRetryAfter(t, retryAfter)
+	})
+
+	t.Run("rate_limited", func(t *testing.T) {
+		// the frontend allows a single challenge GET per minute
+		if status, retryAfter, code := requestChallenge(t, http.MethodGet, ""); status != http.StatusOK || retryAfter != "" {
+			t.Fatalf("first GET = %d %q, Retry-After %q, want %d without Retry-After", status, code, retryAfter, http.StatusOK)
+		}
+		status, retryAfter, code := requestChallenge(t, http.MethodGet, "")
+		if status != http.StatusTooManyRequests || code != "rate_limited" {
+			t.Fatalf("second GET = %d %q, want %d rate_limited", status, code, http.StatusTooManyRequests)
+		}
+		requireRetryAfter(t, retryAfter)
+	})
+}
@@ -36,7 +36,7 @@ berghain_pid=$!
 haproxy -db -f test/e2e/haproxy.cfg >"$run_dir/haproxy.log" 2>&1 &
 haproxy_pid=$!
 
-for port in 18080 18081; do
+for port in 18080 18081 18082; do
     ready=""
     for _ in $(seq 1 30); do
         status="$(curl --max-time 1 --silent --output /dev/null --write-out '%{http_code}' "http://localhost:$port/" || true)"
@@ -54,5 +54,6 @@ done
 
 export BERGHAIN_E2E_BASE_URL=http://localhost:18080
 export BERGHAIN_E2E_TURNSTILE_URL=http://localhost:18081
+export BERGHAIN_E2E_FAILURES_URL=http://localhost:18082
 cd test/e2e
 go test -count=1 -tags=e2e -v .
@@ -0,0 +1,188 @@
+package berghain
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TokenAlgorithm is the JWS algorithm of a trusted token. Tokens stating a
+// different algorithm are rejected, so a key cannot be used with another
+// algorithm than the configured one.
+type TokenAlgorithm int
+
+const (
+	_ TokenAlgorithm = iota
+	TokenAlgorithmHS256
+	TokenAlgorithmEdDSA
+)
+
+func (a TokenAlgorithm) String() string {
+	switch a {
+	case TokenAlgorithmHS256:
+		return "HS256"
+	case TokenAlgorithmEdDSA:
+		return "EdDSA"
+	default:
+		return "unknown"
+	}
+}
+
+// trustedTokenLeeway tolerates clock skew between the application and the
+// agent when checking exp and nbf.
+const trustedTokenLeeway = 30 * time.Second
+
+var (
+	errTrustedTokenMissing = errors.New("no trusted token")
+	errTrustedTokenInvalid = errors.New("invalid trusted token")
+	errTrustedTokenExpired = errors.New("trusted token expired")
+	errTrustedTokenClaims  = errors.New("trusted token claims not accepted")
+)
+
+// TrustedToken is a signed JWT issued by an application, e.g. its session
+// token, accepted instead of the cookie. Tokens are required to have an exp
+// claim.
+type TrustedToken struct {
+	// Name identifies the token in logs and in txn.berghain.trusted_token.
+	Name string
+	// Cookie is the name of the cookie carrying the token. If empty, the
+	// token is read from the Authorization header as Bearer token.
+	Cookie    string
+	Algorithm TokenAlgorithm
+	// Key is the HMAC secret for HS256 and the ed25519.PublicKey for EdDSA.
+	Key []byte
+	// Claims are required to be present with the value, or for array
+	// claims like aud, to contain it.
+	Claims map[string]string
+}
+
+// Validate checks the configuration of the token.
+func (t *TrustedToken) Validate() error {
+	switch t.Algorithm {
+	case TokenAlgorithmHS256:
+		if len(t.Key) < sha256.Size {
+			return fmt.Errorf("trusted token %s: HS256 keys need at least %d bytes", t.Name, sha256.Size)
+		}
+	case TokenAlgorithmEdDSA:
+		if len(t.Key) != ed25519.PublicKeySize {
+			return fmt.Errorf("trusted token %s: EdDSA keys are %d bytes", t.Name, ed25519.PublicKeySize)
+		}
+	default:
+		return fmt.Errorf("trusted token %s: unsupported algorithm", t.Name)
+	}
+	return nil
+}
+
+// Find returns the token from a Cookie header or an Authorization header
+// value, depending on where the token is carried.
+func (t *TrustedToken) Find(cookies, authorization []byte) []byte {
+	if t.Cookie != "" {
+		return findCookie(cookies, "", t.Cookie)
+	}
+
+	scheme, token, _ := bytes.Cut(bytes.TrimSpace(authorization), []byte(" "))
+	if !strings.EqualFold(string(scheme), "Bearer") {
+		return nil
+	}
+	return bytes.TrimSpace(token)
+}
+
+// Verify verifies the signature and the claims of a JWS compact serialized
+// token at now.
+func (t *TrustedToken) Verify(token []byte, now time.Time) error {
+	if len(token) == 0 {
+		return errTrustedTokenMissing
+	}
+
+	header, rest, ok := bytes.Cut(token, []byte("."))
+	payload, signature, ok2 := bytes.Cut(rest, []byte("."))
+	if !ok || !ok2 {
+		return fmt.Errorf("%w: malformed", errTrustedTokenInvalid)
+	}
+
+	var h struct {
+		Alg  string `json:"alg"`
+		Crit []any  `json:"crit"`
+	}
+	if err := decodeJWTPart(header, &h); err != nil {
+		return fmt.Errorf("%w: header: %w", errTrustedTokenInvalid, err)
+	}
+	if h.Alg != t.Algorithm.String() {
+		return fmt.Errorf("%w: algorithm %q", errTrustedTokenInvalid, h.Alg)
+	}
+	if len(h.Crit) > 0 {
+		return fmt.Errorf("%w: critical header parameters are not supported", errTrustedTokenInvalid)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(string(signature))
+	if err != nil {
+		return fmt.Errorf("%w: signature: %w", errTrustedTokenInvalid, err)
+	}
+	signed := token[:len(header)+1+len(payload)]
+	switch t.Algorithm {
+	case TokenAlgorithmHS256:
+		m := hmac.New(sha256.New, t.Key)
+		m.Write(signed)
+		ok = hmac.Equal(m.Sum(nil), sig)
+	case TokenAlgorithmEdDSA:
+		ok = ed25519.Verify(t.Key, signed, sig)
+	}
+	if !ok {
+		return fmt.Errorf("%w: signature", errTrustedTokenInvalid)
+	}
+
+	var claims map[string]any
+	if err := decodeJWTPart(payload, &claims); err != nil {
+		return fmt.Errorf("%w: claims: %w", errTrustedTokenInvalid, err)
+	}
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("%w: missing exp", errTrustedTokenClaims)
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(trustedTokenLeeway)) {
+		return errTrustedTokenExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(trustedTokenLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return fmt.Errorf("%w: not yet valid", errTrustedTokenClaims)
+	}
+
+	for name, want := range t.Claims {
+		if !claimContains(claims[name], want) {
+			return fmt.Errorf("%w: %s", errTrustedTokenClaims, name)
+		}
+	}
+
+	return nil
+}
+
+func decodeJWTPart(part []byte, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(string(part))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// claimContains reports whether a string claim is want, or an array claim
+// contains want.
+func claimContains(claim any, want string) bool {
+	switch c := claim.(type) {
+	case string:
+		return c == want
+	case []any:
+		for _, v := range c {
+			if s, ok := v.(string); ok && s == want {
+				return true
+			}
+		}
+	}
+	return false
+}
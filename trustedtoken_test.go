@@ -0,0 +1,96 @@
+package berghain
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signJWT builds a compact JWS of the header and claims JSON.
+func signJWT(header, claims string, sign func([]byte) []byte) string {
+	signed := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." + base64.RawURLEncoding.EncodeToString([]byte(claims))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func TestTrustedToken_Verify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	secret := []byte(strings.Repeat("k", 32))
+	hs256 := func(b []byte) []byte {
+		m := hmac.New(sha256.New, secret)
+		m.Write(b)
+		return m.Sum(nil)
+	}
+	edKey := ed25519.NewKeyFromSeed(bytes32(7))
+	eddsa := func(b []byte) []byte { return ed25519.Sign(edKey, b) }
+
+	hsToken := &TrustedToken{Name: "session", Algorithm: TokenAlgorithmHS256, Key: secret, Claims: map[string]string{"iss": "app", "aud": "berghain"}}
+	edToken := &TrustedToken{Name: "sso", Algorithm: TokenAlgorithmEdDSA, Key: edKey.Public().(ed25519.PublicKey)}
+	for _, tt := range []*TrustedToken{hsToken, edToken} {
+		if err := tt.Validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const valid = `{"iss": "app", "aud": ["other", "berghain"], "exp": 1700000060}`
+	tests := []struct {
+		name    string
+		trusted *TrustedToken
+		token   string
+		wantErr error
+	}{
+		{name: "HS256", trusted: hsToken, token: signJWT(`{"alg":"HS256","typ":"JWT"}`, valid, hs256)},
+		{name: "EdDSA", trusted: edToken, token: signJWT(`{"alg":"EdDSA"}`, `{"exp": 1700000060}`, eddsa)},
+		{name: "missing", trusted: hsToken, wantErr: errTrustedTokenMissing},
+		{name: "malformed", trusted: hsToken, token: "abc.def", wantErr: errTrustedTokenInvalid},
+		{name: "algorithm none", trusted: hsToken, token: signJWT(`{"alg":"none"}`, valid, func([]byte) []byte { return nil }), wantErr: errTrustedTokenInvalid},
+		{name: "other algorithm", trusted: edToken, token: signJWT(`{"alg":"HS256"}`, valid, hs256), wantErr: errTrustedTokenInvalid},
+		{name: "critical header", trusted: hsToken, token: signJWT(`{"alg":"HS256","crit":["b64"]}`, valid, hs256), wantErr: errTrustedTokenInvalid},
+		{name: "forged", trusted: hsToken, token: signJWT(`{"alg":"HS256"}`, valid, eddsa), wantErr: errTrustedTokenInvalid},
+		{name: "expired", trusted: hsToken, token: signJWT(`{"alg":"HS256"}`, `{"iss": "app", "aud": "berghain", "exp": 1699999960}`, hs256), wantErr: errTrustedTokenExpired},
+		{name: "within leeway", trusted: hsToken, token: signJWT(`{"alg":"HS256"}`, `{"iss": "app", "aud": "berghain", "exp": 1699999990}`, hs256)},
+		{name: "missing exp", trusted: hsToken, token: signJWT(`{"alg":"HS256"}`, `{"iss": "app", "aud": "berghain"}`, hs256), wantErr: errTrustedTokenClaims},
+		{name: "not yet valid", trusted: hsToken, token: signJWT(`{"alg":"HS256"}`, `{"iss": "app", "aud": "berghain", "exp": 1700000600, "nbf": 1700000300}`, hs256), wantErr: errTrustedTokenClaims},
+		{name: "wrong issuer", trusted: hsToken, token: signJWT(`{"alg":"HS256"}`, `{"iss": "evil", "aud": "berghain", "exp": 1700000060}`, hs256), wantErr: errTrustedTokenClaims},
+		{name: "missing audience", trusted: hsToken, token: signJWT(`{"alg":"HS256"}`, `{"iss": "app", "aud": ["other"], "exp": 1700000060}`, hs256), wantErr: errTrustedTokenClaims},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.trusted.Verify([]byte(tt.token), now); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Verify() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTrustedToken_Find(t *testing.T) {
+	cookie := &TrustedToken{Cookie: "session"}
+	if got := cookie.Find([]byte("berghain=x; session=abc.def.ghi"), []byte("Bearer other")); string(got) != "abc.def.ghi" {
+		t.Errorf("Find() from cookie = %q", got)
+	}
+
+	header := &TrustedToken{}
+	if got := header.Find([]byte("session=other"), []byte("bearer abc.def.ghi")); string(got) != "abc.def.ghi" {
+		t.Errorf("Find() from header = %q", got)
+	}
+	if got := header.Find(nil, []byte("Basic abc")); got != nil {
+		t.Errorf("Find() with Basic scheme = %q, want nil", got)
+	}
+}
+
+func TestTrustedToken_Validate(t *testing.T) {
+	for _, tt := range []*TrustedToken{
+		{Name: "short secret", Algorithm: TokenAlgorithmHS256, Key: []byte("short")},
+		{Name: "wrong key size", Algorithm: TokenAlgorithmEdDSA, Key: make([]byte, 31)},
+		{Name: "no algorithm", Key: make([]byte, 32)},
+	} {
+		if err := tt.Validate(); err == nil {
+			t.Errorf("%s: Validate() succeeded", tt.Name)
+		}
+	}
+}
@@ -6,7 +6,9 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"slices"
 	"strings"
+	"time"
 )
 
 type captchaValidator struct {
@@ -23,73 +25,76 @@ var (
 	errCaptchaRejected     = fmt.Errorf("captcha token rejected")
 	errCaptchaHostMismatch = fmt.Errorf("captcha hostname mismatch")
 	errCaptchaUnavailable  = fmt.Errorf("captcha provider unavailable")
+	errCaptchaReplayed     = fmt.Errorf("captcha token already used")
 )
 
-// captchaChallengeBody returns the static challenge response for a captcha
-// level. Unlike POW, the challenge embeds no per-request state: the security
-// binding happens when the solved token is exchanged for a cookie.
-func (lc *LevelConfig) captchaChallengeBody() []byte {
-	lc.captchaBodyOnce.Do(func() {
-		body, err := json.Marshal(struct {
-			Countdown int    `json:"c"`
-			Type      int    `json:"t"`
-			Sitekey   string `json:"k"`
-		}{
-			Countdown: lc.Countdown,
-			Type:      int(lc.Type) - 1, // the web protocol counts types from zero
-			Sitekey:   lc.CaptchaSitekey,
-		})
-		if err != nil {
-			panic(err)
-		}
-		lc.captchaBody = body
-	})
-	return lc.captchaBody
+// CaptchaURL returns the siteverify endpoint of the level, the provider
+// default unless CaptchaVerifyURL is set. It is empty for other types.
+func (lc *LevelConfig) CaptchaURL() string {
+	if lc.CaptchaVerifyURL != "" {
+		return lc.CaptchaVerifyURL
+	}
+
+	// All three providers implement the same siteverify contract:
+	// hCaptcha and Turnstile clone the reCAPTCHA API on purpose.
+	switch lc.Type {
+	case ValidationTypeTurnstile:
+		return "https://challenges.cloudflare.com/turnstile/v0/siteverify"
+	case ValidationTypeHCaptcha:
+		return "https://api.hcaptcha.com/siteverify"
+	case ValidationTypeReCaptcha:
+		return "https://www.google.com/recaptcha/api/siteverify"
+	default:
+		return ""
+	}
 }
 
+// Unlike POW, the captcha challenge embeds no per-request state: the security
+// binding happens when the solved token is exchanged for a cookie.
 func (captchaValidator) onNew(b *Berghain, req *ValidatorRequest, resp *ValidatorResponse) error {
 	lc := b.LevelConfig(req.Identifier.Level)
 
-	body := lc.captchaChallengeBody()
-	if len(body) > len(resp.Body.WriteBytes()) {
-		return fmt.Errorf("captcha challenge body exceeds response buffer: %d bytes", len(body))
+	w := newJSONWriter(resp.Body)
+	if err := writeChallengeHeader(&w, req, lc); err != nil {
+		return err
+	}
+	w.String("k", []byte(lc.CaptchaSitekey))
+	// Captcha challenges only carry the support ID from ProtocolV2 on.
+	if req.Protocol >= ProtocolV2 && ValidSupportID(req.SupportID) {
+		w.String("i", req.SupportID)
 	}
-	copy(resp.Body.WriteNBytes(len(body)), body)
 
-	return nil
+	return w.Close()
 }
 
-func (captchaValidator) isValid(b *Berghain, req *ValidatorRequest, _ *ValidatorResponse) error {
-	if len(req.Body) == 0 {
-		return ErrEmpty
+func (captchaValidator) isValid(b *Berghain, req *ValidatorRequest, resp *ValidatorResponse) error {
+	lc := b.LevelConfig(req.Identifier.Level)
+	t, ok := lc.Type.ChallengeType()
+	if !ok {
+		return fmt.Errorf("validation type %d has no challenge type", lc.Type)
 	}
-	if len(req.Body) > validatorCaptchaMaxTokenLength {
-		return ErrInvalidLength
+	sub, err := ParseSubmission(req.Protocol, t, req.Body)
+	if err != nil {
+		return err
 	}
 
-	lc := b.LevelConfig(req.Identifier.Level)
-
-	// All three providers implement the same siteverify contract:
-	// hCaptcha and Turnstile clone the reCAPTCHA API on purpose.
-	verifyURL := lc.CaptchaVerifyURL
-	if verifyURL == "" {
-		switch lc.Type {
-		case ValidationTypeTurnstile:
-			verifyURL = "https://challenges.cloudflare.com/turnstile/v0/siteverify"
-		case ValidationTypeHCaptcha:
-			verifyURL = "https://api.hcaptcha.com/siteverify"
-		case ValidationTypeReCaptcha:
-			verifyURL = "https://www.google.com/recaptcha/api/siteverify"
-		}
-	}
+	verifyURL := lc.CaptchaURL()
 
 	form := url.Values{
 		"secret":   {lc.CaptchaSecret},
-		"response": {string(req.Body)},
+		"response": {string(sub.Token)},
 		"remoteip": {req.Identifier.SrcAddr.String()},
 	}
 
-	httpResp, err := b.httpClient().PostForm(verifyURL, form)
+	httpReq, err := http.NewRequestWithContext(req.context(), http.MethodPost, verifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errCaptchaUnavailable, err)
+	}
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	start := time.Now()
+	httpResp, err := b.httpClient().Do(httpReq)
+	resp.ProviderLatency = time.Since(start)
 	if err != nil {
 		// Fail closed: the client is told the challenge failed and can retry.
 		return fmt.Errorf("%w: %v", errCaptchaUnavailable, err)
@@ -110,6 +115,11 @@ func (captchaValidator) isValid(b *Berghain, req *ValidatorRequest, _ *Validator
 	}
 
 	if !verdict.Success {
+		// All providers report reused tokens with this code, see
+		// https://developers.cloudflare.com/turnstile/get-started/server-side-validation/
+		if slices.Contains(verdict.ErrorCodes, "timeout-or-duplicate") {
+			return fmt.Errorf("%w: %s", errCaptchaReplayed, strings.Join(verdict.ErrorCodes, ", "))
+		}
 		return fmt.Errorf("%w: %s", errCaptchaRejected, strings.Join(verdict.ErrorCodes, ", "))
 	}
 
@@ -150,5 +160,5 @@ func validatorCaptcha(b *Berghain, req *ValidatorRequest, resp *ValidatorRespons
 		return c.onNew(b, req, resp)
 	}
 
-	return errInvalidMethod
+	return ErrInvalidMethod
 }
@@ -2,6 +2,7 @@ package berghain
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"net/http"
@@ -81,15 +82,14 @@ func Test_validatorCaptcha_GET(t *testing.T) {
 		t.Fatalf("validator failed: %v", err)
 	}
 
-	var challenge struct {
-		Countdown int    `json:"c"`
-		Type      int    `json:"t"`
-		Sitekey   string `json:"k"`
-	}
+	var challenge Challenge
 	if err := json.NewDecoder(bytes.NewReader(resp.Body.ReadBytes())).Decode(&challenge); err != nil {
 		t.Fatalf("decoding challenge: %v", err)
 	}
 
+	if challenge.Version != 0 || challenge.SupportID != "" {
+		t.Errorf("ProtocolV1 challenge carries version or support ID: %+v", challenge)
+	}
 	if challenge.Type != 3 {
 		t.Errorf("invalid challenge type: %d != 3", challenge.Type)
 	}
@@ -104,6 +104,38 @@ func Test_validatorCaptcha_GET(t *testing.T) {
 	}
 }
 
+func Test_validatorCaptcha_GET_protocolV2(t *testing.T) {
+	bh := newCaptchaBerghain(t, "http://invalid.invalid")
+
+	req, resp := AcquireValidatorRequest(), AcquireValidatorResponse()
+	defer ReleaseValidatorRequest(req)
+	defer ReleaseValidatorResponse(resp)
+
+	req.Identifier = newCaptchaIdentifier()
+	req.Method = http.MethodGet
+	req.Protocol = ProtocolV2
+	req.SupportID = []byte("bh@123e4567-e89b-12d3-a456-426614174000")
+
+	if err := validatorCaptcha(bh, req, resp); err != nil {
+		t.Fatalf("validator failed: %v", err)
+	}
+
+	var challenge Challenge
+	if err := json.Unmarshal(resp.Body.ReadBytes(), &challenge); err != nil {
+		t.Fatalf("decoding challenge: %v", err)
+	}
+
+	want := Challenge{
+		Version:   ProtocolV2,
+		Type:      ChallengeTypeTurnstile,
+		Sitekey:   "sitekey-under-test",
+		SupportID: string(req.SupportID),
+	}
+	if challenge != want {
+		t.Errorf("challenge = %+v, want %+v", challenge, want)
+	}
+}
+
 func Test_validatorCaptcha_POST(t *testing.T) {
 	const token = "widget-response-token"
 
@@ -127,6 +159,9 @@ func Test_validatorCaptcha_POST(t *testing.T) {
 	if err := bh.IsValidCookie(*req.Identifier, resp.Token.ReadBytes()); err != nil {
 		t.Errorf("invalid cookie: %v", err)
 	}
+	if resp.ProviderLatency <= 0 {
+		t.Errorf("provider latency = %v, want the duration of the request", resp.ProviderLatency)
+	}
 }
 
 func Test_validatorCaptcha_POST_subdomain(t *testing.T) {
@@ -184,6 +219,34 @@ func Test_validatorCaptcha_POST_rejected(t *testing.T) {
 	}
 }
 
+func Test_validatorCaptcha_POST_replayed(t *testing.T) {
+	const token = "widget-response-token"
+
+	stub := newSiteverifyStub(t, captchaVerdict{
+		Success:    false,
+		ErrorCodes: []string{"timeout-or-duplicate"},
+	}, token)
+	defer stub.Close()
+
+	bh := newCaptchaBerghain(t, stub.URL)
+
+	req, resp := AcquireValidatorRequest(), AcquireValidatorResponse()
+	defer ReleaseValidatorRequest(req)
+	defer ReleaseValidatorResponse(resp)
+
+	req.Identifier = newCaptchaIdentifier()
+	req.Method = http.MethodPost
+	req.Body = []byte(token)
+
+	err := validatorCaptcha(bh, req, resp)
+	if !errors.Is(err, errCaptchaReplayed) {
+		t.Fatalf("expected replayed token error, got: %v", err)
+	}
+	if code := ChallengeErrorCode(req.Method, err); code != ErrorCodeReplayed {
+		t.Errorf("error code = %s, want %s", code, ErrorCodeReplayed)
+	}
+}
+
 func Test_validatorCaptcha_POST_hostMismatch(t *testing.T) {
 	const token = "widget-response-token"
 
@@ -267,6 +330,37 @@ func Test_validatorCaptcha_POST_unavailable(t *testing.T) {
 	}
 }
 
+func Test_validatorCaptcha_POST_context(t *testing.T) {
+	type key struct{}
+
+	bh := newCaptchaBerghain(t, "http://siteverify.invalid")
+	var got any
+	bh.HTTPClient = &http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		got = r.Context().Value(key{})
+		return nil, errors.New("offline")
+	})}
+
+	req, resp := AcquireValidatorRequest(), AcquireValidatorResponse()
+	defer ReleaseValidatorRequest(req)
+	defer ReleaseValidatorResponse(resp)
+
+	req.Identifier = newCaptchaIdentifier()
+	req.Method = http.MethodPost
+	req.Body = []byte("widget-response-token")
+	req.Context = context.WithValue(context.Background(), key{}, "value")
+
+	if err := validatorCaptcha(bh, req, resp); !errors.Is(err, errCaptchaUnavailable) {
+		t.Fatalf("expected unavailable error, got: %v", err)
+	}
+	if got != "value" {
+		t.Errorf("siteverify request context value = %v, want the request context", got)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
 func Test_validatorCaptcha_POST_invalidBody(t *testing.T) {
 	bh := newCaptchaBerghain(t, "http://invalid.invalid")
 
@@ -286,6 +380,10 @@ func Test_validatorCaptcha_POST_invalidBody(t *testing.T) {
 	if err := validatorCaptcha(bh, req, resp); !errors.Is(err, ErrInvalidLength) {
 		t.Errorf("expected invalid length error, got: %v", err)
 	}
+
+	if resp.ProviderLatency != 0 {
+		t.Errorf("provider latency = %v without a provider request", resp.ProviderLatency)
+	}
 }
 
 func Test_captchaHostnameMatches(t *testing.T) {
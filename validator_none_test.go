@@ -13,8 +13,9 @@ func Test_validatorNone(t *testing.T) {
 
 	bh.Levels = []*LevelConfig{
 		{
-			Duration: time.Minute,
-			Type:     ValidationTypeNone,
+			Countdown: 12,
+			Duration:  time.Minute,
+			Type:      ValidationTypeNone,
 		},
 	}
 
@@ -40,7 +41,7 @@ func Test_validatorNone(t *testing.T) {
 	if err := json.Unmarshal(resp.Body.ReadBytes(), &challenge); err != nil {
 		t.Fatalf("decode response: %v", err)
 	}
-	if challenge.Type != 0 || challenge.SupportID != string(req.SupportID) {
+	if challenge.Countdown != 12 || challenge.Type != 0 || challenge.SupportID != string(req.SupportID) {
 		t.Errorf("invalid response: %+v", challenge)
 	}
 
@@ -8,8 +8,6 @@ import (
 	"hash"
 	"net/http"
 	"sync"
-
-	"github.com/dropmorepackets/haproxy-go/pkg/buffer"
 )
 
 var sha256Pool = sync.Pool{
@@ -38,19 +36,6 @@ const (
 	validatorPOWMaxSolutionLength = validatorPOWMinSolutionLength + 19
 )
 
-var validatorPOWChallengeTemplate = mustJSONEncodeString(struct {
-	Countdown int    `json:"c"`
-	Type      int    `json:"t"`
-	Random    string `json:"r"`
-	Hash      string `json:"s"`
-}{
-	// Only strings have to be set, as the default is zero for ints.
-	// We do set the Type here because it is static anyway...
-	Type:   1,
-	Random: validatorPOWRandom,
-	Hash:   "0000000000000000000000000000000000000000000000000000000000000000",
-})
-
 // This prevents invalid template strings by validatoring them on start
 var _ = func() bool {
 	h := hashAlgo()
@@ -73,28 +58,24 @@ func (powValidator) onNew(b *Berghain, req *ValidatorRequest, resp *ValidatorRes
 
 	lc := b.LevelConfig(req.Identifier.Level)
 
-	copy(resp.Body.WriteBytes(), validatorPOWChallengeTemplate)
+	w := newJSONWriter(resp.Body)
+	if err := writeChallengeHeader(&w, req, lc); err != nil {
+		return err
+	}
+	randomArea := w.StringArea("r", len(validatorPOWRandom))
+	hexArea := w.StringArea("s", hex.EncodedLen(h.Size()))
+	w.String("i", req.SupportID)
+	if err := w.Close(); err != nil {
+		return err
+	}
 
-	resp.Body.AdvanceW(len(`{"c":`))
-	// the following conversion is faster than sprintf but also way uglier, I am sorry.
-	// 48 is the ASCII code for '0', adding lc.Countdown will give us the single correct digit.
-	copy(resp.Body.WriteNBytes(1), []byte{byte(48 + lc.Countdown)})
-	resp.Body.AdvanceW(len(`,"t":1,"r":"`))
-	randomArea := resp.Body.WriteNBytes(len(validatorPOWRandom))
 	timestampArea := randomArea[:len(validatorPOWTimestamp)]
 	copy(randomArea[len(validatorPOWTimestamp):], req.SupportID)
-	resp.Body.AdvanceW(len(`","s":"`))
-	hexArea := resp.Body.WriteNBytes(hex.EncodedLen(h.Size()))
-	resp.Body.AdvanceW(len(`"`))
-	appendSupportID(resp.Body, req.SupportID)
 
-	// we use the response body temporarily as a buffer
+	var timestampBuf [8]byte
 	expireAt := tc.Now().Add(lc.Duration)
-	timestampBuf := resp.Body.WriteNBytes(8)
-	resp.Body.AdvanceW(-8) // this should be illegal
-
-	binary.LittleEndian.PutUint64(timestampBuf, uint64(expireAt.Unix()))
-	hex.Encode(timestampArea, timestampBuf)
+	binary.LittleEndian.PutUint64(timestampBuf[:], uint64(expireAt.Unix()))
+	hex.Encode(timestampArea, timestampBuf[:])
 
 	// Write identifier to hash to ensure uniqueness
 	req.Identifier.WriteTo(h)
@@ -107,25 +88,11 @@ func (powValidator) onNew(b *Berghain, req *ValidatorRequest, resp *ValidatorRes
 
 func (powValidator) isValid(b *Berghain, req *ValidatorRequest, resp *ValidatorResponse) error {
 	req.SupportID = nil
-	if len(req.Body) < validatorPOWMinSolutionLength || len(req.Body) > validatorPOWMaxSolutionLength {
-		return ErrInvalidLength
-	}
-
-	body := buffer.NewSliceBufferWithSlice(req.Body)
-	randomArea := body.ReadNBytes(len(validatorPOWRandom))
-	if separator := body.ReadNBytes(1); len(separator) != 1 || separator[0] != '-' {
-		return ErrInvalidLength
-	}
-	sumArea := body.ReadNBytes(len(validatorPOWHash))
-	if separator := body.ReadNBytes(1); len(separator) != 1 || separator[0] != '-' {
-		return ErrInvalidLength
-	}
-	solArea := body.ReadBytes()
-	for _, c := range solArea {
-		if c < '0' || c > '9' {
-			return ErrInvalidLength
-		}
+	sub, err := ParseSubmission(req.Protocol, ChallengeTypePOW, req.Body)
+	if err != nil {
+		return err
 	}
+	randomArea, sumArea := sub.Random, sub.Hash
 
 	h := b.acquireHMAC()
 	defer b.releaseHMAC(h)
@@ -146,11 +113,10 @@ func (powValidator) isValid(b *Berghain, req *ValidatorRequest, resp *ValidatorR
 	}
 	resp.Body.Reset()
 
-	supportID := randomArea[len(validatorPOWTimestamp):]
-	if !ValidSupportID(supportID) {
+	if !ValidSupportID(sub.SupportID) {
 		return ErrInvalidLength
 	}
-	req.SupportID = supportID
+	req.SupportID = sub.SupportID
 	timestampArea := randomArea[:len(validatorPOWTimestamp)]
 
 	expirArea := resp.Body.WriteNBytes(hex.DecodedLen(len(validatorPOWTimestamp)))
@@ -167,7 +133,7 @@ func (powValidator) isValid(b *Berghain, req *ValidatorRequest, resp *ValidatorR
 	defer releaseSHA256(sha)
 
 	sha.Write(randomArea)
-	sha.Write(solArea)
+	sha.Write(sub.Nonce)
 	sum := sha.Sum(nil)
 
 	if !bytes.HasPrefix(sum, []byte{0x00, 0x00}) {
@@ -192,5 +158,5 @@ func validatorPOW(b *Berghain, req *ValidatorRequest, resp *ValidatorResponse) e
 		return p.onNew(b, req, resp)
 	}
 
-	return errInvalidMethod
+	return ErrInvalidMethod
 }
@@ -14,31 +14,22 @@ import (
 func solvePOW(tb testing.TB, b []byte) ([]byte, error) {
 	tb.Helper()
 
-	type powChallenge struct {
-		T int    `json:"t"`
-		R string `json:"r"`
-		S string `json:"s"`
-		I string `json:"i"`
-	}
-
-	var p powChallenge
+	var p Challenge
 	if err := json.NewDecoder(bytes.NewReader(b)).Decode(&p); err != nil {
 		return nil, err
 	}
 
-	if p.T != 1 {
-		return nil, fmt.Errorf("invalid challenge type: %d", p.T)
+	if p.Type != ChallengeTypePOW {
+		return nil, fmt.Errorf("invalid challenge type: %d", p.Type)
 	}
 
 	h := NewZeroHasher(hashAlgo())
-	for i := 0; true; i++ {
-		h.Write([]byte(p.R))
-
-		is := strconv.Itoa(i)
-		h.Write([]byte(is))
+	for i := uint64(0); true; i++ {
+		h.Write([]byte(p.Random))
+		h.Write([]byte(strconv.FormatUint(i, 10)))
 
 		if bytes.HasPrefix(h.Sum(nil), []byte{0x00, 0x00}) {
-			return []byte(p.R + "-" + p.S + "-" + is), nil
+			return []byte(p.Random + "-" + p.Hash + "-" + strconv.FormatUint(i, 10)), nil
 		}
 
 		h.Reset()
@@ -46,8 +37,20 @@ func solvePOW(tb testing.TB, b []byte) ([]byte, error) {
 	panic("unreachable")
 }
 
-func expectedPOWChallengeLength(supportID []byte) int {
-	return len(validatorPOWChallengeTemplate) + len(`,"i":""`) + len(supportID)
+func expectedPOWChallengeLength(tb testing.TB, countdown int, supportID []byte) int {
+	tb.Helper()
+
+	b, err := json.Marshal(struct {
+		Countdown int    `json:"c"`
+		Type      int    `json:"t"`
+		Random    string `json:"r"`
+		Hash      string `json:"s"`
+		SupportID string `json:"i"`
+	}{countdown, 1, validatorPOWRandom, validatorPOWHash, string(supportID)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return len(b)
 }
 
 func Test_validatorPOW(t *testing.T) {
@@ -73,7 +76,7 @@ func Test_validatorPOW(t *testing.T) {
 		t.Errorf("validator failed: %v", err)
 	}
 
-	if resp.Body.Len() != expectedPOWChallengeLength(req.SupportID) {
+	if resp.Body.Len() != expectedPOWChallengeLength(t, 0, req.SupportID) {
 		t.Errorf("invalid challenge response length: %d", resp.Body.Len())
 	}
 	var challenge struct {
@@ -137,7 +140,7 @@ func Test_validatorPOW_unique(t *testing.T) {
 		t.Errorf("validator failed: %v", err)
 	}
 
-	if resp.Body.Len() != expectedPOWChallengeLength(req.SupportID) {
+	if resp.Body.Len() != expectedPOWChallengeLength(t, 0, req.SupportID) {
 		t.Errorf("invalid challenge response length: %d", resp.Body.Len())
 	}
 
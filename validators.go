@@ -1,10 +1,10 @@
 package berghain
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
-	"fmt"
 	"sync"
+	"time"
 
 	"github.com/dropmorepackets/haproxy-go/pkg/buffer"
 )
@@ -15,15 +15,48 @@ const (
 	_ ValidationType = iota
 	ValidationTypeNone
 	ValidationTypePOW
-	_ // reserved for worker-based POW, the web challenge protocol already assigns it t:2
+	_ // reserved for worker-based POW, see ChallengeTypePOWWorker
 	ValidationTypeTurnstile
 	ValidationTypeHCaptcha
 	ValidationTypeReCaptcha
 )
 
+// String returns the name of the type in the config.
+func (v ValidationType) String() string {
+	switch v {
+	case ValidationTypeNone:
+		return "none"
+	case ValidationTypePOW:
+		return "pow"
+	case ValidationTypeTurnstile:
+		return "turnstile"
+	case ValidationTypeHCaptcha:
+		return "hcaptcha"
+	case ValidationTypeReCaptcha:
+		return "recaptcha"
+	default:
+		return "unknown"
+	}
+}
+
+// IsCaptcha reports whether the type verifies tokens with a captcha
+// provider.
+func (v ValidationType) IsCaptcha() bool {
+	switch v {
+	case ValidationTypeTurnstile, ValidationTypeHCaptcha, ValidationTypeReCaptcha:
+		return true
+	default:
+		return false
+	}
+}
+
 type ValidatorResponse struct {
 	Body  *buffer.SliceBuffer
 	Token *buffer.SliceBuffer
+
+	// ProviderLatency is the duration of the captcha verification request,
+	// zero if no request was made.
+	ProviderLatency time.Duration
 }
 
 var validatorResponsePool = sync.Pool{
@@ -42,6 +75,7 @@ func AcquireValidatorResponse() *ValidatorResponse {
 func ReleaseValidatorResponse(v *ValidatorResponse) {
 	v.Token.Reset()
 	v.Body.Reset()
+	v.ProviderLatency = 0
 	validatorResponsePool.Put(v)
 }
 
@@ -50,6 +84,21 @@ type ValidatorRequest struct {
 	Body       []byte
 	Identifier *RequestIdentifier
 	SupportID  []byte
+
+	// Protocol is the negotiated challenge protocol version,
+	// the zero value is treated as ProtocolV1.
+	Protocol ProtocolVersion
+
+	// Context is used for outgoing requests like captcha verifications,
+	// context.Background() if nil.
+	Context context.Context
+}
+
+func (v *ValidatorRequest) context() context.Context {
+	if v.Context == nil {
+		return context.Background()
+	}
+	return v.Context
 }
 
 var validatorRequestPool = sync.Pool{
@@ -64,18 +113,14 @@ func AcquireValidatorRequest() *ValidatorRequest {
 
 func ReleaseValidatorRequest(v *ValidatorRequest) {
 	v.Method = ""
+	v.Protocol = 0
 	v.Body = nil
 	v.Identifier = nil
 	v.SupportID = nil
+	v.Context = nil
 	validatorRequestPool.Put(v)
 }
 
-func appendSupportID(body *buffer.SliceBuffer, id []byte) {
-	copy(body.WriteNBytes(len(`,"i":"`)), []byte(`,"i":"`))
-	copy(body.WriteNBytes(len(id)), id)
-	copy(body.WriteNBytes(len(`"}`)), []byte(`"}`))
-}
-
 func (v ValidationType) RunValidator(b *Berghain, req *ValidatorRequest, resp *ValidatorResponse) error {
 	switch v {
 	case ValidationTypeNone:
@@ -88,13 +133,3 @@ func (v ValidationType) RunValidator(b *Berghain, req *ValidatorRequest, resp *V
 		return errors.New("unknown validation type")
 	}
 }
-
-var errInvalidMethod = fmt.Errorf("invalid method")
-
-func mustJSONEncodeString(v interface{}) string {
-	b, err := json.Marshal(v)
-	if err != nil {
-		panic(err)
-	}
-	return string(b)
-}
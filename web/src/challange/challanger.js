@@ -1,5 +1,5 @@
 import {detectMissingCapabilities} from "./capabilities";
-import {getChallengeSolver} from "./challanges";
+import {challengeFailure, getChallengeSolver, protocolVersion} from "./challanges";
 import * as loader from "./loader.js";
 
 /**
@@ -12,7 +12,9 @@ import * as loader from "./loader.js";
  * @return {Promise<object>}
  */
 async function getChallenge(){
-    const response = await fetch("/cdn-cgi/challenge-platform/challenge");
+    const response = await fetch("/cdn-cgi/challenge-platform/challenge", {
+        headers: {"X-Berghain-Protocol": String(protocolVersion)},
+    });
     return response.json();
 }
 
@@ -33,6 +35,10 @@ export async function doChallenge(){
 
         challenge = await getChallenge();
         session = challenge.i ?? null;
+        const failure = challengeFailure(challenge);
+        if (failure){
+            throw failure;
+        }
         const {t} = challenge;
         countdown = challenge.c;
 
@@ -56,6 +62,7 @@ export async function doChallenge(){
         if (e.advice){
             loader.showCapabilities([e.advice]);
         }
+        session = e.supportId ?? session;
         result = e.toString();
     }
 
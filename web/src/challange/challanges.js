@@ -7,6 +7,64 @@ import {bytesToHex} from "@noble/hashes/utils";
 import {captchaBlockedAdvice} from "./capabilities.js";
 import * as loader from "./loader.js";
 
+/**
+ * Turn a failure payload of the challenge endpoint into an error. Failures
+ * carry a stable error code, a retry hint in seconds and, when known, the
+ * support ID.
+ *
+ * @param {object|null} payload
+ * @return {Error|null}
+ */
+export function challengeFailure(payload){
+    if (!payload?.e){
+        return null;
+    }
+
+    const error = new Error(`Challenge failed: ${payload.e}`);
+    error.code = payload.e;
+    error.retryAfter = payload.a;
+    error.supportId = payload.i ?? null;
+    return error;
+}
+
+/**
+ * Build the error for a rejected challenge submission.
+ *
+ * @param {Response} response
+ * @return {Promise<Error>}
+ */
+async function submissionFailure(response){
+    let payload = null;
+    try {
+        payload = await response.json();
+    }
+    catch {
+        // older agents answer failures without a body
+    }
+    return challengeFailure(payload) ?? new Error("Challenge submission failed");
+}
+
+/**
+ * Challenge protocol version understood by this page. The agent answers
+ * pages stating an older or no version with the protocol they were built for.
+ */
+export const protocolVersion = 2;
+
+/**
+ * Build the body submitting the solution of a challenge, the nonce of a POW
+ * challenge or the response token of a captcha widget.
+ *
+ * @param {object} challenge
+ * @param {string} solution
+ * @return {string}
+ */
+export function submissionBody(challenge, solution){
+    if (challenge.t === 1){
+        return challenge.r + "-" + challenge.s + "-" + solution;
+    }
+    return solution;
+}
+
 async function doHash(data){
     const input = new TextEncoder().encode(data);
 
@@ -35,18 +93,23 @@ async function challengePOW(challenge){
         }
     }
 
+    let response;
     try {
-        const response = await fetch("/cdn-cgi/challenge-platform/challenge", {
-            body: challenge.r + "-" + challenge.s + "-" + i.toString(),
-            headers: {"Content-Type": "text/plain"},
+        response = await fetch("/cdn-cgi/challenge-platform/challenge", {
+            body: submissionBody(challenge, i.toString()),
+            headers: {
+                "Content-Type": "text/plain",
+                "X-Berghain-Protocol": String(protocolVersion),
+            },
             method: "POST",
         });
-        if (!response.ok){
-            throw new Error("Challenge submission failed");
-        }
     }
     catch (error){
         console.error(error.message);
+        return;
+    }
+    if (!response.ok){
+        throw await submissionFailure(response);
     }
 }
 
@@ -167,14 +230,15 @@ export async function challengeCaptcha(challenge, {environment = globalThis} = {
     }
 
     const response = await environment.fetch("/cdn-cgi/challenge-platform/challenge", {
-        body: token,
+        body: submissionBody(challenge, token),
         headers: {
             "Content-Type": "text/plain",
+            "X-Berghain-Protocol": String(protocolVersion),
         },
         method: "POST",
     });
     if (!response.ok){
-        throw new Error("Challenge submission failed");
+        throw await submissionFailure(response);
     }
 }
 
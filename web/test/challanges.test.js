@@ -1,8 +1,16 @@
 import assert from "node:assert/strict";
+import {readFileSync} from "node:fs";
 import test from "node:test";
 
 import {captchaBlockedAdvice} from "../src/challange/capabilities.js";
-import {captchaProviders, challengeCaptcha, getChallengeSolver} from "../src/challange/challanges.js";
+import {
+    captchaProviders,
+    challengeCaptcha,
+    challengeFailure,
+    getChallengeSolver,
+    protocolVersion,
+    submissionBody,
+} from "../src/challange/challanges.js";
 
 function scriptEnvironment(onScript){
     return {
@@ -95,4 +103,49 @@ test("renders the widget and submits its token", async() => {
     assert.equal(requests[0].url, "/cdn-cgi/challenge-platform/challenge");
     assert.equal(requests[0].options.method, "POST");
     assert.equal(requests[0].options.body, "widget-response-token");
+    assert.equal(requests[0].options.headers["X-Berghain-Protocol"], String(protocolVersion));
+});
+
+test("reports the error code of a rejected submission", async() => {
+    const widget = {style: {}};
+    const environment = scriptEnvironment((script) => script.onload());
+    environment.fetch = async() => ({
+        ok: false,
+        json: async() => ({e: "replayed", a: 0, i: "bh@123e4567-e89b-12d3-a456-426614174000"}),
+    });
+    environment.turnstile = {
+        render(container, options){
+            queueMicrotask(() => options.callback("widget-response-token"));
+        },
+    };
+
+    globalThis.document = {
+        getElementById: () => widget,
+        querySelector: () => ({style: {}}),
+    };
+    try {
+        await assert.rejects(challengeCaptcha({k: "sitekey", t: 3}, {environment}), (error) => {
+            assert.equal(error.code, "replayed");
+            assert.equal(error.retryAfter, 0);
+            assert.equal(error.supportId, "bh@123e4567-e89b-12d3-a456-426614174000");
+            return true;
+        });
+    }
+    finally {
+        delete globalThis.document;
+    }
+});
+
+test("ignores payloads without an error code", () => {
+    assert.equal(challengeFailure({c: 3, t: 0}), null);
+    assert.equal(challengeFailure(null), null);
+});
+
+test("builds the submission bodies the agent parses", () => {
+    // testdata/submissions.json is also parsed by the Go protocol tests.
+    const fixtures = JSON.parse(readFileSync(new URL("../../testdata/submissions.json", import.meta.url), "utf8"));
+
+    for (const {name, challenge, solution, body} of fixtures){
+        assert.equal(submissionBody(challenge, solution), body, name);
+    }
 });
@@ -0,0 +1,417 @@
+package berghain
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Web Bot Auth lets crawlers sign requests with HTTP Message Signatures
+// (RFC 9421) using Ed25519 keys published in a key directory, see
+// https://datatracker.ietf.org/doc/draft-meunier-web-bot-auth-architecture/.
+
+const webBotAuthTag = "web-bot-auth"
+
+const (
+	// maxSignatureSkew tolerates clocks of signers running ahead.
+	maxSignatureSkew = time.Minute
+	// defaultSignatureMaxValidity bounds how long a signature can be
+	// replayed, the key directory draft suggests minutes.
+	defaultSignatureMaxValidity = 5 * time.Minute
+)
+
+var (
+	errSignatureMissing = errors.New("no web-bot-auth signature")
+	errSignatureInvalid = errors.New("invalid signature")
+	errSignatureExpired = errors.New("signature expired")
+	errSignatureKey     = errors.New("unknown signature key")
+)
+
+// KeyDirectory is a locally cached HTTP Message Signatures directory, a JWK
+// set of Ed25519 keys. Keys are identified by their JWK SHA-256 thumbprint
+// (RFC 7638) and by their kid, if set.
+type KeyDirectory struct {
+	path string
+	keys atomic.Pointer[map[string]ed25519.PublicKey]
+
+	modTime time.Time
+	size    int64
+}
+
+// OpenKeyDirectory reads the key directory at path.
+func OpenKeyDirectory(path string) (*KeyDirectory, error) {
+	d := &KeyDirectory{path: path}
+	if _, err := d.Reload(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Reload reads the file if it changed since it was last read and reports
+// whether it did. If the file fails to load, the directory keeps its keys.
+// Reload must not be called concurrently.
+func (d *KeyDirectory) Reload() (bool, error) {
+	fi, err := os.Stat(d.path)
+	if err != nil {
+		return false, fmt.Errorf("key directory %s: %w", d.path, err)
+	}
+
+	if d.keys.Load() != nil && d.modTime.Equal(fi.ModTime()) && d.size == fi.Size() {
+		return false, nil
+	}
+
+	b, err := os.ReadFile(d.path)
+	if err != nil {
+		return false, fmt.Errorf("key directory %s: %w", d.path, err)
+	}
+
+	keys, err := parseKeyDirectory(b)
+	if err != nil {
+		return false, fmt.Errorf("key directory %s: %w", d.path, err)
+	}
+
+	d.keys.Store(&keys)
+	d.modTime, d.size = fi.ModTime(), fi.Size()
+
+	return true, nil
+}
+
+// Key returns the key with the id, or nil.
+func (d *KeyDirectory) Key(keyID string) ed25519.PublicKey {
+	return (*d.keys.Load())[keyID]
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Kid string `json:"kid"`
+}
+
+func parseKeyDirectory(b []byte) (map[string]ed25519.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]ed25519.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "OKP" || k.Crv != "Ed25519" {
+			// keys of other algorithms are not supported, but allowed
+			continue
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key %q", k.X)
+		}
+
+		keys[JWKThumbprint(x)] = x
+		if k.Kid != "" {
+			keys[k.Kid] = x
+		}
+	}
+
+	return keys, nil
+}
+
+// JWKThumbprint returns the RFC 7638 thumbprint of an Ed25519 public key,
+// the key id used by Web Bot Auth.
+func JWKThumbprint(key ed25519.PublicKey) string {
+	// the members are required to be in lexicographic order
+	sum := sha256.Sum256([]byte(`{"crv":"Ed25519","kty":"OKP","x":"` + base64.RawURLEncoding.EncodeToString(key) + `"}`))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// SignatureAgent is a signer of requests.
+type SignatureAgent struct {
+	Name string
+	// URL is the Signature-Agent header value of the agent, e.g.
+	// https://signer.example.com. If empty, the agent is only identified
+	// by its keys.
+	URL  string
+	Keys *KeyDirectory
+	// Allow lets verified requests of the agent pass validation without a
+	// cookie. Policy rules can match agents regardless.
+	Allow bool
+}
+
+// SignedRequest holds the parts of a request a signature can cover.
+type SignedRequest struct {
+	Method    []byte
+	Authority []byte
+	Path      []byte
+	TLS       bool
+
+	// Signature, SignatureInput and SignatureAgent are the header values.
+	Signature      []byte
+	SignatureInput []byte
+	SignatureAgent []byte
+
+	Time time.Time
+}
+
+// SignatureVerifier verifies Web Bot Auth signatures of the agents.
+type SignatureVerifier struct {
+	Agents []*SignatureAgent
+
+	// MaxValidity bounds expires-created of a signature and how long after
+	// created it is accepted, defaults to five minutes. Nonces are not
+	// tracked, so this is how long a signature can be replayed.
+	MaxValidity time.Duration
+}
+
+// Reload reloads the key directories of all agents and reports whether any
+// changed.
+func (v *SignatureVerifier) Reload() (bool, error) {
+	var changed bool
+	var errs []error
+	for _, a := range v.Agents {
+		c, err := a.Keys.Reload()
+		changed = changed || c
+		errs = append(errs, err)
+	}
+
+	return changed, errors.Join(errs...)
+}
+
+// Verify returns the agent that signed the request. Only signatures tagged
+// web-bot-auth are considered, and they have to cover the authority and,
+// if sent, the Signature-Agent header.
+func (v *SignatureVerifier) Verify(req *SignedRequest) (*SignatureAgent, error) {
+	inputs, err := parseSignatureInputs(string(req.SignatureInput))
+	if err != nil {
+		return nil, err
+	}
+
+	i := -1
+	for j := range inputs {
+		if inputs[j].tag == webBotAuthTag {
+			i = j
+			break
+		}
+	}
+	if i < 0 {
+		return nil, errSignatureMissing
+	}
+	in := &inputs[i]
+
+	if in.alg != "" && in.alg != "ed25519" {
+		return nil, fmt.Errorf("%w: unsupported algorithm %q", errSignatureInvalid, in.alg)
+	}
+	if in.created == 0 || in.expires == 0 {
+		return nil, fmt.Errorf("%w: created and expires are required", errSignatureInvalid)
+	}
+	maxValidity := int64(orDefault(v.MaxValidity, defaultSignatureMaxValidity) / time.Second)
+	now := req.Time.Unix()
+	if now < in.created-int64(maxSignatureSkew/time.Second) || now > in.expires || now > in.created+maxValidity {
+		return nil, errSignatureExpired
+	}
+	if in.expires-in.created > maxValidity {
+		return nil, fmt.Errorf("%w: valid for more than %ds", errSignatureInvalid, maxValidity)
+	}
+
+	agentURL := signatureAgentURL(req.SignatureAgent)
+	if !slices.Contains(in.components, "@authority") || len(req.SignatureAgent) > 0 && !slices.Contains(in.components, "signature-agent") {
+		return nil, fmt.Errorf("%w: @authority and signature-agent must be covered", errSignatureInvalid)
+	}
+
+	sig, err := findSignature(string(req.Signature), in.label)
+	if err != nil {
+		return nil, err
+	}
+
+	var agent *SignatureAgent
+	var key ed25519.PublicKey
+	for _, a := range v.Agents {
+		if a.URL != "" && a.URL != agentURL {
+			continue
+		}
+		if k := a.Keys.Key(in.keyid); k != nil {
+			agent, key = a, k
+			break
+		}
+	}
+	if agent == nil {
+		return nil, errSignatureKey
+	}
+
+	base, err := signatureBase(req, in)
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(key, base, sig) {
+		return nil, fmt.Errorf("%w: verification failed", errSignatureInvalid)
+	}
+
+	return agent, nil
+}
+
+// signatureAgentURL unquotes the Signature-Agent header, a structured field
+// string.
+func signatureAgentURL(v []byte) string {
+	s := strings.TrimSpace(string(v))
+	if u, err := strconv.Unquote(s); err == nil && strings.HasPrefix(s, `"`) {
+		return u
+	}
+	return s
+}
+
+// signatureBase builds the signature base of RFC 9421 section 2.5.
+func signatureBase(req *SignedRequest, in *signatureInput) ([]byte, error) {
+	var b bytes.Buffer
+	for _, c := range in.components {
+		var v []byte
+		switch c {
+		case "@authority":
+			v = bytes.ToLower(req.Authority)
+		case "@method":
+			v = req.Method
+		case "@path":
+			v = req.Path
+			if i := bytes.IndexByte(v, '?'); i >= 0 {
+				v = v[:i]
+			}
+		case "@scheme":
+			v = []byte("http")
+			if req.TLS {
+				v = []byte("https")
+			}
+		case "signature-agent":
+			v = bytes.TrimSpace(req.SignatureAgent)
+		default:
+			return nil, fmt.Errorf("%w: unsupported component %q", errSignatureInvalid, c)
+		}
+		if len(v) == 0 && c != "@path" {
+			return nil, fmt.Errorf("%w: missing component %q", errSignatureInvalid, c)
+		}
+
+		b.WriteString(strconv.Quote(c))
+		b.WriteString(": ")
+		b.Write(v)
+		b.WriteByte('\n')
+	}
+
+	b.WriteString(`"@signature-params": `)
+	b.WriteString(in.params)
+
+	return b.Bytes(), nil
+}
+
+type signatureInput struct {
+	label      string
+	components []string
+	// params is the serialized value used as @signature-params
+	params string
+
+	created, expires int64
+	keyid, alg, tag  string
+}
+
+// splitDictionary splits a structured field dictionary into its members,
+// ignoring commas in strings and inner lists.
+func splitDictionary(v string) []string {
+	var members []string
+	depth, quoted, start := 0, false, 0
+	for i := 0; i < len(v); i++ {
+		switch c := v[i]; {
+		case quoted && c == '\\':
+			i++
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			members = append(members, strings.TrimSpace(v[start:i]))
+			start = i + 1
+		}
+	}
+	return append(members, strings.TrimSpace(v[start:]))
+}
+
+func parseSignatureInputs(v string) ([]signatureInput, error) {
+	var inputs []signatureInput
+	for _, m := range splitDictionary(v) {
+		if m == "" {
+			continue
+		}
+		label, value, ok := strings.Cut(m, "=")
+		if !ok || !strings.HasPrefix(value, "(") {
+			return nil, fmt.Errorf("%w: malformed Signature-Input", errSignatureInvalid)
+		}
+
+		in := signatureInput{label: label, params: value}
+
+		end := strings.IndexByte(value, ')')
+		if end < 0 {
+			return nil, fmt.Errorf("%w: malformed Signature-Input", errSignatureInvalid)
+		}
+		for _, c := range strings.Fields(value[1:end]) {
+			name, err := strconv.Unquote(c)
+			if err != nil || !strings.HasPrefix(c, `"`) {
+				// component parameters are not supported
+				return nil, fmt.Errorf("%w: unsupported component %s", errSignatureInvalid, c)
+			}
+			in.components = append(in.components, name)
+		}
+
+		for _, p := range strings.Split(value[end+1:], ";")[1:] {
+			k, pv, _ := strings.Cut(strings.TrimSpace(p), "=")
+			if s, err := strconv.Unquote(pv); err == nil && strings.HasPrefix(pv, `"`) {
+				pv = s
+			}
+			switch k {
+			case "created":
+				in.created, _ = strconv.ParseInt(pv, 10, 64)
+			case "expires":
+				in.expires, _ = strconv.ParseInt(pv, 10, 64)
+			case "keyid":
+				in.keyid = pv
+			case "alg":
+				in.alg = pv
+			case "tag":
+				in.tag = pv
+			}
+		}
+
+		inputs = append(inputs, in)
+	}
+
+	return inputs, nil
+}
+
+// findSignature returns the signature with the label from the Signature
+// header, a dictionary of byte sequences.
+func findSignature(v, label string) ([]byte, error) {
+	for _, m := range splitDictionary(v) {
+		l, value, ok := strings.Cut(m, "=")
+		if !ok || l != label {
+			continue
+		}
+		if len(value) < 2 || value[0] != ':' || value[len(value)-1] != ':' {
+			break
+		}
+		sig, err := base64.StdEncoding.DecodeString(value[1 : len(value)-1])
+		if err != nil {
+			break
+		}
+		return sig, nil
+	}
+
+	return nil, fmt.Errorf("%w: no signature labeled %s", errSignatureInvalid, label)
+}
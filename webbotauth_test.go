@@ -0,0 +1,180 @@
+package berghain
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testSigner signs requests like a Web Bot Auth crawler.
+type testSigner struct {
+	key   ed25519.PrivateKey
+	keyID string
+}
+
+func newTestSigner(seed byte) testSigner {
+	key := ed25519.NewKeyFromSeed(bytes32(seed))
+	return testSigner{key: key, keyID: JWKThumbprint(key.Public().(ed25519.PublicKey))}
+}
+
+func bytes32(b byte) []byte {
+	s := make([]byte, ed25519.SeedSize)
+	for i := range s {
+		s[i] = b
+	}
+	return s
+}
+
+// sign returns the Signature and Signature-Input of a request to authority
+// signed by agent, built from the literal signature base of RFC 9421.
+func (s testSigner) sign(authority, agent string, created, expires int64) (signature, input string) {
+	params := `("@authority" "signature-agent");created=` + strconv.FormatInt(created, 10) +
+		`;expires=` + strconv.FormatInt(expires, 10) +
+		`;keyid="` + s.keyID + `";alg="ed25519";nonce="bm9uY2U=";tag="web-bot-auth"`
+	base := `"@authority": ` + authority + "\n" +
+		`"signature-agent": "` + agent + `"` + "\n" +
+		`"@signature-params": ` + params
+
+	sig := ed25519.Sign(s.key, []byte(base))
+	return "sig1=:" + base64.StdEncoding.EncodeToString(sig) + ":", "sig1=" + params
+}
+
+func (s testSigner) directory(t *testing.T) *KeyDirectory {
+	t.Helper()
+
+	pub := s.key.Public().(ed25519.PublicKey)
+	path := filepath.Join(t.TempDir(), "keys.json")
+	jwks := `{"keys": [
+		{"kty": "RSA", "n": "unsupported", "e": "AQAB"},
+		{"kty": "OKP", "crv": "Ed25519", "x": "` + base64.RawURLEncoding.EncodeToString(pub) + `"}
+	]}`
+	if err := os.WriteFile(path, []byte(jwks), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := OpenKeyDirectory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestJWKThumbprint(t *testing.T) {
+	// RFC 8037 appendix A.3
+	x, err := base64.RawURLEncoding.DecodeString("11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := JWKThumbprint(x), "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k"; got != want {
+		t.Errorf("JWKThumbprint() = %s, want %s", got, want)
+	}
+}
+
+func TestSignatureVerifier_Verify(t *testing.T) {
+	const agentURL = "https://signer.example.com"
+	now := time.Unix(1767225600, 0)
+
+	signer := newTestSigner(1)
+	other := newTestSigner(2)
+	v := &SignatureVerifier{Agents: []*SignatureAgent{
+		{Name: "other", URL: "https://other.example.com", Keys: signer.directory(t)},
+		{Name: "signer", URL: agentURL, Keys: signer.directory(t), Allow: true},
+	}}
+
+	request := func(s testSigner, authority, agent string, created, expires int64) *SignedRequest {
+		sig, input := s.sign(authority, agent, created, expires)
+		return &SignedRequest{
+			Authority:      []byte("Example.COM"),
+			Signature:      []byte(sig),
+			SignatureInput: []byte(input),
+			SignatureAgent: []byte(`"` + agent + `"`),
+			Time:           now,
+		}
+	}
+	created, expires := now.Unix()-10, now.Unix()+60
+
+	tests := []struct {
+		name    string
+		req     *SignedRequest
+		wantErr error
+	}{
+		{name: "valid", req: request(signer, "example.com", agentURL, created, expires)},
+		{name: "clock ahead", req: request(signer, "example.com", agentURL, now.Unix()+30, expires)},
+		{name: "expired", req: request(signer, "example.com", agentURL, created-120, created-60), wantErr: errSignatureExpired},
+		{name: "too long validity", req: request(signer, "example.com", agentURL, created, created+301), wantErr: errSignatureInvalid},
+		{name: "created too long ago", req: request(signer, "example.com", agentURL, now.Unix()-301, expires), wantErr: errSignatureExpired},
+		{name: "not yet valid", req: request(signer, "example.com", agentURL, now.Unix()+120, now.Unix()+180), wantErr: errSignatureExpired},
+		{name: "other authority", req: request(signer, "example.net", agentURL, created, expires), wantErr: errSignatureInvalid},
+		{name: "unknown key", req: request(other, "example.com", agentURL, created, expires), wantErr: errSignatureKey},
+		{name: "unknown agent", req: request(signer, "example.com", "https://unknown.example.com", created, expires), wantErr: errSignatureKey},
+		{name: "not web-bot-auth", req: &SignedRequest{SignatureInput: []byte(`sig1=("@authority");created=1;keyid="x"`), Time: now}, wantErr: errSignatureMissing},
+		{name: "malformed", req: &SignedRequest{SignatureInput: []byte(`sig1=@authority`), Time: now}, wantErr: errSignatureInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent, err := v.Verify(tt.req)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && agent.Name != "signer" {
+				t.Errorf("Verify() = %s, want signer", agent.Name)
+			}
+		})
+	}
+}
+
+func TestSignatureVerifier_VerifyTampered(t *testing.T) {
+	const agentURL = "https://signer.example.com"
+	now := time.Unix(1767225600, 0)
+	signer := newTestSigner(1)
+	v := &SignatureVerifier{Agents: []*SignatureAgent{{Name: "signer", Keys: signer.directory(t)}}}
+
+	sig, input := signer.sign("example.com", agentURL, now.Unix(), now.Unix()+60)
+	req := &SignedRequest{
+		Authority:      []byte("example.com"),
+		Signature:      []byte(sig),
+		SignatureInput: []byte(input),
+		SignatureAgent: []byte(`"` + agentURL + `"`),
+		Time:           now,
+	}
+	if _, err := v.Verify(req); err != nil {
+		t.Fatalf("Verify() = %v", err)
+	}
+
+	// the agent is covered by the signature
+	req.SignatureAgent = []byte(`"https://other.example.com"`)
+	if _, err := v.Verify(req); !errors.Is(err, errSignatureInvalid) {
+		t.Errorf("Verify() of tampered agent = %v", err)
+	}
+}
+
+func TestParseSignatureInputs(t *testing.T) {
+	inputs, err := parseSignatureInputs(`sig1=("@authority" "content-type");created=1;keyid="a,b";tag="other", sig2=("@authority");created=2;expires=3;keyid="k";alg="ed25519";tag="web-bot-auth"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) != 2 {
+		t.Fatalf("parsed %d inputs, want 2", len(inputs))
+	}
+
+	in := inputs[1]
+	if in.label != "sig2" || in.created != 2 || in.expires != 3 || in.keyid != "k" || in.alg != "ed25519" || in.tag != "web-bot-auth" {
+		t.Errorf("input = %+v", in)
+	}
+	if in.params != `("@authority");created=2;expires=3;keyid="k";alg="ed25519";tag="web-bot-auth"` {
+		t.Errorf("params = %s", in.params)
+	}
+	if inputs[0].keyid != "a,b" || len(inputs[0].components) != 2 {
+		t.Errorf("input = %+v", inputs[0])
+	}
+
+	if _, err := parseSignatureInputs(`sig1=("signature-agent";key="sig1");created=1`); err == nil {
+		t.Errorf("component parameters accepted")
+	}
+}